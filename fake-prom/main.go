@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tamalsaha/prometheus-demo/prometheus/promtest"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+func main() {
+	if err := newRootCmd().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func newRootCmd() *cobra.Command {
+	var (
+		listen    string
+		file      string
+		rulesFile string
+		start     string
+		gen       = promtest.Generator{Interval: 15 * time.Second, Points: 241}
+	)
+	cmd := &cobra.Command{
+		Use:   "fake-prom",
+		Short: "Serve the Prometheus HTTP API from synthetic or recorded series",
+		Long: `Serve the Prometheus HTTP API from synthetic or recorded series.
+
+Without --file, the series of a small cluster are generated from --start, so
+every run serves the same samples. Queries without a time are evaluated at
+the last sample.`,
+		Example: `  fake-prom --listen=:9090
+  read-prom range 'sum by (code) (rate(http_requests_total[5m]))' --prometheus.address=http://localhost:9090 --start=2026-01-01T00:10:00Z --end=2026-01-01T01:00:00Z
+  read-prom range up --start=-1h -o openmetrics > up.txt && fake-prom --file=up.txt`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			t, err := time.Parse(time.RFC3339, start)
+			if err != nil {
+				return fmt.Errorf("invalid --start: %w", err)
+			}
+			gen.Start = t
+
+			db := promtest.NewStorage()
+			if file != "" {
+				err = db.LoadOpenMetricsFile(file, gen.Start)
+			} else {
+				gen.Synthetic(db)
+			}
+			if err != nil {
+				return err
+			}
+			h := promtest.NewHandler(db)
+			if rulesFile != "" {
+				data, err := os.ReadFile(rulesFile)
+				if err != nil {
+					return err
+				}
+				if err := yaml.UnmarshalStrict(data, &h.Rules); err != nil {
+					return fmt.Errorf("failed to parse %s: %w", rulesFile, err)
+				}
+			}
+			klog.Infof("serving series up to %s on %s", db.MaxTime().Format(time.RFC3339), listen)
+			return http.ListenAndServe(listen, h)
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&listen, "listen", ":9090", "Address to serve the API on")
+	flags.StringVar(&file, "file", "", "Serve the samples of this OpenMetrics file instead of synthetic series")
+	flags.StringVar(&rulesFile, "rules", "", "YAML file with the rule groups served by /api/v1/rules")
+	flags.StringVar(&start, "start", promtest.DefaultStart.Format(time.RFC3339), "Time of the first synthetic sample, and of the samples in --file without a timestamp")
+	flags.DurationVar(&gen.Interval, "interval", gen.Interval, "Interval between synthetic samples")
+	flags.IntVar(&gen.Points, "points", gen.Points, "Number of synthetic samples per series")
+	return cmd
+}
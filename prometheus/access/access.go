@@ -0,0 +1,274 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package access grants a service account the least privilege needed to
+// query a Prometheus service through the apiserver service proxy, verifies
+// the result with access reviews and reports bindings that open the proxy to
+// more subjects than that, like the system:anonymous binding of
+// trickster-conf/rbac.yaml.
+package access
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	core "k8s.io/api/core/v1"
+	rbac "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// serviceAccountsGroup is the group of all service accounts.
+const serviceAccountsGroup = "system:serviceaccounts"
+
+// ProxyVerbs are the verbs needed on services/proxy. The Prometheus client
+// sends queries as POST, which is the create verb, and falls back to GET.
+var ProxyVerbs = []string{"get", "create"}
+
+// deniedProxyVerbs are checked to not be allowed on services/proxy.
+var deniedProxyVerbs = []string{"update", "patch", "delete"}
+
+// Options describe the access to grant.
+type Options struct {
+	ServiceAccount types.NamespacedName
+	Service        prometheus.ServiceReference
+	// Name of the Role and RoleBinding in the namespace of the service.
+	// Defaults to the name of the service account.
+	Name string
+}
+
+// serviceAccountUserPrefix is the prefix of the username of a service
+// account, followed by <namespace>:<name>.
+const serviceAccountUserPrefix = "system:serviceaccount:"
+
+func serviceAccountUser(sa types.NamespacedName) string {
+	return serviceAccountUserPrefix + sa.Namespace + ":" + sa.Name
+}
+
+func (opts Options) name() string {
+	if opts.Name != "" {
+		return opts.Name
+	}
+	return opts.ServiceAccount.Name
+}
+
+// ProxyResourceName returns the name that the apiserver authorizes
+// services/proxy requests for, in the scheme:name:port form of the proxy
+// url built by prometheus.ServiceProxyURL.
+func ProxyResourceName(ref prometheus.ServiceReference) string {
+	return fmt.Sprintf("%s:%s:%d", ref.Scheme, ref.Name, ref.Port)
+}
+
+// Objects returns the ServiceAccount, Role and RoleBinding that grant the
+// access. The Role only allows ProxyVerbs on the proxy of the service.
+func Objects(opts Options) (*core.ServiceAccount, *rbac.Role, *rbac.RoleBinding) {
+	sa := &core.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      opts.ServiceAccount.Name,
+			Namespace: opts.ServiceAccount.Namespace,
+		},
+	}
+	role := &rbac.Role{
+		TypeMeta: metav1.TypeMeta{APIVersion: rbac.SchemeGroupVersion.String(), Kind: "Role"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      opts.name(),
+			Namespace: opts.Service.Namespace,
+		},
+		Rules: []rbac.PolicyRule{{
+			APIGroups:     []string{""},
+			Resources:     []string{"services/proxy"},
+			ResourceNames: []string{ProxyResourceName(opts.Service)},
+			Verbs:         ProxyVerbs,
+		}},
+	}
+	binding := &rbac.RoleBinding{
+		TypeMeta: metav1.TypeMeta{APIVersion: rbac.SchemeGroupVersion.String(), Kind: "RoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      opts.name(),
+			Namespace: opts.Service.Namespace,
+		},
+		RoleRef: rbac.RoleRef{
+			APIGroup: rbac.GroupName,
+			Kind:     "Role",
+			Name:     role.Name,
+		},
+		Subjects: []rbac.Subject{{
+			Kind:      rbac.ServiceAccountKind,
+			Name:      opts.ServiceAccount.Name,
+			Namespace: opts.ServiceAccount.Namespace,
+		}},
+	}
+	return sa, role, binding
+}
+
+// Provision creates the objects returned by Objects. An existing
+// ServiceAccount is left as is, the Role and RoleBinding are updated.
+func Provision(ctx context.Context, kc client.Client, opts Options) error {
+	sa, role, binding := Objects(opts)
+
+	if err := kc.Create(ctx, sa); err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("failed to create service account %s: %w", opts.ServiceAccount, err)
+	}
+
+	var cur rbac.Role
+	err := kc.Get(ctx, client.ObjectKeyFromObject(role), &cur)
+	switch {
+	case apierrors.IsNotFound(err):
+		err = kc.Create(ctx, role)
+	case err == nil && !equality.Semantic.DeepEqual(cur.Rules, role.Rules):
+		cur.Rules = role.Rules
+		err = kc.Update(ctx, &cur)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply role %s/%s: %w", role.Namespace, role.Name, err)
+	}
+
+	var curBinding rbac.RoleBinding
+	err = kc.Get(ctx, client.ObjectKeyFromObject(binding), &curBinding)
+	switch {
+	case apierrors.IsNotFound(err):
+		err = kc.Create(ctx, binding)
+	case err == nil && curBinding.RoleRef != binding.RoleRef:
+		// the role of a binding can't be changed
+		err = fmt.Errorf("it is bound to %s %s", curBinding.RoleRef.Kind, curBinding.RoleRef.Name)
+	case err == nil && !equality.Semantic.DeepEqual(curBinding.Subjects, binding.Subjects):
+		curBinding.Subjects = binding.Subjects
+		err = kc.Update(ctx, &curBinding)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to apply role binding %s/%s: %w", binding.Namespace, binding.Name, err)
+	}
+	klog.V(1).InfoS("Provisioned Prometheus access", "serviceaccount", opts.ServiceAccount, "service", opts.Service)
+	return nil
+}
+
+// Check is the result of an access review.
+type Check struct {
+	Namespace   string `json:"namespace"`
+	Verb        string `json:"verb"`
+	Group       string `json:"group,omitempty"`
+	Resource    string `json:"resource"`
+	Subresource string `json:"subresource,omitempty"`
+	// Name is empty for a check of all objects of the resource.
+	Name string `json:"name,omitempty"`
+	// Want is true if the access must be allowed and false if it must be
+	// denied.
+	Want    bool   `json:"want"`
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// OK returns true if the access is allowed exactly when it should be.
+func (c Check) OK() bool {
+	return c.Want == c.Allowed
+}
+
+// String returns the permission checked, like get services/proxy
+// monitoring/http:prometheus:9090.
+func (c Check) String() string {
+	resource := c.Resource
+	if c.Subresource != "" {
+		resource += "/" + c.Subresource
+	}
+	name := c.Name
+	if name == "" {
+		name = "*"
+	}
+	return fmt.Sprintf("%s %s %s/%s", c.Verb, resource, c.Namespace, name)
+}
+
+func (c Check) attributes() *authorizationv1.ResourceAttributes {
+	return &authorizationv1.ResourceAttributes{
+		Namespace:   c.Namespace,
+		Verb:        c.Verb,
+		Group:       c.Group,
+		Resource:    c.Resource,
+		Subresource: c.Subresource,
+		Name:        c.Name,
+	}
+}
+
+// Verify checks with SubjectAccessReviews that the service account may use
+// ProxyVerbs on the proxy of the service and nothing else: no other verbs,
+// no other services and no Secrets of the namespace.
+func Verify(ctx context.Context, kc client.Client, opts Options) ([]Check, error) {
+	ns := opts.Service.Namespace
+	name := ProxyResourceName(opts.Service)
+	var checks []Check
+	for _, verb := range ProxyVerbs {
+		checks = append(checks, Check{Namespace: ns, Verb: verb, Resource: "services", Subresource: "proxy", Name: name, Want: true})
+	}
+	for _, verb := range deniedProxyVerbs {
+		checks = append(checks, Check{Namespace: ns, Verb: verb, Resource: "services", Subresource: "proxy", Name: name})
+	}
+	for _, verb := range ProxyVerbs {
+		checks = append(checks, Check{Namespace: ns, Verb: verb, Resource: "services", Subresource: "proxy"})
+	}
+	checks = append(checks, Check{Namespace: ns, Verb: "get", Resource: "secrets"})
+
+	username := serviceAccountUser(opts.ServiceAccount)
+	groups := []string{serviceAccountsGroup, serviceAccountsGroup + ":" + opts.ServiceAccount.Namespace, user.AllAuthenticated}
+	for i := range checks {
+		review := &authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				ResourceAttributes: checks[i].attributes(),
+				User:               username,
+				Groups:             groups,
+			},
+		}
+		if err := kc.Create(ctx, review); err != nil {
+			return nil, fmt.Errorf("failed to review access of %s: %w", username, err)
+		}
+		checks[i].Allowed = review.Status.Allowed
+		checks[i].Reason = review.Status.Reason
+	}
+	return checks, nil
+}
+
+// Preflight checks with SelfSubjectAccessReviews that the caller may
+// provision the access. Binding a Role that grants the proxy also needs the
+// proxy access itself, or the bind verb on roles.
+func Preflight(ctx context.Context, kc client.Client, opts Options) ([]Check, error) {
+	checks := []Check{
+		{Namespace: opts.ServiceAccount.Namespace, Verb: "create", Resource: "serviceaccounts", Want: true},
+		{Namespace: opts.Service.Namespace, Verb: "create", Group: rbac.GroupName, Resource: "roles", Want: true},
+		{Namespace: opts.Service.Namespace, Verb: "update", Group: rbac.GroupName, Resource: "roles", Name: opts.name(), Want: true},
+		{Namespace: opts.Service.Namespace, Verb: "create", Group: rbac.GroupName, Resource: "rolebindings", Want: true},
+		{Namespace: opts.Service.Namespace, Verb: "update", Group: rbac.GroupName, Resource: "rolebindings", Name: opts.name(), Want: true},
+	}
+	for _, verb := range ProxyVerbs {
+		checks = append(checks, Check{Namespace: opts.Service.Namespace, Verb: verb, Resource: "services", Subresource: "proxy", Name: ProxyResourceName(opts.Service), Want: true})
+	}
+	for i := range checks {
+		review := &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: checks[i].attributes()},
+		}
+		if err := kc.Create(ctx, review); err != nil {
+			return nil, fmt.Errorf("failed to review own access: %w", err)
+		}
+		checks[i].Allowed = review.Status.Allowed
+		checks[i].Reason = review.Status.Reason
+	}
+	return checks, nil
+}
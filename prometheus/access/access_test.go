@@ -0,0 +1,73 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package access
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	rbac "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var testOptions = Options{
+	ServiceAccount: types.NamespacedName{Namespace: "monitoring", Name: "trickster"},
+	Service:        prometheus.ServiceReference{Scheme: "http", Namespace: "monitoring", Name: "prometheus", Port: 9090},
+}
+
+func TestObjects(t *testing.T) {
+	opts := testOptions
+	opts.ServiceAccount.Namespace = "trickster"
+	sa, role, binding := Objects(opts)
+
+	if sa.Namespace != "trickster" || sa.Name != "trickster" || sa.Kind != "ServiceAccount" {
+		t.Errorf("service account = %s/%s of kind %s", sa.Namespace, sa.Name, sa.Kind)
+	}
+	// the Role and RoleBinding are in the namespace of the service
+	if role.Namespace != "monitoring" || role.Name != "trickster" || binding.Namespace != "monitoring" || binding.Name != "trickster" {
+		t.Errorf("role %s/%s and binding %s/%s, want monitoring/trickster", role.Namespace, role.Name, binding.Namespace, binding.Name)
+	}
+	wantRules := []rbac.PolicyRule{{
+		APIGroups:     []string{""},
+		Resources:     []string{"services/proxy"},
+		ResourceNames: []string{"http:prometheus:9090"},
+		Verbs:         []string{"get", "create"},
+	}}
+	if !reflect.DeepEqual(role.Rules, wantRules) {
+		t.Errorf("rules = %+v, want %+v", role.Rules, wantRules)
+	}
+	if want := (rbac.RoleRef{APIGroup: rbac.GroupName, Kind: "Role", Name: "trickster"}); binding.RoleRef != want {
+		t.Errorf("role ref = %+v, want %+v", binding.RoleRef, want)
+	}
+	wantSubjects := []rbac.Subject{{Kind: rbac.ServiceAccountKind, Namespace: "trickster", Name: "trickster"}}
+	if !reflect.DeepEqual(binding.Subjects, wantSubjects) {
+		t.Errorf("subjects = %+v, want %+v", binding.Subjects, wantSubjects)
+	}
+
+	opts.Name = "prometheus-reader"
+	if _, role, binding = Objects(opts); role.Name != "prometheus-reader" || binding.RoleRef.Name != "prometheus-reader" {
+		t.Errorf("role %s bound by %s, want prometheus-reader", role.Name, binding.RoleRef.Name)
+	}
+}
+
+func TestProxyResourceName(t *testing.T) {
+	ref := prometheus.ServiceReference{Scheme: "https", Namespace: "openshift-monitoring", Name: "thanos-querier", Port: 9091}
+	if got := ProxyResourceName(ref); got != "https:thanos-querier:9091" {
+		t.Errorf("ProxyResourceName() = %s, want https:thanos-querier:9091", got)
+	}
+}
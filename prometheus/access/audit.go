@@ -0,0 +1,204 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package access
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	rbac "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Finding is a binding that grants the proxy of the service more widely
+// than needed.
+type Finding struct {
+	// Binding is ClusterRoleBinding/<name> or RoleBinding/<namespace>/<name>.
+	Binding string `json:"binding"`
+	// Role is ClusterRole/<name> or Role/<name>.
+	Role    string   `json:"role"`
+	Subject string   `json:"subject"`
+	Verbs   []string `json:"verbs"`
+	Message string   `json:"message"`
+}
+
+// broadSubjects are the users and groups that include clients other than
+// the service account.
+var broadSubjects = map[string]string{
+	rbac.UserKind + "/" + user.Anonymous:           "every unauthenticated client",
+	rbac.GroupKind + "/" + user.AllUnauthenticated: "every unauthenticated client",
+	rbac.GroupKind + "/" + user.AllAuthenticated:   "every authenticated user",
+	rbac.GroupKind + "/" + serviceAccountsGroup:    "every service account",
+}
+
+// Audit reports the ClusterRoleBindings and the RoleBindings in the
+// namespace of the service that grant its proxy to anonymous or all
+// authenticated clients or to all service accounts, the bindings of the
+// service account that grant more than ProxyVerbs, and the bindings that
+// grant any service account the proxy of every service.
+func Audit(ctx context.Context, kc client.Reader, opts Options) ([]Finding, error) {
+	var findings []Finding
+
+	var crbs rbac.ClusterRoleBindingList
+	if err := kc.List(ctx, &crbs); err != nil {
+		return nil, err
+	}
+	for _, b := range crbs.Items {
+		f, err := auditBinding(ctx, kc, opts, "ClusterRoleBinding/"+b.Name, "", b.RoleRef, b.Subjects)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, f...)
+	}
+
+	var rbs rbac.RoleBindingList
+	if err := kc.List(ctx, &rbs, client.InNamespace(opts.Service.Namespace)); err != nil {
+		return nil, err
+	}
+	for _, b := range rbs.Items {
+		f, err := auditBinding(ctx, kc, opts, "RoleBinding/"+b.Namespace+"/"+b.Name, b.Namespace, b.RoleRef, b.Subjects)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, f...)
+	}
+	return findings, nil
+}
+
+func auditBinding(ctx context.Context, kc client.Reader, opts Options, binding, ns string, ref rbac.RoleRef, subjects []rbac.Subject) ([]Finding, error) {
+	rules, err := roleRules(ctx, kc, ns, ref)
+	if err != nil {
+		return nil, err
+	}
+	verbs, allServices := proxyGrant(rules, ProxyResourceName(opts.Service))
+	if len(verbs) == 0 {
+		return nil, nil
+	}
+
+	var findings []Finding
+	for _, s := range subjects {
+		subject := s.Kind + "/" + s.Name
+		f := Finding{
+			Binding: binding,
+			Role:    ref.Kind + "/" + ref.Name,
+			Subject: subject,
+			Verbs:   verbs,
+		}
+		if who, ok := broadSubjects[subject]; ok || (s.Kind == rbac.GroupKind && strings.HasPrefix(s.Name, serviceAccountsGroup+":")) {
+			if !ok {
+				who = "every service account of namespace " + strings.TrimPrefix(s.Name, serviceAccountsGroup+":")
+			}
+			f.Message = fmt.Sprintf("%s grants %s on the proxy of %s to %s", binding, strings.Join(verbs, ","), opts.Service, who)
+			findings = append(findings, f)
+			continue
+		}
+
+		username, ok := serviceAccountSubject(s)
+		if !ok {
+			continue
+		}
+		f.Subject = username
+		scope := "in namespace " + opts.Service.Namespace
+		if ns == "" {
+			scope = "in the cluster"
+		}
+		extra := slices.DeleteFunc(slices.Clone(verbs), func(v string) bool { return slices.Contains(ProxyVerbs, v) })
+		switch {
+		case username != serviceAccountUser(opts.ServiceAccount):
+			// other clients of the service need their own narrow grant
+			if !allServices {
+				continue
+			}
+			f.Message = fmt.Sprintf("%s grants %s the proxy of every service %s, including %s", binding, f.Subject, scope, opts.Service)
+		case len(extra) > 0:
+			f.Message = fmt.Sprintf("%s grants %s the verbs %s on the proxy of %s, only %s are needed", binding, f.Subject, strings.Join(extra, ","), opts.Service, strings.Join(ProxyVerbs, " and "))
+		case allServices:
+			f.Message = fmt.Sprintf("%s grants %s the proxy of every service %s, not only %s", binding, f.Subject, scope, opts.Service.Name)
+		default:
+			continue
+		}
+		findings = append(findings, f)
+	}
+	return findings, nil
+}
+
+// serviceAccountSubject returns the username of a subject that is a service
+// account, bound as a ServiceAccount or as the system:serviceaccount user.
+func serviceAccountSubject(s rbac.Subject) (string, bool) {
+	switch s.Kind {
+	case rbac.ServiceAccountKind:
+		return serviceAccountUser(types.NamespacedName{Namespace: s.Namespace, Name: s.Name}), true
+	case rbac.UserKind:
+		rest, ok := strings.CutPrefix(s.Name, serviceAccountUserPrefix)
+		ns, name, found := strings.Cut(rest, ":")
+		return s.Name, ok && found && ns != "" && name != ""
+	}
+	return "", false
+}
+
+// roleRules returns the rules of the role of a binding, or nil if the role
+// doesn't exist.
+func roleRules(ctx context.Context, kc client.Reader, ns string, ref rbac.RoleRef) ([]rbac.PolicyRule, error) {
+	var rules []rbac.PolicyRule
+	var err error
+	if ref.Kind == "ClusterRole" {
+		var role rbac.ClusterRole
+		err = kc.Get(ctx, client.ObjectKey{Name: ref.Name}, &role)
+		rules = role.Rules
+	} else {
+		var role rbac.Role
+		err = kc.Get(ctx, client.ObjectKey{Namespace: ns, Name: ref.Name}, &role)
+		rules = role.Rules
+	}
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	return rules, err
+}
+
+// proxyGrant returns the verbs the rules grant on the services/proxy name,
+// and whether they are granted on every service.
+func proxyGrant(rules []rbac.PolicyRule, name string) ([]string, bool) {
+	var verbs []string
+	allServices := false
+	for _, r := range rules {
+		if !matches(r.APIGroups, "") || !(matches(r.Resources, "services/proxy") || slices.Contains(r.Resources, "services/*")) {
+			continue
+		}
+		if len(r.ResourceNames) > 0 && !slices.Contains(r.ResourceNames, name) {
+			continue
+		}
+		if len(r.ResourceNames) == 0 {
+			allServices = true
+		}
+		for _, v := range r.Verbs {
+			if !slices.Contains(verbs, v) {
+				verbs = append(verbs, v)
+			}
+		}
+	}
+	return verbs, allServices
+}
+
+func matches(values []string, v string) bool {
+	return slices.Contains(values, v) || slices.Contains(values, rbac.ResourceAll)
+}
@@ -0,0 +1,205 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package access
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	rbac "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// reader serves RBAC objects to Audit.
+type reader struct {
+	objects []client.Object
+}
+
+func (r *reader) Get(_ context.Context, key client.ObjectKey, obj client.Object, _ ...client.GetOption) error {
+	for _, o := range r.objects {
+		if reflect.TypeOf(o) == reflect.TypeOf(obj) && client.ObjectKeyFromObject(o) == key {
+			reflect.ValueOf(obj).Elem().Set(reflect.ValueOf(o).Elem())
+			return nil
+		}
+	}
+	return apierrors.NewNotFound(schema.GroupResource{Group: rbac.GroupName, Resource: "roles"}, key.Name)
+}
+
+func (r *reader) List(_ context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	lo := (&client.ListOptions{}).ApplyOptions(opts)
+	for _, o := range r.objects {
+		if lo.Namespace != "" && o.GetNamespace() != lo.Namespace {
+			continue
+		}
+		switch l := list.(type) {
+		case *rbac.ClusterRoleBindingList:
+			if b, ok := o.(*rbac.ClusterRoleBinding); ok {
+				l.Items = append(l.Items, *b)
+			}
+		case *rbac.RoleBindingList:
+			if b, ok := o.(*rbac.RoleBinding); ok {
+				l.Items = append(l.Items, *b)
+			}
+		}
+	}
+	return nil
+}
+
+func proxyRule(names []string, verbs ...string) rbac.PolicyRule {
+	return rbac.PolicyRule{APIGroups: []string{""}, Resources: []string{"services/proxy"}, ResourceNames: names, Verbs: verbs}
+}
+
+func clusterRole(name string, rules ...rbac.PolicyRule) *rbac.ClusterRole {
+	return &rbac.ClusterRole{ObjectMeta: metav1.ObjectMeta{Name: name}, Rules: rules}
+}
+
+func clusterRoleBinding(name, role string, subjects ...rbac.Subject) *rbac.ClusterRoleBinding {
+	return &rbac.ClusterRoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		RoleRef:    rbac.RoleRef{APIGroup: rbac.GroupName, Kind: "ClusterRole", Name: role},
+		Subjects:   subjects,
+	}
+}
+
+func roleBinding(ns, name, kind, role string, subjects ...rbac.Subject) *rbac.RoleBinding {
+	return &rbac.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+		RoleRef:    rbac.RoleRef{APIGroup: rbac.GroupName, Kind: kind, Name: role},
+		Subjects:   subjects,
+	}
+}
+
+func serviceAccount(ns, name string) rbac.Subject {
+	return rbac.Subject{Kind: rbac.ServiceAccountKind, Namespace: ns, Name: name}
+}
+
+func TestAudit(t *testing.T) {
+	_, role, binding := Objects(testOptions)
+	prometheusProxy := []string{"http:prometheus:9090"}
+	objects := []client.Object{
+		// the least privilege of Objects is fine
+		role, binding,
+
+		clusterRole("proxy-all", proxyRule(nil, "get")),
+		clusterRole("proxy-prometheus", proxyRule(prometheusProxy, "get", "create")),
+		clusterRole("admin-like", rbac.PolicyRule{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}),
+		clusterRole("pod-reader", rbac.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get"}}),
+		&rbac.Role{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "proxy-delete"},
+			Rules:      []rbac.PolicyRule{proxyRule(prometheusProxy, "get", "create", "delete")},
+		},
+
+		// like trickster-conf/rbac.yaml
+		clusterRoleBinding("trickster-anonymous", "proxy-all", rbac.Subject{Kind: rbac.UserKind, Name: "system:anonymous"}),
+		roleBinding("monitoring", "monitoring-sas", "ClusterRole", "proxy-prometheus", rbac.Subject{Kind: rbac.GroupKind, Name: "system:serviceaccounts:monitoring"}),
+		// the service account bound by its username
+		roleBinding("monitoring", "trickster-delete", "Role", "proxy-delete", rbac.Subject{Kind: rbac.UserKind, Name: "system:serviceaccount:monitoring:trickster"}),
+		// service accounts of any namespace with the proxy of every service
+		clusterRoleBinding("grafana-proxy", "proxy-all", serviceAccount("grafana", "grafana")),
+		roleBinding("monitoring", "ci-admin", "ClusterRole", "admin-like", rbac.Subject{Kind: rbac.UserKind, Name: "system:serviceaccount:ci:deployer"}),
+		// other clients of just this service
+		roleBinding("monitoring", "grafana-prometheus", "ClusterRole", "proxy-prometheus", serviceAccount("grafana", "grafana")),
+		// not about the proxy, of a missing role, or in another namespace
+		clusterRoleBinding("pod-readers", "pod-reader", rbac.Subject{Kind: rbac.GroupKind, Name: "system:authenticated"}),
+		clusterRoleBinding("missing", "deleted-role", rbac.Subject{Kind: rbac.GroupKind, Name: "system:authenticated"}),
+		roleBinding("default", "default-admin", "ClusterRole", "admin-like", serviceAccount("default", "default")),
+	}
+
+	findings, err := Audit(context.Background(), &reader{objects: objects}, testOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, f := range findings {
+		got[f.Binding+" "+f.Subject] = f.Message
+	}
+	want := map[string]string{
+		"ClusterRoleBinding/trickster-anonymous User/system:anonymous":                       "to every unauthenticated client",
+		"RoleBinding/monitoring/monitoring-sas Group/system:serviceaccounts:monitoring":      "to every service account of namespace monitoring",
+		"RoleBinding/monitoring/trickster-delete system:serviceaccount:monitoring:trickster": "the verbs delete on the proxy",
+		"ClusterRoleBinding/grafana-proxy system:serviceaccount:grafana:grafana":             "the proxy of every service in the cluster",
+		"RoleBinding/monitoring/ci-admin system:serviceaccount:ci:deployer":                  "the proxy of every service in namespace monitoring",
+	}
+	for k, msg := range want {
+		if !strings.Contains(got[k], msg) {
+			t.Errorf("finding of %s = %q, want %q", k, got[k], msg)
+		}
+	}
+	for k, msg := range got {
+		if _, ok := want[k]; !ok {
+			t.Errorf("unexpected finding of %s: %s", k, msg)
+		}
+	}
+}
+
+func TestServiceAccountSubject(t *testing.T) {
+	tests := []struct {
+		subject rbac.Subject
+		want    string
+	}{
+		{subject: serviceAccount("monitoring", "trickster"), want: "system:serviceaccount:monitoring:trickster"},
+		{subject: rbac.Subject{Kind: rbac.UserKind, Name: "system:serviceaccount:monitoring:trickster"}, want: "system:serviceaccount:monitoring:trickster"},
+		{subject: rbac.Subject{Kind: rbac.UserKind, Name: "system:serviceaccount:monitoring"}},
+		{subject: rbac.Subject{Kind: rbac.UserKind, Name: "jane@example.com"}},
+		{subject: rbac.Subject{Kind: rbac.GroupKind, Name: "system:serviceaccount:monitoring:trickster"}},
+	}
+	for _, tt := range tests {
+		got, ok := serviceAccountSubject(tt.subject)
+		if ok != (tt.want != "") || ok && got != tt.want {
+			t.Errorf("serviceAccountSubject(%+v) = %q, %v, want %q", tt.subject, got, ok, tt.want)
+		}
+	}
+}
+
+func TestProxyGrant(t *testing.T) {
+	const name = "http:prometheus:9090"
+	tests := []struct {
+		name      string
+		rules     []rbac.PolicyRule
+		wantVerbs []string
+		wantAll   bool
+	}{
+		{name: "named", rules: []rbac.PolicyRule{proxyRule([]string{name}, "get", "create")}, wantVerbs: []string{"get", "create"}},
+		{name: "other service", rules: []rbac.PolicyRule{proxyRule([]string{"http:grafana:80"}, "get")}},
+		{name: "every service", rules: []rbac.PolicyRule{proxyRule(nil, "get")}, wantVerbs: []string{"get"}, wantAll: true},
+		{
+			name: "merged verbs",
+			rules: []rbac.PolicyRule{
+				proxyRule([]string{name}, "get"),
+				proxyRule([]string{"http:grafana:80", name}, "get", "create"),
+			},
+			wantVerbs: []string{"get", "create"},
+		},
+		{name: "wildcards", rules: []rbac.PolicyRule{{APIGroups: []string{"*"}, Resources: []string{"*"}, Verbs: []string{"*"}}}, wantVerbs: []string{"*"}, wantAll: true},
+		{name: "subresources", rules: []rbac.PolicyRule{{APIGroups: []string{""}, Resources: []string{"services/*"}, Verbs: []string{"get"}}}, wantVerbs: []string{"get"}, wantAll: true},
+		{name: "services only", rules: []rbac.PolicyRule{{APIGroups: []string{""}, Resources: []string{"services"}, Verbs: []string{"get"}}}},
+		{name: "other group", rules: []rbac.PolicyRule{{APIGroups: []string{"apps"}, Resources: []string{"services/proxy"}, Verbs: []string{"get"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verbs, all := proxyGrant(tt.rules, name)
+			if !reflect.DeepEqual(verbs, tt.wantVerbs) || all != tt.wantAll {
+				t.Errorf("proxyGrant() = %v, %v, want %v, %v", verbs, all, tt.wantVerbs, tt.wantAll)
+			}
+		})
+	}
+}
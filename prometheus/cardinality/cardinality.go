@@ -0,0 +1,411 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cardinality reports the metrics and labels that make up most of
+// the series of a Prometheus server, so high-cardinality labels are found
+// before queries through Trickster start to time out.
+package cardinality
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/tamalsaha/prometheus-demo/prometheus/promql"
+	"github.com/tamalsaha/prometheus-demo/prometheus/query"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultLimit is the number of metrics and labels reported.
+	DefaultLimit = 10
+	// BytesPerSeries is a rough estimate of the memory of a head series,
+	// with its labels, postings and open chunk. The actual number depends
+	// on the label sizes and the scrape interval.
+	BytesPerSeries = 4 * 1024
+
+	// seriesWindow is how far back the labels of a metric are looked up,
+	// like the lookback of the queries that count their values.
+	seriesWindow = 5 * time.Minute
+	// concurrency limits the lookups of series and label values.
+	concurrency = 4
+)
+
+// Source is where the statistics of a report come from.
+type Source string
+
+const (
+	// SourceTSDB is the /api/v1/status/tsdb endpoint of Prometheus.
+	SourceTSDB Source = "tsdb"
+	// SourceQuery is a count by (__name__) query and the label values API,
+	// for servers without the TSDB status endpoint, like Thanos Query.
+	SourceQuery Source = "query"
+)
+
+// Thresholds flag offenders. A zero threshold is not checked.
+type Thresholds struct {
+	// MetricSeries is the number of series a metric may have.
+	MetricSeries uint64 `json:"metricSeries,omitempty"`
+	// LabelValues is the number of values a label may have.
+	LabelValues uint64 `json:"labelValues,omitempty"`
+	// HeadSeries is the number of series the server may have.
+	HeadSeries uint64 `json:"headSeries,omitempty"`
+	// Churn is the fraction by which the series of a metric may change
+	// between two reports.
+	Churn float64 `json:"churn,omitempty"`
+}
+
+// DefaultThresholds are the thresholds of a medium sized Prometheus.
+var DefaultThresholds = Thresholds{
+	MetricSeries: 10000,
+	LabelValues:  1000,
+	HeadSeries:   2000000,
+	Churn:        0.5,
+}
+
+// Options configure Analyze.
+type Options struct {
+	// Limit is the number of metrics and labels reported.
+	Limit int
+	// Time is when the series and label values are looked up. It defaults
+	// to now.
+	Time       time.Time
+	Thresholds Thresholds
+	// Previous is an earlier report. If set, the report has the churn
+	// since then.
+	Previous *Report
+}
+
+// Report is the cardinality of a server at a time.
+type Report struct {
+	Time       time.Time  `json:"time"`
+	Source     Source     `json:"source"`
+	HeadSeries uint64     `json:"headSeries"`
+	LabelPairs uint64     `json:"labelPairs,omitempty"`
+	Chunks     uint64     `json:"chunks,omitempty"`
+	Thresholds Thresholds `json:"thresholds"`
+	// EstimatedMemoryBytes is HeadSeries times BytesPerSeries.
+	EstimatedMemoryBytes uint64      `json:"estimatedMemoryBytes"`
+	Metrics              []Metric    `json:"metrics"`
+	Labels               []Label     `json:"labels"`
+	LabelValuePairs      []LabelPair `json:"labelValuePairs,omitempty"`
+	Churn                *Churn      `json:"churn,omitempty"`
+	// Findings are the values over a threshold. Alerting can fire on a
+	// non-empty list.
+	Findings []Finding `json:"findings"`
+}
+
+// Metric is the number of series of a metric.
+type Metric struct {
+	Name   string `json:"name"`
+	Series uint64 `json:"series"`
+	// Share is the percentage of the head series.
+	Share                float64 `json:"share"`
+	EstimatedMemoryBytes uint64  `json:"estimatedMemoryBytes"`
+	// TopLabel is the label with the most values among the series of the
+	// metric, the usual cause of its cardinality.
+	TopLabel       string `json:"topLabel,omitempty"`
+	TopLabelValues int    `json:"topLabelValues,omitempty"`
+}
+
+// Label is the number of distinct values of a label.
+type Label struct {
+	Name   string `json:"name"`
+	Values uint64 `json:"values"`
+	// MemoryBytes is the memory used by the values, if known.
+	MemoryBytes uint64 `json:"memoryBytes,omitempty"`
+}
+
+// LabelPair is the number of series with a label value, like
+// job="node-exporter".
+type LabelPair struct {
+	Pair   string `json:"pair"`
+	Series uint64 `json:"series"`
+}
+
+// Finding is a value over its threshold.
+type Finding struct {
+	// Kind is headSeries, metricSeries, labelValues or churn.
+	Kind      string  `json:"kind"`
+	Name      string  `json:"name,omitempty"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	Message   string  `json:"message"`
+}
+
+// LoadReport reads a report written as JSON, like the output of
+// `read-prom cardinality -o json`.
+func LoadReport(filename string) (*Report, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	return &r, nil
+}
+
+// Analyze returns the cardinality report of the server behind api. It uses
+// the TSDB status endpoint and falls back to queries if the server doesn't
+// have it. The top label of every reported metric is found by counting the
+// values of its labels.
+func Analyze(ctx context.Context, api promv1.API, opts Options) (*Report, error) {
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultLimit
+	}
+	if opts.Time.IsZero() {
+		opts.Time = time.Now()
+	}
+	r := &Report{Time: opts.Time, Thresholds: opts.Thresholds}
+
+	stats, err := api.TSDB(ctx, promv1.WithLimit(uint64(opts.Limit)))
+	if err == nil {
+		r.fromTSDB(stats, opts.Limit)
+	} else {
+		klog.V(2).Infof("TSDB status is not available, falling back to queries: %v", err)
+		if err := r.fromQueries(ctx, api, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range r.Metrics {
+		m := &r.Metrics[i]
+		if r.HeadSeries > 0 {
+			m.Share = float64(m.Series) / float64(r.HeadSeries) * 100
+		}
+		m.EstimatedMemoryBytes = m.Series * BytesPerSeries
+	}
+	r.EstimatedMemoryBytes = r.HeadSeries * BytesPerSeries
+	if err := r.findTopLabels(ctx, api); err != nil {
+		return nil, err
+	}
+	if opts.Previous != nil {
+		r.Churn = NewChurn(opts.Previous, r)
+	}
+	r.Findings = r.check(opts.Thresholds)
+	return r, nil
+}
+
+func (r *Report) fromTSDB(stats promv1.TSDBResult, limit int) {
+	r.Source = SourceTSDB
+	r.HeadSeries = uint64(stats.HeadStats.NumSeries)
+	r.LabelPairs = uint64(stats.HeadStats.NumLabelPairs)
+	r.Chunks = uint64(stats.HeadStats.ChunkCount)
+
+	memory := map[string]uint64{}
+	for _, s := range stats.MemoryInBytesByLabelName {
+		memory[s.Name] = s.Value
+	}
+	for _, s := range top(stats.SeriesCountByMetricName, limit) {
+		r.Metrics = append(r.Metrics, Metric{Name: s.Name, Series: s.Value})
+	}
+	for _, s := range top(stats.LabelValueCountByLabelName, limit) {
+		r.Labels = append(r.Labels, Label{Name: s.Name, Values: s.Value, MemoryBytes: memory[s.Name]})
+	}
+	for _, s := range top(stats.SeriesCountByLabelValuePair, limit) {
+		r.LabelValuePairs = append(r.LabelValuePairs, LabelPair{Pair: s.Name, Series: s.Value})
+	}
+}
+
+// top returns the limit largest stats. Servers that ignore the limit
+// parameter return their own number of stats.
+func top(stats []promv1.Stat, limit int) []promv1.Stat {
+	out := append([]promv1.Stat(nil), stats...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Value > out[j].Value
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// fromQueries counts the series of every metric with one query and the
+// values of every label with the label values API.
+func (r *Report) fromQueries(ctx context.Context, api promv1.API, opts Options) error {
+	r.Source = SourceQuery
+	res, err := query.New(api).Query(ctx, `count by (__name__) ({__name__!=""})`, opts.Time)
+	if err != nil {
+		return fmt.Errorf("failed to count series: %w", err)
+	}
+	var metrics []promv1.Stat
+	for _, s := range res.Samples {
+		n := uint64(s.Value)
+		metrics = append(metrics, promv1.Stat{Name: s.Labels[model.MetricNameLabel], Value: n})
+		r.HeadSeries += n
+	}
+	for _, s := range top(metrics, opts.Limit) {
+		r.Metrics = append(r.Metrics, Metric{Name: s.Name, Series: s.Value})
+	}
+
+	start := opts.Time.Add(-seriesWindow)
+	names, _, err := api.LabelNames(ctx, nil, start, opts.Time)
+	if err != nil {
+		return fmt.Errorf("failed to list label names: %w", err)
+	}
+	labels := make([]promv1.Stat, len(names))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for i, name := range names {
+		g.Go(func() error {
+			values, _, err := api.LabelValues(gctx, name, nil, start, opts.Time)
+			if err != nil {
+				return fmt.Errorf("failed to list values of label %s: %w", name, err)
+			}
+			labels[i] = promv1.Stat{Name: name, Value: uint64(len(values))}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	for _, s := range top(labels, opts.Limit) {
+		r.Labels = append(r.Labels, Label{Name: s.Name, Values: s.Value})
+	}
+	return nil
+}
+
+// findTopLabels sets the label with the most distinct values among the
+// recent series of the reported metrics. The values are counted by the
+// server with a count(count by (label) (metric)) query for every label of
+// the metric, so that the series of a metric are never listed.
+func (r *Report) findTopLabels(ctx context.Context, api promv1.API) error {
+	start := r.Time.Add(-seriesWindow)
+	selectors := make([]promql.Selector, len(r.Metrics))
+	names := make([][]string, len(r.Metrics))
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for i, m := range r.Metrics {
+		selectors[i] = promql.Metric("", promql.Eq(model.MetricNameLabel, m.Name))
+		g.Go(func() error {
+			labels, _, err := api.LabelNames(gctx, []string{selectors[i].String()}, start, r.Time)
+			if err != nil {
+				return fmt.Errorf("failed to list labels of %s: %w", m.Name, err)
+			}
+			for _, l := range labels {
+				if l != model.MetricNameLabel {
+					names[i] = append(names[i], l)
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	g, gctx = errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
+	for i := range r.Metrics {
+		m := &r.Metrics[i]
+		for _, label := range names[i] {
+			q, err := promql.Build(promql.Count(promql.Count(selectors[i]).By(label)))
+			if err != nil {
+				klog.V(2).Infof("Skipping label %s of %s: %v", label, m.Name, err)
+				continue
+			}
+			g.Go(func() error {
+				res, err := query.New(api).Query(gctx, q, r.Time)
+				if err != nil {
+					return fmt.Errorf("failed to count values of label %s of %s: %w", label, m.Name, err)
+				}
+				if len(res.Samples) == 0 {
+					return nil
+				}
+				n := int(res.Samples[0].Value)
+				mu.Lock()
+				defer mu.Unlock()
+				// ties go to the first label name, so reports are stable
+				if n > m.TopLabelValues || (n == m.TopLabelValues && label < m.TopLabel) {
+					m.TopLabel = label
+					m.TopLabelValues = n
+				}
+				return nil
+			})
+		}
+	}
+	return g.Wait()
+}
+
+func (r *Report) check(t Thresholds) []Finding {
+	findings := []Finding{}
+	if t.HeadSeries > 0 && r.HeadSeries > t.HeadSeries {
+		findings = append(findings, Finding{
+			Kind:      "headSeries",
+			Value:     float64(r.HeadSeries),
+			Threshold: float64(t.HeadSeries),
+			Message:   fmt.Sprintf("%d head series, over %d", r.HeadSeries, t.HeadSeries),
+		})
+	}
+	if t.MetricSeries > 0 {
+		for _, m := range r.Metrics {
+			if m.Series > t.MetricSeries {
+				msg := fmt.Sprintf("metric %s has %d series, over %d", m.Name, m.Series, t.MetricSeries)
+				if m.TopLabel != "" {
+					msg += fmt.Sprintf(", label %s has %d values", m.TopLabel, m.TopLabelValues)
+				}
+				findings = append(findings, Finding{
+					Kind:      "metricSeries",
+					Name:      m.Name,
+					Value:     float64(m.Series),
+					Threshold: float64(t.MetricSeries),
+					Message:   msg,
+				})
+			}
+		}
+	}
+	if t.LabelValues > 0 {
+		for _, l := range r.Labels {
+			if l.Values > t.LabelValues {
+				findings = append(findings, Finding{
+					Kind:      "labelValues",
+					Name:      l.Name,
+					Value:     float64(l.Values),
+					Threshold: float64(t.LabelValues),
+					Message:   fmt.Sprintf("label %s has %d values, over %d", l.Name, l.Values, t.LabelValues),
+				})
+			}
+		}
+	}
+	if t.Churn > 0 && r.Churn != nil {
+		for _, m := range r.Churn.Metrics {
+			if m.Ratio > t.Churn || -m.Ratio > t.Churn {
+				msg := fmt.Sprintf("metric %s changed from %d to %d series since %s", m.Name, m.Before, m.After, r.Churn.Since.Format(time.RFC3339))
+				if m.New {
+					msg = fmt.Sprintf("metric %s grew from at most %d to %d series since %s", m.Name, m.Before, m.After, r.Churn.Since.Format(time.RFC3339))
+				}
+				findings = append(findings, Finding{
+					Kind:      "churn",
+					Name:      m.Name,
+					Value:     m.Ratio,
+					Threshold: t.Churn,
+					Message:   msg,
+				})
+			}
+		}
+	}
+	return findings
+}
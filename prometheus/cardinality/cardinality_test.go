@@ -0,0 +1,190 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cardinality
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	"github.com/tamalsaha/prometheus-demo/prometheus/promtest"
+)
+
+var now = promtest.DefaultStart.Add(time.Hour)
+
+// testStorage has an http_requests_total metric with 40 paths, 2 methods
+// and a pod, so 80 series, a 3 series up metric and a single build info.
+func testStorage() *promtest.Storage {
+	db := promtest.NewStorage()
+	g := promtest.Generator{Start: now.Add(-2 * time.Minute), Interval: 15 * time.Second, Points: 9}
+	for i := range 40 {
+		for _, method := range []string{"GET", "POST"} {
+			g.Constant(db, "http_requests_total", map[string]string{
+				"path": fmt.Sprintf("/api/items/%d", i), "method": method, "pod": "web-0",
+			}, 1)
+		}
+	}
+	for _, job := range []string{"node", "kubelet", "prometheus"} {
+		g.Constant(db, "up", map[string]string{"job": job}, 1)
+	}
+	g.Constant(db, "prometheus_build_info", map[string]string{"version": "2.55.1"}, 1)
+	return db
+}
+
+// newTestAPI serves db, without the TSDB status API if noTSDB is set, and
+// records the requested paths.
+func newTestAPI(t *testing.T, db *promtest.Storage, noTSDB bool) (promv1.API, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var paths []string
+	h := promtest.NewHandler(db)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if noTSDB && r.URL.Path == "/api/v1/status/tsdb" {
+			http.NotFound(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	c, err := (&prometheus.Config{Addr: srv.URL}).NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return promv1.NewAPI(c), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	for _, source := range []Source{SourceTSDB, SourceQuery} {
+		t.Run(string(source), func(t *testing.T) {
+			api, paths := newTestAPI(t, testStorage(), source == SourceQuery)
+			r, err := Analyze(context.Background(), api, Options{
+				Limit:      2,
+				Time:       now,
+				Thresholds: Thresholds{MetricSeries: 50, LabelValues: 30, HeadSeries: 100},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Source != source || r.HeadSeries != 84 || r.EstimatedMemoryBytes != 84*BytesPerSeries {
+				t.Errorf("report = %s with %d head series, want %s with 84", r.Source, r.HeadSeries, source)
+			}
+			want := []Metric{
+				{Name: "http_requests_total", Series: 80, Share: float64(80) / 84 * 100, EstimatedMemoryBytes: 80 * BytesPerSeries, TopLabel: "path", TopLabelValues: 40},
+				{Name: "up", Series: 3, Share: float64(3) / 84 * 100, EstimatedMemoryBytes: 3 * BytesPerSeries, TopLabel: "job", TopLabelValues: 3},
+			}
+			if !reflect.DeepEqual(r.Metrics, want) {
+				t.Errorf("metrics = %+v, want %+v", r.Metrics, want)
+			}
+			if len(r.Labels) != 2 || r.Labels[0].Name != "path" || r.Labels[0].Values != 40 {
+				t.Errorf("labels = %+v, want path with 40 values first", r.Labels)
+			}
+
+			var kinds []string
+			for _, f := range r.Findings {
+				kinds = append(kinds, f.Kind+"/"+f.Name)
+			}
+			if want := []string{"metricSeries/http_requests_total", "labelValues/path"}; !reflect.DeepEqual(kinds, want) {
+				t.Errorf("findings = %v, want %v", kinds, want)
+			}
+			if msg := r.Findings[0].Message; !strings.Contains(msg, "label path has 40 values") {
+				t.Errorf("finding %q doesn't name the top label", msg)
+			}
+
+			// the series of a metric are counted by the server, not listed
+			for _, p := range paths() {
+				if p == "/api/v1/series" {
+					t.Error("the series of a metric were listed")
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestChurn(t *testing.T) {
+	before := &Report{
+		Time:       now.Add(-24 * time.Hour),
+		HeadSeries: 1000,
+		Metrics: []Metric{
+			{Name: "http_requests_total", Series: 500},
+			{Name: "up", Series: 100},
+			{Name: "node_cpu_seconds_total", Series: 50},
+		},
+	}
+	after := &Report{
+		Time:       now,
+		HeadSeries: 2500,
+		Metrics: []Metric{
+			// a new metric, entering the top list
+			{Name: "grpc_server_handled_total", Series: 1200},
+			{Name: "http_requests_total", Series: 550},
+			{Name: "up", Series: 30},
+		},
+	}
+	c := NewChurn(before, after)
+	want := &Churn{
+		Since:            before.Time,
+		HeadSeriesBefore: 1000,
+		HeadSeriesAfter:  2500,
+		Metrics: []MetricChurn{
+			{Name: "grpc_server_handled_total", Before: 50, After: 1200, Delta: 1150, Ratio: 23, New: true},
+			{Name: "up", Before: 100, After: 30, Delta: -70, Ratio: -0.7},
+			{Name: "http_requests_total", Before: 500, After: 550, Delta: 50, Ratio: 0.1},
+		},
+		Appeared:    []string{"grpc_server_handled_total"},
+		Disappeared: []string{"node_cpu_seconds_total"},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("NewChurn() = %+v, want %+v", c, want)
+	}
+
+	after.Churn = c
+	var got []string
+	for _, f := range after.check(Thresholds{Churn: 0.5}) {
+		got = append(got, f.Name+": "+f.Message)
+	}
+	since := before.Time.Format(time.RFC3339)
+	wantFindings := []string{
+		"grpc_server_handled_total: metric grpc_server_handled_total grew from at most 50 to 1200 series since " + since,
+		"up: metric up changed from 100 to 30 series since " + since,
+	}
+	if !reflect.DeepEqual(got, wantFindings) {
+		t.Errorf("findings = %q, want %q", got, wantFindings)
+	}
+
+	// a metric that had no series before
+	c = NewChurn(&Report{Time: before.Time}, after)
+	if m := c.Metrics[0]; !m.New || m.Before != 0 || m.Ratio != 1 {
+		t.Errorf("churn of a metric of an empty report = %+v, want new with a ratio of 1", m)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cardinality
+
+import (
+	"sort"
+	"time"
+)
+
+// Churn is the change of the series between two reports.
+type Churn struct {
+	Since            time.Time `json:"since"`
+	HeadSeriesBefore uint64    `json:"headSeriesBefore"`
+	HeadSeriesAfter  uint64    `json:"headSeriesAfter"`
+	// Metrics are the metrics in the top list of the later report, by the
+	// size of their change.
+	Metrics []MetricChurn `json:"metrics"`
+	// Appeared and Disappeared are the metrics that are only in the top
+	// list of the later or the earlier report.
+	Appeared    []string `json:"appeared,omitempty"`
+	Disappeared []string `json:"disappeared,omitempty"`
+}
+
+// MetricChurn is the change of the series of a metric.
+type MetricChurn struct {
+	Name   string `json:"name"`
+	Before uint64 `json:"before"`
+	After  uint64 `json:"after"`
+	Delta  int64  `json:"delta"`
+	// Ratio is Delta relative to Before, or 1 for a metric that had no
+	// series before.
+	Ratio float64 `json:"ratio"`
+	// New is true if the metric was not in the top list of the earlier
+	// report. Before is then the fewest series of that list, the most the
+	// metric can have had, so Delta and Ratio are the least change.
+	New bool `json:"new,omitempty"`
+}
+
+// NewChurn compares the metrics of two reports. Reports only have the top
+// metrics, so a metric that drops out of the top list is reported as
+// disappeared, not as zero series, and a metric that enters it is compared
+// with the smallest metric of the earlier list.
+func NewChurn(before, after *Report) *Churn {
+	c := &Churn{
+		Since:            before.Time,
+		HeadSeriesBefore: before.HeadSeries,
+		HeadSeriesAfter:  after.HeadSeries,
+		Metrics:          []MetricChurn{},
+	}
+	prev := map[string]uint64{}
+	var smallest uint64
+	for i, m := range before.Metrics {
+		prev[m.Name] = m.Series
+		if i == 0 || m.Series < smallest {
+			smallest = m.Series
+		}
+	}
+	for _, m := range after.Metrics {
+		b, ok := prev[m.Name]
+		if ok {
+			delete(prev, m.Name)
+		} else {
+			c.Appeared = append(c.Appeared, m.Name)
+			b = min(smallest, m.Series)
+		}
+		mc := MetricChurn{Name: m.Name, Before: b, After: m.Series, Delta: int64(m.Series) - int64(b), New: !ok}
+		switch {
+		case b > 0:
+			mc.Ratio = float64(mc.Delta) / float64(b)
+		case m.Series > 0:
+			mc.Ratio = 1
+		}
+		c.Metrics = append(c.Metrics, mc)
+	}
+	for name := range prev {
+		c.Disappeared = append(c.Disappeared, name)
+	}
+	sort.Strings(c.Disappeared)
+	sort.SliceStable(c.Metrics, func(i, j int) bool {
+		return abs(c.Metrics[i].Delta) > abs(c.Metrics[j].Delta)
+	})
+	return c
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
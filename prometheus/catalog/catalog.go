@@ -0,0 +1,419 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package catalog keeps named PromQL queries in YAML files, so dashboards
+// and reports share one definition of a query instead of a copy of its
+// string in every Go file. A query is a text/template with typed
+// parameters:
+//
+//	queries:
+//	- name: pod_memory
+//	  description: Working set bytes of the containers of a pod
+//	  params:
+//	  - name: namespace
+//	    type: string
+//	  - name: pod
+//	    type: string
+//	  query: sum(container_memory_working_set_bytes{namespace={{ .namespace }}, pod={{ .pod }}, container!=""})
+//
+// String parameters are rendered as quoted PromQL strings, so a value can't
+// change the structure of the query. Every query is rendered and parsed
+// when the catalog is loaded.
+package catalog
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+	"sigs.k8s.io/yaml"
+)
+
+// ParamType is the type of a query parameter. It decides how a value is
+// validated and rendered.
+type ParamType string
+
+const (
+	// ParamString is a label value or any other string, rendered as a
+	// quoted PromQL string like "monitoring". Use {{ re .name }} to match
+	// the value literally with =~.
+	ParamString ParamType = "string"
+	// ParamLabel is a label name, like the label of a by clause.
+	ParamLabel ParamType = "label"
+	// ParamDuration is a PromQL duration, like the range of a selector.
+	ParamDuration ParamType = "duration"
+	// ParamNumber is a float, like the k of topk or a threshold.
+	ParamNumber ParamType = "number"
+)
+
+// Shape is the result of a query. Vector and scalar queries are instant
+// queries, matrix queries are range queries of a vector or scalar
+// expression.
+type Shape string
+
+const (
+	ShapeVector Shape = "vector"
+	ShapeScalar Shape = "scalar"
+	ShapeMatrix Shape = "matrix"
+)
+
+// DefaultRange is the range of matrix queries that don't set one.
+var DefaultRange = Range{
+	Duration: model.Duration(time.Hour),
+	Step:     model.Duration(time.Minute),
+}
+
+// Param is a parameter of a query.
+type Param struct {
+	Name        string    `json:"name"`
+	Type        ParamType `json:"type"`
+	Description string    `json:"description,omitempty"`
+	// Default is used if the parameter isn't given. A parameter without a
+	// default is required.
+	Default *string `json:"default,omitempty"`
+}
+
+// Range is the default range of a matrix query, ending now.
+type Range struct {
+	Duration model.Duration `json:"duration"`
+	Step     model.Duration `json:"step"`
+}
+
+// Query is a named query template.
+type Query struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Params      []Param `json:"params,omitempty"`
+	Query       string  `json:"query"`
+	Result      Shape   `json:"result,omitempty"`
+	Range       *Range  `json:"range,omitempty"`
+
+	tmpl *template.Template
+}
+
+// File is the format of a catalog file.
+type File struct {
+	Queries []*Query `json:"queries"`
+}
+
+// Catalog is a set of queries by name.
+type Catalog struct {
+	queries map[string]*Query
+	files   map[string]string
+}
+
+//go:embed queries.yaml
+var defaultQueries []byte
+
+// Default is the catalog of the queries used by the reports in this
+// repository.
+var Default = mustParse("queries.yaml", defaultQueries)
+
+func mustParse(filename string, data []byte) *Catalog {
+	c := New()
+	if err := c.add(filename, data); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// New returns an empty catalog.
+func New() *Catalog {
+	return &Catalog{queries: map[string]*Query{}, files: map[string]string{}}
+}
+
+// Load reads the catalog files in paths. A directory adds all its .yaml,
+// .yml and .json files. A query name may only be defined once.
+func Load(paths ...string) (*Catalog, error) {
+	c := New()
+	for _, p := range paths {
+		files := []string{p}
+		if fi, err := os.Stat(p); err != nil {
+			return nil, err
+		} else if fi.IsDir() {
+			if files, err = catalogFiles(p); err != nil {
+				return nil, err
+			}
+		}
+		for _, f := range files {
+			data, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if err := c.add(f, data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return c, nil
+}
+
+func catalogFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		switch filepath.Ext(e.Name()) {
+		case ".yaml", ".yml", ".json":
+			if !e.IsDir() {
+				files = append(files, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+func (c *Catalog) add(filename string, data []byte) error {
+	var f File
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	for _, q := range f.Queries {
+		if q == nil {
+			continue
+		}
+		if err := q.compile(); err != nil {
+			return fmt.Errorf("invalid query %q in %s: %w", q.Name, filename, err)
+		}
+		if other, ok := c.files[q.Name]; ok {
+			return fmt.Errorf("query %q in %s is already defined in %s", q.Name, filename, other)
+		}
+		c.queries[q.Name] = q
+		c.files[q.Name] = filename
+	}
+	return nil
+}
+
+// Merge returns a catalog with the queries of c and other. Queries of other
+// replace those of c with the same name.
+func (c *Catalog) Merge(other *Catalog) *Catalog {
+	out := New()
+	for _, from := range []*Catalog{c, other} {
+		for name, q := range from.queries {
+			out.queries[name] = q
+			out.files[name] = from.files[name]
+		}
+	}
+	return out
+}
+
+// Get returns the named query.
+func (c *Catalog) Get(name string) (*Query, error) {
+	q, ok := c.queries[name]
+	if !ok {
+		return nil, fmt.Errorf("query %q is not in the catalog", name)
+	}
+	return q, nil
+}
+
+// Queries returns the queries sorted by name.
+func (c *Catalog) Queries() []*Query {
+	out := make([]*Query, 0, len(c.queries))
+	for _, q := range c.queries {
+		out = append(out, q)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// compile checks the definition of q and parses its template. The query
+// is rendered with the defaults of its parameters, or a placeholder of
+// their type, and must parse as PromQL of the declared result shape.
+func (q *Query) compile() error {
+	if !nameRegexp.MatchString(q.Name) {
+		return fmt.Errorf("name must match %s", nameRegexp)
+	}
+	switch q.Result {
+	case "":
+		q.Result = ShapeVector
+	case ShapeVector, ShapeScalar, ShapeMatrix:
+	default:
+		return fmt.Errorf("unknown result %q, must be one of vector, scalar or matrix", q.Result)
+	}
+	if q.Range != nil && q.Result != ShapeMatrix {
+		return fmt.Errorf("range is only used by matrix queries")
+	}
+	if q.Range != nil && (q.Range.Duration <= 0 || q.Range.Step <= 0) {
+		return fmt.Errorf("range duration and step must be positive")
+	}
+
+	seen := map[string]bool{}
+	sample := map[string]string{}
+	for _, p := range q.Params {
+		if !nameRegexp.MatchString(p.Name) {
+			return fmt.Errorf("parameter name %q must match %s", p.Name, nameRegexp)
+		}
+		if seen[p.Name] {
+			return fmt.Errorf("duplicate parameter %q", p.Name)
+		}
+		seen[p.Name] = true
+		v, ok := placeholders[p.Type]
+		if !ok {
+			return fmt.Errorf("parameter %s has unknown type %q, must be one of string, label, duration or number", p.Name, p.Type)
+		}
+		if p.Default != nil {
+			if _, err := p.value(*p.Default); err != nil {
+				return fmt.Errorf("invalid default: %w", err)
+			}
+			v = *p.Default
+		}
+		sample[p.Name] = v
+	}
+
+	tmpl, err := template.New(q.Name).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"re": regexQuote}).
+		Parse(q.Query)
+	if err != nil {
+		return err
+	}
+	q.tmpl = tmpl
+
+	expr, err := q.render(sample)
+	if err != nil {
+		return err
+	}
+	typ := expr.Type()
+	switch {
+	case q.Result == ShapeVector && typ != parser.ValueTypeVector,
+		q.Result == ShapeScalar && typ != parser.ValueTypeScalar,
+		q.Result == ShapeMatrix && typ != parser.ValueTypeVector && typ != parser.ValueTypeScalar:
+		return fmt.Errorf("query is of type %s, which doesn't match result %s", parser.DocumentedType(typ), q.Result)
+	}
+	return nil
+}
+
+// placeholders are rendered for parameters without a default when a query
+// is checked.
+var placeholders = map[ParamType]string{
+	ParamString:   "placeholder",
+	ParamLabel:    "placeholder",
+	ParamDuration: "5m",
+	ParamNumber:   "1",
+}
+
+// quoted is a string parameter. It prints as a PromQL string literal.
+type quoted string
+
+func (s quoted) String() string {
+	return strconv.Quote(string(s))
+}
+
+// regexQuote returns a string literal that matches s literally with =~.
+func regexQuote(s quoted) quoted {
+	return quoted(regexp.QuoteMeta(string(s)))
+}
+
+type number float64
+
+func (n number) String() string {
+	return strconv.FormatFloat(float64(n), 'g', -1, 64)
+}
+
+// value validates s and returns it in the form the template prints.
+func (p Param) value(s string) (interface{}, error) {
+	switch p.Type {
+	case ParamString:
+		return quoted(s), nil
+	case ParamLabel:
+		if !model.LabelName(s).IsValidLegacy() {
+			return nil, fmt.Errorf("parameter %s: %q is not a valid label name", p.Name, s)
+		}
+		return s, nil
+	case ParamDuration:
+		d, err := model.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s: %w", p.Name, err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("parameter %s: duration must be positive", p.Name)
+		}
+		return d, nil
+	case ParamNumber:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s: %q is not a number", p.Name, s)
+		}
+		return number(f), nil
+	}
+	return nil, fmt.Errorf("parameter %s has unknown type %q", p.Name, p.Type)
+}
+
+// Render returns the query with params. Parameters that aren't given use
+// their default; unknown parameters are an error.
+func (q *Query) Render(params map[string]string) (string, error) {
+	expr, err := q.render(params)
+	if err != nil {
+		return "", err
+	}
+	return expr.String(), nil
+}
+
+func (q *Query) render(params map[string]string) (parser.Expr, error) {
+	known := map[string]bool{}
+	data := map[string]interface{}{}
+	for _, p := range q.Params {
+		known[p.Name] = true
+		s, ok := params[p.Name]
+		if !ok {
+			if p.Default == nil {
+				return nil, fmt.Errorf("missing parameter %s", p.Name)
+			}
+			s = *p.Default
+		}
+		v, err := p.value(s)
+		if err != nil {
+			return nil, err
+		}
+		data[p.Name] = v
+	}
+	var unknown []string
+	for name := range params {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown parameters %s of query %s", strings.Join(unknown, ", "), q.Name)
+	}
+
+	var buf bytes.Buffer
+	if err := q.tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	expr, err := parser.ParseExpr(buf.String())
+	if err != nil {
+		return nil, fmt.Errorf("rendered query %q is invalid: %w", buf.String(), err)
+	}
+	return expr, nil
+}
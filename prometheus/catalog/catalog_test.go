@@ -0,0 +1,288 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package catalog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const testCatalog = `
+queries:
+- name: pod_up
+  params:
+  - name: namespace
+    type: string
+  - name: pod
+    type: string
+  query: up{namespace={{ .namespace }}, pod=~{{ re .pod }}}
+- name: top
+  result: vector
+  params:
+  - name: k
+    type: number
+    default: "3"
+  - name: by
+    type: label
+    default: job
+  - name: window
+    type: duration
+    default: 5m
+  query: topk({{ .k }}, sum by ({{ .by }}) (rate(http_requests_total[{{ .window }}])))
+`
+
+func parse(t *testing.T, data string) *Catalog {
+	t.Helper()
+	c := New()
+	if err := c.add("test.yaml", []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// matchers returns the label matchers of the selectors in query.
+func matchers(t *testing.T, query string) map[string]*labels.Matcher {
+	t.Helper()
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		t.Fatalf("rendered query %q doesn't parse: %v", query, err)
+	}
+	out := map[string]*labels.Matcher{}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			for _, m := range vs.LabelMatchers {
+				out[m.Name] = m
+			}
+		}
+		return nil
+	})
+	return out
+}
+
+func TestRenderLiterals(t *testing.T) {
+	q, err := parse(t, testCatalog).Get("pod_up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{
+		`monitoring`,
+		`a"b`,
+		`a\b`,
+		`a\`,
+		`"} or vector(1) or up{x="`,
+		`"}) or vector(1)#`,
+		"line\nbreak\ttab",
+		"é ✓ \x00",
+		"`raw`",
+		`web-.*(0|1)[a-z]+$`,
+	} {
+		t.Run(v, func(t *testing.T) {
+			s, err := q.Render(map[string]string{"namespace": v, "pod": v})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := matchers(t, s)
+			if len(m) != 3 {
+				t.Fatalf("rendered query %q has matchers %v, want __name__, namespace and pod", s, m)
+			}
+			if ns := m["namespace"]; ns.Type != labels.MatchEqual || ns.Value != v {
+				t.Errorf("namespace matcher of %q = %s, want = %q", s, ns, v)
+			}
+			// the regexp matches the value and nothing else
+			pod := m["pod"]
+			if pod.Type != labels.MatchRegexp || !pod.Matches(v) || pod.Matches(v+"x") || v != "" && pod.Matches("x"+v[1:]) {
+				t.Errorf("pod matcher of %q = %s, want to match %q literally", s, pod, v)
+			}
+		})
+	}
+}
+
+func TestRender(t *testing.T) {
+	q, err := parse(t, testCatalog).Get("top")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		params  map[string]string
+		want    string
+		wantErr string
+	}{
+		{want: `topk(3, sum by (job) (rate(http_requests_total[5m])))`},
+		{params: map[string]string{"k": "1e1", "by": "pod", "window": "1h30m"}, want: `topk(10, sum by (pod) (rate(http_requests_total[1h30m])))`},
+		{params: map[string]string{"k": "3) or vector(1"}, wantErr: "not a number"},
+		{params: map[string]string{"by": "job) or (up"}, wantErr: "not a valid label name"},
+		{params: map[string]string{"window": "5m] or up[5m"}, wantErr: "parameter window"},
+		{params: map[string]string{"window": "0s"}, wantErr: "must be positive"},
+		{params: map[string]string{"namespace": "x"}, wantErr: "unknown parameters namespace"},
+	}
+	for _, tt := range tests {
+		got, err := q.Render(tt.params)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Render(%v) = %q, %v, want error %q", tt.params, got, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("Render(%v): %v", tt.params, err)
+		case got != tt.want:
+			t.Errorf("Render(%v) = %q, want %q", tt.params, got, tt.want)
+		}
+	}
+
+	q, _ = parse(t, testCatalog).Get("pod_up")
+	if _, err := q.Render(map[string]string{"namespace": "x"}); err == nil || !strings.Contains(err.Error(), "missing parameter pod") {
+		t.Errorf("Render() without pod = %v, want missing parameter pod", err)
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantErr string
+	}{
+		{
+			name:    "bad number default",
+			query:   "params: [{name: k, type: number, default: many}]\n  query: topk({{ .k }}, up)",
+			wantErr: "invalid default",
+		},
+		{
+			name:    "bad duration default",
+			query:   "params: [{name: w, type: duration, default: 5 minutes}]\n  query: rate(up[{{ .w }}])",
+			wantErr: "invalid default",
+		},
+		{
+			name:    "bad label default",
+			query:   "params: [{name: by, type: label, default: pod-name}]\n  query: sum by ({{ .by }}) (up)",
+			wantErr: "invalid default",
+		},
+		{
+			name:    "default breaks the query",
+			query:   "params: [{name: w, type: duration, default: 5m}]\n  query: rate(up{{ .w }})",
+			wantErr: "is invalid",
+		},
+		{
+			name:    "scalar as vector",
+			query:   "query: scalar(up)",
+			wantErr: "doesn't match result vector",
+		},
+		{
+			name:    "vector as scalar",
+			query:   "result: scalar\n  query: up",
+			wantErr: "doesn't match result scalar",
+		},
+		{
+			name:    "range vector as matrix",
+			query:   "result: matrix\n  query: up[5m]",
+			wantErr: "doesn't match result matrix",
+		},
+		{
+			name:    "unknown result",
+			query:   "result: table\n  query: up",
+			wantErr: "unknown result",
+		},
+		{
+			name:    "range of a vector query",
+			query:   "range: {duration: 1h, step: 1m}\n  query: up",
+			wantErr: "range is only used by matrix queries",
+		},
+		{
+			name:    "unknown parameter type",
+			query:   "params: [{name: x, type: regex}]\n  query: up",
+			wantErr: "unknown type",
+		},
+		{
+			name:    "duplicate parameter",
+			query:   "params: [{name: x, type: string}, {name: x, type: string}]\n  query: up",
+			wantErr: "duplicate parameter",
+		},
+		{
+			name:    "undeclared parameter",
+			query:   "query: up{job={{ .job }}}",
+			wantErr: "job",
+		},
+		{
+			name:    "unknown field",
+			query:   "step: 1m\n  query: up",
+			wantErr: "unknown field",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := "queries:\n- name: test\n  " + tt.query + "\n"
+			err := New().add("test.yaml", []byte(data))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("add() = %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.yaml", "queries:\n- name: a\n  query: up\n")
+	write("b.json", `{"queries": [{"name": "b", "result": "scalar", "query": "1"}]}`)
+	write("README.md", "not a catalog")
+
+	c, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, q := range c.Queries() {
+		names = append(names, q.Name)
+	}
+	if strings.Join(names, ",") != "a,b" {
+		t.Errorf("queries = %v, want a and b", names)
+	}
+	// queries of the files replace those of the default catalog
+	if q, _ := Default.Merge(c).Get("a"); q == nil || q.Query != "up" {
+		t.Errorf("merged query a = %+v", q)
+	}
+
+	write("c.yaml", "queries:\n- name: a\n  query: down\n")
+	if _, err := Load(dir); err == nil || !strings.Contains(err.Error(), "already defined") {
+		t.Errorf("Load() with a duplicate query = %v, want already defined", err)
+	}
+}
+
+func TestDefault(t *testing.T) {
+	if len(Default.Queries()) == 0 {
+		t.Fatal("the default catalog is empty")
+	}
+	q, err := Default.Get("pod_memory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := q.Render(map[string]string{"namespace": "demo", "pod": `web"}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := matchers(t, s); m["pod"].Value != `web"}` {
+		t.Errorf("pod matcher of %q = %s", s, m["pod"])
+	}
+}
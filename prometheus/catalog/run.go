@@ -0,0 +1,95 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package catalog
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/tamalsaha/prometheus-demo/prometheus/query"
+)
+
+// Options set the time of a query. Zero fields use the defaults of Run.
+type Options struct {
+	// Time is the evaluation time of vector and scalar queries.
+	Time time.Time
+	// Start, End and Step are the range of matrix queries.
+	Start, End time.Time
+	Step       time.Duration
+}
+
+// Run runs the named query of the Default catalog, see Catalog.Run.
+func Run(ctx context.Context, api promv1.API, name string, params map[string]string) (*query.Result, error) {
+	return Default.Run(ctx, api, name, params)
+}
+
+// Run runs the named query with params. Vector and scalar queries are
+// evaluated now, matrix queries over their default range up to now.
+func (c *Catalog) Run(ctx context.Context, api promv1.API, name string, params map[string]string) (*query.Result, error) {
+	return c.RunWithOptions(ctx, api, name, params, Options{})
+}
+
+// RunWithOptions runs the named query with params at the time set in opts.
+func (c *Catalog) RunWithOptions(ctx context.Context, api promv1.API, name string, params map[string]string, opts Options) (*query.Result, error) {
+	q, err := c.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := q.Render(params)
+	if err != nil {
+		return nil, err
+	}
+
+	qc := query.New(api)
+	if q.Result != ShapeMatrix {
+		t := opts.Time
+		if t.IsZero() {
+			t = time.Now()
+		}
+		return qc.Query(ctx, expr, t)
+	}
+	r, err := q.window(opts)
+	if err != nil {
+		return nil, err
+	}
+	return qc.QueryRange(ctx, expr, r)
+}
+
+// window returns the range of a matrix query. End defaults to now, start
+// to the range duration before end.
+func (q *Query) window(opts Options) (promv1.Range, error) {
+	def := DefaultRange
+	if q.Range != nil {
+		def = *q.Range
+	}
+	r := promv1.Range{Start: opts.Start, End: opts.End, Step: opts.Step}
+	if r.End.IsZero() {
+		r.End = time.Now()
+	}
+	if r.Start.IsZero() {
+		r.Start = r.End.Add(-time.Duration(def.Duration))
+	}
+	if r.Step <= 0 {
+		r.Step = time.Duration(def.Step)
+	}
+	if !r.Start.Before(r.End) {
+		return r, errors.New("start of the range must be before its end")
+	}
+	return r, nil
+}
@@ -0,0 +1,266 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package convert translates a prometheus.Config to and from the other
+// representations of a Prometheus connection used in this repo: AppBindings
+// and Trickster backends.
+package convert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Keys of the auth Secret referenced by an AppBinding. The basic auth and
+// token keys are the ones read by the monitoring-agent-api ClientBuilder.
+const (
+	KeyUsername          = core.BasicAuthUsernameKey
+	KeyPassword          = core.BasicAuthPasswordKey
+	KeyToken             = "token"
+	KeyCredentials       = "credentials"
+	KeyOAuth2Secret      = "oauth2-client-secret"
+	KeySigV4AccessKey    = "sigv4-access-key"
+	KeySigV4SecretKey    = "sigv4-secret-key"
+	KeyHeaderPrefix      = "header."
+	KeyTLSCert           = core.TLSCertKey
+	KeyTLSKey            = core.TLSPrivateKeyKey
+	authSecretNameSuffix = "-auth"
+	tlsSecretNameSuffix  = "-tls"
+)
+
+// ToAppBinding returns an AppBinding for cfg along with the auth and TLS
+// Secrets it references. The Secrets are nil if there is nothing to store in
+// them. Settings that have no place in the AppBinding spec, like the proxy
+// url, the tenant id or the paths of credential files, are stored in
+// spec.parameters. A TokenSource can't be stored and is an error.
+func ToAppBinding(cfg *prometheus.Config, key types.NamespacedName) (*appcatalog.AppBinding, *core.Secret, *core.Secret, error) {
+	if cfg.TokenSource != nil {
+		return nil, nil, nil, errors.New("a token source can't be stored in an AppBinding")
+	}
+	addr := cfg.Addr
+	caData, certData, keyData := inlineTLS(cfg)
+	app := &appcatalog.AppBinding{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      key.Name,
+			Namespace: key.Namespace,
+		},
+		Spec: appcatalog.AppBindingSpec{
+			ClientConfig: appcatalog.ClientConfig{
+				URL:                   &addr,
+				ServerName:            cfg.TLSConfig.ServerName,
+				InsecureSkipTLSVerify: cfg.TLSConfig.InsecureSkipVerify,
+				CABundle:              caData,
+			},
+		},
+	}
+
+	params, err := parameters(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	app.Spec.Parameters = params
+
+	auth := map[string][]byte{}
+	set := func(k, v string) {
+		if v != "" {
+			auth[k] = []byte(v)
+		}
+	}
+	set(KeyUsername, cfg.BasicAuth.Username)
+	set(KeyPassword, cfg.BasicAuth.Password)
+	set(KeyToken, cfg.BearerToken)
+	set(KeyCredentials, cfg.Authorization.Credentials)
+	set(KeyOAuth2Secret, cfg.OAuth2.ClientSecret)
+	set(KeySigV4AccessKey, cfg.SigV4.AccessKey)
+	set(KeySigV4SecretKey, cfg.SigV4.SecretKey)
+	for k, v := range cfg.Headers {
+		set(KeyHeaderPrefix+k, v)
+	}
+
+	var authSecret, tlsSecret *core.Secret
+	if len(auth) > 0 {
+		authSecret = &core.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      key.Name + authSecretNameSuffix,
+				Namespace: key.Namespace,
+			},
+			Type: core.SecretTypeOpaque,
+			Data: auth,
+		}
+		app.Spec.Secret = &appcatalog.TypedLocalObjectReference{Kind: "Secret", Name: authSecret.Name}
+	}
+	if len(certData) > 0 || len(keyData) > 0 {
+		tlsSecret = &core.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      key.Name + tlsSecretNameSuffix,
+				Namespace: key.Namespace,
+			},
+			Type: core.SecretTypeOpaque,
+			Data: map[string][]byte{},
+		}
+		if len(certData) > 0 && len(keyData) > 0 {
+			tlsSecret.Type = core.SecretTypeTLS
+		}
+		if len(certData) > 0 {
+			tlsSecret.Data[KeyTLSCert] = certData
+		}
+		if len(keyData) > 0 {
+			tlsSecret.Data[KeyTLSKey] = keyData
+		}
+		app.Spec.TLSSecret = &appcatalog.TypedLocalObjectReference{Kind: "Secret", Name: tlsSecret.Name}
+	}
+	return app, authSecret, tlsSecret, nil
+}
+
+// FromAppBinding returns the Config described by app, reading the auth and
+// TLS Secrets it references with kc. All TLS material is kept in memory.
+func FromAppBinding(ctx context.Context, kc client.Reader, app *appcatalog.AppBinding) (*prometheus.Config, error) {
+	var authData, tlsData map[string][]byte
+	if app.Spec.Secret != nil && app.Spec.Secret.Name != "" {
+		var secret core.Secret
+		key := client.ObjectKey{Namespace: app.Namespace, Name: app.Spec.Secret.Name}
+		if err := kc.Get(ctx, key, &secret); err != nil {
+			return nil, fmt.Errorf("failed to get auth secret %s: %w", key, err)
+		}
+		authData = secret.Data
+	}
+	if app.Spec.TLSSecret != nil && app.Spec.TLSSecret.Name != "" {
+		var secret core.Secret
+		key := client.ObjectKey{Namespace: app.Namespace, Name: app.Spec.TLSSecret.Name}
+		if err := kc.Get(ctx, key, &secret); err != nil {
+			return nil, fmt.Errorf("failed to get tls secret %s: %w", key, err)
+		}
+		tlsData = secret.Data
+	}
+	return FromAppBindingWithSecrets(app, authData, tlsData)
+}
+
+// FromAppBindingWithSecrets is FromAppBinding with the data of the
+// referenced Secrets already loaded.
+func FromAppBindingWithSecrets(app *appcatalog.AppBinding, authData, tlsData map[string][]byte) (*prometheus.Config, error) {
+	cfg := &prometheus.Config{}
+	if app.Spec.Parameters != nil && len(app.Spec.Parameters.Raw) > 0 {
+		if err := json.Unmarshal(app.Spec.Parameters.Raw, cfg); err != nil {
+			return nil, fmt.Errorf("AppBinding %s/%s contains invalid parameters: %w", app.Namespace, app.Name, err)
+		}
+	}
+
+	addr, err := app.URL()
+	if err != nil {
+		return nil, fmt.Errorf("AppBinding %s/%s contains invalid url: %w", app.Namespace, app.Name, err)
+	}
+	cfg.Addr = addr
+	cfg.TLSConfig.ServerName = app.Spec.ClientConfig.ServerName
+	cfg.TLSConfig.InsecureSkipVerify = app.Spec.ClientConfig.InsecureSkipTLSVerify
+	cfg.CAData = app.Spec.ClientConfig.CABundle
+
+	get := func(k string) string {
+		return string(authData[k])
+	}
+	cfg.BasicAuth.Username = get(KeyUsername)
+	cfg.BasicAuth.Password = get(KeyPassword)
+	cfg.BearerToken = get(KeyToken)
+	cfg.Authorization.Credentials = get(KeyCredentials)
+	cfg.OAuth2.ClientSecret = get(KeyOAuth2Secret)
+	cfg.SigV4.AccessKey = get(KeySigV4AccessKey)
+	cfg.SigV4.SecretKey = get(KeySigV4SecretKey)
+	for k, v := range authData {
+		if name, ok := strings.CutPrefix(k, KeyHeaderPrefix); ok {
+			if cfg.Headers == nil {
+				cfg.Headers = prometheus.Headers{}
+			}
+			cfg.Headers[name] = string(v)
+		}
+	}
+
+	cfg.CertData = tlsData[KeyTLSCert]
+	cfg.KeyData = tlsData[KeyTLSKey]
+	return cfg, nil
+}
+
+// parameters returns the settings of cfg that are neither part of the
+// AppBinding spec nor secret.
+func parameters(cfg *prometheus.Config) (*runtime.RawExtension, error) {
+	params := *cfg
+	params.Addr = ""
+	params.TLSConfig.ServerName = ""
+	params.TLSConfig.InsecureSkipVerify = false
+	params.TLSConfig.CA = ""
+	params.TLSConfig.Cert = ""
+	params.TLSConfig.Key = ""
+	params.CAData = nil
+	params.CertData = nil
+	params.KeyData = nil
+	params.BasicAuth.Username = ""
+	params.BasicAuth.Password = ""
+	params.BearerToken = ""
+	params.Authorization.Credentials = ""
+	params.OAuth2.ClientSecret = ""
+	params.SigV4.AccessKey = ""
+	params.SigV4.SecretKey = ""
+	params.Headers = nil
+
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+	empty, err := json.Marshal(prometheus.Config{})
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(data, empty) {
+		return nil, nil
+	}
+	return &runtime.RawExtension{Raw: data}, nil
+}
+
+// inlineTLS returns the in-memory TLS material of cfg, which is either set
+// directly or inline in TLSConfig.
+func inlineTLS(cfg *prometheus.Config) (ca, cert, key []byte) {
+	ca, cert, key = cfg.CAData, cfg.CertData, cfg.KeyData
+	if len(ca) == 0 && cfg.TLSConfig.CA != "" {
+		ca = []byte(cfg.TLSConfig.CA)
+	}
+	if len(cert) == 0 && cfg.TLSConfig.Cert != "" {
+		cert = []byte(cfg.TLSConfig.Cert)
+	}
+	if len(key) == 0 && cfg.TLSConfig.Key != "" {
+		key = []byte(cfg.TLSConfig.Key)
+	}
+	return
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
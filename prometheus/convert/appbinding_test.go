@@ -0,0 +1,264 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package convert
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	prom_config "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	"github.com/tamalsaha/prometheus-demo/prometheus/sigv4"
+	"golang.org/x/oauth2"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var appKey = types.NamespacedName{Namespace: "monitoring", Name: "prometheus"}
+
+func TestAppBindingRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  prometheus.Config
+		// want is the config read back, if it differs from cfg
+		want *prometheus.Config
+		// secrets are values that must only be stored in the Secrets
+		secrets []string
+	}{
+		{
+			name: "address only",
+			cfg:  prometheus.Config{Addr: "http://prometheus.monitoring.svc:9090"},
+		},
+		{
+			name: "basic auth",
+			cfg: prometheus.Config{
+				Addr:      "https://prometheus.example.com",
+				BasicAuth: prometheus.BasicAuth{Username: "admin", Password: "s3cret"},
+			},
+			secrets: []string{"s3cret"},
+		},
+		{
+			name: "basic auth password file",
+			cfg: prometheus.Config{
+				Addr:      "https://prometheus.example.com",
+				BasicAuth: prometheus.BasicAuth{Username: "admin", PasswordFile: "/etc/prometheus/password"},
+			},
+		},
+		{
+			name: "bearer token",
+			cfg: prometheus.Config{
+				Addr:        "https://prometheus.example.com",
+				BearerToken: "token-value",
+			},
+			secrets: []string{"token-value"},
+		},
+		{
+			name: "bearer token file",
+			cfg: prometheus.Config{
+				Addr:            "https://prometheus.example.com",
+				BearerTokenFile: "/var/run/secrets/kubernetes.io/serviceaccount/token",
+			},
+		},
+		{
+			name: "authorization",
+			cfg: prometheus.Config{
+				Addr:          "https://prometheus.example.com",
+				Authorization: prometheus.Authorization{Type: "Token", Credentials: "credentials-value"},
+			},
+			secrets: []string{"credentials-value"},
+		},
+		{
+			name: "authorization credentials file",
+			cfg: prometheus.Config{
+				Addr:          "https://prometheus.example.com",
+				Authorization: prometheus.Authorization{Type: "Token", CredentialsFile: "/etc/prometheus/credentials"},
+			},
+		},
+		{
+			name: "oauth2",
+			cfg: prometheus.Config{
+				Addr: "https://prometheus.example.com",
+				OAuth2: prometheus.OAuth2{
+					ClientID:       "client",
+					ClientSecret:   "client-secret-value",
+					Scopes:         []string{"read", "write"},
+					TokenURL:       "https://auth.example.com/token",
+					EndpointParams: map[string]string{"audience": "prometheus"},
+				},
+			},
+			secrets: []string{"client-secret-value"},
+		},
+		{
+			name: "oauth2 client secret file",
+			cfg: prometheus.Config{
+				Addr: "https://prometheus.example.com",
+				OAuth2: prometheus.OAuth2{
+					ClientID:         "client",
+					ClientSecretFile: "/etc/prometheus/client-secret",
+					TokenURL:         "https://auth.example.com/token",
+				},
+			},
+		},
+		{
+			name: "sigv4",
+			cfg: prometheus.Config{
+				Addr: "https://aps-workspaces.us-east-1.amazonaws.com/workspaces/ws-1",
+				SigV4: sigv4.Config{
+					Region:      "us-east-1",
+					AccessKey:   "AKIDEXAMPLE",
+					SecretKey:   "sigv4-secret-value",
+					RoleARN:     "arn:aws:iam::123456789012:role/prometheus",
+					Service:     "aps",
+					STSEndpoint: "https://sts.us-east-1.amazonaws.com",
+				},
+			},
+			secrets: []string{"AKIDEXAMPLE", "sigv4-secret-value"},
+		},
+		{
+			name: "sigv4 profile",
+			cfg: prometheus.Config{
+				Addr:  "https://aps-workspaces.us-east-1.amazonaws.com/workspaces/ws-1",
+				SigV4: sigv4.Config{Region: "us-east-1", Profile: "prod"},
+			},
+		},
+		{
+			name: "headers and tenant",
+			cfg: prometheus.Config{
+				Addr:         "https://mimir.example.com/prometheus",
+				Headers:      prometheus.Headers{"X-Api-Key": "api-key-value", "X-Team": "platform"},
+				TenantID:     "team-a",
+				TenantHeader: prometheus.TenantHeaderThanos,
+			},
+			secrets: []string{"api-key-value"},
+		},
+		{
+			name: "tls in memory",
+			cfg: prometheus.Config{
+				Addr:      "https://prometheus.example.com",
+				TLSConfig: prom_config.TLSConfig{ServerName: "prometheus.internal", InsecureSkipVerify: true},
+				CAData:    []byte("ca-pem"),
+				CertData:  []byte("cert-pem"),
+				KeyData:   []byte("key-pem"),
+			},
+			secrets: []string{"cert-pem", "key-pem"},
+		},
+		{
+			name: "tls inline in TLSConfig",
+			cfg: prometheus.Config{
+				Addr: "https://prometheus.example.com",
+				TLSConfig: prom_config.TLSConfig{
+					CA:   "ca-pem",
+					Cert: "cert-pem",
+					Key:  prom_config.Secret("key-pem"),
+				},
+			},
+			want: &prometheus.Config{
+				Addr:     "https://prometheus.example.com",
+				CAData:   []byte("ca-pem"),
+				CertData: []byte("cert-pem"),
+				KeyData:  []byte("key-pem"),
+			},
+			secrets: []string{"cert-pem", "key-pem"},
+		},
+		{
+			name: "tls files",
+			cfg: prometheus.Config{
+				Addr: "https://prometheus.example.com",
+				TLSConfig: prom_config.TLSConfig{
+					CAFile:   "/etc/prometheus/ca.crt",
+					CertFile: "/etc/prometheus/tls.crt",
+					KeyFile:  "/etc/prometheus/tls.key",
+				},
+			},
+		},
+		{
+			name: "proxy, service and client settings",
+			cfg: prometheus.Config{
+				Addr:            "https://prometheus.example.com",
+				ProxyURL:        "http://proxy.example.com:3128",
+				Service:         &prometheus.ServiceReference{Scheme: "https", Namespace: "monitoring", Name: "prometheus", Port: 9090},
+				Transport:       prometheus.TransportProxy,
+				Kubeconfig:      "/home/user/.kube/config",
+				KubeContext:     "prod",
+				MaxRetries:      3,
+				RetryBackoff:    model.Duration(time.Second),
+				MaxRetryBackoff: model.Duration(time.Minute),
+				QPS:             5,
+				Burst:           10,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, authSecret, tlsSecret, err := ToAppBinding(&tt.cfg, appKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if app.Namespace != appKey.Namespace || app.Name != appKey.Name {
+				t.Errorf("AppBinding is %s/%s, want %s", app.Namespace, app.Name, appKey)
+			}
+			if app.Spec.Parameters != nil {
+				for _, s := range tt.secrets {
+					if strings.Contains(string(app.Spec.Parameters.Raw), s) {
+						t.Errorf("parameters %s contain the secret %q", app.Spec.Parameters.Raw, s)
+					}
+				}
+			}
+			if (authSecret != nil) != (app.Spec.Secret != nil) {
+				t.Errorf("auth secret is %v, but spec.secret is %v", authSecret, app.Spec.Secret)
+			}
+			if (tlsSecret != nil) != (app.Spec.TLSSecret != nil) {
+				t.Errorf("tls secret is %v, but spec.tlsSecret is %v", tlsSecret, app.Spec.TLSSecret)
+			}
+			if tlsSecret != nil && len(tlsSecret.Data[KeyTLSCert]) > 0 && len(tlsSecret.Data[KeyTLSKey]) > 0 && tlsSecret.Type != core.SecretTypeTLS {
+				t.Errorf("tls secret type is %s, want %s", tlsSecret.Type, core.SecretTypeTLS)
+			}
+
+			got, err := FromAppBindingWithSecrets(app, secretData(authSecret), secretData(tlsSecret))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := &tt.cfg
+			if tt.want != nil {
+				want = tt.want
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip changed the config\n got: %+v\nwant: %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestToAppBindingRejectsTokenSource(t *testing.T) {
+	cfg := prometheus.Config{
+		Addr:        "https://prometheus.example.com",
+		TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "token"}),
+	}
+	if _, _, _, err := ToAppBinding(&cfg, appKey); err == nil {
+		t.Error("a token source was silently dropped")
+	}
+}
+
+func secretData(s *core.Secret) map[string][]byte {
+	if s == nil {
+		return nil
+	}
+	return s.Data
+}
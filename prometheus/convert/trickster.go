@@ -0,0 +1,276 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package convert
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	bo "github.com/trickstercache/trickster/v2/pkg/backends/options"
+	rwopts "github.com/trickstercache/trickster/v2/pkg/proxy/request/rewriter/options"
+	to "github.com/trickstercache/trickster/v2/pkg/proxy/tls/options"
+)
+
+const (
+	// TricksterProvider is the Trickster backend provider for Prometheus.
+	TricksterProvider = "prometheus"
+	// TricksterBackendName is the name of the backend in the config
+	// generated by trickster-conf.
+	TricksterBackendName = "k8s"
+
+	caFileName   = "ca.crt"
+	certFileName = "tls.crt"
+	keyFileName  = "tls.key"
+)
+
+// ToTricksterBackend returns the Trickster backend and request rewriter that
+// connect to the Prometheus server described by cfg. The rewriter is nil if
+// no headers need to be set, otherwise the backend refers to it by name.
+//
+// Trickster only reads TLS material from files, so in-memory certificates are
+// written to certDir, with the private key only readable by the current
+// user. Credentials are set by the rewriter as a static header, so credential
+// files are rejected: their rotated contents would never reach Trickster. A
+// TokenSource is read once, the config has to be generated again when the
+// token is refreshed, like trickster-conf watch does. Settings that Trickster
+// can't honor, like a proxy url, OAuth2 or SigV4, are reported as an error
+// instead of being dropped.
+func ToTricksterBackend(cfg *prometheus.Config, name, certDir string) (*bo.Options, *rwopts.Options, error) {
+	switch {
+	case cfg.ProxyURL != "":
+		return nil, nil, errors.New("trickster backends don't support a proxy url")
+	case cfg.TLSConfig.ServerName != "":
+		return nil, nil, errors.New("trickster backends don't support a tls server name")
+	case cfg.OAuth2.ClientID != "" || cfg.OAuth2.TokenURL != "":
+		return nil, nil, errors.New("trickster backends don't support oauth2")
+	case cfg.SigV4.IsSet():
+		return nil, nil, errors.New("trickster backends don't support sigv4")
+	case cfg.Transport == prometheus.TransportPortForward:
+		return nil, nil, errors.New("trickster backends don't support the portforward transport")
+	case cfg.BearerTokenFile != "" || cfg.BasicAuth.PasswordFile != "" || cfg.Authorization.CredentialsFile != "":
+		return nil, nil, errors.New("trickster backends don't support credential files, the rewriter would keep sending the credentials read at conversion time")
+	}
+
+	tls, err := tricksterTLS(cfg, certDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	b := &bo.Options{
+		Provider:  TricksterProvider,
+		OriginURL: cfg.Addr,
+		TLS:       tls,
+	}
+
+	instructions, err := rewriteInstructions(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(instructions) == 0 {
+		return b, nil, nil
+	}
+	b.ReqRewriterName = name
+	return b, &rwopts.Options{Instructions: instructions}, nil
+}
+
+// ToTricksterFrontend returns the connection to backend name through the
+// Trickster frontend at addr, like http://trickster:9090. Trickster routes
+// requests by the first path segment and its request rewriter sets the
+// credentials of the backend, so none are needed here. Range queries sent
+// this way are served from the Trickster cache where possible.
+func ToTricksterFrontend(addr, name string) *prometheus.Config {
+	return &prometheus.Config{
+		Addr: strings.TrimSuffix(addr, "/") + "/" + name,
+	}
+}
+
+// FromTricksterBackend returns the Config for a Trickster backend and its
+// request rewriter, which may be nil. The result sends the same requests as
+// the Config the backend was made from, but not always in the same form: an
+// Authorization of type Bearer comes back as a BearerToken, TLS material as
+// files and a tenant header other than X-Scope-OrgID or THANOS-TENANT as a
+// plain header.
+func FromTricksterBackend(b *bo.Options, rw *rwopts.Options) (*prometheus.Config, error) {
+	if b.Provider != "" && b.Provider != TricksterProvider {
+		return nil, fmt.Errorf("unsupported trickster provider %q", b.Provider)
+	}
+	cfg := &prometheus.Config{
+		Addr: b.OriginURL,
+	}
+	if b.TLS != nil {
+		switch len(b.TLS.CertificateAuthorityPaths) {
+		case 0:
+		case 1:
+			cfg.TLSConfig.CAFile = b.TLS.CertificateAuthorityPaths[0]
+		default:
+			return nil, errors.New("at most one certificate authority is supported")
+		}
+		cfg.TLSConfig.CertFile = b.TLS.ClientCertPath
+		cfg.TLSConfig.KeyFile = b.TLS.ClientKeyPath
+		cfg.TLSConfig.InsecureSkipVerify = b.TLS.InsecureSkipVerify
+	}
+	if rw == nil {
+		return cfg, nil
+	}
+
+	for _, in := range rw.Instructions {
+		if len(in) != 4 || in[0] != "header" || in[1] != "set" {
+			return nil, fmt.Errorf("unsupported rewrite instruction %q", strings.Join(in, " "))
+		}
+		header, value := in[2], in[3]
+		switch {
+		case strings.EqualFold(header, "Authorization"):
+			if err := setAuthorization(cfg, value); err != nil {
+				return nil, err
+			}
+		case strings.EqualFold(header, prometheus.TenantHeaderMimir),
+			strings.EqualFold(header, prometheus.TenantHeaderThanos):
+			cfg.TenantID = value
+			if !strings.EqualFold(header, prometheus.TenantHeaderMimir) {
+				cfg.TenantHeader = header
+			}
+		default:
+			if cfg.Headers == nil {
+				cfg.Headers = prometheus.Headers{}
+			}
+			cfg.Headers[header] = value
+		}
+	}
+	return cfg, nil
+}
+
+func tricksterTLS(cfg *prometheus.Config, certDir string) (*to.Options, error) {
+	out := &to.Options{
+		InsecureSkipVerify: cfg.TLSConfig.InsecureSkipVerify,
+		ClientCertPath:     cfg.TLSConfig.CertFile,
+		ClientKeyPath:      cfg.TLSConfig.KeyFile,
+	}
+	if cfg.TLSConfig.CAFile != "" {
+		out.CertificateAuthorityPaths = []string{cfg.TLSConfig.CAFile}
+	}
+
+	ca, cert, key := inlineTLS(cfg)
+	if len(ca) == 0 && len(cert) == 0 && len(key) == 0 {
+		return out, nil
+	}
+	if certDir == "" {
+		return nil, errors.New("a directory is required to write the tls certificates for trickster")
+	}
+	if err := os.MkdirAll(certDir, 0o755); err != nil {
+		return nil, err
+	}
+	write := func(name string, data []byte, perm os.FileMode) (string, error) {
+		filename := filepath.Join(certDir, name)
+		return filename, os.WriteFile(filename, data, perm)
+	}
+	var err error
+	if len(ca) > 0 {
+		var caFile string
+		if caFile, err = write(caFileName, ca, 0o644); err != nil {
+			return nil, err
+		}
+		out.CertificateAuthorityPaths = []string{caFile}
+	}
+	if len(cert) > 0 {
+		if out.ClientCertPath, err = write(certFileName, cert, 0o644); err != nil {
+			return nil, err
+		}
+	}
+	if len(key) > 0 {
+		if out.ClientKeyPath, err = write(keyFileName, key, 0o600); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func rewriteInstructions(cfg *prometheus.Config) (rwopts.RewriteList, error) {
+	var out rwopts.RewriteList
+	set := func(header, value string) {
+		out = append(out, []string{"header", "set", header, value})
+	}
+
+	auth, err := authorization(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if auth != "" {
+		set("Authorization", auth)
+	}
+	for _, k := range sortedKeys(cfg.Headers) {
+		set(k, cfg.Headers[k])
+	}
+	if cfg.TenantID != "" {
+		header := cfg.TenantHeader
+		if header == "" {
+			header = prometheus.TenantHeaderMimir
+		}
+		set(header, cfg.TenantID)
+	}
+	return out, nil
+}
+
+// authorization returns the value of the Authorization header sent by a
+// client built from cfg, which has no credential files.
+func authorization(cfg *prometheus.Config) (string, error) {
+	switch {
+	case cfg.BasicAuth.Username != "" || cfg.BasicAuth.Password != "":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(cfg.BasicAuth.Username+":"+cfg.BasicAuth.Password)), nil
+	case cfg.TokenSource != nil:
+		token, err := cfg.TokenSource.Token()
+		if err != nil {
+			return "", err
+		}
+		return token.Type() + " " + token.AccessToken, nil
+	case cfg.BearerToken != "":
+		return "Bearer " + cfg.BearerToken, nil
+	case cfg.Authorization.Credentials != "":
+		typ := cfg.Authorization.Type
+		if typ == "" {
+			typ = "Bearer"
+		}
+		return typ + " " + cfg.Authorization.Credentials, nil
+	}
+	return "", nil
+}
+
+func setAuthorization(cfg *prometheus.Config, value string) error {
+	typ, credentials, ok := strings.Cut(value, " ")
+	if !ok {
+		return fmt.Errorf("invalid Authorization header %q", typ)
+	}
+	switch {
+	case strings.EqualFold(typ, "Basic"):
+		data, err := base64.StdEncoding.DecodeString(credentials)
+		if err != nil {
+			return fmt.Errorf("invalid basic auth credentials: %w", err)
+		}
+		username, password, _ := strings.Cut(string(data), ":")
+		cfg.BasicAuth.Username = username
+		cfg.BasicAuth.Password = password
+	case strings.EqualFold(typ, "Bearer"):
+		cfg.BearerToken = credentials
+	default:
+		cfg.Authorization.Type = typ
+		cfg.Authorization.Credentials = credentials
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package convert
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	prom_config "github.com/prometheus/common/config"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	"github.com/tamalsaha/prometheus-demo/prometheus/sigv4"
+	"golang.org/x/oauth2"
+)
+
+func TestTricksterRoundTrip(t *testing.T) {
+	const addr = "https://prometheus.example.com"
+	tests := []struct {
+		name string
+		cfg  prometheus.Config
+		// want is the config read back, if it differs from cfg. TLS files
+		// in the cert dir are relative to it.
+		want *prometheus.Config
+		// files are the contents of the files written to the cert dir
+		files map[string]string
+	}{
+		{
+			name: "address only",
+			cfg:  prometheus.Config{Addr: addr},
+		},
+		{
+			name: "basic auth",
+			cfg:  prometheus.Config{Addr: addr, BasicAuth: prometheus.BasicAuth{Username: "admin", Password: "pass:word"}},
+		},
+		{
+			name: "bearer token",
+			cfg:  prometheus.Config{Addr: addr, BearerToken: "token-value"},
+		},
+		{
+			name: "authorization",
+			cfg:  prometheus.Config{Addr: addr, Authorization: prometheus.Authorization{Type: "Token", Credentials: "credentials-value"}},
+		},
+		{
+			name: "authorization of type bearer",
+			cfg:  prometheus.Config{Addr: addr, Authorization: prometheus.Authorization{Credentials: "credentials-value"}},
+			want: &prometheus.Config{Addr: addr, BearerToken: "credentials-value"},
+		},
+		{
+			name: "token source",
+			cfg:  prometheus.Config{Addr: addr, TokenSource: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "sa-token"})},
+			want: &prometheus.Config{Addr: addr, BearerToken: "sa-token"},
+		},
+		{
+			name: "headers",
+			cfg:  prometheus.Config{Addr: addr, Headers: prometheus.Headers{"X-Api-Key": "api-key-value", "X-Team": "platform"}},
+		},
+		{
+			name: "mimir tenant",
+			cfg:  prometheus.Config{Addr: addr, TenantID: "team-a"},
+		},
+		{
+			name: "thanos tenant",
+			cfg:  prometheus.Config{Addr: addr, TenantID: "team-a", TenantHeader: prometheus.TenantHeaderThanos},
+		},
+		{
+			name: "custom tenant header",
+			cfg:  prometheus.Config{Addr: addr, TenantID: "team-a", TenantHeader: "X-Tenant"},
+			want: &prometheus.Config{Addr: addr, Headers: prometheus.Headers{"X-Tenant": "team-a"}},
+		},
+		{
+			name: "auth, headers and tenant",
+			cfg: prometheus.Config{
+				Addr:        addr,
+				BearerToken: "token-value",
+				Headers:     prometheus.Headers{"X-Team": "platform"},
+				TenantID:    "team-a",
+			},
+		},
+		{
+			name: "tls files",
+			cfg: prometheus.Config{
+				Addr: addr,
+				TLSConfig: prom_config.TLSConfig{
+					CAFile:             "/etc/prometheus/ca.crt",
+					CertFile:           "/etc/prometheus/tls.crt",
+					KeyFile:            "/etc/prometheus/tls.key",
+					InsecureSkipVerify: true,
+				},
+			},
+		},
+		{
+			name: "tls in memory",
+			cfg: prometheus.Config{
+				Addr:     addr,
+				CAData:   []byte("ca-pem"),
+				CertData: []byte("cert-pem"),
+				KeyData:  []byte("key-pem"),
+			},
+			want: &prometheus.Config{
+				Addr: addr,
+				TLSConfig: prom_config.TLSConfig{
+					CAFile:   caFileName,
+					CertFile: certFileName,
+					KeyFile:  keyFileName,
+				},
+			},
+			files: map[string]string{caFileName: "ca-pem", certFileName: "cert-pem", keyFileName: "key-pem"},
+		},
+		{
+			name: "tls inline in TLSConfig",
+			cfg: prometheus.Config{
+				Addr:      addr,
+				TLSConfig: prom_config.TLSConfig{CA: "ca-pem"},
+			},
+			want: &prometheus.Config{
+				Addr:      addr,
+				TLSConfig: prom_config.TLSConfig{CAFile: caFileName},
+			},
+			files: map[string]string{caFileName: "ca-pem"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certDir := t.TempDir()
+			b, rw, err := ToTricksterBackend(&tt.cfg, TricksterBackendName, certDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (rw != nil) != (b.ReqRewriterName != "") {
+				t.Errorf("rewriter is %v, but the backend refers to %q", rw, b.ReqRewriterName)
+			}
+
+			got, err := FromTricksterBackend(b, rw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.cfg
+			if tt.want != nil {
+				want = *tt.want
+			}
+			for _, f := range []*string{&want.TLSConfig.CAFile, &want.TLSConfig.CertFile, &want.TLSConfig.KeyFile} {
+				if _, ok := tt.files[*f]; ok {
+					*f = filepath.Join(certDir, *f)
+				}
+			}
+			if !reflect.DeepEqual(got, &want) {
+				t.Errorf("round trip changed the config\n got: %+v\nwant: %+v", got, &want)
+			}
+
+			for name, content := range tt.files {
+				filename := filepath.Join(certDir, name)
+				data, err := os.ReadFile(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != content {
+					t.Errorf("%s = %q, want %q", name, data, content)
+				}
+				fi, err := os.Stat(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if name == keyFileName && fi.Mode().Perm() != 0o600 {
+					t.Errorf("%s has mode %s, want 0600", name, fi.Mode().Perm())
+				}
+			}
+		})
+	}
+}
+
+func TestToTricksterBackendRejects(t *testing.T) {
+	const addr = "https://prometheus.example.com"
+	tests := []struct {
+		name string
+		cfg  prometheus.Config
+	}{
+		{name: "proxy url", cfg: prometheus.Config{Addr: addr, ProxyURL: "http://proxy:3128"}},
+		{name: "tls server name", cfg: prometheus.Config{Addr: addr, TLSConfig: prom_config.TLSConfig{ServerName: "prometheus"}}},
+		{name: "oauth2", cfg: prometheus.Config{Addr: addr, OAuth2: prometheus.OAuth2{ClientID: "id", TokenURL: "https://auth/token"}}},
+		{name: "sigv4", cfg: prometheus.Config{Addr: addr, SigV4: sigv4.Config{Region: "us-east-1"}}},
+		{name: "portforward", cfg: prometheus.Config{Addr: addr, Transport: prometheus.TransportPortForward}},
+		{name: "bearer token file", cfg: prometheus.Config{Addr: addr, BearerTokenFile: "/var/run/secrets/token"}},
+		{name: "password file", cfg: prometheus.Config{Addr: addr, BasicAuth: prometheus.BasicAuth{Username: "admin", PasswordFile: "/etc/password"}}},
+		{name: "credentials file", cfg: prometheus.Config{Addr: addr, Authorization: prometheus.Authorization{CredentialsFile: "/etc/credentials"}}},
+		{name: "inline tls without cert dir", cfg: prometheus.Config{Addr: addr, CAData: []byte("ca-pem")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ToTricksterBackend(&tt.cfg, TricksterBackendName, ""); err == nil {
+				t.Error("the setting was silently dropped")
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cost estimates what namespaces or teams owe for the resources
+// their pods reserve and use, from the usage series in Prometheus and a
+// price list.
+package cost
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Prices are per unit and hour.
+type Prices struct {
+	CPUCoreHour    float64 `json:"cpuCoreHour"`
+	MemoryGiBHour  float64 `json:"memoryGiBHour"`
+	StorageGiBHour float64 `json:"storageGiBHour"`
+}
+
+// PriceOverride replaces the CPU and memory prices for pods on nodes with
+// matching labels, like a node.kubernetes.io/instance-type or a spot
+// capacity type. Unset prices keep the default.
+type PriceOverride struct {
+	// NodeLabels are Kubernetes node labels that must all match. They are
+	// read from kube_node_labels, so kube-state-metrics must be allowed to
+	// export them with --metric-labels-allowlist.
+	NodeLabels    map[string]string `json:"nodeLabels"`
+	CPUCoreHour   *float64          `json:"cpuCoreHour,omitempty"`
+	MemoryGiBHour *float64          `json:"memoryGiBHour,omitempty"`
+}
+
+// PriceList is the price model of a report.
+type PriceList struct {
+	Currency string `json:"currency,omitempty"`
+	Default  Prices `json:"default"`
+	// Overrides are tried in order and the first match wins.
+	Overrides []PriceOverride `json:"overrides,omitempty"`
+}
+
+// LoadPriceList reads a PriceList from a YAML or JSON file.
+func LoadPriceList(filename string) (*PriceList, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var pl PriceList
+	if err := yaml.UnmarshalStrict(data, &pl); err != nil {
+		return nil, fmt.Errorf("failed to parse price list %s: %w", filename, err)
+	}
+	if err := pl.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid price list %s: %w", filename, err)
+	}
+	return &pl, nil
+}
+
+func (pl *PriceList) Validate() error {
+	if pl.Default.CPUCoreHour < 0 || pl.Default.MemoryGiBHour < 0 || pl.Default.StorageGiBHour < 0 {
+		return errors.New("prices must not be negative")
+	}
+	for i, o := range pl.Overrides {
+		if len(o.NodeLabels) == 0 {
+			return fmt.Errorf("override %d has no node labels", i)
+		}
+		if (o.CPUCoreHour != nil && *o.CPUCoreHour < 0) || (o.MemoryGiBHour != nil && *o.MemoryGiBHour < 0) {
+			return fmt.Errorf("override %d has a negative price", i)
+		}
+	}
+	return nil
+}
+
+// nodePrices returns the prices for a node with the given kube_node_labels
+// series labels.
+func (pl *PriceList) nodePrices(metricLabels map[string]string) Prices {
+	p := pl.Default
+	for _, o := range pl.Overrides {
+		if !matches(o.NodeLabels, metricLabels) {
+			continue
+		}
+		if o.CPUCoreHour != nil {
+			p.CPUCoreHour = *o.CPUCoreHour
+		}
+		if o.MemoryGiBHour != nil {
+			p.MemoryGiBHour = *o.MemoryGiBHour
+		}
+		break
+	}
+	return p
+}
+
+func matches(nodeLabels, metricLabels map[string]string) bool {
+	for k, v := range nodeLabels {
+		if metricLabels[MetricLabel(k)] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// MetricLabel returns the label that kube-state-metrics exports a
+// Kubernetes label as, like label_node_kubernetes_io_instance_type for
+// node.kubernetes.io/instance-type.
+func MetricLabel(key string) string {
+	return "label_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, key)
+}
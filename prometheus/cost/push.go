@@ -0,0 +1,87 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cost
+
+import (
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/tamalsaha/prometheus-demo/prometheus/remotewrite"
+)
+
+// Metrics of a report written by Append.
+const (
+	MetricCost  = "chargeback_cost"
+	MetricUsage = "chargeback_usage_hours"
+)
+
+// Append adds the charges of r to app as samples at t, so they can be
+// graphed and alerted on next to the metrics they were computed from. The
+// billing period is in the period_start and period_end labels, because
+// remote write backends reject samples as old as the start of a month.
+// The group is in the namespace label, or in the kube-state-metrics form of
+// the report label, like label_team, and missing for charges without one.
+func (r *Report) Append(app remotewrite.Appender, t time.Time) error {
+	group := "namespace"
+	if r.Label != "" {
+		group = MetricLabel(r.Label)
+	}
+	ts := t.UnixMilli()
+	for _, c := range r.Items {
+		samples := []struct {
+			name, resource string
+			value          float64
+		}{
+			{MetricCost, "cpu", c.CPUCost},
+			{MetricCost, "memory", c.MemoryCost},
+			{MetricCost, "storage", c.StorageCost},
+			{MetricCost, "total", c.TotalCost},
+			{MetricUsage, "cpu_cores", c.CPUCoreHours},
+			{MetricUsage, "memory_gib", c.MemoryGiBHours},
+			{MetricUsage, "storage_gib", c.StorageGiBHours},
+		}
+		for _, s := range samples {
+			b := labels.NewScratchBuilder(6)
+			b.Add(labels.MetricName, s.name)
+			if c.Group != "" {
+				b.Add(group, c.Group)
+			}
+			b.Add("resource", s.resource)
+			b.Add("period_start", r.Start.UTC().Format(time.RFC3339))
+			b.Add("period_end", r.End.UTC().Format(time.RFC3339))
+			b.Add("basis", string(r.Basis))
+			if s.name == MetricCost && r.Currency != "" {
+				b.Add("currency", r.Currency)
+			}
+			b.Sort()
+			if err := app.Append(b.Labels(), ts, s.value); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := app.UpdateMetadata(MetricCost, remotewrite.Metadata{
+		Type: remotewrite.MetricTypeGauge,
+		Help: "Charge of a group for a resource over the billing period.",
+	}); err != nil {
+		return err
+	}
+	return app.UpdateMetadata(MetricUsage, remotewrite.Metadata{
+		Type: remotewrite.MetricTypeGauge,
+		Help: "Usage hours of a group for a resource over the billing period, in core-hours or GiB-hours.",
+	})
+}
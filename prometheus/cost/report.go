@@ -0,0 +1,365 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cost
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/tamalsaha/prometheus-demo/prometheus/promql"
+	"github.com/tamalsaha/prometheus-demo/prometheus/query"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/klog/v2"
+)
+
+// Basis is what CPU and memory are charged for.
+type Basis string
+
+const (
+	// BasisMax charges the larger of usage and requests, since requested
+	// resources are reserved even when they aren't used.
+	BasisMax      Basis = "max"
+	BasisUsage    Basis = "usage"
+	BasisRequests Basis = "requests"
+)
+
+// DefaultStep is the resolution of the range queries of a report.
+const DefaultStep = time.Hour
+
+const gib = 1 << 30
+
+// Options selects the billing period and grouping of a report.
+type Options struct {
+	Start time.Time
+	End   time.Time
+	// Step is the resolution of the report. Start and End are aligned to it,
+	// so that repeated reports for the same period run the same range
+	// queries and hit the cache of a Trickster frontend.
+	Step time.Duration
+	// Label groups the report by this Kubernetes label of pods and
+	// PersistentVolumeClaims instead of by namespace.
+	Label string
+	// Namespace limits the report to one namespace. All namespaces are
+	// reported if empty.
+	Namespace string
+	Basis     Basis
+}
+
+// Report is the chargeback for a billing period.
+type Report struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Label    string    `json:"label,omitempty"`
+	Basis    Basis     `json:"basis"`
+	Currency string    `json:"currency,omitempty"`
+	Items    []Charge  `json:"items"`
+	Total    Charge    `json:"total"`
+}
+
+// Charge is what one namespace, or one value of the report label, owes.
+type Charge struct {
+	Group           string  `json:"group"`
+	CPUCoreHours    float64 `json:"cpuCoreHours"`
+	MemoryGiBHours  float64 `json:"memoryGiBHours"`
+	StorageGiBHours float64 `json:"storageGiBHours"`
+	CPUCost         float64 `json:"cpuCost"`
+	MemoryCost      float64 `json:"memoryCost"`
+	StorageCost     float64 `json:"storageCost"`
+	TotalCost       float64 `json:"totalCost"`
+}
+
+func (c *Charge) add(o Charge) {
+	c.CPUCoreHours += o.CPUCoreHours
+	c.MemoryGiBHours += o.MemoryGiBHours
+	c.StorageGiBHours += o.StorageGiBHours
+	c.CPUCost += o.CPUCost
+	c.MemoryCost += o.MemoryCost
+	c.StorageCost += o.StorageCost
+	c.TotalCost += o.TotalCost
+}
+
+type objectKey struct {
+	namespace, name string
+}
+
+// podStep is what a pod used and requested during one step, and the node
+// it ran on.
+type podStep struct {
+	cpu, cpuRequests       float64
+	memory, memoryRequests float64
+	node                   string
+}
+
+type reportData struct {
+	pods map[objectKey]map[int64]*podStep
+	// podGroups and pvcGroups are the values of the report label
+	podGroups  map[objectKey]string
+	nodeLabels map[string]map[string]string
+	pvcBytes   map[objectKey]map[int64]float64
+	pvcGroups  map[objectKey]string
+}
+
+func (d *reportData) step(labels map[string]string, ts time.Time) *podStep {
+	key := objectKey{labels["namespace"], labels["pod"]}
+	steps, ok := d.pods[key]
+	if !ok {
+		steps = map[int64]*podStep{}
+		d.pods[key] = steps
+	}
+	s, ok := steps[ts.Unix()]
+	if !ok {
+		s = &podStep{}
+		steps[ts.Unix()] = s
+	}
+	return s
+}
+
+// NewReport prices the CPU-core-hours, memory GiB-hours and
+// PersistentVolumeClaim GiB-hours between opts.Start and opts.End. CPU and
+// memory are priced by the node the pod ran on during each step, storage by
+// the requested size of the claim. Requests only count while a pod is
+// pending or running.
+//
+// Only range queries are used, so api may point at a Trickster frontend,
+// see convert.ToTricksterFrontend.
+func NewReport(ctx context.Context, api promv1.API, prices *PriceList, opts Options) (*Report, error) {
+	if err := prices.Validate(); err != nil {
+		return nil, err
+	}
+	switch opts.Basis {
+	case BasisMax, BasisUsage, BasisRequests:
+	case "":
+		opts.Basis = BasisMax
+	default:
+		return nil, fmt.Errorf("unknown basis %q, must be one of max, usage or requests", opts.Basis)
+	}
+	if opts.Step <= 0 {
+		opts.Step = DefaultStep
+	}
+	if opts.Step < time.Minute {
+		return nil, fmt.Errorf("step %s is shorter than 1m", opts.Step)
+	}
+	start, end := opts.Start.Truncate(opts.Step), opts.End.Truncate(opts.Step)
+	if !start.Before(end) {
+		return nil, fmt.Errorf("billing period must span at least one step of %s", opts.Step)
+	}
+
+	d := &reportData{
+		pods:       map[objectKey]map[int64]*podStep{},
+		podGroups:  map[objectKey]string{},
+		nodeLabels: map[string]map[string]string{},
+		pvcBytes:   map[objectKey]map[int64]float64{},
+		pvcGroups:  map[objectKey]string{},
+	}
+	// each point covers the step before it, so the first one is at
+	// start+step
+	r := promv1.Range{Start: start.Add(opts.Step), End: end, Step: opts.Step}
+	if err := d.load(ctx, query.New(api), r, opts); err != nil {
+		return nil, err
+	}
+
+	report := &Report{
+		Start:    start,
+		End:      end,
+		Label:    opts.Label,
+		Basis:    opts.Basis,
+		Currency: prices.Currency,
+		Items:    d.charges(prices, opts),
+	}
+	for _, c := range report.Items {
+		report.Total.add(c)
+	}
+	return report, nil
+}
+
+func (d *reportData) load(ctx context.Context, qc *query.Client, r promv1.Range, opts Options) error {
+	selector := func(metric string, matchers ...promql.Matcher) promql.Selector {
+		s := promql.Metric(metric, matchers...)
+		if opts.Namespace != "" {
+			s = s.Where(promql.Eq("namespace", opts.Namespace))
+		}
+		return s
+	}
+	containers := []promql.Matcher{promql.Neq("container", ""), promql.Neq("image", "")}
+	// kube-state-metrics exports the requests of pods that are done until
+	// they are deleted
+	active := promql.BinaryOp("==", selector("kube_pod_status_phase", promql.OneOf("phase", "Pending", "Running")), promql.Number(1))
+	requests := func(resource string) promql.Expr {
+		s := selector("kube_pod_container_resource_requests", promql.Eq("resource", resource))
+		return promql.Sum(promql.And(s, active).On("namespace", "pod")).By("namespace", "pod")
+	}
+
+	type job struct {
+		expr promql.Expr
+		fill func(labels map[string]string, p query.Point)
+	}
+	jobs := []job{
+		{
+			expr: promql.Sum(promql.Rate(selector("container_cpu_usage_seconds_total", containers...), r.Step)).By("namespace", "pod"),
+			fill: func(l map[string]string, p query.Point) { d.step(l, p.Timestamp).cpu = p.Value },
+		},
+		{
+			expr: requests("cpu"),
+			fill: func(l map[string]string, p query.Point) { d.step(l, p.Timestamp).cpuRequests = p.Value },
+		},
+		{
+			expr: promql.Sum(promql.Func("avg_over_time", selector("container_memory_working_set_bytes", containers...).Over(r.Step))).By("namespace", "pod"),
+			fill: func(l map[string]string, p query.Point) { d.step(l, p.Timestamp).memory = p.Value },
+		},
+		{
+			expr: requests("memory"),
+			fill: func(l map[string]string, p query.Point) { d.step(l, p.Timestamp).memoryRequests = p.Value },
+		},
+		{
+			expr: promql.Max(selector("kube_pod_info", promql.Neq("node", ""))).By("namespace", "pod", "node"),
+			fill: func(l map[string]string, p query.Point) { d.step(l, p.Timestamp).node = l["node"] },
+		},
+		{
+			expr: promql.Sum(selector("kube_persistentvolumeclaim_resource_requests_storage_bytes")).By("namespace", "persistentvolumeclaim"),
+			fill: func(l map[string]string, p query.Point) {
+				key := objectKey{l["namespace"], l["persistentvolumeclaim"]}
+				if d.pvcBytes[key] == nil {
+					d.pvcBytes[key] = map[int64]float64{}
+				}
+				d.pvcBytes[key][p.Timestamp.Unix()] = p.Value
+			},
+		},
+		{
+			// kube_node_labels isn't filtered by namespace
+			expr: promql.Metric("kube_node_labels"),
+			fill: func(l map[string]string, p query.Point) { d.nodeLabels[l["node"]] = l },
+		},
+	}
+	if opts.Label != "" {
+		label := MetricLabel(opts.Label)
+		jobs = append(jobs,
+			job{
+				expr: promql.Max(selector("kube_pod_labels")).By("namespace", "pod", label),
+				fill: func(l map[string]string, p query.Point) {
+					d.podGroups[objectKey{l["namespace"], l["pod"]}] = l[label]
+				},
+			},
+			job{
+				expr: promql.Max(selector("kube_persistentvolumeclaim_labels")).By("namespace", "persistentvolumeclaim", label),
+				fill: func(l map[string]string, p query.Point) {
+					d.pvcGroups[objectKey{l["namespace"], l["persistentvolumeclaim"]}] = l[label]
+				},
+			})
+	}
+
+	results := make([]*query.Result, len(jobs))
+	g, ctx := errgroup.WithContext(ctx)
+	for i, j := range jobs {
+		q, err := promql.Build(j.expr)
+		if err != nil {
+			return err
+		}
+		g.Go(func() error {
+			res, err := qc.QueryRange(ctx, q, r)
+			if err != nil {
+				return fmt.Errorf("failed to run %s: %w", q, err)
+			}
+			for _, w := range res.Warnings {
+				klog.Warningln(w)
+			}
+			results[i] = res
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	for i, j := range jobs {
+		for _, s := range results[i].Series {
+			for _, p := range s.Points {
+				j.fill(s.Labels, p)
+			}
+		}
+		for _, s := range results[i].Samples {
+			j.fill(s.Labels, query.Point{Timestamp: s.Timestamp, Value: s.Value})
+		}
+	}
+	return nil
+}
+
+func (d *reportData) charges(prices *PriceList, opts Options) []Charge {
+	hours := opts.Step.Hours()
+	groups := map[string]*Charge{}
+	charge := func(name string) *Charge {
+		c, ok := groups[name]
+		if !ok {
+			c = &Charge{Group: name}
+			groups[name] = c
+		}
+		return c
+	}
+
+	for key, steps := range d.pods {
+		name := key.namespace
+		if opts.Label != "" {
+			name = d.podGroups[key]
+		}
+		c := charge(name)
+		for _, s := range steps {
+			// a pod that is rescheduled, like a StatefulSet pod, may run on
+			// nodes of different prices
+			p := prices.nodePrices(d.nodeLabels[s.node])
+			cores := basis(opts.Basis, s.cpu, s.cpuRequests) * hours
+			mem := basis(opts.Basis, s.memory, s.memoryRequests) / gib * hours
+			c.CPUCoreHours += cores
+			c.MemoryGiBHours += mem
+			c.CPUCost += cores * p.CPUCoreHour
+			c.MemoryCost += mem * p.MemoryGiBHour
+		}
+	}
+	for key, steps := range d.pvcBytes {
+		name := key.namespace
+		if opts.Label != "" {
+			name = d.pvcGroups[key]
+		}
+		c := charge(name)
+		for _, b := range steps {
+			storage := b / gib * hours
+			c.StorageGiBHours += storage
+			c.StorageCost += storage * prices.Default.StorageGiBHour
+		}
+	}
+
+	out := make([]Charge, 0, len(groups))
+	for _, c := range groups {
+		c.TotalCost = c.CPUCost + c.MemoryCost + c.StorageCost
+		out = append(out, *c)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Group < out[j].Group
+	})
+	return out
+}
+
+func basis(b Basis, usage, requests float64) float64 {
+	switch b {
+	case BasisUsage:
+		return usage
+	case BasisRequests:
+		return requests
+	}
+	return math.Max(usage, requests)
+}
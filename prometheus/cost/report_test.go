@@ -0,0 +1,328 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cost
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/tamalsaha/prometheus-demo/prometheus/promtest"
+)
+
+const step = 15 * time.Minute
+
+var (
+	start = promtest.DefaultStart
+	end   = promtest.DefaultStart.Add(time.Hour)
+)
+
+func float(v float64) *float64 {
+	return &v
+}
+
+// prices are round per hour, spot nodes are cheaper
+var prices = &PriceList{
+	Currency: "USD",
+	Default:  Prices{CPUCoreHour: 0.04, MemoryGiBHour: 0.005, StorageGiBHour: 0.0001},
+	Overrides: []PriceOverride{
+		{NodeLabels: map[string]string{"karpenter.sh/capacity-type": "spot"}, CPUCoreHour: float(0.01), MemoryGiBHour: float(0.002)},
+		// never used, the first match wins
+		{NodeLabels: map[string]string{"kubernetes.io/hostname": "node-2"}, CPUCoreHour: float(100)},
+	},
+}
+
+func newTestAPI(t *testing.T, db *promtest.Storage) promv1.API {
+	t.Helper()
+	srv := promtest.NewServer(db)
+	t.Cleanup(srv.Close)
+	c, err := srv.PrometheusConfig().NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return promv1.NewAPI(c)
+}
+
+// The synthetic cluster runs for an hour in the demo namespace:
+//
+//	pod              node         cores  memory  cpu req  memory req
+//	web-7d9f8-abcde  node-1       0.25   128Mi   0.5      256Mi
+//	web-7d9f8-fghij  node-2 spot  0.15    96Mi   0.5      256Mi
+//	db-0             node-1       1        1Gi   1          2Gi
+//
+// and db-0 has a 10Gi PersistentVolumeClaim.
+func TestNewReport(t *testing.T) {
+	api := newTestAPI(t, promtest.Synthetic())
+
+	tests := []struct {
+		name string
+		opts Options
+		want []Charge
+	}{
+		{
+			name: "max",
+			opts: Options{Basis: BasisMax},
+			want: []Charge{{
+				Group:           "demo",
+				CPUCoreHours:    2,
+				MemoryGiBHours:  2.5,
+				StorageGiBHours: 10,
+				CPUCost:         1.5*0.04 + 0.5*0.01,
+				MemoryCost:      2.25*0.005 + 0.25*0.002,
+				StorageCost:     10 * 0.0001,
+			}},
+		},
+		{
+			name: "usage",
+			opts: Options{Basis: BasisUsage},
+			want: []Charge{{
+				Group:           "demo",
+				CPUCoreHours:    1.4,
+				MemoryGiBHours:  1.21875,
+				StorageGiBHours: 10,
+				CPUCost:         1.25*0.04 + 0.15*0.01,
+				MemoryCost:      1.125*0.005 + 0.09375*0.002,
+				StorageCost:     10 * 0.0001,
+			}},
+		},
+		{
+			name: "requests",
+			opts: Options{Basis: BasisRequests},
+			want: []Charge{{
+				Group:           "demo",
+				CPUCoreHours:    2,
+				MemoryGiBHours:  2.5,
+				StorageGiBHours: 10,
+				CPUCost:         1.5*0.04 + 0.5*0.01,
+				MemoryCost:      2.25*0.005 + 0.25*0.002,
+				StorageCost:     10 * 0.0001,
+			}},
+		},
+		{
+			name: "label",
+			opts: Options{Basis: BasisRequests, Label: "team"},
+			want: []Charge{
+				{
+					Group:           "backend",
+					CPUCoreHours:    1,
+					MemoryGiBHours:  2,
+					StorageGiBHours: 10,
+					CPUCost:         0.04,
+					MemoryCost:      2 * 0.005,
+					StorageCost:     10 * 0.0001,
+				},
+				{
+					Group:          "frontend",
+					CPUCoreHours:   1,
+					MemoryGiBHours: 0.5,
+					CPUCost:        0.5*0.04 + 0.5*0.01,
+					MemoryCost:     0.25*0.005 + 0.25*0.002,
+				},
+			},
+		},
+		{
+			name: "other namespace",
+			opts: Options{Namespace: "kube-system"},
+			want: []Charge{},
+		},
+		{
+			name: "unaligned period",
+			opts: Options{Basis: BasisRequests, Start: start.Add(5 * time.Minute), End: end.Add(10 * time.Minute)},
+			want: []Charge{{
+				Group:           "demo",
+				CPUCoreHours:    2,
+				MemoryGiBHours:  2.5,
+				StorageGiBHours: 10,
+				CPUCost:         1.5*0.04 + 0.5*0.01,
+				MemoryCost:      2.25*0.005 + 0.25*0.002,
+				StorageCost:     10 * 0.0001,
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if opts.Start.IsZero() {
+				opts.Start, opts.End = start, end
+			}
+			opts.Step = step
+			r, err := NewReport(context.Background(), api, prices, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the period is aligned to the step
+			if !r.Start.Equal(start) || !r.End.Equal(end) {
+				t.Errorf("period = %s to %s, want %s to %s", r.Start, r.End, start, end)
+			}
+			if r.Currency != "USD" || r.Basis != opts.Basis && opts.Basis != "" {
+				t.Errorf("report currency %s and basis %s", r.Currency, r.Basis)
+			}
+			if len(r.Items) != len(tt.want) {
+				t.Fatalf("got %d items, want %d: %+v", len(r.Items), len(tt.want), r.Items)
+			}
+			var total Charge
+			for i, want := range tt.want {
+				want.TotalCost = want.CPUCost + want.MemoryCost + want.StorageCost
+				assertCharge(t, r.Items[i], want)
+				total.add(want)
+			}
+			total.Group = ""
+			assertCharge(t, r.Total, total)
+		})
+	}
+}
+
+// TestNewReportLifecycle checks that pods are charged for what they
+// requested and where they ran during each step.
+func TestNewReportLifecycle(t *testing.T) {
+	db := promtest.NewStorage()
+	g := promtest.Generator{Start: start, Interval: 15 * time.Second, Points: 241}
+	for _, node := range []map[string]string{
+		{"node": "node-1"},
+		{"node": "node-2", "label_karpenter_sh_capacity_type": "spot"},
+	} {
+		g.Constant(db, "kube_node_labels", node, 1)
+	}
+	// the first 121 samples are the first half hour, up to 30m
+	half := func(first bool) func(i int) float64 {
+		return func(i int) float64 {
+			if (i <= 120) == first {
+				return 1
+			}
+			return 0
+		}
+	}
+	pod := func(name string) map[string]string {
+		return map[string]string{"namespace": "demo", "pod": name}
+	}
+	request := func(name string, cores float64) {
+		g.Constant(db, "kube_pod_container_resource_requests", map[string]string{
+			"namespace": "demo", "pod": name, "container": "main", "resource": "cpu", "unit": "core",
+		}, cores)
+	}
+	phase := func(name, phase string, fn func(i int) float64) {
+		lbls := pod(name)
+		lbls["phase"] = phase
+		g.Gauge(db, "kube_pod_status_phase", lbls, fn)
+	}
+
+	// a job that is done after half an hour, and kept
+	request("job-x", 1)
+	g.Constant(db, "kube_pod_info", map[string]string{"namespace": "demo", "pod": "job-x", "node": "node-1"}, 1)
+	phase("job-x", "Running", half(true))
+	phase("job-x", "Succeeded", half(false))
+
+	// a StatefulSet pod that moves to a spot node after half an hour
+	request("cache-0", 2)
+	phase("cache-0", "Running", func(int) float64 { return 1 })
+	first := promtest.Generator{Start: start, Interval: 15 * time.Second, Points: 121}
+	first.Constant(db, "kube_pod_info", map[string]string{"namespace": "demo", "pod": "cache-0", "node": "node-1"}, 1)
+	db.Stale("kube_pod_info", map[string]string{"namespace": "demo", "pod": "cache-0", "node": "node-1"}, start.Add(30*time.Minute+15*time.Second))
+	second := promtest.Generator{Start: start.Add(30*time.Minute + 15*time.Second), Interval: 15 * time.Second, Points: 120}
+	second.Constant(db, "kube_pod_info", map[string]string{"namespace": "demo", "pod": "cache-0", "node": "node-2"}, 1)
+
+	for _, basis := range []Basis{BasisMax, BasisRequests} {
+		t.Run(string(basis), func(t *testing.T) {
+			r, err := NewReport(context.Background(), newTestAPI(t, db), &PriceList{
+				Default:   Prices{CPUCoreHour: 0.04},
+				Overrides: prices.Overrides,
+			}, Options{Start: start, End: end, Step: step, Basis: basis, Label: "app"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Items) != 1 {
+				t.Fatalf("got %d items, want 1: %+v", len(r.Items), r.Items)
+			}
+			want := Charge{
+				// job-x for the steps up to 30m, cache-0 for the hour
+				CPUCoreHours: 0.5 + 2,
+				// cache-0 on node-2 for the steps after 30m
+				CPUCost: 0.5*0.04 + 1*0.04 + 1*0.01,
+			}
+			want.TotalCost = want.CPUCost
+			assertCharge(t, r.Items[0], want)
+		})
+	}
+}
+
+func TestNewReportRejects(t *testing.T) {
+	api := newTestAPI(t, promtest.NewStorage())
+	for name, opts := range map[string]Options{
+		"basis":           {Start: start, End: end, Basis: "cheapest"},
+		"short step":      {Start: start, End: end, Step: time.Second},
+		"shorter than 1h": {Start: start.Add(5 * time.Minute), End: start.Add(55 * time.Minute)},
+		"reversed":        {Start: end, End: start},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if r, err := NewReport(context.Background(), api, prices, opts); err == nil {
+				t.Errorf("NewReport() = %+v, want error", r)
+			}
+		})
+	}
+	negative := &PriceList{Default: Prices{CPUCoreHour: -1}}
+	if _, err := NewReport(context.Background(), api, negative, Options{Start: start, End: end}); err == nil {
+		t.Error("NewReport() with negative prices succeeded, want error")
+	}
+}
+
+func TestNodePrices(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   Prices
+	}{
+		{
+			name:   "default",
+			labels: map[string]string{"node": "node-1"},
+			want:   prices.Default,
+		},
+		{
+			name:   "override keeps unset prices",
+			labels: map[string]string{"node": "node-2", "label_karpenter_sh_capacity_type": "spot", "label_kubernetes_io_hostname": "node-2"},
+			want:   Prices{CPUCoreHour: 0.01, MemoryGiBHour: 0.002, StorageGiBHour: 0.0001},
+		},
+		{
+			name:   "unknown node",
+			labels: nil,
+			want:   prices.Default,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := prices.nodePrices(tt.labels); got != tt.want {
+				t.Errorf("nodePrices() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func assertCharge(t *testing.T, got, want Charge) {
+	t.Helper()
+	if got.Group != want.Group ||
+		!equal(got.CPUCoreHours, want.CPUCoreHours) || !equal(got.MemoryGiBHours, want.MemoryGiBHours) || !equal(got.StorageGiBHours, want.StorageGiBHours) ||
+		!equal(got.CPUCost, want.CPUCost) || !equal(got.MemoryCost, want.MemoryCost) || !equal(got.StorageCost, want.StorageCost) ||
+		!equal(got.TotalCost, want.TotalCost) {
+		t.Errorf("charge = %+v, want %+v", got, want)
+	}
+}
+
+func equal(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
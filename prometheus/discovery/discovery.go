@@ -0,0 +1,497 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package discovery finds the Prometheus compatible Services of a cluster,
+// so a client can connect without being told the namespace, name and port
+// of the Service. It recognizes kube-prometheus-stack, rancher-monitoring,
+// OpenShift monitoring, the prometheus-community chart, Thanos and the
+// Services of prometheus-operator Prometheus and ThanosRuler objects.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	core "k8s.io/api/core/v1"
+	kerr "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Kind is the API a candidate serves.
+type Kind string
+
+const (
+	// KindPrometheus is a Prometheus server.
+	KindPrometheus Kind = "prometheus"
+	// KindThanosQuerier is a Thanos Query or Query Frontend, which merges
+	// the data of several Prometheus servers.
+	KindThanosQuerier Kind = "thanos-querier"
+	// KindThanosRuler only has the series of its recording rules and
+	// alerts.
+	KindThanosRuler Kind = "thanos-ruler"
+)
+
+// Distribution is the packaging that created a Service.
+type Distribution string
+
+const (
+	DistributionKubePrometheusStack Distribution = "kube-prometheus-stack"
+	DistributionRancher             Distribution = "rancher-monitoring"
+	DistributionOpenShift           Distribution = "openshift-monitoring"
+	DistributionPrometheusOperator  Distribution = "prometheus-operator"
+	DistributionPrometheusChart     Distribution = "prometheus-community"
+	DistributionThanos              Distribution = "thanos"
+)
+
+// Candidate is a Service that serves the Prometheus HTTP API.
+type Candidate struct {
+	Service      prometheus.ServiceReference `json:"service"`
+	Kind         Kind                        `json:"kind"`
+	Distribution Distribution                `json:"distribution,omitempty"`
+	// Owner is the Prometheus or ThanosRuler object whose pods the Service
+	// selects, in namespace/name form.
+	Owner string `json:"owner,omitempty"`
+	// Score ranks the candidates, higher is better.
+	Score int `json:"score"`
+	// Reasons explain the score.
+	Reasons []string `json:"reasons"`
+}
+
+// Options limit the search.
+type Options struct {
+	// Namespaces to search. All namespaces are searched if empty.
+	Namespaces []string
+	// Kinds to return. All kinds are returned if empty.
+	Kinds []Kind
+}
+
+// ErrNotFound is returned by Best if the cluster has no candidate.
+var ErrNotFound = errors.New("no Prometheus compatible service found")
+
+// scores of the kinds: a querier sees the data of all the Prometheus servers
+// behind it, a ruler only the results of its rules
+var kindScores = map[Kind]int{
+	KindThanosQuerier: 100,
+	KindPrometheus:    80,
+	KindThanosRuler:   20,
+}
+
+// wellKnown are the Services of distributions that are installed with
+// fixed names.
+var wellKnown = map[string]struct {
+	kind         Kind
+	distribution Distribution
+	scheme       string
+	port         int32
+}{
+	"openshift-monitoring/thanos-querier":                    {KindThanosQuerier, DistributionOpenShift, "https", 9091},
+	"openshift-monitoring/prometheus-k8s":                    {KindPrometheus, DistributionOpenShift, "https", 9091},
+	"cattle-monitoring-system/rancher-monitoring-prometheus": {KindPrometheus, DistributionRancher, "http", 9090},
+	"monitoring/kube-prometheus-stack-prometheus":            {KindPrometheus, DistributionKubePrometheusStack, "http", 9090},
+}
+
+// Discover lists the Services, Prometheus and ThanosRuler objects in the
+// namespaces of opts and returns the candidates, best first. Clusters
+// without the prometheus-operator CRDs are searched by Service only.
+func Discover(ctx context.Context, kc client.Reader, opts Options) ([]Candidate, error) {
+	namespaces := opts.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{core.NamespaceAll}
+	}
+
+	var (
+		services    []core.Service
+		prometheses []monitoringv1.Prometheus
+		rulers      []monitoringv1.ThanosRuler
+	)
+	for _, ns := range namespaces {
+		var svcs core.ServiceList
+		if err := kc.List(ctx, &svcs, client.InNamespace(ns)); err != nil {
+			return nil, fmt.Errorf("failed to list services: %w", err)
+		}
+		services = append(services, svcs.Items...)
+
+		var proms monitoringv1.PrometheusList
+		if err := listOptional(ctx, kc, &proms, ns); err != nil {
+			return nil, err
+		}
+		prometheses = append(prometheses, proms.Items...)
+
+		var trs monitoringv1.ThanosRulerList
+		if err := listOptional(ctx, kc, &trs, ns); err != nil {
+			return nil, err
+		}
+		rulers = append(rulers, trs.Items...)
+	}
+
+	var out []Candidate
+	for i := range services {
+		c, ok := classify(&services[i], prometheses, rulers)
+		if !ok || !wanted(c.Kind, opts.Kinds) {
+			continue
+		}
+		out = append(out, c)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		if out[i].Service.Namespace != out[j].Service.Namespace {
+			return out[i].Service.Namespace < out[j].Service.Namespace
+		}
+		return out[i].Service.Name < out[j].Service.Name
+	})
+	return out, nil
+}
+
+// Best returns the best candidate of Discover.
+func Best(ctx context.Context, kc client.Reader, opts Options) (*Candidate, error) {
+	candidates, err := Discover(ctx, kc, opts)
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNotFound
+	}
+	return &candidates[0], nil
+}
+
+// listOptional lists objects of a CRD that may not be installed, or not be
+// registered in the scheme of kc.
+func listOptional(ctx context.Context, kc client.Reader, list client.ObjectList, ns string) error {
+	err := kc.List(ctx, list, client.InNamespace(ns))
+	switch {
+	case err == nil:
+		return nil
+	case meta.IsNoMatchError(err), runtime.IsNotRegisteredError(err), kerr.IsNotFound(err):
+		klog.V(3).InfoS("Skipping prometheus-operator objects", "type", fmt.Sprintf("%T", list), "err", err)
+		return nil
+	case kerr.IsForbidden(err):
+		klog.V(2).InfoS("Not allowed to list prometheus-operator objects", "type", fmt.Sprintf("%T", list), "err", err)
+		return nil
+	}
+	return fmt.Errorf("failed to list %T: %w", list, err)
+}
+
+func wanted(k Kind, kinds []Kind) bool {
+	if len(kinds) == 0 {
+		return true
+	}
+	for _, w := range kinds {
+		if w == k {
+			return true
+		}
+	}
+	return false
+}
+
+// classify decides if svc serves the Prometheus API and scores it.
+func classify(svc *core.Service, prometheses []monitoringv1.Prometheus, rulers []monitoringv1.ThanosRuler) (Candidate, bool) {
+	key := svc.Namespace + "/" + svc.Name
+	lbls := svc.Labels
+	c := Candidate{
+		Service: prometheus.ServiceReference{
+			Scheme:    "http",
+			Name:      svc.Name,
+			Namespace: svc.Namespace,
+		},
+	}
+	var (
+		// the web port of the owner or of a well-known service
+		portName string
+		port     int32
+	)
+
+	if wk, ok := wellKnown[key]; ok {
+		c.Kind, c.Distribution, c.Service.Scheme, port = wk.kind, wk.distribution, wk.scheme, wk.port
+		c.reason(10, "well-known service of "+string(wk.distribution))
+	}
+
+	if p := ownerPrometheus(svc, prometheses); p != nil {
+		c.Owner = p.Namespace + "/" + p.Name
+		c.Kind = KindPrometheus
+		c.Service.Scheme = p.Spec.PrometheusURIScheme()
+		portName = p.Spec.PortName
+		c.reason(10, "selects the pods of Prometheus "+c.Owner)
+	} else if r := ownerThanosRuler(svc, rulers); r != nil {
+		c.Owner = r.Namespace + "/" + r.Name
+		c.Kind = KindThanosRuler
+		if r.Spec.Web != nil && r.Spec.Web.TLSConfig != nil {
+			c.Service.Scheme = "https"
+		}
+		portName = r.Spec.PortName
+		c.reason(10, "selects the pods of ThanosRuler "+c.Owner)
+	}
+
+	switch {
+	case lbls["operated-prometheus"] == "true":
+		c.Kind = KindPrometheus
+		c.reason(0, "governing service of prometheus-operator")
+	case lbls["operated-thanos-ruler"] == "true":
+		c.Kind = KindThanosRuler
+		c.reason(0, "governing service of prometheus-operator")
+	case isThanosQuery(lbls, svc.Name):
+		c.Kind = KindThanosQuerier
+		if strings.Contains(svc.Name, "frontend") || lbls["app.kubernetes.io/component"] == "query-frontend" {
+			c.reason(5, "Thanos query frontend caches results")
+		}
+	case c.Kind == "" && isPrometheusServer(svc):
+		c.Kind = KindPrometheus
+	}
+	if c.Kind == "" {
+		return c, false
+	}
+	c.reason(kindScores[c.Kind], "serves the "+string(c.Kind)+" API")
+
+	if c.Distribution == "" {
+		c.Distribution = distribution(svc, c.Owner != "")
+	}
+	if c.Distribution == DistributionOpenShift {
+		// the monitoring stack is only reachable through kube-rbac-proxy
+		c.Service.Scheme = "https"
+	}
+	if c.Distribution != "" && c.Distribution != DistributionPrometheusOperator {
+		c.reason(5, "installed by "+string(c.Distribution))
+	}
+
+	ports := svc.Spec.Ports
+	if c.Kind == KindPrometheus && selectsOperatorPods(svc, c.Owner) {
+		// like the thanos-discovery Service of kube-prometheus-stack, which
+		// only exposes the Thanos sidecar of the Prometheus pods
+		ports = withoutSidecar(ports)
+	}
+	sp, scheme, ok := pickPort(ports, portName, port)
+	if !ok {
+		return c, false
+	}
+	c.Service.Port = int(sp.Port)
+	if scheme != "" {
+		c.Service.Scheme = scheme
+	}
+
+	if svc.Spec.ClusterIP == core.ClusterIPNone {
+		// the service proxy picks a pod, so replicas of an HA pair answer
+		// in turns and graphs may flicker
+		c.reason(-5, "headless service")
+	}
+	return c, true
+}
+
+func (c *Candidate) reason(score int, why string) {
+	c.Score += score
+	c.Reasons = append(c.Reasons, why)
+}
+
+// prometheusPodLabels and thanosRulerPodLabels are the labels
+// prometheus-operator sets on the pods of a Prometheus or ThanosRuler.
+// ref: https://github.com/prometheus-operator/prometheus-operator/blob/v0.87.1/pkg/prometheus/statefulset.go
+func prometheusPodLabels(p *monitoringv1.Prometheus) labels.Set {
+	return labels.Set{
+		"app.kubernetes.io/name":       "prometheus",
+		"app.kubernetes.io/managed-by": "prometheus-operator",
+		"app.kubernetes.io/instance":   p.Name,
+		"operator.prometheus.io/name":  p.Name,
+		"prometheus":                   p.Name,
+	}
+}
+
+func thanosRulerPodLabels(r *monitoringv1.ThanosRuler) labels.Set {
+	return labels.Set{
+		"app.kubernetes.io/name":       "thanos-ruler",
+		"app.kubernetes.io/managed-by": "prometheus-operator",
+		"app.kubernetes.io/instance":   r.Name,
+		"thanos-ruler":                 r.Name,
+	}
+}
+
+func selects(svc *core.Service, pod labels.Set) bool {
+	if len(svc.Spec.Selector) == 0 {
+		return false
+	}
+	return labels.SelectorFromSet(svc.Spec.Selector).Matches(pod)
+}
+
+func ownerPrometheus(svc *core.Service, prometheses []monitoringv1.Prometheus) *monitoringv1.Prometheus {
+	for i := range prometheses {
+		p := &prometheses[i]
+		if p.Namespace == svc.Namespace && selects(svc, prometheusPodLabels(p)) {
+			return p
+		}
+	}
+	return nil
+}
+
+func ownerThanosRuler(svc *core.Service, rulers []monitoringv1.ThanosRuler) *monitoringv1.ThanosRuler {
+	for i := range rulers {
+		r := &rulers[i]
+		if r.Namespace == svc.Namespace && selects(svc, thanosRulerPodLabels(r)) {
+			return r
+		}
+	}
+	return nil
+}
+
+func isThanosQuery(lbls map[string]string, name string) bool {
+	switch lbls["app.kubernetes.io/name"] {
+	case "thanos-query", "thanos-querier", "thanos-query-frontend":
+		return true
+	case "thanos":
+		// bitnami chart
+		c := lbls["app.kubernetes.io/component"]
+		return c == "query" || c == "query-frontend"
+	}
+	return name == "thanos-querier" || name == "thanos-query" || name == "thanos-query-frontend"
+}
+
+// isPrometheusServer recognizes the server of the prometheus-community
+// chart, the Prometheus of kube-prometheus-stack and rancher-monitoring,
+// and Services that select the pods of a Prometheus, for clusters where
+// Prometheus objects can't be listed.
+func isPrometheusServer(svc *core.Service) bool {
+	lbls, sel := svc.Labels, svc.Spec.Selector
+	switch {
+	case lbls["app.kubernetes.io/name"] == "prometheus":
+		c, ok := lbls["app.kubernetes.io/component"]
+		return !ok || c == "server"
+	case lbls["app"] == "prometheus":
+		return lbls["component"] == "server"
+	case strings.HasSuffix(lbls["app"], "kube-prometheus-stack-prometheus"),
+		strings.HasSuffix(lbls["app"], "kube-prometheus-prometheus"),
+		lbls["app"] == "rancher-monitoring-prometheus":
+		return true
+	}
+	return sel["app.kubernetes.io/name"] == "prometheus" || sel["operator.prometheus.io/name"] != "" || sel["prometheus"] != ""
+}
+
+func distribution(svc *core.Service, operated bool) Distribution {
+	lbls := svc.Labels
+	switch {
+	case strings.HasPrefix(svc.Namespace, "openshift-"):
+		return DistributionOpenShift
+	case svc.Namespace == "cattle-monitoring-system", strings.HasPrefix(lbls["app"], "rancher-monitoring"):
+		return DistributionRancher
+	case lbls["app.kubernetes.io/part-of"] == "kube-prometheus-stack",
+		strings.HasPrefix(lbls["chart"], "kube-prometheus-stack"),
+		strings.HasSuffix(lbls["app"], "kube-prometheus-stack-prometheus"),
+		strings.HasSuffix(lbls["app"], "kube-prometheus-prometheus"):
+		return DistributionKubePrometheusStack
+	case operated,
+		lbls["operated-prometheus"] == "true",
+		lbls["operated-thanos-ruler"] == "true",
+		lbls["app.kubernetes.io/managed-by"] == "prometheus-operator":
+		return DistributionPrometheusOperator
+	case strings.HasPrefix(lbls["app.kubernetes.io/name"], "thanos"),
+		lbls["app.kubernetes.io/part-of"] == "thanos":
+		return DistributionThanos
+	case strings.HasPrefix(lbls["helm.sh/chart"], "prometheus-"),
+		strings.HasPrefix(lbls["chart"], "prometheus-"):
+		return DistributionPrometheusChart
+	}
+	return ""
+}
+
+// webPortNames are the names of the HTTP ports of Prometheus and Thanos in
+// the common charts, best first.
+var webPortNames = []string{"web", "http-web", "https-web", "http", "https", "http-query", "http-prometheus", "server"}
+
+// webPorts are the default HTTP ports of Prometheus, kube-rbac-proxy in
+// front of it, and Thanos.
+var webPorts = []int32{9090, 9091, 10902, 80, 443}
+
+// selectsOperatorPods reports whether svc selects the pods of a
+// Prometheus object, which may run a Thanos sidecar.
+func selectsOperatorPods(svc *core.Service, owner string) bool {
+	sel := svc.Spec.Selector
+	return owner != "" || sel["operator.prometheus.io/name"] != "" || sel["prometheus"] != ""
+}
+
+// sidecarPorts are the container ports prometheus-operator gives the Thanos
+// sidecar in the pods of a Prometheus object. They serve the StoreAPI and
+// the metrics of the sidecar, not the Prometheus API.
+var sidecarPorts = map[string]int32{"grpc": 10901, "http": 10902}
+
+// withoutSidecar returns the ports that don't target the Thanos sidecar.
+func withoutSidecar(ports []core.ServicePort) []core.ServicePort {
+	var out []core.ServicePort
+	for _, p := range ports {
+		target := p.TargetPort.IntVal
+		if target == 0 && p.TargetPort.StrVal == "" {
+			target = p.Port
+		}
+		sidecar := false
+		for name, num := range sidecarPorts {
+			if p.TargetPort.StrVal == name || target == num {
+				sidecar = true
+			}
+		}
+		if !sidecar {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// pickPort returns the port of ports that serves HTTP, and "https" if the
+// port says it uses TLS.
+func pickPort(ports []core.ServicePort, portName string, port int32) (core.ServicePort, string, bool) {
+	find := func(match func(p core.ServicePort) bool) (core.ServicePort, bool) {
+		for _, p := range ports {
+			if match(p) {
+				return p, true
+			}
+		}
+		return core.ServicePort{}, false
+	}
+
+	p, ok := find(func(p core.ServicePort) bool { return port != 0 && p.Port == port })
+	if !ok && portName != "" {
+		p, ok = find(func(p core.ServicePort) bool { return p.Name == portName })
+	}
+	for _, name := range webPortNames {
+		if ok {
+			break
+		}
+		p, ok = find(func(p core.ServicePort) bool { return p.Name == name })
+	}
+	for _, num := range webPorts {
+		if ok {
+			break
+		}
+		p, ok = find(func(p core.ServicePort) bool { return p.Port == num })
+	}
+	if !ok && len(ports) == 1 {
+		p, ok = ports[0], true
+	}
+	if !ok || p.Protocol != "" && p.Protocol != core.ProtocolTCP {
+		return p, "", false
+	}
+
+	if p.AppProtocol != nil && strings.EqualFold(*p.AppProtocol, "https") ||
+		strings.HasPrefix(p.Name, "https") ||
+		p.Port == 443 {
+		return p, "https", true
+	}
+	return p, "", true
+}
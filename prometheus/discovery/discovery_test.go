@@ -0,0 +1,281 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package discovery
+
+import (
+	"testing"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	core "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func service(ns, name string, lbls, selector map[string]string, ports ...core.ServicePort) core.Service {
+	return core.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name, Labels: lbls},
+		Spec:       core.ServiceSpec{Selector: selector, Ports: ports, ClusterIP: "10.96.0.10"},
+	}
+}
+
+func port(name string, num int32, target intstr.IntOrString) core.ServicePort {
+	return core.ServicePort{Name: name, Port: num, TargetPort: target, Protocol: core.ProtocolTCP}
+}
+
+func headless(svc core.Service) core.Service {
+	svc.Spec.ClusterIP = core.ClusterIPNone
+	return svc
+}
+
+// The Services below are rendered by the charts with their default values,
+// for a release named kube-prometheus-stack in the monitoring namespace.
+var (
+	kpsLabels = map[string]string{
+		"app":                          "kube-prometheus-stack-prometheus",
+		"app.kubernetes.io/managed-by": "Helm",
+		"app.kubernetes.io/part-of":    "kube-prometheus-stack",
+		"chart":                        "kube-prometheus-stack-79.0.0",
+		"release":                      "kube-prometheus-stack",
+	}
+	kpsSelector = map[string]string{
+		"app.kubernetes.io/name":      "prometheus",
+		"operator.prometheus.io/name": "kube-prometheus-stack-prometheus",
+	}
+
+	kpsPrometheus = service("monitoring", "kube-prometheus-stack-prometheus", kpsLabels, kpsSelector,
+		port("http-web", 9090, intstr.FromInt32(9090)),
+		port("reloader-web", 8080, intstr.FromString("reloader-web")))
+
+	kpsThanosDiscovery = headless(service("monitoring", "kube-prometheus-stack-thanos-discovery",
+		map[string]string{
+			"app":                       "kube-prometheus-stack-thanos-discovery",
+			"app.kubernetes.io/part-of": "kube-prometheus-stack",
+			"chart":                     "kube-prometheus-stack-79.0.0",
+			"release":                   "kube-prometheus-stack",
+		},
+		kpsSelector,
+		port("grpc", 10901, intstr.FromString("grpc")),
+		port("http", 10902, intstr.FromString("http"))))
+
+	// the kube-prometheus-stack Service with thanosService.enabled and a
+	// custom release name
+	kpsThanosSidecar = headless(service("monitoring", "mon-kube-prometheus-stack-thanos-discovery",
+		map[string]string{"app": "kube-prometheus-stack-thanos-discovery", "release": "mon"},
+		map[string]string{"app.kubernetes.io/name": "prometheus", "prometheus": "mon-kube-prometheus-stack-prometheus"},
+		port("http", 10902, intstr.FromInt32(10902))))
+
+	operated = headless(service("monitoring", "prometheus-operated",
+		map[string]string{"managed-by": "prometheus-operator", "operated-prometheus": "true"},
+		map[string]string{"app.kubernetes.io/name": "prometheus"},
+		port("web", 9090, intstr.FromString("web")),
+		port("grpc", 10901, intstr.FromString("grpc"))))
+
+	rulerOperated = headless(service("monitoring", "thanos-ruler-operated",
+		map[string]string{"operated-thanos-ruler": "true"},
+		map[string]string{"app.kubernetes.io/name": "thanos-ruler"},
+		port("grpc", 10901, intstr.FromString("grpc")),
+		port("web", 10902, intstr.FromString("web"))))
+
+	chartServer = service("prometheus", "prometheus-server",
+		map[string]string{
+			"app.kubernetes.io/name":      "prometheus",
+			"app.kubernetes.io/component": "server",
+			"helm.sh/chart":               "prometheus-27.45.0",
+		},
+		map[string]string{"app.kubernetes.io/name": "prometheus", "app.kubernetes.io/component": "server"},
+		port("http", 80, intstr.FromInt32(9090)))
+
+	chartAlertmanager = service("prometheus", "prometheus-alertmanager",
+		map[string]string{"app.kubernetes.io/name": "alertmanager", "helm.sh/chart": "alertmanager-1.28.0"},
+		map[string]string{"app.kubernetes.io/name": "alertmanager"},
+		port("http", 9093, intstr.FromString("http")))
+
+	openshiftQuerier = service("openshift-monitoring", "thanos-querier",
+		map[string]string{"app.kubernetes.io/name": "thanos-query", "app.kubernetes.io/part-of": "openshift-monitoring"},
+		map[string]string{"app.kubernetes.io/name": "thanos-query"},
+		port("web", 9091, intstr.FromString("web")),
+		port("tenancy", 9092, intstr.FromString("tenancy")),
+		port("metrics", 9093, intstr.FromString("metrics")))
+
+	bitnamiQueryFrontend = service("thanos", "thanos-query-frontend",
+		map[string]string{"app.kubernetes.io/name": "thanos", "app.kubernetes.io/component": "query-frontend"},
+		map[string]string{"app.kubernetes.io/name": "thanos", "app.kubernetes.io/component": "query-frontend"},
+		port("http", 9090, intstr.FromString("http")))
+
+	nodeExporter = service("monitoring", "kube-prometheus-stack-prometheus-node-exporter",
+		map[string]string{"app.kubernetes.io/name": "prometheus-node-exporter"},
+		map[string]string{"app.kubernetes.io/name": "prometheus-node-exporter"},
+		port("http-metrics", 9100, intstr.FromInt32(9100)))
+)
+
+var (
+	kpsObject = monitoringv1.Prometheus{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "kube-prometheus-stack-prometheus"},
+		Spec:       monitoringv1.PrometheusSpec{CommonPrometheusFields: monitoringv1.CommonPrometheusFields{PortName: "http-web"}},
+	}
+	rulerObject = monitoringv1.ThanosRuler{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "thanos-ruler"},
+	}
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name string
+		svc  core.Service
+		// the CRDs aren't installed or can't be listed
+		noObjects bool
+		want      *Candidate
+	}{
+		{
+			name: "kube-prometheus-stack",
+			svc:  kpsPrometheus,
+			want: &Candidate{
+				Service:      prometheus.ServiceReference{Scheme: "http", Namespace: "monitoring", Name: "kube-prometheus-stack-prometheus", Port: 9090},
+				Kind:         KindPrometheus,
+				Distribution: DistributionKubePrometheusStack,
+				Owner:        "monitoring/kube-prometheus-stack-prometheus",
+				Score:        10 + 10 + 80 + 5,
+			},
+		},
+		{
+			name:      "kube-prometheus-stack without objects",
+			svc:       kpsPrometheus,
+			noObjects: true,
+			want: &Candidate{
+				Service:      prometheus.ServiceReference{Scheme: "http", Namespace: "monitoring", Name: "kube-prometheus-stack-prometheus", Port: 9090},
+				Kind:         KindPrometheus,
+				Distribution: DistributionKubePrometheusStack,
+				Score:        10 + 80 + 5,
+			},
+		},
+		{name: "kube-prometheus-stack thanos discovery", svc: kpsThanosDiscovery},
+		{name: "kube-prometheus-stack thanos discovery without objects", svc: kpsThanosDiscovery, noObjects: true},
+		{name: "thanos sidecar by port number", svc: kpsThanosSidecar, noObjects: true},
+		{
+			// the grpc port of the sidecar is not picked either
+			name: "governing service",
+			svc:  operated,
+			want: &Candidate{
+				Service:      prometheus.ServiceReference{Scheme: "http", Namespace: "monitoring", Name: "prometheus-operated", Port: 9090},
+				Kind:         KindPrometheus,
+				Distribution: DistributionPrometheusOperator,
+				Owner:        "monitoring/kube-prometheus-stack-prometheus",
+				Score:        10 + 80 - 5,
+			},
+		},
+		{
+			// the web port of the ruler is 10902 as well
+			name: "thanos ruler",
+			svc:  rulerOperated,
+			want: &Candidate{
+				Service:      prometheus.ServiceReference{Scheme: "http", Namespace: "monitoring", Name: "thanos-ruler-operated", Port: 10902},
+				Kind:         KindThanosRuler,
+				Distribution: DistributionPrometheusOperator,
+				Owner:        "monitoring/thanos-ruler",
+				Score:        10 + 20 - 5,
+			},
+		},
+		{
+			name: "prometheus-community chart",
+			svc:  chartServer,
+			want: &Candidate{
+				Service:      prometheus.ServiceReference{Scheme: "http", Namespace: "prometheus", Name: "prometheus-server", Port: 80},
+				Kind:         KindPrometheus,
+				Distribution: DistributionPrometheusChart,
+				Score:        80 + 5,
+			},
+		},
+		{name: "alertmanager", svc: chartAlertmanager},
+		{name: "node exporter", svc: nodeExporter},
+		{
+			name: "openshift",
+			svc:  openshiftQuerier,
+			want: &Candidate{
+				Service:      prometheus.ServiceReference{Scheme: "https", Namespace: "openshift-monitoring", Name: "thanos-querier", Port: 9091},
+				Kind:         KindThanosQuerier,
+				Distribution: DistributionOpenShift,
+				Score:        10 + 100 + 5,
+			},
+		},
+		{
+			name: "bitnami thanos query frontend",
+			svc:  bitnamiQueryFrontend,
+			want: &Candidate{
+				Service:      prometheus.ServiceReference{Scheme: "http", Namespace: "thanos", Name: "thanos-query-frontend", Port: 9090},
+				Kind:         KindThanosQuerier,
+				Distribution: DistributionThanos,
+				Score:        5 + 100 + 5,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prometheses := []monitoringv1.Prometheus{kpsObject}
+			rulers := []monitoringv1.ThanosRuler{rulerObject}
+			if tt.noObjects {
+				prometheses, rulers = nil, nil
+			}
+			got, ok := classify(&tt.svc, prometheses, rulers)
+			if tt.want == nil {
+				if ok {
+					t.Errorf("classify() = %+v, want no candidate", got)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("classify() found no candidate, want %+v", tt.want)
+			}
+			if got.Service != tt.want.Service || got.Kind != tt.want.Kind || got.Distribution != tt.want.Distribution ||
+				got.Owner != tt.want.Owner || got.Score != tt.want.Score {
+				t.Errorf("classify() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickPort(t *testing.T) {
+	https := "https"
+	tests := []struct {
+		name       string
+		ports      []core.ServicePort
+		portName   string
+		port       int32
+		want       int32
+		wantScheme string
+		wantOK     bool
+	}{
+		{name: "port of the owner", ports: []core.ServicePort{port("metrics", 8080, intstr.IntOrString{}), port("custom", 9095, intstr.IntOrString{})}, portName: "custom", want: 9095, wantOK: true},
+		{name: "well-known port", ports: []core.ServicePort{port("web", 9090, intstr.IntOrString{}), port("rbac", 9091, intstr.IntOrString{})}, port: 9091, want: 9091, wantOK: true},
+		{name: "web name first", ports: []core.ServicePort{port("http", 80, intstr.IntOrString{}), port("web", 9090, intstr.IntOrString{})}, want: 9090, wantOK: true},
+		{name: "default port", ports: []core.ServicePort{port("a", 8080, intstr.IntOrString{}), port("b", 9090, intstr.IntOrString{})}, want: 9090, wantOK: true},
+		{name: "single port", ports: []core.ServicePort{port("a", 8080, intstr.IntOrString{})}, want: 8080, wantOK: true},
+		{name: "https by name", ports: []core.ServicePort{port("https-web", 9091, intstr.IntOrString{})}, want: 9091, wantScheme: "https", wantOK: true},
+		{name: "https by app protocol", ports: []core.ServicePort{{Name: "web", Port: 9090, AppProtocol: &https}}, want: 9090, wantScheme: "https", wantOK: true},
+		{name: "udp", ports: []core.ServicePort{{Name: "web", Port: 9090, Protocol: core.ProtocolUDP}}},
+		{name: "no web port", ports: []core.ServicePort{port("a", 8080, intstr.IntOrString{}), port("b", 8081, intstr.IntOrString{})}},
+		{name: "no ports"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, scheme, ok := pickPort(tt.ports, tt.portName, tt.port)
+			if ok != tt.wantOK || ok && (p.Port != tt.want || scheme != tt.wantScheme) {
+				t.Errorf("pickPort() = %d, %q, %v, want %d, %q, %v", p.Port, scheme, ok, tt.want, tt.wantScheme, tt.wantOK)
+			}
+		})
+	}
+}
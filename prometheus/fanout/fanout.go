@@ -0,0 +1,299 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fanout runs a PromQL query against many Prometheus servers, one
+// per cluster, and merges the results. Each cluster is reached through its
+// own prometheus.Config, so a cluster may be behind the apiserver service
+// proxy, a port forward, a Rancher /k8s/clusters/<id>/ path or a tenant path
+// on Trickster.
+package fanout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	"github.com/tamalsaha/prometheus-demo/prometheus/query"
+	"golang.org/x/sync/errgroup"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// DefaultClusterLabel is added to every series with the cluster name.
+	DefaultClusterLabel = "cluster"
+	// DefaultConcurrency is the number of clusters queried at the same time.
+	DefaultConcurrency = 8
+)
+
+// Executor runs queries against a named set of clusters.
+type Executor struct {
+	clients map[string]*query.Client
+	names   []string
+
+	// Concurrency limits the number of clusters queried at the same time.
+	Concurrency int
+	// ClusterLabel is the label set to the cluster name. A label of the
+	// same name returned by Prometheus, like an external label, is kept as
+	// exported_<label>.
+	ClusterLabel string
+}
+
+// New returns an Executor for the clusters in configs, keyed by name.
+func New(configs map[string]*prometheus.Config) (*Executor, error) {
+	clients := make(map[string]*query.Client, len(configs))
+	for name, cfg := range configs {
+		if err := cfg.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid config for cluster %s: %w", name, err)
+		}
+		c, err := query.NewForConfig(cfg)
+		if err != nil {
+			_ = NewForClients(clients).Close()
+			return nil, fmt.Errorf("failed to create client for cluster %s: %w", name, err)
+		}
+		clients[name] = c
+	}
+	return NewForClients(clients), nil
+}
+
+// NewForClients returns an Executor for clients keyed by cluster name.
+func NewForClients(clients map[string]*query.Client) *Executor {
+	names := make([]string, 0, len(clients))
+	for name := range clients {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return &Executor{
+		clients:      clients,
+		names:        names,
+		Concurrency:  DefaultConcurrency,
+		ClusterLabel: DefaultClusterLabel,
+	}
+}
+
+// Close closes the clients of all clusters.
+func (e *Executor) Close() error {
+	var errs []error
+	for _, name := range e.names {
+		if err := e.clients[name].Close(); err != nil {
+			errs = append(errs, fmt.Errorf("failed to close client for cluster %s: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LoadFile reads the configs of a set of clusters from a YAML or JSON file
+// that maps cluster names to prometheus.Config, like
+//
+//	prod-eu:
+//	  address: https://rancher.example.com/k8s/clusters/c-m-abc/api/v1/namespaces/monitoring/services/http:prometheus:9090/proxy
+//	  bearer_token_file: /var/run/secrets/rancher/token
+//	staging:
+//	  address: https://trickster.example.com/1-be34d9c6-74eb-4bfe-bf22-f57c0065b713
+//	dev:
+//	  service: {scheme: http, namespace: monitoring, name: prometheus-operated, port: 9090}
+//	  transport: portforward
+//	  kube_context: kind-dev
+func LoadFile(filename string) (map[string]*prometheus.Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var configs map[string]*prometheus.Config
+	if err := yaml.UnmarshalStrict(data, &configs); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	for name, cfg := range configs {
+		if cfg == nil {
+			return nil, fmt.Errorf("cluster %s in %s has no config", name, filename)
+		}
+	}
+	return configs, nil
+}
+
+// Clusters returns the sorted cluster names.
+func (e *Executor) Clusters() []string {
+	return e.names
+}
+
+// ClusterStatus is the outcome of a query on one cluster.
+type ClusterStatus struct {
+	Cluster  string   `json:"cluster"`
+	Error    string   `json:"error,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	// Duration is the time the query took in seconds, like the durations
+	// of the Prometheus API.
+	Duration float64 `json:"duration"`
+
+	err error
+}
+
+// Err returns the error of the cluster, if any.
+func (s ClusterStatus) Err() error {
+	return s.err
+}
+
+// Response is the merged result of a query with the status of every
+// cluster.
+type Response struct {
+	Result   *query.Result   `json:"result"`
+	Clusters []ClusterStatus `json:"clusters"`
+}
+
+// Failed returns the status of the clusters that returned an error.
+func (r *Response) Failed() []ClusterStatus {
+	var out []ClusterStatus
+	for _, s := range r.Clusters {
+		if s.err != nil {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// Partial reports whether some, but not all, clusters failed.
+func (r *Response) Partial() bool {
+	n := len(r.Failed())
+	return n > 0 && n < len(r.Clusters)
+}
+
+// Query evaluates an instant query at ts on every cluster. The error is
+// only set if all clusters failed; failures of single clusters are reported
+// in Response.Clusters.
+func (e *Executor) Query(ctx context.Context, q string, ts time.Time, opts ...promv1.Option) (*Response, error) {
+	return e.run(ctx, func(ctx context.Context, c *query.Client) (*query.Result, error) {
+		return c.Query(ctx, q, ts, opts...)
+	})
+}
+
+// QueryRange evaluates a range query on every cluster, see Query.
+func (e *Executor) QueryRange(ctx context.Context, q string, r promv1.Range, opts ...promv1.Option) (*Response, error) {
+	return e.run(ctx, func(ctx context.Context, c *query.Client) (*query.Result, error) {
+		return c.QueryRange(ctx, q, r, opts...)
+	})
+}
+
+func (e *Executor) run(ctx context.Context, fn func(ctx context.Context, c *query.Client) (*query.Result, error)) (*Response, error) {
+	if len(e.names) == 0 {
+		return nil, errors.New("no clusters to query")
+	}
+	results := make([]*query.Result, len(e.names))
+	statuses := make([]ClusterStatus, len(e.names))
+
+	// errors are reported per cluster, so the group never fails and one
+	// cluster doesn't cancel the others
+	var g errgroup.Group
+	if e.Concurrency > 0 {
+		g.SetLimit(e.Concurrency)
+	}
+	for i, name := range e.names {
+		c := e.clients[name]
+		g.Go(func() error {
+			start := time.Now()
+			res, err := fn(ctx, c)
+			statuses[i] = ClusterStatus{Cluster: name, Duration: time.Since(start).Seconds()}
+			if err != nil {
+				statuses[i].err = err
+				statuses[i].Error = err.Error()
+				return nil
+			}
+			statuses[i].Warnings = res.Warnings
+			results[i] = res
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	resp := &Response{Clusters: statuses}
+	resp.Result = e.merge(results, statuses)
+	if failed := resp.Failed(); len(failed) == len(statuses) {
+		errs := make([]error, len(failed))
+		for i, s := range failed {
+			errs[i] = fmt.Errorf("cluster %s: %w", s.Cluster, s.err)
+		}
+		return resp, errors.Join(errs...)
+	}
+	return resp, nil
+}
+
+// merge combines the results of the clusters into one. Scalars become a
+// vector with one sample per cluster. Results of a different type than the
+// first one, and string results, can't be merged and are reported as an
+// error of their cluster.
+func (e *Executor) merge(results []*query.Result, statuses []ClusterStatus) *query.Result {
+	label := e.ClusterLabel
+	if label == "" {
+		label = DefaultClusterLabel
+	}
+
+	merged := &query.Result{Type: model.ValNone}
+	for i, res := range results {
+		if res == nil {
+			continue
+		}
+		cluster := statuses[i].Cluster
+		typ := res.Type
+		if typ == model.ValScalar {
+			typ = model.ValVector
+		}
+		var err error
+		switch {
+		case typ == model.ValString:
+			err = errors.New("string results can't be merged")
+		case typ == model.ValNone:
+			continue
+		case merged.Type == model.ValNone:
+			merged.Type = typ
+		case merged.Type != typ:
+			err = fmt.Errorf("result type %s doesn't match %s of the other clusters", res.Type, merged.Type)
+		}
+		if err != nil {
+			statuses[i].err = err
+			statuses[i].Error = err.Error()
+			continue
+		}
+
+		for _, s := range res.Samples {
+			s.Labels = withCluster(s.Labels, label, cluster)
+			merged.Samples = append(merged.Samples, s)
+		}
+		for _, s := range res.Series {
+			s.Labels = withCluster(s.Labels, label, cluster)
+			merged.Series = append(merged.Series, s)
+		}
+		for _, w := range res.Warnings {
+			merged.Warnings = append(merged.Warnings, cluster+": "+w)
+		}
+	}
+	return merged
+}
+
+func withCluster(labels map[string]string, label, cluster string) map[string]string {
+	out := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		out[k] = v
+	}
+	if v, ok := out[label]; ok {
+		out[model.ExportedLabelPrefix+label] = v
+	}
+	out[label] = cluster
+	return out
+}
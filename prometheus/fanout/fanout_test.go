@@ -0,0 +1,268 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fanout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	"github.com/tamalsaha/prometheus-demo/prometheus/query"
+)
+
+var ts = time.Unix(1700000000, 0)
+
+const (
+	// up of a node exporter, with the cluster external label of Thanos
+	vector = `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"node","cluster":"eu-1"},"value":[1700000000,"1"]}]}}`
+	scalar = `{"status":"success","data":{"resultType":"scalar","result":[1700000000,"2"]}}`
+	matrix = `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"node"},"values":[[1700000000,"1"]]}]}}`
+	warn   = `{"status":"success","warnings":["partial response"],"data":{"resultType":"vector","result":[{"metric":{"job":"api"},"value":[1700000000,"3"]}]}}`
+	failed = `{"status":"error","errorType":"execution","error":"query timed out"}`
+)
+
+// newExecutor returns an Executor for clusters that answer with the bodies,
+// with status 503 for the failed body.
+func newExecutor(t *testing.T, bodies map[string]string) *Executor {
+	t.Helper()
+	handlers := make(map[string]http.Handler, len(bodies))
+	for name, body := range bodies {
+		handlers[name] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			if body == failed {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			_, _ = w.Write([]byte(body))
+		})
+	}
+	return newExecutorForHandlers(t, handlers)
+}
+
+func newExecutorForHandlers(t *testing.T, handlers map[string]http.Handler) *Executor {
+	t.Helper()
+	clients := map[string]*query.Client{}
+	for name, h := range handlers {
+		srv := httptest.NewServer(h)
+		t.Cleanup(srv.Close)
+		c, err := query.NewForConfig(&prometheus.Config{Addr: srv.URL})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients[name] = c
+	}
+	e := NewForClients(clients)
+	t.Cleanup(func() { _ = e.Close() })
+	return e
+}
+
+// byCluster returns the values of the merged samples keyed by cluster and
+// the other labels.
+func byCluster(r *query.Result) map[string]float64 {
+	out := map[string]float64{}
+	for _, s := range r.Instant() {
+		var lbls []string
+		for k, v := range s.Labels {
+			if k != DefaultClusterLabel {
+				lbls = append(lbls, k+"="+v)
+			}
+		}
+		sort.Strings(lbls)
+		out[s.Labels[DefaultClusterLabel]+" "+strings.Join(lbls, ",")] = s.Value
+	}
+	return out
+}
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		name       string
+		bodies     map[string]string
+		wantType   model.ValueType
+		want       map[string]float64
+		wantFailed []string
+		wantErr    bool
+	}{
+		{
+			name:     "relabel",
+			bodies:   map[string]string{"prod": vector, "dev": warn},
+			wantType: model.ValVector,
+			want: map[string]float64{
+				// the cluster label of Prometheus is kept as exported_cluster
+				"prod __name__=up,exported_cluster=eu-1,job=node": 1,
+				"dev job=api": 3,
+			},
+		},
+		{
+			name:     "scalars",
+			bodies:   map[string]string{"prod": scalar, "dev": scalar},
+			wantType: model.ValVector,
+			want:     map[string]float64{"prod ": 2, "dev ": 2},
+		},
+		{
+			name:     "scalar and vector",
+			bodies:   map[string]string{"prod": vector, "dev": scalar},
+			wantType: model.ValVector,
+			want:     map[string]float64{"prod __name__=up,exported_cluster=eu-1,job=node": 1, "dev ": 2},
+		},
+		{
+			// the first cluster by name sets the type
+			name:       "type mismatch",
+			bodies:     map[string]string{"a": matrix, "b": vector},
+			wantType:   model.ValMatrix,
+			want:       map[string]float64{"a job=node": 1},
+			wantFailed: []string{"b"},
+		},
+		{
+			name:       "partial failure",
+			bodies:     map[string]string{"prod": vector, "dev": failed},
+			wantType:   model.ValVector,
+			want:       map[string]float64{"prod __name__=up,exported_cluster=eu-1,job=node": 1},
+			wantFailed: []string{"dev"},
+		},
+		{
+			name:       "all failed",
+			bodies:     map[string]string{"prod": failed, "dev": failed},
+			wantType:   model.ValNone,
+			want:       map[string]float64{},
+			wantFailed: []string{"dev", "prod"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newExecutor(t, tt.bodies)
+			resp, err := e.Query(context.Background(), "up", ts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Query() error = %v, want error %v", err, tt.wantErr)
+			}
+			if resp.Result.Type != tt.wantType {
+				t.Errorf("type = %s, want %s", resp.Result.Type, tt.wantType)
+			}
+			if got := byCluster(resp.Result); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("result = %v, want %v", got, tt.want)
+			}
+			var failed []string
+			for _, s := range resp.Failed() {
+				if s.Err() == nil || s.Error == "" {
+					t.Errorf("failed cluster %s has no error", s.Cluster)
+				}
+				failed = append(failed, s.Cluster)
+			}
+			if !reflect.DeepEqual(failed, tt.wantFailed) {
+				t.Errorf("failed clusters = %v, want %v", failed, tt.wantFailed)
+			}
+			if partial := len(tt.wantFailed) > 0 && !tt.wantErr; resp.Partial() != partial {
+				t.Errorf("Partial() = %v, want %v", resp.Partial(), partial)
+			}
+		})
+	}
+}
+
+func TestQueryWarnings(t *testing.T) {
+	e := newExecutor(t, map[string]string{"prod": vector, "dev": warn})
+	resp, err := e.Query(context.Background(), "up", ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dev: partial response"}; !reflect.DeepEqual(resp.Result.Warnings, want) {
+		t.Errorf("warnings = %q, want %q", resp.Result.Warnings, want)
+	}
+	if s := resp.Clusters[0]; s.Cluster != "dev" || len(s.Warnings) != 1 {
+		t.Errorf("status of dev = %+v, want its warning", s)
+	}
+}
+
+func TestQueryRange(t *testing.T) {
+	e := newExecutor(t, map[string]string{"prod": matrix, "dev": matrix})
+	e.ClusterLabel = "k8s_cluster"
+	resp, err := e.QueryRange(context.Background(), "up", promv1.Range{Start: ts, End: ts.Add(time.Minute), Step: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Result.Series) != 2 || resp.Result.Series[0].Labels["k8s_cluster"] != "dev" || resp.Result.Series[1].Labels["k8s_cluster"] != "prod" {
+		t.Errorf("series = %+v, want one per cluster with the k8s_cluster label", resp.Result.Series)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	var inflight, peak atomic.Int32
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(scalar))
+	})
+	handlers := map[string]http.Handler{}
+	for i := range 6 {
+		handlers[fmt.Sprintf("cluster-%d", i)] = slow
+	}
+	e := newExecutorForHandlers(t, handlers)
+	e.Concurrency = 2
+
+	resp, err := e.Query(context.Background(), "1", ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Result.Samples) != 6 {
+		t.Errorf("got %d samples, want one per cluster", len(resp.Result.Samples))
+	}
+	if p := peak.Load(); p != 2 {
+		t.Errorf("%d clusters were queried at the same time, want 2", p)
+	}
+	for _, s := range resp.Clusters {
+		if s.Duration < 0.02 {
+			t.Errorf("duration of %s = %vs, want at least 0.02s", s.Cluster, s.Duration)
+		}
+	}
+}
+
+func TestResponseJSON(t *testing.T) {
+	resp := &Response{
+		Result:   &query.Result{Type: model.ValVector},
+		Clusters: []ClusterStatus{{Cluster: "prod", Duration: 1.5}},
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `"clusters":[{"cluster":"prod","duration":1.5}]`; !strings.Contains(string(b), want) {
+		t.Errorf("JSON = %s, want the duration in seconds %s", b, want)
+	}
+}
+
+func TestNoClusters(t *testing.T) {
+	if _, err := NewForClients(nil).Query(context.Background(), "up", ts); err == nil {
+		t.Error("Query() without clusters succeeded")
+	}
+}
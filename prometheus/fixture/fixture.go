@@ -0,0 +1,245 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package fixture records HTTP traffic to a JSONL file and replays it, so
+// that code talking to Prometheus or the Kubernetes apiserver can run
+// without a live cluster.
+//
+// Each line of a fixture file is one Entry. Credentials in headers and
+// query parameters are redacted before they are written.
+package fixture
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Redacted replaces the value of secret headers and parameters.
+const Redacted = "REDACTED"
+
+// Entry is a recorded request and its response.
+type Entry struct {
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request is the normalized form of a request, see Normalize.
+type Request struct {
+	Method string      `json:"method"`
+	Path   string      `json:"path"`
+	Params url.Values  `json:"params,omitempty"`
+	Header http.Header `json:"header,omitempty"`
+}
+
+// Response is a recorded response. Body holds text bodies as is and other
+// bodies in BodyBase64.
+type Response struct {
+	StatusCode int         `json:"status"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 []byte      `json:"bodyBase64,omitempty"`
+}
+
+// secretHeaders are always redacted.
+var secretHeaders = []string{
+	"Authorization",
+	"Proxy-Authorization",
+	"Cookie",
+	"Set-Cookie",
+	"X-Amz-Security-Token",
+	"X-Api-Key",
+}
+
+// secretParams are redacted from the query and form parameters.
+var secretParams = []string{
+	"access_token",
+	"api_key",
+	"client_secret",
+	"password",
+	"secret",
+	"token",
+}
+
+// Normalize returns the parts of req that a fixture is matched on. The
+// path starts at the last /api/v1/ if it has a prefix, like an apiserver
+// service proxy or tenant path, so fixtures recorded through one route
+// replay through another.
+// URL query and form parameters are merged. A form body is read and put
+// back, so req can still be sent.
+func Normalize(req *http.Request) (Request, error) {
+	params := url.Values{}
+	for k, vs := range req.URL.Query() {
+		params[k] = append(params[k], vs...)
+	}
+	if req.Body != nil && isForm(req.Header.Get("Content-Type")) {
+		body, err := io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return Request{}, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return Request{}, err
+		}
+		for k, vs := range form {
+			params[k] = append(params[k], vs...)
+		}
+	}
+	for _, vs := range params {
+		sort.Strings(vs)
+	}
+	if len(params) == 0 {
+		params = nil
+	}
+
+	// a GET and a POST of the same query are the same request to the
+	// Prometheus API
+	method := req.Method
+	if method == http.MethodPost && isForm(req.Header.Get("Content-Type")) {
+		method = http.MethodGet
+	}
+	return Request{
+		Method: method,
+		Path:   normalizePath(req.URL.Path),
+		Params: params,
+	}, nil
+}
+
+func isForm(contentType string) bool {
+	mt, _, _ := mime.ParseMediaType(contentType)
+	return mt == "application/x-www-form-urlencoded"
+}
+
+// normalizePath strips the prefix of a Prometheus API path. The last /api/v1/
+// is used since a service proxy path starts with the /api/v1/ of the
+// apiserver, and no Prometheus API path has another one after its own.
+func normalizePath(p string) string {
+	if i := strings.LastIndex(p, "/api/v1/"); i > 0 {
+		return p[i:]
+	}
+	return p
+}
+
+// RedactHeader returns a copy of h with secret headers and the given extra
+// headers redacted.
+func RedactHeader(h http.Header, extra ...string) http.Header {
+	if len(h) == 0 {
+		return nil
+	}
+	out := h.Clone()
+	for k, vs := range out {
+		// client_golang sets headers to nil to keep net/http from adding
+		// them, they carry no value
+		if vs == nil {
+			delete(out, k)
+		}
+	}
+	for _, k := range append(secretHeaders, extra...) {
+		if _, ok := out[http.CanonicalHeaderKey(k)]; ok {
+			out.Set(k, Redacted)
+		}
+	}
+	return out
+}
+
+// RedactParams returns a copy of params with secret parameters redacted.
+func RedactParams(params url.Values) url.Values {
+	if params == nil {
+		return nil
+	}
+	out := url.Values{}
+	for k, vs := range params {
+		out[k] = append([]string(nil), vs...)
+		for _, s := range secretParams {
+			if strings.EqualFold(k, s) {
+				for i := range out[k] {
+					out[k][i] = Redacted
+				}
+			}
+		}
+	}
+	return out
+}
+
+// key identifies the entries that a request matches.
+func (r Request) key(ignore map[string]bool) string {
+	names := make([]string, 0, len(r.Params))
+	for k := range r.Params {
+		if !ignore[k] {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	var sb strings.Builder
+	sb.WriteString(r.Method + " " + r.Path)
+	for _, k := range names {
+		for _, v := range r.Params[k] {
+			sb.WriteString("\n" + k + "=" + v)
+		}
+	}
+	return sb.String()
+}
+
+func newResponse(resp *http.Response, body []byte, redactHeaders []string) Response {
+	out := Response{
+		StatusCode: resp.StatusCode,
+		Header:     RedactHeader(resp.Header, redactHeaders...),
+	}
+	if utf8.Valid(body) {
+		out.Body = string(body)
+	} else {
+		out.BodyBase64 = body
+	}
+	return out
+}
+
+func (r Response) toHTTP(req *http.Request) *http.Response {
+	body := []byte(r.Body)
+	if r.BodyBase64 != nil {
+		body = r.BodyBase64
+	}
+	header := r.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        http.StatusText(r.StatusCode),
+		StatusCode:    r.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+func marshalEntry(e Entry) ([]byte, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,293 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fixture
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	query := url.Values{"query": {"up"}, "time": {"1767229200"}}
+	want := Request{Method: http.MethodGet, Path: "/api/v1/query", Params: query}
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want Request
+	}{
+		{
+			name: "get",
+			req:  get("http://prometheus:9090/api/v1/query?" + query.Encode()),
+			want: want,
+		},
+		{
+			name: "post form",
+			req:  postForm("http://prometheus:9090/api/v1/query", query),
+			want: want,
+		},
+		{
+			name: "service proxy",
+			req:  postForm("https://kube:6443/api/v1/namespaces/monitoring/services/http:prometheus:9090/proxy/api/v1/query", query),
+			want: want,
+		},
+		{
+			name: "tenant path",
+			req:  get("https://trickster:8480/1-be34d9c6-74eb-4bfe-bf22-f57c0065b713/api/v1/query?" + query.Encode()),
+			want: want,
+		},
+		{
+			name: "query and form merged",
+			req:  postForm("http://prometheus:9090/api/v1/query?time=1767229200", url.Values{"query": {"up"}}),
+			want: want,
+		},
+		{
+			name: "repeated params sorted",
+			req:  get("http://prometheus:9090/api/v1/series?match[]=up&match[]=down"),
+			want: Request{Method: http.MethodGet, Path: "/api/v1/series", Params: url.Values{"match[]": {"down", "up"}}},
+		},
+		{
+			name: "apiserver path",
+			req:  get("https://kube:6443/api/v1/namespaces/monitoring/pods"),
+			want: Request{Method: http.MethodGet, Path: "/api/v1/namespaces/monitoring/pods"},
+		},
+		{
+			name: "label named api",
+			req:  get("https://kube:6443/api/v1/namespaces/monitoring/services/prometheus:9090/proxy/api/v1/label/api/values"),
+			want: Request{Method: http.MethodGet, Path: "/api/v1/label/api/values"},
+		},
+		{
+			name: "no api path",
+			req:  get("http://prometheus:9090/federate"),
+			want: Request{Method: http.MethodGet, Path: "/federate"},
+		},
+		{
+			name: "post without form",
+			req:  post("http://prometheus:9090/api/v1/admin/tsdb/snapshot", "application/json", "{}"),
+			want: Request{Method: http.MethodPost, Path: "/api/v1/admin/tsdb/snapshot"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Normalize(tt.req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Normalize() = %+v, want %+v", got, tt.want)
+			}
+			if tt.req.Body != nil {
+				// the body is put back for sending
+				body, _ := io.ReadAll(tt.req.Body)
+				if tt.req.ContentLength > 0 && int64(len(body)) != tt.req.ContentLength {
+					t.Errorf("body has %d bytes after Normalize, want %d", len(body), tt.req.ContentLength)
+				}
+			}
+		})
+	}
+}
+
+func TestRecorderRedacts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "cookie-secret"})
+		w.Header().Set("X-Api-Key", "response-secret")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = io.WriteString(w, `{"status":"success","data":[]}`)
+	}))
+	defer srv.Close()
+
+	filename := filepath.Join(t.TempDir(), "fixture.jsonl")
+	rec := NewRecorder(filename, srv.Client().Transport)
+	rec.RedactHeaders = []string{"X-Custom-Auth"}
+
+	req := postForm(srv.URL+"/api/v1/labels?token=query-secret", url.Values{
+		"match[]":  {"up"},
+		"password": {"form-secret"},
+	})
+	req.Header.Set("Authorization", "Bearer bearer-secret")
+	req.Header.Set("Cookie", "session=cookie-secret")
+	req.Header.Set("X-Custom-Auth", "custom-secret")
+	req.Header.Set("X-Scope-OrgID", "tenant-1")
+	resp, err := rec.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != `{"status":"success","data":[]}` {
+		t.Errorf("caller got body %s", body)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"query-secret", "form-secret", "bearer-secret", "cookie-secret", "custom-secret", "response-secret"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("fixture contains %s: %s", secret, data)
+		}
+	}
+	if !strings.Contains(string(data), "tenant-1") {
+		t.Errorf("fixture doesn't keep the X-Scope-OrgID header: %s", data)
+	}
+	if info, err := os.Stat(filename); err != nil {
+		t.Fatal(err)
+	} else if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("fixture has mode %o, want 600", perm)
+	}
+
+	// the redacted request still replays
+	r, err := LoadReplayer(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = get("https://kube:6443/api/v1/namespaces/monitoring/services/prometheus:9090/proxy/api/v1/labels?match[]=up&password=other&token=other")
+	if _, err := r.RoundTrip(req); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReplayer(t *testing.T) {
+	entry := func(params url.Values, body string) Entry {
+		return Entry{
+			Request:  Request{Method: http.MethodGet, Path: "/api/v1/query", Params: params},
+			Response: Response{StatusCode: http.StatusOK, Body: body},
+		}
+	}
+	r := NewReplayer([]Entry{
+		entry(url.Values{"query": {"up"}, "time": {"100"}}, "up at 100"),
+		entry(url.Values{"query": {"up"}, "time": {"200"}}, "up at 200, first"),
+		entry(url.Values{"query": {"up"}, "time": {"200"}}, "up at 200, second"),
+		entry(url.Values{"query": {"down"}, "time": {"100"}}, "down at 100"),
+	}, DefaultLooseParams...)
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want string
+	}{
+		{
+			name: "exact",
+			req:  get("http://prometheus/api/v1/query?query=up&time=100"),
+			want: "up at 100",
+		},
+		{
+			name: "exact post",
+			req:  postForm("http://prometheus/api/v1/query", url.Values{"query": {"up"}, "time": {"200"}}),
+			want: "up at 200, first",
+		},
+		{
+			name: "in recorded order",
+			req:  get("http://prometheus/api/v1/query?query=up&time=200"),
+			want: "up at 200, second",
+		},
+		{
+			name: "last one repeated",
+			req:  get("http://prometheus/api/v1/query?query=up&time=200"),
+			want: "up at 200, second",
+		},
+		{
+			name: "loose time",
+			req:  get("http://prometheus/api/v1/query?query=down&time=300"),
+			want: "down at 100",
+		},
+		{
+			name: "loose without time",
+			req:  get("http://prometheus/api/v1/query?query=down"),
+			want: "down at 100",
+		},
+		{
+			name: "loose from the first recording",
+			req:  get("http://prometheus/api/v1/query?query=up&time=300"),
+			want: "up at 100",
+		},
+		{
+			name: "loose in recorded order",
+			req:  get("http://prometheus/api/v1/query?query=up&time=400"),
+			want: "up at 200, first",
+		},
+		{
+			name: "no match",
+			req:  get("http://prometheus/api/v1/query?query=absent&time=100"),
+		},
+		{
+			name: "loose only ignores time params",
+			req:  get("http://prometheus/api/v1/query?query=up&time=100&timeout=5s"),
+		},
+		{
+			name: "other path",
+			req:  get("http://prometheus/api/v1/query_range?query=up&time=100"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := r.RoundTrip(tt.req)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("RoundTrip() = %d, want error", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if string(body) != tt.want {
+				t.Errorf("RoundTrip() = %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestBinaryBody(t *testing.T) {
+	body := []byte{0xff, 0x00, 0xfe}
+	resp := newResponse(&http.Response{StatusCode: http.StatusOK}, body, nil)
+	if resp.Body != "" || !reflect.DeepEqual(resp.BodyBase64, body) {
+		t.Fatalf("newResponse() = %+v, want base64 body", resp)
+	}
+	got, _ := io.ReadAll(resp.toHTTP(nil).Body)
+	if !reflect.DeepEqual(got, body) {
+		t.Errorf("replayed body %v, want %v", got, body)
+	}
+}
+
+func get(u string) *http.Request {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		panic(err)
+	}
+	return req
+}
+
+func post(u, contentType, body string) *http.Request {
+	req, err := http.NewRequest(http.MethodPost, u, strings.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	return req
+}
+
+func postForm(u string, form url.Values) *http.Request {
+	return post(u, "application/x-www-form-urlencoded", form.Encode())
+}
@@ -0,0 +1,93 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fixture
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// Recorder is a round tripper that appends every request it sends and the
+// response to a fixture file.
+type Recorder struct {
+	filename string
+	next     http.RoundTripper
+	// RedactHeaders are redacted in addition to the standard credential
+	// headers, like a custom API key header.
+	RedactHeaders []string
+
+	mu sync.Mutex
+}
+
+// NewRecorder returns a Recorder that sends requests with next and appends
+// them to filename.
+func NewRecorder(filename string, next http.RoundTripper) *Recorder {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &Recorder{filename: filename, next: next}
+}
+
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	nr, err := Normalize(req)
+	if err != nil {
+		return nil, err
+	}
+	nr.Params = RedactParams(nr.Params)
+	nr.Header = RedactHeader(req.Header, r.RedactHeaders...)
+
+	resp, err := r.next.RoundTrip(req)
+	if err != nil {
+		// failed requests aren't recorded, there is nothing to replay
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	if err := r.write(Entry{Request: nr, Response: newResponse(resp, body, r.RedactHeaders)}); err != nil {
+		// recording is best effort, the caller still gets the response
+		klog.Errorf("failed to record %s %s to %s: %v", nr.Method, nr.Path, r.filename, err)
+	}
+	return resp, nil
+}
+
+func (r *Recorder) write(e Entry) error {
+	line, err := marshalEntry(e)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, err := os.OpenFile(r.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,125 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fixture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// DefaultLooseParams are the parameters that are ignored when no fixture
+// matches a request exactly. They are timestamps that callers usually take
+// from time.Now, so they change between a recording and its replay.
+var DefaultLooseParams = []string{"time", "start", "end"}
+
+// Replayer is a round tripper that answers requests from fixtures without
+// sending them. A request is matched on its normalized method, path and
+// parameters first, then without the loose parameters. Fixtures that match the
+// same request are served in recorded order and the last one is repeated,
+// so a replay is deterministic.
+type Replayer struct {
+	exact  map[string][]Entry
+	loose  map[string][]Entry
+	ignore map[string]bool
+
+	mu   sync.Mutex
+	next map[string]int
+}
+
+// LoadReplayer reads the fixtures in filename.
+func LoadReplayer(filename string) (*Replayer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, len(data)+1)
+	for line := 1; s.Scan(); line++ {
+		if len(bytes.TrimSpace(s.Bytes())) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("invalid fixture at %s:%d: %w", filename, line, err)
+		}
+		entries = append(entries, e)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return NewReplayer(entries, DefaultLooseParams...), nil
+}
+
+// NewReplayer returns a Replayer for entries. looseParams are ignored when
+// no entry matches a request exactly.
+func NewReplayer(entries []Entry, looseParams ...string) *Replayer {
+	r := &Replayer{
+		exact:  map[string][]Entry{},
+		loose:  map[string][]Entry{},
+		ignore: map[string]bool{},
+		next:   map[string]int{},
+	}
+	for _, p := range looseParams {
+		r.ignore[p] = true
+	}
+	for _, e := range entries {
+		k := e.Request.key(nil)
+		r.exact[k] = append(r.exact[k], e)
+		k = e.Request.key(r.ignore)
+		r.loose[k] = append(r.loose[k], e)
+	}
+	return r
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	nr, err := Normalize(req)
+	if err != nil {
+		return nil, err
+	}
+	nr.Params = RedactParams(nr.Params)
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.take("exact\n", r.exact, nr.key(nil)); ok {
+		return e.Response.toHTTP(req), nil
+	}
+	if e, ok := r.take("loose\n", r.loose, nr.key(r.ignore)); ok {
+		return e.Response.toHTTP(req), nil
+	}
+	return nil, fmt.Errorf("no fixture for %s %s %s", nr.Method, nr.Path, nr.Params.Encode())
+}
+
+func (r *Replayer) take(kind string, index map[string][]Entry, key string) (Entry, bool) {
+	entries := index[key]
+	if len(entries) == 0 {
+		return Entry{}, false
+	}
+	i := r.next[kind+key]
+	if i < len(entries)-1 {
+		r.next[kind+key] = i + 1
+	}
+	return entries[i], true
+}
@@ -0,0 +1,182 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type flagValue struct {
+	name  string
+	value string
+}
+
+// recordingValue remembers the raw values set on the command line, so that
+// Load can apply them again on top of the file and environment values.
+type recordingValue struct {
+	flag.Value
+	name string
+	cfg  *Config
+}
+
+func (v *recordingValue) Set(s string) error {
+	if err := v.Value.Set(s); err != nil {
+		return err
+	}
+	v.cfg.setFlags = append(v.cfg.setFlags, flagValue{name: v.name, value: s})
+	return nil
+}
+
+// recordingBoolValue is a recordingValue for boolean flags, which may be set
+// without a value. pflag treats any value with an IsBoolFlag method as a
+// boolean, so it is only implemented by this type.
+type recordingBoolValue struct {
+	*recordingValue
+}
+
+func (v recordingBoolValue) IsBoolFlag() bool {
+	return true
+}
+
+func newRecordingValue(p *Config, f *flag.Flag) flag.Value {
+	rv := &recordingValue{Value: f.Value, name: f.Name, cfg: p}
+	if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && bf.IsBoolFlag() {
+		return recordingBoolValue{rv}
+	}
+	return rv
+}
+
+// Type lets pflag show the type of the wrapped value instead of the name of
+// the wrapper.
+func (v *recordingValue) Type() string {
+	if tv, ok := v.Value.(interface{ Type() string }); ok {
+		return tv.Type()
+	}
+	t := reflect.TypeOf(v.Value)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return strings.TrimSuffix(t.Name(), "Value")
+}
+
+// listValue is implemented by the flag values that collect several values.
+type listValue interface {
+	flag.Value
+	// reset clears the collected values.
+	reset()
+}
+
+// stringSliceValue is a flag.Value for comma separated lists.
+type stringSliceValue struct {
+	p *[]string
+}
+
+func newStringSliceValue(p *[]string) *stringSliceValue {
+	return &stringSliceValue{p: p}
+}
+
+func (v *stringSliceValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return strings.Join(*v.p, ",")
+}
+
+func (v *stringSliceValue) reset() {
+	*v.p = nil
+}
+
+func (v *stringSliceValue) Set(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*v.p = append(*v.p, item)
+		}
+	}
+	return nil
+}
+
+// stringMapValue is a flag.Value for comma separated key=value pairs.
+type stringMapValue struct {
+	p *map[string]string
+}
+
+func newStringMapValue(p *map[string]string) *stringMapValue {
+	return &stringMapValue{p: p}
+}
+
+func (v *stringMapValue) String() string {
+	if v.p == nil || len(*v.p) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(*v.p))
+	for k, val := range *v.p {
+		pairs = append(pairs, k+"="+val)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v *stringMapValue) reset() {
+	*v.p = nil
+}
+
+func (v *stringMapValue) Set(s string) error {
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, val, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("%q is not a key=value pair", pair)
+		}
+		if *v.p == nil {
+			*v.p = map[string]string{}
+		}
+		(*v.p)[k] = val
+	}
+	return nil
+}
+
+// serviceValue is a flag.Value for a ServiceReference in
+// [scheme:]namespace/name:port form.
+type serviceValue struct {
+	p **ServiceReference
+}
+
+func newServiceValue(p **ServiceReference) *serviceValue {
+	return &serviceValue{p: p}
+}
+
+func (v *serviceValue) String() string {
+	if v.p == nil || *v.p == nil {
+		return ""
+	}
+	return (*v.p).String()
+}
+
+func (v *serviceValue) Set(s string) error {
+	ref, err := ParseServiceReference(s)
+	if err != nil {
+		return err
+	}
+	*v.p = &ref
+	return nil
+}
@@ -0,0 +1,107 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	prom_config "github.com/prometheus/common/config"
+)
+
+const (
+	// TenantHeaderMimir is the tenant header used by Grafana Mimir and Cortex.
+	TenantHeaderMimir = "X-Scope-OrgID"
+	// TenantHeaderThanos is the default tenant header used by Thanos.
+	TenantHeaderThanos = "THANOS-TENANT"
+)
+
+const redacted = "<secret>"
+
+// Headers are extra HTTP headers sent with every request. Header values are
+// treated as secrets and are redacted by String, so they don't show up in
+// logs. They are marshalled as is, so a saved config can be loaded again.
+type Headers map[string]string
+
+func (h Headers) String() string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+redacted)
+	}
+	return "map[" + strings.Join(pairs, " ") + "]"
+}
+
+// toHTTPHeaders returns the headers, including the tenant header, in the
+// form used by prom_config.HTTPClientConfig.
+func (p *Config) toHTTPHeaders() *prom_config.Headers {
+	if len(p.Headers) == 0 && p.TenantID == "" {
+		return nil
+	}
+	out := &prom_config.Headers{
+		Headers: make(map[string]prom_config.Header, len(p.Headers)+1),
+	}
+	for k, v := range p.Headers {
+		out.Headers[k] = prom_config.Header{Secrets: []prom_config.Secret{prom_config.Secret(v)}}
+	}
+	if p.TenantID != "" {
+		name := p.TenantHeader
+		if name == "" {
+			name = TenantHeaderMimir
+		}
+		out.Headers[name] = prom_config.Header{Values: []string{p.TenantID}}
+	}
+	return out
+}
+
+// headerValue is a flag.Value that adds one key=value header per use.
+type headerValue struct {
+	p *Headers
+}
+
+func newHeaderValue(p *Headers) *headerValue {
+	return &headerValue{p: p}
+}
+
+func (v *headerValue) String() string {
+	if v.p == nil || len(*v.p) == 0 {
+		return ""
+	}
+	return v.p.String()
+}
+
+func (v *headerValue) reset() {
+	*v.p = nil
+}
+
+func (v *headerValue) Set(s string) error {
+	k, val, ok := strings.Cut(s, "=")
+	k = strings.TrimSpace(k)
+	if !ok || k == "" {
+		return fmt.Errorf("header %q must be in key=value form", s)
+	}
+	if *v.p == nil {
+		*v.p = Headers{}
+	}
+	(*v.p)[k] = val
+	return nil
+}
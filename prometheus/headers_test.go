@@ -0,0 +1,125 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+)
+
+func TestHeadersRoundTrip(t *testing.T) {
+	in := Config{Addr: "http://localhost:9090", Headers: Headers{"X-Api-Key": "api-key-value", "X-Team": "platform"}}
+
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Config
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out.Headers, in.Headers) {
+		t.Errorf("JSON round trip = %v, want %v", out.Headers, in.Headers)
+	}
+
+	data, err = yaml.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = Config{}
+	if err := yaml.UnmarshalStrict(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(out.Headers, in.Headers) {
+		t.Errorf("YAML round trip = %v, want %v", out.Headers, in.Headers)
+	}
+}
+
+func TestHeadersString(t *testing.T) {
+	h := Headers{"X-Team": "platform", "X-Api-Key": "api-key-value"}
+	for _, s := range []string{h.String(), fmt.Sprintf("%v", h), fmt.Sprintf("%+v", Config{Headers: h})} {
+		if strings.Contains(s, "api-key-value") || strings.Contains(s, "platform") {
+			t.Errorf("%s shows header values", s)
+		}
+	}
+	if got, want := h.String(), "map[X-Api-Key=<secret> X-Team=<secret>]"; got != want {
+		t.Errorf("String() = %s, want %s", got, want)
+	}
+}
+
+func TestHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		want http.Header
+	}{
+		{
+			name: "headers",
+			cfg:  Config{Headers: Headers{"X-Api-Key": "api-key-value"}},
+			want: http.Header{"X-Api-Key": {"api-key-value"}},
+		},
+		{
+			name: "default tenant header",
+			cfg:  Config{TenantID: "team-a"},
+			want: http.Header{"X-Scope-Orgid": {"team-a"}},
+		},
+		{
+			name: "tenant header",
+			cfg:  Config{Headers: Headers{"X-Team": "platform"}, TenantID: "team-a", TenantHeader: TenantHeaderThanos},
+			want: http.Header{"X-Team": {"platform"}, "Thanos-Tenant": {"team-a"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got http.Header
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Clone()
+			}))
+			defer srv.Close()
+
+			cfg := tt.cfg
+			cfg.Addr = srv.URL
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			pc, err := cfg.NewPrometheusClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/status/buildinfo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := pc.Do(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.want {
+				if !reflect.DeepEqual(got.Values(k), v) {
+					t.Errorf("%s = %q, want %q", k, got.Values(k), v)
+				}
+			}
+		})
+	}
+}
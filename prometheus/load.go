@@ -0,0 +1,113 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+func (p *Config) flagPrefix() string {
+	if p.prefix == "" {
+		return DefaultFlagPrefix
+	}
+	return p.prefix
+}
+
+// EnvName returns the environment variable read by Load for a flag, e.g.
+// prometheus.bearer-token is read from PROMETHEUS_BEARER_TOKEN.
+func EnvName(flagName string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flagName))
+}
+
+// LoadFile reads a Config from a YAML or JSON file.
+func LoadFile(filename string) (*Config, error) {
+	var cfg Config
+	if err := decodeFile(filename, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// decodeFile sets the fields of cfg that are present in the file.
+func decodeFile(filename string, cfg *Config) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	return nil
+}
+
+// Load completes the config from ConfigFile and the environment. Flags set on
+// the command line take precedence over environment variables, which take
+// precedence over the file, which takes precedence over the values already
+// set on the config. List values are replaced, not appended to, by a source
+// of higher precedence.
+func (p *Config) Load() error {
+	prefix := p.flagPrefix()
+
+	if p.ConfigFile == "" {
+		p.ConfigFile = os.Getenv(EnvName(prefix + ".config-file"))
+	}
+	if p.ConfigFile != "" {
+		if err := decodeFile(p.ConfigFile, p); err != nil {
+			return err
+		}
+	}
+
+	fs := flag.NewFlagSet(prefix, flag.ContinueOnError)
+	p.bindGoFlags(fs, prefix)
+
+	var err error
+	fromEnv := map[string]bool{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(EnvName(f.Name)); ok && err == nil {
+			if e := setFlag(fs, f.Name, v, fromEnv); e != nil {
+				err = fmt.Errorf("invalid value for %s: %w", EnvName(f.Name), e)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fromFlags := map[string]bool{}
+	for _, f := range p.setFlags {
+		if err := setFlag(fs, f.name, f.value, fromFlags); err != nil {
+			return fmt.Errorf("invalid value for flag --%s: %w", f.name, err)
+		}
+	}
+	return nil
+}
+
+// setFlag sets a flag of fs. The first time a source sets a list flag, the
+// values of the sources it takes precedence over are cleared.
+func setFlag(fs *flag.FlagSet, name, value string, seen map[string]bool) error {
+	if !seen[name] {
+		seen[name] = true
+		if lv, ok := fs.Lookup(name).Value.(listValue); ok {
+			lv.reset()
+		}
+	}
+	return fs.Set(name, value)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"golang.org/x/oauth2"
+)
+
+const loadTestFile = `
+address: http://file:9090
+tenant_id: file-tenant
+oauth2:
+  client_id: id
+  token_url: http://token
+  scopes: [file-a, file-b]
+headers:
+  X-File: "1"
+`
+
+func TestLoad(t *testing.T) {
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "code"})
+
+	tests := []struct {
+		name  string
+		cfg   Config
+		env   map[string]string
+		args  []string
+		check func(t *testing.T, cfg *Config)
+	}{
+		{
+			name: "file",
+			cfg:  Config{TokenSource: ts, ProxyURL: "http://proxy"},
+			check: func(t *testing.T, cfg *Config) {
+				want(t, "Addr", cfg.Addr, "http://file:9090")
+				want(t, "Scopes", cfg.OAuth2.Scopes, []string{"file-a", "file-b"})
+				want(t, "Headers", cfg.Headers, Headers{"X-File": "1"})
+				want(t, "ProxyURL", cfg.ProxyURL, "http://proxy")
+				want(t, "TokenSource", cfg.TokenSource, ts)
+			},
+		},
+		{
+			name: "env over file",
+			env: map[string]string{
+				"PROMETHEUS_ADDRESS":       "http://env:9090",
+				"PROMETHEUS_OAUTH2_SCOPES": "env-a,env-b",
+				"PROMETHEUS_HEADER":        "X-Env=2",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				want(t, "Addr", cfg.Addr, "http://env:9090")
+				want(t, "TenantID", cfg.TenantID, "file-tenant")
+				want(t, "Scopes", cfg.OAuth2.Scopes, []string{"env-a", "env-b"})
+				want(t, "Headers", cfg.Headers, Headers{"X-Env": "2"})
+			},
+		},
+		{
+			name: "flags over env",
+			env: map[string]string{
+				"PROMETHEUS_ADDRESS":       "http://env:9090",
+				"PROMETHEUS_OAUTH2_SCOPES": "env-a",
+				"PROMETHEUS_HEADER":        "X-Env=2",
+			},
+			args: []string{
+				"--prometheus.address=http://flag:9090",
+				"--prometheus.oauth2-scopes=flag-a",
+				"--prometheus.oauth2-scopes=flag-b",
+				"--prometheus.header=X-Flag=3",
+				"--prometheus.header=X-Other=4",
+				"--prometheus.insecure-skip-verify",
+			},
+			check: func(t *testing.T, cfg *Config) {
+				want(t, "Addr", cfg.Addr, "http://flag:9090")
+				want(t, "Scopes", cfg.OAuth2.Scopes, []string{"flag-a", "flag-b"})
+				want(t, "Headers", cfg.Headers, Headers{"X-Flag": "3", "X-Other": "4"})
+				want(t, "InsecureSkipVerify", cfg.TLSConfig.InsecureSkipVerify, true)
+				want(t, "TenantID", cfg.TenantID, "file-tenant")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "prometheus.yaml")
+			if err := os.WriteFile(filename, []byte(loadTestFile), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			t.Setenv("PROMETHEUS_CONFIG_FILE", filename)
+
+			cfg := tt.cfg
+			fs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+			cfg.AddFlags(fs)
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			if err := cfg.Load(); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, &cfg)
+		})
+	}
+}
+
+func want(t *testing.T, field string, got, want interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %v, want %v", field, got, want)
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+)
+
+type clientMetrics struct {
+	requests *prom.CounterVec
+	duration *prom.HistogramVec
+	retries  *prom.CounterVec
+}
+
+// registerClientMetrics registers the client metrics with reg. Clients
+// sharing a Registerer share the same collectors.
+func registerClientMetrics(reg prom.Registerer) (*clientMetrics, error) {
+	m := &clientMetrics{
+		requests: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: "prometheus_client",
+			Name:      "requests_total",
+			Help:      "Number of requests sent to the Prometheus API, by endpoint and status code.",
+		}, []string{"endpoint", "code"}),
+		duration: prom.NewHistogramVec(prom.HistogramOpts{
+			Namespace: "prometheus_client",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of requests sent to the Prometheus API, by endpoint and status code.",
+			Buckets:   prom.DefBuckets,
+		}, []string{"endpoint", "code"}),
+		retries: prom.NewCounterVec(prom.CounterOpts{
+			Namespace: "prometheus_client",
+			Name:      "retries_total",
+			Help:      "Number of retried requests to the Prometheus API, by endpoint.",
+		}, []string{"endpoint"}),
+	}
+
+	var err error
+	if m.requests, err = register(reg, m.requests); err != nil {
+		return nil, err
+	}
+	if m.duration, err = register(reg, m.duration); err != nil {
+		return nil, err
+	}
+	if m.retries, err = register(reg, m.retries); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func register[T prom.Collector](reg prom.Registerer, c T) (T, error) {
+	if err := reg.Register(c); err != nil {
+		var are prom.AlreadyRegisteredError
+		if errors.As(err, &are) {
+			if existing, ok := are.ExistingCollector.(T); ok {
+				return existing, nil
+			}
+		}
+		return c, err
+	}
+	return c, nil
+}
+
+func (m *clientMetrics) instrument(next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		start := time.Now()
+		resp, err := next.RoundTrip(req)
+
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		ep := endpointLabel(req)
+		m.requests.WithLabelValues(ep, code).Inc()
+		m.duration.WithLabelValues(ep, code).Observe(time.Since(start).Seconds())
+		return resp, err
+	})
+}
@@ -0,0 +1,304 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+	"k8s.io/klog/v2"
+)
+
+// portForwarder dials a ready pod of a Service through the pods/portforward
+// subresource of the apiserver, like kubectl port-forward svc/<name>. One
+// SPDY connection is shared by all dialed connections, each of which is a
+// pair of streams on it. The connection is replaced, with a freshly picked
+// pod, once it is closed because the pod is gone, the kubelet timed it out
+// or the apiserver restarted.
+type portForwarder struct {
+	cfg *rest.Config
+	kc  kubernetes.Interface
+	ref ServiceReference
+
+	mu        sync.Mutex
+	conn      httpstream.Connection
+	pod       string
+	port      int32
+	requestID int
+	closed    bool
+}
+
+func newPortForwarder(cfg *rest.Config, ref ServiceReference) (*portForwarder, error) {
+	kc, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &portForwarder{cfg: cfg, kc: kc, ref: ref}, nil
+}
+
+// DialContext returns a connection to the service port of a ready pod. The
+// address is ignored, so that the url of the Config only determines the
+// Host header and the TLS server name.
+func (f *portForwarder) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		conn, pod, port, id, err := f.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c, err := newStreamConn(conn, pod, port, id)
+		if err == nil {
+			return c, nil
+		}
+		// the connection may have died since it was last used
+		f.reset(conn)
+		if attempt > 0 {
+			return nil, fmt.Errorf("failed to forward to pod %s/%s: %w", f.ref.Namespace, pod, err)
+		}
+	}
+}
+
+// connection returns the current connection, or dials a new one.
+func (f *portForwarder) connection(ctx context.Context) (httpstream.Connection, string, int32, int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil, "", 0, 0, fmt.Errorf("port forward to service %s is closed", f.ref)
+	}
+	if f.conn != nil {
+		select {
+		case <-f.conn.CloseChan():
+			klog.V(2).InfoS("Port forward connection closed, reconnecting", "service", f.ref, "pod", f.pod)
+			f.conn = nil
+		default:
+		}
+	}
+	if f.conn == nil {
+		pod, port, err := f.resolve(ctx)
+		if err != nil {
+			return nil, "", 0, 0, err
+		}
+		conn, err := f.dial(pod)
+		if err != nil {
+			return nil, "", 0, 0, err
+		}
+		klog.V(1).InfoS("Forwarding to Prometheus pod", "service", f.ref, "pod", pod, "port", port)
+		f.conn, f.pod, f.port, f.requestID = conn, pod, port, 0
+	}
+	id := f.requestID
+	f.requestID++
+	return f.conn, f.pod, f.port, id, nil
+}
+
+// reset closes conn if it is still the current connection.
+func (f *portForwarder) reset(conn httpstream.Connection) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conn == conn {
+		_ = f.conn.Close()
+		f.conn = nil
+	}
+}
+
+// close closes the current connection, and with it the streams of all
+// dialed connections. Later dials fail.
+func (f *portForwarder) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.conn == nil {
+		return nil
+	}
+	err := f.conn.Close()
+	f.conn = nil
+	return err
+}
+
+// resolve returns a ready pod of the service and the container port that
+// the service port targets, from the EndpointSlices of the service.
+func (f *portForwarder) resolve(ctx context.Context) (string, int32, error) {
+	svc, err := f.kc.CoreV1().Services(f.ref.Namespace).Get(ctx, f.ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", 0, err
+	}
+	var svcPort *core.ServicePort
+	for i := range svc.Spec.Ports {
+		if svc.Spec.Ports[i].Port == int32(f.ref.Port) {
+			svcPort = &svc.Spec.Ports[i]
+			break
+		}
+	}
+	if svcPort == nil {
+		return "", 0, fmt.Errorf("service %s/%s has no port %d", f.ref.Namespace, f.ref.Name, f.ref.Port)
+	}
+
+	slices, err := f.kc.DiscoveryV1().EndpointSlices(f.ref.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: discoveryv1.LabelServiceName + "=" + f.ref.Name,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	for _, slice := range slices.Items {
+		var port *int32
+		for _, p := range slice.Ports {
+			if p.Name != nil && *p.Name == svcPort.Name && p.Port != nil {
+				port = p.Port
+				break
+			}
+		}
+		if port == nil {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			if ep.TargetRef == nil || ep.TargetRef.Kind != "Pod" {
+				continue
+			}
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			return ep.TargetRef.Name, *port, nil
+		}
+	}
+	return "", 0, fmt.Errorf("service %s/%s has no ready pod", f.ref.Namespace, f.ref.Name)
+}
+
+func (f *portForwarder) dial(pod string) (httpstream.Connection, error) {
+	transport, upgrader, err := spdy.RoundTripperFor(f.cfg)
+	if err != nil {
+		return nil, err
+	}
+	u := f.kc.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(f.ref.Namespace).
+		Name(pod).
+		SubResource("portforward").
+		URL()
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, u)
+	conn, protocol, err := dialer.Dial(portforward.PortForwardProtocolV1Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to forward to pod %s/%s: %w", f.ref.Namespace, pod, err)
+	}
+	if protocol != portforward.PortForwardProtocolV1Name {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to forward to pod %s/%s: server returned protocol %q", f.ref.Namespace, pod, protocol)
+	}
+	return conn, nil
+}
+
+// streamConn is a net.Conn over the data stream of a forwarded port. Errors
+// the kubelet reports on the error stream, like a refused connection, are
+// returned by Read instead of a bare EOF.
+type streamConn struct {
+	httpstream.Stream
+	conn        httpstream.Connection
+	errorStream httpstream.Stream
+	addr        streamAddr
+
+	errDone chan struct{}
+	err     error
+}
+
+var _ net.Conn = &streamConn{}
+
+func newStreamConn(conn httpstream.Connection, pod string, port int32, id int) (*streamConn, error) {
+	headers := http.Header{}
+	headers.Set(core.StreamType, core.StreamTypeError)
+	headers.Set(core.PortHeader, strconv.Itoa(int(port)))
+	headers.Set(core.PortForwardRequestIDHeader, strconv.Itoa(id))
+	errorStream, err := conn.CreateStream(headers)
+	if err != nil {
+		return nil, fmt.Errorf("error creating error stream: %w", err)
+	}
+	// only read from the error stream
+	_ = errorStream.Close()
+
+	headers.Set(core.StreamType, core.StreamTypeData)
+	dataStream, err := conn.CreateStream(headers)
+	if err != nil {
+		conn.RemoveStreams(errorStream)
+		return nil, fmt.Errorf("error creating data stream: %w", err)
+	}
+
+	c := &streamConn{
+		Stream:      dataStream,
+		conn:        conn,
+		errorStream: errorStream,
+		addr:        streamAddr(fmt.Sprintf("%s:%d", pod, port)),
+		errDone:     make(chan struct{}),
+	}
+	go func() {
+		defer close(c.errDone)
+		msg, err := io.ReadAll(errorStream)
+		switch {
+		case err != nil:
+			c.err = fmt.Errorf("error reading from error stream: %w", err)
+		case len(msg) > 0:
+			c.err = fmt.Errorf("port forward to %s: %s", c.addr, strings.TrimSpace(string(msg)))
+		}
+	}()
+	return c, nil
+}
+
+func (c *streamConn) Read(b []byte) (int, error) {
+	n, err := c.Stream.Read(b)
+	if errors.Is(err, io.EOF) {
+		select {
+		case <-c.errDone:
+			if c.err != nil {
+				return n, c.err
+			}
+		default:
+		}
+	}
+	return n, err
+}
+
+func (c *streamConn) Close() error {
+	err := c.Stream.Close()
+	c.conn.RemoveStreams(c.errorStream, c.Stream)
+	return err
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return streamAddr("localhost") }
+func (c *streamConn) RemoteAddr() net.Addr { return c.addr }
+
+// Deadlines are not supported by SPDY streams. net/http closes the
+// connection instead when a request is canceled.
+func (c *streamConn) SetDeadline(time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(time.Time) error { return nil }
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "portforward" }
+func (a streamAddr) String() string  { return string(a) }
@@ -0,0 +1,59 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+)
+
+// fakeConnection is a httpstream.Connection that only records Close.
+type fakeConnection struct {
+	httpstream.Connection
+	closed chan bool
+}
+
+func (c *fakeConnection) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func (c *fakeConnection) CloseChan() <-chan bool {
+	return c.closed
+}
+
+func TestClientClosesPortForward(t *testing.T) {
+	conn := &fakeConnection{closed: make(chan bool)}
+	fw := &portForwarder{
+		ref:  ServiceReference{Namespace: "monitoring", Name: "prometheus", Port: 9090},
+		conn: conn,
+	}
+	c := &Client{fw: fw}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-conn.closed:
+	default:
+		t.Fatal("the port forward connection was not closed")
+	}
+	if _, err := fw.DialContext(context.Background(), "tcp", "prometheus:9090"); err == nil {
+		t.Error("DialContext() after Close succeeded, want error")
+	}
+}
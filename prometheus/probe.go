@@ -0,0 +1,247 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	promapi "github.com/prometheus/client_golang/api"
+)
+
+type Flavor string
+
+const (
+	FlavorUnknown         Flavor = ""
+	FlavorPrometheus      Flavor = "Prometheus"
+	FlavorThanos          Flavor = "Thanos"
+	FlavorMimir           Flavor = "Mimir"
+	FlavorVictoriaMetrics Flavor = "VictoriaMetrics"
+)
+
+// Optional APIs checked by Probe. Not every Prometheus compatible backend
+// implements them.
+var probedAPIs = map[string]string{
+	"flags":       "/api/v1/status/flags",
+	"runtimeinfo": "/api/v1/status/runtimeinfo",
+	"tsdb":        "/api/v1/status/tsdb",
+	"targets":     "/api/v1/targets",
+	"rules":       "/api/v1/rules",
+	"alerts":      "/api/v1/alerts",
+	"metadata":    "/api/v1/metadata",
+	"exemplars":   "/api/v1/query_exemplars",
+}
+
+// probeArgs returns the parameters required by a probed API, so that it
+// doesn't answer 400 bad_data.
+func probeArgs(name string) url.Values {
+	switch name {
+	case "exemplars":
+		now := time.Now()
+		return url.Values{
+			"query": {"up"},
+			"start": {strconv.FormatInt(now.Add(-time.Minute).Unix(), 10)},
+			"end":   {strconv.FormatInt(now.Unix(), 10)},
+		}
+	}
+	return nil
+}
+
+// ProbeResult describes the backend found at Config.Addr.
+type ProbeResult struct {
+	// Reachable is true if the endpoint returned an HTTP response.
+	Reachable bool `json:"reachable"`
+	// Authorized is true if the endpoint accepted the credentials.
+	Authorized bool `json:"authorized"`
+	// StatusCode of the buildinfo request.
+	StatusCode int    `json:"statusCode,omitempty"`
+	Flavor     Flavor `json:"flavor,omitempty"`
+	Version    string `json:"version,omitempty"`
+	// ServiceProxy is true if the endpoint is reached through the
+	// Kubernetes apiserver service proxy.
+	ServiceProxy bool `json:"serviceProxy"`
+	// APIs reports which optional APIs are available.
+	APIs map[string]bool `json:"apis,omitempty"`
+}
+
+type buildinfo struct {
+	Application string `json:"application"`
+	Version     string `json:"version"`
+	Revision    string `json:"revision"`
+	GoVersion   string `json:"goVersion"`
+}
+
+// Probe checks that the endpoint is reachable and that the credentials are
+// accepted, and detects the backend flavor and the optional APIs it
+// supports. The returned error explains how to fix the configuration.
+func (p *Config) Probe(ctx context.Context) (*ProbeResult, error) {
+	if !p.IsSet() {
+		return nil, errors.New("prometheus address is not set")
+	}
+	p, err := p.resolveService()
+	if err != nil {
+		return nil, err
+	}
+	pc, err := p.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+
+	result := &ProbeResult{
+		ServiceProxy: strings.Contains(p.Addr, "/services/") && strings.Contains(p.Addr, "/proxy"),
+		APIs:         map[string]bool{},
+	}
+
+	resp, body, err := get(ctx, pc, "/api/v1/status/buildinfo", nil)
+	if err != nil {
+		return result, fmt.Errorf("prometheus at %s is not reachable: %w", p.Addr, err)
+	}
+	result.Reachable = true
+	result.StatusCode = resp.StatusCode
+	if resp.Header.Get("Audit-Id") != "" || resp.Header.Get("X-Kubernetes-Pf-Flowschema-Uid") != "" {
+		result.ServiceProxy = true
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return result, p.authError(resp.StatusCode, body, result.ServiceProxy)
+	case resp.StatusCode == http.StatusNotFound:
+		// older Prometheus and some proxies do not implement buildinfo, keep
+		// going if the query API is served and detect the flavor from the
+		// other APIs
+		if isKubernetesStatus(body) || !available(ctx, pc, "/api/v1/query", url.Values{"query": {"1"}}) {
+			return result, p.statusError(resp.StatusCode, body, result.ServiceProxy)
+		}
+	case resp.StatusCode/100 != 2:
+		return result, p.statusError(resp.StatusCode, body, result.ServiceProxy)
+	}
+	result.Authorized = true
+
+	var info struct {
+		Data buildinfo `json:"data"`
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := json.Unmarshal(body, &info); err != nil {
+			return result, fmt.Errorf("endpoint %s does not serve the Prometheus HTTP API: %w", p.Addr, err)
+		}
+		result.Version = info.Data.Version
+	}
+
+	for name, ep := range probedAPIs {
+		resp, _, err := get(ctx, pc, ep, probeArgs(name))
+		result.APIs[name] = err == nil && resp.StatusCode == http.StatusOK
+	}
+	result.Flavor = detectFlavor(ctx, pc, info.Data, result.APIs["flags"])
+
+	return result, nil
+}
+
+func detectFlavor(ctx context.Context, pc promapi.Client, info buildinfo, hasFlags bool) Flavor {
+	switch {
+	case strings.Contains(info.Application, "Mimir"), strings.Contains(info.Application, "Cortex"):
+		return FlavorMimir
+	case available(ctx, pc, "/api/v1/stores", nil):
+		return FlavorThanos
+	case available(ctx, pc, "/api/v1/status/active_queries", nil):
+		return FlavorVictoriaMetrics
+	case hasFlags && info.Revision != "":
+		return FlavorPrometheus
+	}
+	return FlavorUnknown
+}
+
+func (p *Config) authError(code int, body []byte, serviceProxy bool) error {
+	msg := strings.TrimSpace(string(body))
+	switch {
+	case strings.Contains(msg, "no org id"):
+		return fmt.Errorf("prometheus at %s requires a tenant id, set --%s.tenant-id: %s", p.Addr, p.flagPrefix(), msg)
+	case serviceProxy && code == http.StatusForbidden:
+		return fmt.Errorf("access to %s is forbidden, the credentials need the get and create verbs on services/proxy in the Prometheus service namespace: %s", p.Addr, msg)
+	case p.countAuthModes() == 0:
+		return fmt.Errorf("prometheus at %s requires authentication but no credentials are configured (HTTP %d)", p.Addr, code)
+	}
+	return fmt.Errorf("prometheus at %s rejected the configured credentials (HTTP %d): %s", p.Addr, code, msg)
+}
+
+// statusError explains why the endpoint answered the buildinfo request with
+// an error status that is not about the credentials.
+func (p *Config) statusError(code int, body []byte, serviceProxy bool) error {
+	msg := responseMessage(body)
+	switch {
+	case serviceProxy && code == http.StatusServiceUnavailable && strings.Contains(msg, "no endpoints available"):
+		return fmt.Errorf("the Prometheus service behind %s has no ready pods, check that Prometheus is running: %s", p.Addr, msg)
+	case code == http.StatusNotFound && isKubernetesStatus(body):
+		return fmt.Errorf("the apiserver found no service for %s, check the namespace, name and port of the service: %s", p.Addr, msg)
+	case code == http.StatusNotFound:
+		return fmt.Errorf("no Prometheus HTTP API at %s (HTTP 404), check the address and its path prefix", p.Addr)
+	case code == http.StatusBadGateway || code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout:
+		return fmt.Errorf("prometheus at %s is unavailable or overloaded, retry later (HTTP %d): %s", p.Addr, code, msg)
+	case code/100 == 5:
+		return fmt.Errorf("prometheus at %s failed to answer, check its logs (HTTP %d): %s", p.Addr, code, msg)
+	}
+	return fmt.Errorf("prometheus at %s rejected the request (HTTP %d): %s", p.Addr, code, msg)
+}
+
+// isKubernetesStatus returns true if body is a Status of the apiserver,
+// which the service proxy returns for its own errors.
+func isKubernetesStatus(body []byte) bool {
+	var status struct {
+		Kind string `json:"kind"`
+	}
+	return json.Unmarshal(body, &status) == nil && status.Kind == "Status"
+}
+
+// responseMessage returns the error message of a Prometheus or apiserver
+// error response, or else the body.
+func responseMessage(body []byte) string {
+	var resp struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &resp) == nil {
+		switch {
+		case resp.Error != "":
+			return resp.Error
+		case resp.Message != "":
+			return resp.Message
+		}
+	}
+	return strings.TrimSpace(string(body))
+}
+
+func get(ctx context.Context, pc promapi.Client, ep string, args url.Values) (*http.Response, []byte, error) {
+	u := pc.URL(ep, nil)
+	u.RawQuery = args.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pc.Do(ctx, req)
+}
+
+func available(ctx context.Context, pc promapi.Client, ep string, args url.Values) bool {
+	resp, _, err := get(ctx, pc, ep, args)
+	return err == nil && resp.StatusCode == http.StatusOK
+}
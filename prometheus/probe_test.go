@@ -0,0 +1,146 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestProbeExemplars(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/status/buildinfo", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"success","data":{"version":"2.55.1","revision":"abc"}}`))
+	})
+	mux.HandleFunc("/api/v1/query_exemplars", func(w http.ResponseWriter, r *http.Request) {
+		// like Prometheus, reject a request without a query
+		if r.FormValue("query") == "" || r.FormValue("start") == "" || r.FormValue("end") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"status":"error","errorType":"bad_data","error":"invalid parameter \"query\""}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"status":"success","data":[]}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := Config{Addr: srv.URL}
+	result, err := cfg.Probe(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.APIs["exemplars"] {
+		t.Error("exemplars API is reported as unavailable")
+	}
+	if result.APIs["rules"] {
+		t.Error("rules API is reported as available")
+	}
+	if result.Version != "2.55.1" {
+		t.Errorf("Version = %q, want 2.55.1", result.Version)
+	}
+}
+
+func TestProbeStatus(t *testing.T) {
+	kubeStatus := `{"kind":"Status","apiVersion":"v1","status":"Failure","message":"services \"prometheus\" not found","reason":"NotFound","code":404}`
+	tests := []struct {
+		name      string
+		code      int
+		body      string
+		noQuery   bool
+		wantErr   string
+		reachable bool
+	}{
+		{
+			name:      "no buildinfo",
+			code:      http.StatusNotFound,
+			body:      "404 page not found",
+			reachable: true,
+		},
+		{
+			name:    "wrong path",
+			code:    http.StatusNotFound,
+			body:    "404 page not found",
+			noQuery: true,
+			wantErr: "check the address and its path prefix",
+		},
+		{
+			name:    "unknown service",
+			code:    http.StatusNotFound,
+			body:    kubeStatus,
+			wantErr: `found no service for .*: services "prometheus" not found`,
+		},
+		{
+			name:    "no endpoints",
+			code:    http.StatusServiceUnavailable,
+			body:    `{"kind":"Status","apiVersion":"v1","status":"Failure","message":"no endpoints available for service \"prometheus\"","reason":"ServiceUnavailable","code":503}`,
+			wantErr: `has no ready pods, check that Prometheus is running: no endpoints available for service "prometheus"`,
+		},
+		{
+			name:    "internal error",
+			code:    http.StatusInternalServerError,
+			body:    `{"status":"error","errorType":"internal","error":"tsdb closed"}`,
+			wantErr: `failed to answer, check its logs \(HTTP 500\): tsdb closed`,
+		},
+		{
+			name:    "unauthorized",
+			code:    http.StatusUnauthorized,
+			body:    "Unauthorized",
+			wantErr: "requires authentication but no credentials are configured",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/api/v1/status/buildinfo", func(w http.ResponseWriter, r *http.Request) {
+				// like the apiserver service proxy
+				w.Header().Set("Audit-Id", "b0b5ac5b-5e8f-4b2c-9f0e-1a6c3b1f2d3e")
+				w.WriteHeader(tt.code)
+				_, _ = w.Write([]byte(tt.body))
+			})
+			mux.HandleFunc("/api/v1/query", func(w http.ResponseWriter, r *http.Request) {
+				if tt.noQuery {
+					http.NotFound(w, r)
+					return
+				}
+				_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"scalar","result":[0,"1"]}}`))
+			})
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			cfg := Config{Addr: srv.URL}
+			result, err := cfg.Probe(context.Background())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !result.Reachable || !result.Authorized || !result.ServiceProxy {
+					t.Errorf("result = %+v, want a reachable and authorized service proxy", result)
+				}
+				return
+			}
+			if err == nil || !regexp.MustCompile(tt.wantErr).MatchString(err.Error()) {
+				t.Fatalf("Probe() error = %v, want %q", err, tt.wantErr)
+			}
+			if result == nil || !result.Reachable || result.Authorized || result.StatusCode != tt.code {
+				t.Errorf("result = %+v, want reachable and not authorized with HTTP %d", result, tt.code)
+			}
+		})
+	}
+}
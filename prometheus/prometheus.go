@@ -17,18 +17,29 @@ limitations under the License.
 package prometheus
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"net/http"
 	"net/url"
 
 	promapi "github.com/prometheus/client_golang/api"
+	prom "github.com/prometheus/client_golang/prometheus"
 	prom_config "github.com/prometheus/common/config"
+	"github.com/prometheus/common/model"
 	"github.com/spf13/pflag"
+	"github.com/tamalsaha/prometheus-demo/prometheus/fixture"
+	"github.com/tamalsaha/prometheus-demo/prometheus/sigv4"
 	"go.bytebuilders.dev/license-verifier/info"
+	"golang.org/x/oauth2"
+	"k8s.io/client-go/rest"
 )
 
+const DefaultFlagPrefix = "prometheus"
+
 type Config struct {
 	// The address where metrics will be sent
-	Addr string
+	Addr string `yaml:"address,omitempty" json:"address,omitempty"`
 	// The HTTP basic authentication credentials for the targets.
 	BasicAuth BasicAuth `yaml:"basic_auth,omitempty" json:"basic_auth,omitempty"`
 	// The bearer token for the targets. Deprecated in favour of
@@ -37,10 +48,79 @@ type Config struct {
 	// The bearer token file for the targets. Deprecated in favour of
 	// Authorization.CredentialsFile.
 	BearerTokenFile string `yaml:"bearer_token_file,omitempty" json:"bearer_token_file,omitempty"`
+	// The HTTP authorization credentials for the targets.
+	Authorization Authorization `yaml:"authorization,omitempty" json:"authorization,omitempty"`
+	// The OAuth2 client credentials used to fetch a token for the targets.
+	OAuth2 OAuth2 `yaml:"oauth2,omitempty" json:"oauth2,omitempty"`
+	// The AWS SigV4 signing configuration for Amazon Managed Service for Prometheus.
+	SigV4 sigv4.Config `yaml:"sigv4,omitempty" json:"sigv4,omitempty"`
+	// Extra HTTP headers sent with every request.
+	Headers Headers `yaml:"headers,omitempty" json:"headers,omitempty"`
+	// The tenant id sent to multi-tenant backends like Mimir, Cortex or Thanos.
+	TenantID string `yaml:"tenant_id,omitempty" json:"tenant_id,omitempty"`
+	// The header used to send TenantID. Defaults to X-Scope-OrgID.
+	TenantHeader string `yaml:"tenant_header,omitempty" json:"tenant_header,omitempty"`
 	// HTTP proxy server to use to connect to the targets.
 	ProxyURL string `yaml:"proxy_url,omitempty" json:"proxy_url,omitempty"`
 	// TLSConfig to use to connect to the targets.
 	TLSConfig prom_config.TLSConfig `yaml:"tls_config,omitempty" json:"tls_config,omitempty"`
+	// The number of times a request is retried after a connection reset or a
+	// 429, 502, 503 or 504 response. A Retry-After header of the response is
+	// honored, unless it asks to wait longer than a minute or past the
+	// deadline of the request. Retries are disabled if zero.
+	MaxRetries int `yaml:"max_retries,omitempty" json:"max_retries,omitempty"`
+	// The initial delay between retries, doubled after every attempt.
+	RetryBackoff model.Duration `yaml:"retry_backoff,omitempty" json:"retry_backoff,omitempty"`
+	// The maximum delay between retries without Retry-After.
+	MaxRetryBackoff model.Duration `yaml:"max_retry_backoff,omitempty" json:"max_retry_backoff,omitempty"`
+	// The maximum number of requests per second. Unlimited if zero.
+	QPS float64 `yaml:"qps,omitempty" json:"qps,omitempty"`
+	// The maximum burst of requests above QPS.
+	Burst int `yaml:"burst,omitempty" json:"burst,omitempty"`
+	// TokenSource supplies the bearer token of every request, like a
+	// satoken.Source of bound service account tokens that are refreshed
+	// before they expire.
+	TokenSource oauth2.TokenSource `yaml:"-" json:"-"`
+	// Registerer for the client request metrics. Metrics are not collected if nil.
+	Registerer prom.Registerer `yaml:"-" json:"-"`
+	// PEM encoded CA certificate. Takes precedence over TLSConfig.CAFile.
+	CAData []byte `yaml:"ca_data,omitempty" json:"ca_data,omitempty"`
+	// PEM encoded client certificate. Takes precedence over TLSConfig.CertFile.
+	CertData []byte `yaml:"cert_data,omitempty" json:"cert_data,omitempty"`
+	// PEM encoded client key. Takes precedence over TLSConfig.KeyFile.
+	KeyData []byte `yaml:"key_data,omitempty" json:"key_data,omitempty"`
+
+	// RecordFile is a JSONL file that every request and its response is
+	// appended to, with credentials redacted.
+	RecordFile string `yaml:"record_file,omitempty" json:"record_file,omitempty"`
+	// ReplayFile is a JSONL file recorded with RecordFile. Requests are
+	// answered from it instead of being sent.
+	ReplayFile string `yaml:"replay_file,omitempty" json:"replay_file,omitempty"`
+
+	// Service is the Prometheus compatible Service reached with Transport.
+	// Address, if set, is used instead of the url derived from it.
+	Service *ServiceReference `yaml:"service,omitempty" json:"service,omitempty"`
+	// Transport is how Service is reached: proxy, portforward or direct.
+	// Defaults to proxy with a Service and to direct without one.
+	Transport Transport `yaml:"transport,omitempty" json:"transport,omitempty"`
+	// Kubeconfig is the kubeconfig file of the cluster of Service. Defaults
+	// to the KUBECONFIG environment variable, ~/.kube/config or the
+	// in-cluster config.
+	Kubeconfig string `yaml:"kubeconfig,omitempty" json:"kubeconfig,omitempty"`
+	// KubeContext is the kubeconfig context of the cluster of Service.
+	KubeContext string `yaml:"kube_context,omitempty" json:"kube_context,omitempty"`
+
+	// ConfigFile is the YAML or JSON file read by Load.
+	ConfigFile string `yaml:"-" json:"-"`
+
+	// kube config of the proxy and portforward transports, set by
+	// NewServiceConfig and resolveService
+	restConfig *rest.Config
+
+	// prefix of the registered flags
+	prefix string
+	// raw values of the flags set on the command line, in order
+	setFlags []flagValue
 }
 
 // BasicAuth contains basic HTTP authentication credentials.
@@ -50,39 +130,151 @@ type BasicAuth struct {
 	PasswordFile string `yaml:"password_file,omitempty" json:"password_file,omitempty"`
 }
 
+// Authorization contains HTTP authorization credentials.
+type Authorization struct {
+	// Type defaults to Bearer.
+	Type            string `yaml:"type,omitempty" json:"type,omitempty"`
+	Credentials     string `yaml:"credentials,omitempty" json:"credentials,omitempty"`
+	CredentialsFile string `yaml:"credentials_file,omitempty" json:"credentials_file,omitempty"`
+}
+
+// OAuth2 is the oauth2 client credentials grant configuration.
+type OAuth2 struct {
+	ClientID         string            `yaml:"client_id" json:"client_id"`
+	ClientSecret     string            `yaml:"client_secret,omitempty" json:"client_secret,omitempty"`
+	ClientSecretFile string            `yaml:"client_secret_file,omitempty" json:"client_secret_file,omitempty"`
+	Scopes           []string          `yaml:"scopes,omitempty" json:"scopes,omitempty"`
+	TokenURL         string            `yaml:"token_url" json:"token_url"`
+	EndpointParams   map[string]string `yaml:"endpoint_params,omitempty" json:"endpoint_params,omitempty"`
+}
+
 func NewPrometheusConfig() *Config {
 	return &Config{}
 }
 
 func (p *Config) AddGoFlags(fs *flag.FlagSet) {
-	fs.StringVar(&p.Addr, "prometheus.address", p.Addr, "The address of metrics storage where metrics data will be sent")
-
-	fs.StringVar(&p.BasicAuth.Username, "prometheus.basic-auth-username", p.BasicAuth.Username, "The HTTP basic authentication username for the targets.")
-	fs.StringVar(&p.BasicAuth.Password, "prometheus.basic-auth-password", p.BasicAuth.Password, "The HTTP basic authentication password for the targets.")
-	fs.StringVar(&p.BasicAuth.PasswordFile, "prometheus.basic-auth-password-file", p.BasicAuth.PasswordFile, "The HTTP basic authentication password file for the targets.")
+	p.AddGoFlagsWithPrefix(fs, DefaultFlagPrefix)
+}
 
-	fs.StringVar(&p.BearerToken, "prometheus.bearer-token", p.BearerToken, "The bearer token for the targets.")
-	fs.StringVar(&p.BearerTokenFile, "prometheus.bearer-token-file", p.BearerTokenFile, "The bearer token file for the targets.")
+func (p *Config) AddFlags(fs *pflag.FlagSet) {
+	p.AddFlagsWithPrefix(fs, DefaultFlagPrefix)
+}
 
-	fs.StringVar(&p.ProxyURL, "prometheus.proxy-url", p.ProxyURL, "HTTP proxy server to use to connect to the targets.")
+// AddGoFlagsWithPrefix registers the flags as <prefix>.address,
+// <prefix>.bearer-token, etc. so that a process can hold several Configs.
+func (p *Config) AddGoFlagsWithPrefix(fs *flag.FlagSet, prefix string) {
+	p.prefix = prefix
 
-	fs.StringVar(&p.TLSConfig.CAFile, "prometheus.ca-cert-file", p.TLSConfig.CAFile, "The path of the CA cert to use for the remote metric storage.")
-	fs.StringVar(&p.TLSConfig.CertFile, "prometheus.client-cert-file", p.TLSConfig.CertFile, "The path of the client cert to use for communicating with the remote metric storage.")
-	fs.StringVar(&p.TLSConfig.KeyFile, "prometheus.client-key-file", p.TLSConfig.KeyFile, "The path of the client key to use for communicating with the remote metric storage.")
-	fs.StringVar(&p.TLSConfig.ServerName, "prometheus.server-name", p.TLSConfig.ServerName, "The server name which will be used to verify metrics storage.")
-	fs.BoolVar(&p.TLSConfig.InsecureSkipVerify, "prometheus.insecure-skip-verify", p.TLSConfig.InsecureSkipVerify, "To skip tls verification when communicating with the remote metric storage.")
+	bound := flag.NewFlagSet(prefix, flag.ContinueOnError)
+	p.bindGoFlags(bound, prefix)
+	bound.VisitAll(func(f *flag.Flag) {
+		fs.Var(newRecordingValue(p, f), f.Name, f.Usage)
+	})
 }
 
-func (p *Config) AddFlags(fs *pflag.FlagSet) {
-	pfs := flag.NewFlagSet("postgres-server", flag.ExitOnError)
-	p.AddGoFlags(pfs)
+func (p *Config) AddFlagsWithPrefix(fs *pflag.FlagSet, prefix string) {
+	pfs := flag.NewFlagSet(prefix, flag.ExitOnError)
+	p.AddGoFlagsWithPrefix(pfs, prefix)
 	fs.AddGoFlagSet(pfs)
 }
 
+func (p *Config) bindGoFlags(fs *flag.FlagSet, prefix string) {
+	fs.StringVar(&p.ConfigFile, prefix+".config-file", p.ConfigFile, "The path of a YAML or JSON file with the metrics storage configuration. Flags and environment variables take precedence over it.")
+	fs.StringVar(&p.Addr, prefix+".address", p.Addr, "The address of metrics storage where metrics data will be sent")
+
+	fs.StringVar(&p.BasicAuth.Username, prefix+".basic-auth-username", p.BasicAuth.Username, "The HTTP basic authentication username for the targets.")
+	fs.StringVar(&p.BasicAuth.Password, prefix+".basic-auth-password", p.BasicAuth.Password, "The HTTP basic authentication password for the targets.")
+	fs.StringVar(&p.BasicAuth.PasswordFile, prefix+".basic-auth-password-file", p.BasicAuth.PasswordFile, "The HTTP basic authentication password file for the targets.")
+
+	fs.StringVar(&p.BearerToken, prefix+".bearer-token", p.BearerToken, "The bearer token for the targets.")
+	fs.StringVar(&p.BearerTokenFile, prefix+".bearer-token-file", p.BearerTokenFile, "The bearer token file for the targets.")
+
+	fs.StringVar(&p.Authorization.Type, prefix+".authorization-type", p.Authorization.Type, "The HTTP authorization type for the targets. Defaults to Bearer.")
+	fs.StringVar(&p.Authorization.Credentials, prefix+".authorization-credentials", p.Authorization.Credentials, "The HTTP authorization credentials for the targets.")
+	fs.StringVar(&p.Authorization.CredentialsFile, prefix+".authorization-credentials-file", p.Authorization.CredentialsFile, "The HTTP authorization credentials file for the targets.")
+
+	fs.StringVar(&p.OAuth2.ClientID, prefix+".oauth2-client-id", p.OAuth2.ClientID, "The OAuth2 client id used to fetch a token for the targets.")
+	fs.StringVar(&p.OAuth2.ClientSecret, prefix+".oauth2-client-secret", p.OAuth2.ClientSecret, "The OAuth2 client secret used to fetch a token for the targets.")
+	fs.StringVar(&p.OAuth2.ClientSecretFile, prefix+".oauth2-client-secret-file", p.OAuth2.ClientSecretFile, "The OAuth2 client secret file used to fetch a token for the targets.")
+	fs.StringVar(&p.OAuth2.TokenURL, prefix+".oauth2-token-url", p.OAuth2.TokenURL, "The OAuth2 URL to fetch the token from.")
+	fs.Var(newStringSliceValue(&p.OAuth2.Scopes), prefix+".oauth2-scopes", "Comma separated OAuth2 scopes for the token request.")
+	fs.Var(newStringMapValue(&p.OAuth2.EndpointParams), prefix+".oauth2-endpoint-params", "Comma separated key=value parameters to append to the OAuth2 token URL.")
+
+	fs.StringVar(&p.SigV4.Region, prefix+".sigv4-region", p.SigV4.Region, "The AWS region used to sign requests with SigV4.")
+	fs.StringVar(&p.SigV4.AccessKey, prefix+".sigv4-access-key", p.SigV4.AccessKey, "The AWS access key used to sign requests with SigV4.")
+	fs.StringVar(&p.SigV4.SecretKey, prefix+".sigv4-secret-key", p.SigV4.SecretKey, "The AWS secret key used to sign requests with SigV4.")
+	fs.StringVar(&p.SigV4.Profile, prefix+".sigv4-profile", p.SigV4.Profile, "The AWS shared credentials profile used to sign requests with SigV4.")
+	fs.StringVar(&p.SigV4.RoleARN, prefix+".sigv4-role-arn", p.SigV4.RoleARN, "The AWS role to assume before signing requests with SigV4.")
+
+	fs.Var(newHeaderValue(&p.Headers), prefix+".header", "Extra HTTP header in key=value form to send with every request. Can be repeated.")
+	fs.StringVar(&p.TenantID, prefix+".tenant-id", p.TenantID, "The tenant id sent to multi-tenant backends like Mimir, Cortex or Thanos.")
+	fs.StringVar(&p.TenantHeader, prefix+".tenant-header", p.TenantHeader, "The header used to send the tenant id. Use THANOS-TENANT for Thanos. Defaults to X-Scope-OrgID.")
+
+	fs.Var(newServiceValue(&p.Service), prefix+".service", "The Prometheus compatible Service to reach with the transport, in [scheme:]namespace/name:port form.")
+	fs.StringVar((*string)(&p.Transport), prefix+".transport", string(p.Transport), "How the service is reached. One of: proxy (the apiserver service proxy), portforward (a port forward to a ready pod) or direct (the cluster DNS name).")
+	fs.StringVar(&p.Kubeconfig, prefix+".kubeconfig", p.Kubeconfig, "The kubeconfig file of the cluster of the service.")
+	fs.StringVar(&p.KubeContext, prefix+".kube-context", p.KubeContext, "The kubeconfig context of the cluster of the service.")
+
+	fs.StringVar(&p.ProxyURL, prefix+".proxy-url", p.ProxyURL, "HTTP proxy server to use to connect to the targets.")
+
+	fs.IntVar(&p.MaxRetries, prefix+".max-retries", p.MaxRetries, "The number of times a failed request is retried. Retries are disabled if zero.")
+	fs.Var(&p.RetryBackoff, prefix+".retry-backoff", "The initial delay between retries, doubled after every attempt.")
+	fs.Var(&p.MaxRetryBackoff, prefix+".max-retry-backoff", "The maximum delay between retries, unless the server asks for a longer one with Retry-After.")
+	fs.Float64Var(&p.QPS, prefix+".qps", p.QPS, "The maximum number of requests per second sent to the metrics storage. Unlimited if zero.")
+	fs.IntVar(&p.Burst, prefix+".burst", p.Burst, "The maximum burst of requests above the qps limit.")
+
+	fs.StringVar(&p.RecordFile, prefix+".record-file", p.RecordFile, "Append every request and its response to this JSONL file, with credentials redacted.")
+	fs.StringVar(&p.ReplayFile, prefix+".replay-file", p.ReplayFile, "Answer requests from a JSONL file written with --"+prefix+".record-file instead of sending them.")
+
+	fs.StringVar(&p.TLSConfig.CAFile, prefix+".ca-cert-file", p.TLSConfig.CAFile, "The path of the CA cert to use for the remote metric storage.")
+	fs.StringVar(&p.TLSConfig.CertFile, prefix+".client-cert-file", p.TLSConfig.CertFile, "The path of the client cert to use for communicating with the remote metric storage.")
+	fs.StringVar(&p.TLSConfig.KeyFile, prefix+".client-key-file", p.TLSConfig.KeyFile, "The path of the client key to use for communicating with the remote metric storage.")
+	fs.StringVar(&p.TLSConfig.ServerName, prefix+".server-name", p.TLSConfig.ServerName, "The server name which will be used to verify metrics storage.")
+	fs.BoolVar(&p.TLSConfig.InsecureSkipVerify, prefix+".insecure-skip-verify", p.TLSConfig.InsecureSkipVerify, "To skip tls verification when communicating with the remote metric storage.")
+}
+
+// IsSet returns true if an address or a service is configured.
+func (p *Config) IsSet() bool {
+	return p.Addr != "" || p.Service != nil
+}
+
 func (p *Config) Validate() error {
-	if p.Addr == "" {
+	if !p.IsSet() {
 		return nil // if prometheus.address is not set, skip validation check
 	}
+	switch p.Transport {
+	case "", TransportDirect, TransportProxy, TransportPortForward:
+	default:
+		return fmt.Errorf("unknown transport %q, must be one of proxy, portforward or direct", p.Transport)
+	}
+	if p.Service == nil && (p.Transport == TransportProxy || p.Transport == TransportPortForward) {
+		return fmt.Errorf("the %s transport requires a service", p.Transport)
+	}
+	if p.Service != nil && (p.Service.Namespace == "" || p.Service.Name == "" || p.Service.Port <= 0) {
+		return fmt.Errorf("service %s must have a namespace, a name and a port", p.Service)
+	}
+	if p.transport() == TransportPortForward && p.ProxyURL != "" {
+		return errors.New("the portforward transport can't be used with a proxy url")
+	}
+	if p.RecordFile != "" && p.ReplayFile != "" {
+		return errors.New("record file and replay file are mutually exclusive")
+	}
+	if n := p.countAuthModes(); n > 1 {
+		return fmt.Errorf("at most one of basic auth, bearer token, authorization, oauth2 & sigv4 must be configured, found %d", n)
+	}
+	if p.SigV4.IsSet() {
+		if err := p.SigV4.Validate(); err != nil {
+			return err
+		}
+	}
+	if p.OAuth2.ClientID != "" || p.OAuth2.TokenURL != "" {
+		if p.OAuth2.ClientID == "" {
+			return errors.New("oauth2 client id must be configured")
+		}
+		if p.OAuth2.TokenURL == "" {
+			return errors.New("oauth2 token url must be configured")
+		}
+	}
 	httpConf, err := p.ToHTTPClientConfig()
 	if err != nil {
 		return err
@@ -90,6 +282,26 @@ func (p *Config) Validate() error {
 	return httpConf.Validate()
 }
 
+func (p *Config) countAuthModes() int {
+	n := 0
+	if p.BasicAuth.Username != "" || p.BasicAuth.Password != "" || p.BasicAuth.PasswordFile != "" {
+		n++
+	}
+	if p.BearerToken != "" || p.BearerTokenFile != "" || p.TokenSource != nil {
+		n++
+	}
+	if p.Authorization.Credentials != "" || p.Authorization.CredentialsFile != "" {
+		n++
+	}
+	if p.OAuth2.ClientID != "" || p.OAuth2.TokenURL != "" {
+		n++
+	}
+	if p.SigV4.IsSet() {
+		n++
+	}
+	return n
+}
+
 func (p *Config) ToHTTPClientConfig() (*prom_config.HTTPClientConfig, error) {
 	cfg := prom_config.HTTPClientConfig{
 		TLSConfig: prom_config.TLSConfig{
@@ -100,6 +312,18 @@ func (p *Config) ToHTTPClientConfig() (*prom_config.HTTPClientConfig, error) {
 			InsecureSkipVerify: p.TLSConfig.InsecureSkipVerify,
 		},
 	}
+	if len(p.CAData) > 0 {
+		cfg.TLSConfig.CA = string(p.CAData)
+		cfg.TLSConfig.CAFile = ""
+	}
+	if len(p.CertData) > 0 {
+		cfg.TLSConfig.Cert = string(p.CertData)
+		cfg.TLSConfig.CertFile = ""
+	}
+	if len(p.KeyData) > 0 {
+		cfg.TLSConfig.Key = prom_config.Secret(p.KeyData)
+		cfg.TLSConfig.KeyFile = ""
+	}
 
 	if p.BasicAuth.Username != "" || p.BasicAuth.Password != "" || p.BasicAuth.PasswordFile != "" {
 		cfg.BasicAuth = &prom_config.BasicAuth{
@@ -112,6 +336,20 @@ func (p *Config) ToHTTPClientConfig() (*prom_config.HTTPClientConfig, error) {
 	cfg.BearerToken = prom_config.Secret(p.BearerToken)
 	cfg.BearerTokenFile = p.BearerTokenFile
 
+	if p.Authorization.Credentials != "" || p.Authorization.CredentialsFile != "" {
+		typ := p.Authorization.Type
+		if typ == "" {
+			typ = "Bearer"
+		}
+		cfg.Authorization = &prom_config.Authorization{
+			Type:            typ,
+			Credentials:     prom_config.Secret(p.Authorization.Credentials),
+			CredentialsFile: p.Authorization.CredentialsFile,
+		}
+	}
+
+	cfg.HTTPHeaders = p.toHTTPHeaders()
+
 	if p.ProxyURL != "" {
 		u, err := url.Parse(p.ProxyURL)
 		if err != nil {
@@ -120,24 +358,130 @@ func (p *Config) ToHTTPClientConfig() (*prom_config.HTTPClientConfig, error) {
 		cfg.ProxyURL = prom_config.URL{URL: u}
 	}
 
+	if p.OAuth2.ClientID != "" || p.OAuth2.TokenURL != "" {
+		cfg.OAuth2 = &prom_config.OAuth2{
+			ClientID:         p.OAuth2.ClientID,
+			ClientSecret:     prom_config.Secret(p.OAuth2.ClientSecret),
+			ClientSecretFile: p.OAuth2.ClientSecretFile,
+			Scopes:           p.OAuth2.Scopes,
+			TokenURL:         p.OAuth2.TokenURL,
+			EndpointParams:   p.OAuth2.EndpointParams,
+			ProxyConfig:      cfg.ProxyConfig,
+		}
+	}
+
 	return &cfg, nil
 }
 
+// Client is a promapi.Client that holds on to its connections, and the port
+// forward of the portforward transport, until it is closed.
+type Client struct {
+	promapi.Client
+	rt http.RoundTripper
+	fw *portForwarder
+}
+
+// Close closes the idle connections of the client and its port forward.
+// Requests in flight are not interrupted, except for those over the port
+// forward.
+func (c *Client) Close() error {
+	if ci, ok := c.rt.(interface{ CloseIdleConnections() }); ok {
+		ci.CloseIdleConnections()
+	}
+	if c.fw != nil {
+		return c.fw.close()
+	}
+	return nil
+}
+
 func (p *Config) NewPrometheusClient() (promapi.Client, error) {
-	if p.Addr == "" {
+	c, err := p.NewClient()
+	if err != nil || c == nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClient returns a client for the config, or nil if neither an address
+// nor a service is set. Call Close once the client is no longer used.
+func (p *Config) NewClient() (*Client, error) {
+	if !p.IsSet() {
 		return nil, nil
 	}
+	p, err := p.resolveService()
+	if err != nil {
+		return nil, err
+	}
+	if p.ReplayFile != "" {
+		rt, err := fixture.LoadReplayer(p.ReplayFile)
+		if err != nil {
+			return nil, err
+		}
+		return newClient(p.Addr, rt, nil)
+	}
 
 	httpConf, err := p.ToHTTPClientConfig()
 	if err != nil {
 		return nil, err
 	}
-	rt, err := prom_config.NewRoundTripperFromConfig(*httpConf, info.ProductName)
+	var base http.RoundTripper
+	var fw *portForwarder
+	switch p.transport() {
+	case TransportProxy:
+		// authenticated by the kube transport, with the extra headers on top
+		if base, err = rest.TransportFor(p.restConfig); err != nil {
+			return nil, err
+		}
+		if httpConf.HTTPHeaders != nil {
+			base = prom_config.NewHeadersRoundTripper(httpConf.HTTPHeaders, base)
+		}
+	case TransportPortForward:
+		if fw, err = newPortForwarder(p.restConfig, *p.Service); err != nil {
+			return nil, err
+		}
+		base, err = prom_config.NewRoundTripperFromConfig(*httpConf, info.ProductName, prom_config.WithDialContextFunc(fw.DialContext))
+	default:
+		base, err = prom_config.NewRoundTripperFromConfig(*httpConf, info.ProductName)
+	}
 	if err != nil {
 		return nil, err
 	}
-	return promapi.NewClient(promapi.Config{
-		Address:      p.Addr,
+	rt := base
+	if p.TokenSource != nil {
+		rt = &oauth2.Transport{Source: p.TokenSource, Base: rt}
+	}
+	if p.SigV4.IsSet() {
+		rt, err = sigv4.NewRoundTripper(&p.SigV4, rt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rt, err = p.wrapRoundTripper(rt)
+	if err != nil {
+		return nil, err
+	}
+	if p.RecordFile != "" {
+		rec := fixture.NewRecorder(p.RecordFile, rt)
+		for k := range p.Headers {
+			rec.RedactHeaders = append(rec.RedactHeaders, k)
+		}
+		rt = rec
+	}
+	c, err := newClient(p.Addr, rt, base)
+	if err != nil {
+		return nil, err
+	}
+	c.fw = fw
+	return c, nil
+}
+
+func newClient(addr string, rt, base http.RoundTripper) (*Client, error) {
+	pc, err := promapi.NewClient(promapi.Config{
+		Address:      addr,
 		RoundTripper: rt,
 	})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{Client: pc, rt: base}, nil
 }
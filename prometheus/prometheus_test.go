@@ -0,0 +1,63 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizationHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		auth Authorization
+		want string
+	}{
+		{name: "default type", auth: Authorization{Credentials: "secret"}, want: "Bearer secret"},
+		{name: "explicit type", auth: Authorization{Type: "Token", Credentials: "secret"}, want: "Token secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Get("Authorization")
+			}))
+			defer srv.Close()
+
+			cfg := Config{Addr: srv.URL, Authorization: tt.auth}
+			if err := cfg.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			pc, err := cfg.NewPrometheusClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/status/buildinfo", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := pc.Do(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Authorization = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,469 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// maxPrecedence is the precedence of expressions that never need
+// parentheses.
+const maxPrecedence = 100
+
+// Number is a number literal.
+type Number float64
+
+func (n Number) String() string {
+	return fmt.Sprint(float64(n))
+}
+
+func (n Number) validate() error {
+	if math.IsNaN(float64(n)) || math.IsInf(float64(n), 0) {
+		// the parser reads NaN and Inf as identifiers in some positions,
+		// use Func("NaN") style expressions through the API instead
+		return fmt.Errorf("number %v is not supported", float64(n))
+	}
+	return nil
+}
+
+func (n Number) precedence() int {
+	if n < 0 {
+		// keep the sign next to the number, 2 ^ -1 reads better as 2 ^ (-1)
+		return 0
+	}
+	return maxPrecedence
+}
+
+// Str is a string literal, as used by label_replace and label_join.
+type Str string
+
+func (s Str) String() string {
+	return strconv.Quote(string(s))
+}
+
+func (s Str) validate() error {
+	return nil
+}
+
+func (s Str) precedence() int {
+	return maxPrecedence
+}
+
+// Paren wraps an expression in parentheses. Binary operations add the
+// parentheses they need on their own, so Paren is rarely needed.
+type Paren struct {
+	expr Expr
+}
+
+// Parens returns e in parentheses.
+func Parens(e Expr) Paren {
+	return Paren{expr: e}
+}
+
+func (p Paren) String() string {
+	return "(" + p.expr.String() + ")"
+}
+
+func (p Paren) validate() error {
+	if p.expr == nil {
+		return errors.New("empty expression in parentheses")
+	}
+	return p.expr.validate()
+}
+
+func (p Paren) precedence() int {
+	return maxPrecedence
+}
+
+// Call is a function call.
+type Call struct {
+	fn   string
+	args []Expr
+}
+
+// Func calls the PromQL function name with args. Build checks that the
+// function exists and that the arguments have the right types.
+func Func(name string, args ...Expr) Call {
+	return Call{fn: name, args: append([]Expr(nil), args...)}
+}
+
+// Rate returns rate(s[window]).
+func Rate(s Selector, window time.Duration) Call {
+	return Func("rate", s.Over(window))
+}
+
+// IRate returns irate(s[window]).
+func IRate(s Selector, window time.Duration) Call {
+	return Func("irate", s.Over(window))
+}
+
+// Increase returns increase(s[window]).
+func Increase(s Selector, window time.Duration) Call {
+	return Func("increase", s.Over(window))
+}
+
+func (c Call) String() string {
+	args := make([]string, len(c.args))
+	for i, a := range c.args {
+		args[i] = a.String()
+	}
+	return c.fn + "(" + strings.Join(args, ", ") + ")"
+}
+
+func (c Call) validate() error {
+	if _, ok := parser.Functions[c.fn]; !ok {
+		return fmt.Errorf("unknown function %q", c.fn)
+	}
+	for _, a := range c.args {
+		if a == nil {
+			return fmt.Errorf("empty argument to %s", c.fn)
+		}
+		if err := a.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Call) precedence() int {
+	return maxPrecedence
+}
+
+// Subquery evaluates an instant expression at every step of a range, for
+// the _over_time functions.
+type Subquery struct {
+	expr      Expr
+	rng, step time.Duration
+}
+
+// SubqueryOf returns e[rng:step]. A zero step uses the evaluation interval
+// of the server.
+func SubqueryOf(e Expr, rng, step time.Duration) Subquery {
+	return Subquery{expr: e, rng: rng, step: step}
+}
+
+func (s Subquery) String() string {
+	step := ""
+	if s.step > 0 {
+		step = model.Duration(s.step).String()
+	}
+	return operand(s.expr, maxPrecedence) + "[" + model.Duration(s.rng).String() + ":" + step + "]"
+}
+
+func (s Subquery) validate() error {
+	if s.expr == nil {
+		return errors.New("empty subquery")
+	}
+	if s.rng <= 0 || s.step < 0 {
+		return fmt.Errorf("invalid subquery range %s and step %s", s.rng, s.step)
+	}
+	if err := validateDuration(s.rng); err != nil {
+		return err
+	}
+	if err := validateDuration(s.step); err != nil {
+		return err
+	}
+	return s.expr.validate()
+}
+
+func (s Subquery) precedence() int {
+	return maxPrecedence
+}
+
+// Aggregation is an aggregation operator like sum or topk.
+type Aggregation struct {
+	op       string
+	param    Expr
+	expr     Expr
+	grouping []string
+	without  bool
+}
+
+// aggregators maps the aggregation operators to whether they take a
+// parameter.
+var aggregators = map[string]bool{
+	"sum":          false,
+	"avg":          false,
+	"min":          false,
+	"max":          false,
+	"count":        false,
+	"group":        false,
+	"stddev":       false,
+	"stdvar":       false,
+	"topk":         true,
+	"bottomk":      true,
+	"quantile":     true,
+	"count_values": true,
+}
+
+// Aggregate applies the aggregation operator op to e. param is the
+// parameter of topk, bottomk, quantile and count_values and must be nil for
+// the other operators.
+func Aggregate(op string, param, e Expr) Aggregation {
+	return Aggregation{op: op, param: param, expr: e}
+}
+
+func Sum(e Expr) Aggregation    { return Aggregate("sum", nil, e) }
+func Avg(e Expr) Aggregation    { return Aggregate("avg", nil, e) }
+func Min(e Expr) Aggregation    { return Aggregate("min", nil, e) }
+func Max(e Expr) Aggregation    { return Aggregate("max", nil, e) }
+func Count(e Expr) Aggregation  { return Aggregate("count", nil, e) }
+func Group(e Expr) Aggregation  { return Aggregate("group", nil, e) }
+func Stddev(e Expr) Aggregation { return Aggregate("stddev", nil, e) }
+
+func TopK(k int, e Expr) Aggregation    { return Aggregate("topk", Number(k), e) }
+func BottomK(k int, e Expr) Aggregation { return Aggregate("bottomk", Number(k), e) }
+
+func Quantile(q float64, e Expr) Aggregation { return Aggregate("quantile", Number(q), e) }
+
+// By returns a copy of a that keeps only the given labels.
+func (a Aggregation) By(labels ...string) Aggregation {
+	a.grouping = append([]string(nil), labels...)
+	a.without = false
+	return a
+}
+
+// Without returns a copy of a that drops the given labels.
+func (a Aggregation) Without(labels ...string) Aggregation {
+	a.grouping = append([]string(nil), labels...)
+	a.without = true
+	return a
+}
+
+func (a Aggregation) String() string {
+	var sb strings.Builder
+	sb.WriteString(a.op)
+	switch {
+	case a.without:
+		sb.WriteString(" without (" + strings.Join(a.grouping, ", ") + ") ")
+	case len(a.grouping) > 0:
+		sb.WriteString(" by (" + strings.Join(a.grouping, ", ") + ") ")
+	}
+	sb.WriteByte('(')
+	if a.param != nil {
+		sb.WriteString(a.param.String() + ", ")
+	}
+	sb.WriteString(a.expr.String() + ")")
+	return sb.String()
+}
+
+func (a Aggregation) validate() error {
+	withParam, ok := aggregators[a.op]
+	if !ok {
+		return fmt.Errorf("unknown aggregation %q", a.op)
+	}
+	if withParam != (a.param != nil) {
+		if a.param == nil {
+			return fmt.Errorf("aggregation %s needs a parameter", a.op)
+		}
+		return fmt.Errorf("aggregation %s doesn't take a parameter", a.op)
+	}
+	if a.param != nil {
+		if err := a.param.validate(); err != nil {
+			return err
+		}
+	}
+	if a.expr == nil {
+		return fmt.Errorf("empty expression in %s", a.op)
+	}
+	if err := validateLabelNames(a.grouping); err != nil {
+		return err
+	}
+	return a.expr.validate()
+}
+
+func (a Aggregation) precedence() int {
+	return maxPrecedence
+}
+
+// Binary is a binary operation.
+type Binary struct {
+	op         string
+	lhs, rhs   Expr
+	returnBool bool
+	matching   *vectorMatching
+}
+
+type vectorMatching struct {
+	on     bool
+	labels []string
+	// card is "left" or "right" for group_left and group_right
+	card    string
+	include []string
+}
+
+// precedences of the binary operators, from the PromQL grammar
+var precedences = map[string]int{
+	"or":     1,
+	"and":    2,
+	"unless": 2,
+	"==":     3,
+	"!=":     3,
+	"<=":     3,
+	"<":      3,
+	">=":     3,
+	">":      3,
+	"+":      4,
+	"-":      4,
+	"*":      5,
+	"/":      5,
+	"%":      5,
+	"atan2":  5,
+	"^":      6,
+}
+
+// BinaryOp applies op to lhs and rhs. Operands are put in parentheses where
+// the precedence of op requires it.
+func BinaryOp(op string, lhs, rhs Expr) Binary {
+	return Binary{op: op, lhs: lhs, rhs: rhs}
+}
+
+func Add(lhs, rhs Expr) Binary    { return BinaryOp("+", lhs, rhs) }
+func Sub(lhs, rhs Expr) Binary    { return BinaryOp("-", lhs, rhs) }
+func Mul(lhs, rhs Expr) Binary    { return BinaryOp("*", lhs, rhs) }
+func Div(lhs, rhs Expr) Binary    { return BinaryOp("/", lhs, rhs) }
+func And(lhs, rhs Expr) Binary    { return BinaryOp("and", lhs, rhs) }
+func Or(lhs, rhs Expr) Binary     { return BinaryOp("or", lhs, rhs) }
+func Unless(lhs, rhs Expr) Binary { return BinaryOp("unless", lhs, rhs) }
+func GT(lhs, rhs Expr) Binary     { return BinaryOp(">", lhs, rhs) }
+func LT(lhs, rhs Expr) Binary     { return BinaryOp("<", lhs, rhs) }
+
+// On returns a copy of b that matches series only on the given labels.
+func (b Binary) On(labels ...string) Binary {
+	b.matching = b.withMatching(true, labels)
+	return b
+}
+
+// Ignoring returns a copy of b that ignores the given labels when matching
+// series.
+func (b Binary) Ignoring(labels ...string) Binary {
+	b.matching = b.withMatching(false, labels)
+	return b
+}
+
+// GroupLeft returns a copy of b with many-to-one matching, copying the
+// given labels from the right hand side. It must follow On or Ignoring.
+func (b Binary) GroupLeft(labels ...string) Binary {
+	return b.group("left", labels)
+}
+
+// GroupRight returns a copy of b with one-to-many matching, copying the
+// given labels from the left hand side. It must follow On or Ignoring.
+func (b Binary) GroupRight(labels ...string) Binary {
+	return b.group("right", labels)
+}
+
+// Bool returns a copy of a comparison that returns 0 or 1 instead of
+// filtering.
+func (b Binary) Bool() Binary {
+	b.returnBool = true
+	return b
+}
+
+func (b Binary) withMatching(on bool, labels []string) *vectorMatching {
+	vm := &vectorMatching{}
+	if b.matching != nil {
+		*vm = *b.matching
+	}
+	vm.on = on
+	vm.labels = append([]string(nil), labels...)
+	return vm
+}
+
+func (b Binary) group(card string, labels []string) Binary {
+	if b.matching == nil {
+		b.matching = b.withMatching(false, nil)
+	} else {
+		vm := *b.matching
+		b.matching = &vm
+	}
+	b.matching.card = card
+	b.matching.include = append([]string(nil), labels...)
+	return b
+}
+
+func (b Binary) String() string {
+	var sb strings.Builder
+	p := b.precedence()
+	// ^ is right associative, all other operators are left associative
+	lp, rp := p, p+1
+	if b.op == "^" {
+		lp, rp = p+1, p
+	}
+	sb.WriteString(operand(b.lhs, lp))
+	sb.WriteString(" " + b.op)
+	if b.returnBool {
+		sb.WriteString(" bool")
+	}
+	if vm := b.matching; vm != nil && (vm.on || len(vm.labels) > 0) {
+		tag := "ignoring"
+		if vm.on {
+			tag = "on"
+		}
+		sb.WriteString(" " + tag + " (" + strings.Join(vm.labels, ", ") + ")")
+		if vm.card != "" {
+			sb.WriteString(" group_" + vm.card + " (" + strings.Join(vm.include, ", ") + ")")
+		}
+	}
+	sb.WriteString(" " + operand(b.rhs, rp))
+	return sb.String()
+}
+
+// operand returns e in parentheses if its precedence is lower than min.
+func operand(e Expr, min int) string {
+	if e.precedence() < min {
+		return "(" + e.String() + ")"
+	}
+	return e.String()
+}
+
+func (b Binary) validate() error {
+	if _, ok := precedences[b.op]; !ok {
+		return fmt.Errorf("unknown binary operator %q", b.op)
+	}
+	if b.lhs == nil || b.rhs == nil {
+		return fmt.Errorf("missing operand of %s", b.op)
+	}
+	if vm := b.matching; vm != nil {
+		if vm.card != "" && !vm.on && len(vm.labels) == 0 {
+			// the parser drops "ignoring ()", and group_x needs it
+			return fmt.Errorf("group_%s needs on or ignoring with labels", vm.card)
+		}
+		if err := validateLabelNames(vm.labels); err != nil {
+			return err
+		}
+		if err := validateLabelNames(vm.include); err != nil {
+			return err
+		}
+	}
+	if err := b.lhs.validate(); err != nil {
+		return err
+	}
+	return b.rhs.validate()
+}
+
+func (b Binary) precedence() int {
+	return precedences[b.op]
+}
@@ -0,0 +1,78 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package promql builds PromQL queries from typed selectors, functions,
+// aggregations and binary operations instead of formatting strings, so that
+// label values taken from user input can't change the meaning of a query.
+//
+//	q, err := promql.Build(
+//		promql.Sum(promql.Rate(promql.Metric("http_requests_total", promql.Eq("namespace", ns)), 5*time.Minute)).By("code"),
+//	)
+//
+// Expressions are printed in the same form as the upstream Prometheus
+// parser prints them, and Build checks that the query parses back to the
+// same expression.
+package promql
+
+import (
+	"fmt"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Expr is a PromQL expression.
+type Expr interface {
+	// String returns the expression without checking that it is valid. Use
+	// Build to get a query for sending to Prometheus.
+	String() string
+
+	validate() error
+	// precedence of the expression when it is the operand of a binary
+	// operation. Only binary operations have a precedence lower than
+	// maxPrecedence.
+	precedence() int
+}
+
+// Build validates e and returns it as a query. It is an error if e uses
+// invalid metric, label or function names, or if the upstream parser
+// doesn't read the query back as the same expression.
+func Build(e Expr) (string, error) {
+	if e == nil {
+		return "", fmt.Errorf("empty expression")
+	}
+	if err := e.validate(); err != nil {
+		return "", err
+	}
+	q := e.String()
+	parsed, err := parser.ParseExpr(q)
+	if err != nil {
+		return "", fmt.Errorf("invalid query %s: %w", q, err)
+	}
+	if s := parsed.String(); s != q {
+		return "", fmt.Errorf("query %s is parsed as %s", q, s)
+	}
+	return q, nil
+}
+
+// MustBuild is like Build but panics if e is invalid. It is meant for
+// queries built from constants.
+func MustBuild(e Expr) string {
+	q, err := Build(e)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
@@ -0,0 +1,286 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// escapingValues are label values that must reach Prometheus unchanged.
+var escapingValues = map[string]string{
+	"empty":          "",
+	"double quote":   `a"b`,
+	"closing brace":  `x"} or vector(1) or up{a="`,
+	"backslash":      `a\b`,
+	"trailing slash": `a\`,
+	"single quote":   `it's`,
+	"backtick":       "a`b",
+	"unicode":        "ünïcødé-名前-🚀",
+	"nul":            "a\x00b",
+	"newline":        "a\nb\tc\r",
+	"line separator": "a\u2028b\u2029c",
+	"invalid utf8":   "a\xffb",
+	"regex meta":     `.*+?()[]{}|^$`,
+}
+
+func TestMatcherRoundTrip(t *testing.T) {
+	for name, value := range escapingValues {
+		t.Run(name, func(t *testing.T) {
+			for _, m := range []Matcher{Eq("pod", value), Neq("pod", value)} {
+				sel := parse(t, Metric("up", m))
+				got := labelMatcher(t, sel, "pod")
+				if got.Value != value {
+					t.Errorf("%s: parsed value %q, want %q", m.Type, got.Value, value)
+				}
+				if string(m.Type) != got.Type.String() {
+					t.Errorf("parsed type %s, want %s", got.Type, m.Type)
+				}
+			}
+		})
+	}
+}
+
+func TestOneOfMatchesLiterally(t *testing.T) {
+	values := make([]string, 0, len(escapingValues))
+	for name, v := range escapingValues {
+		// regular expressions only match valid UTF-8
+		if v != "" && name != "invalid utf8" {
+			values = append(values, v)
+		}
+	}
+	sel := parse(t, Metric("up", OneOf("pod", values...)))
+	m := labelMatcher(t, sel, "pod")
+	for _, v := range values {
+		if !m.Matches(v) {
+			t.Errorf("%s doesn't match %q", m, v)
+		}
+	}
+	for _, v := range []string{"", "a", "ab", "xa\"b", `a\\b`} {
+		if m.Matches(v) {
+			t.Errorf("%s matches %q", m, v)
+		}
+	}
+}
+
+func TestStrRoundTrip(t *testing.T) {
+	for name, value := range escapingValues {
+		t.Run(name, func(t *testing.T) {
+			e := Func("label_join", Metric("up"), Str("dst"), Str(value), Str("a"), Str("b"))
+			args := parseExpr(t, e).(*parser.Call).Args
+			if got := args[2].(*parser.StringLiteral).Val; got != value {
+				t.Errorf("parsed separator %q, want %q", got, value)
+			}
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	ns := Eq("namespace", "default")
+	tests := []struct {
+		name string
+		expr Expr
+		want string
+	}{
+		{
+			name: "selector",
+			expr: Metric("up", Eq("job", "api"), ns),
+			want: `up{job="api",namespace="default"}`,
+		},
+		{
+			name: "matchers only",
+			expr: Metric("", Re("__name__", "up|down")),
+			want: `{__name__=~"up|down"}`,
+		},
+		{
+			name: "range and offset",
+			expr: Metric("up").Over(90 * time.Second).Offset(time.Hour),
+			want: `up[1m30s] offset 1h`,
+		},
+		{
+			name: "negative offset",
+			expr: Metric("up").Offset(-5 * time.Minute),
+			want: `up offset -5m`,
+		},
+		{
+			name: "rate",
+			expr: Rate(Metric("http_requests_total", ns), 5*time.Minute),
+			want: `rate(http_requests_total{namespace="default"}[5m])`,
+		},
+		{
+			name: "sum by",
+			expr: Sum(Rate(Metric("http_requests_total"), 5*time.Minute)).By("code", "method"),
+			want: `sum by (code, method) (rate(http_requests_total[5m]))`,
+		},
+		{
+			name: "without",
+			expr: Avg(Metric("up")).Without("instance"),
+			want: `avg without (instance) (up)`,
+		},
+		{
+			name: "topk",
+			expr: TopK(3, Metric("up")),
+			want: `topk(3, up)`,
+		},
+		{
+			name: "quantile",
+			expr: Quantile(0.99, Metric("latency")),
+			want: `quantile(0.99, latency)`,
+		},
+		{
+			name: "precedence",
+			expr: Mul(Add(Metric("a"), Metric("b")), Metric("c")),
+			want: `(a + b) * c`,
+		},
+		{
+			name: "no extra parentheses",
+			expr: Add(Metric("a"), Mul(Metric("b"), Metric("c"))),
+			want: `a + b * c`,
+		},
+		{
+			name: "left associative",
+			expr: Sub(Metric("a"), Sub(Metric("b"), Metric("c"))),
+			want: `a - (b - c)`,
+		},
+		{
+			name: "right associative",
+			expr: BinaryOp("^", BinaryOp("^", Metric("a"), Metric("b")), Metric("c")),
+			want: `(a ^ b) ^ c`,
+		},
+		{
+			name: "set operators",
+			expr: Or(Metric("a"), Unless(Metric("b"), Metric("c"))),
+			want: `a or b unless c`,
+		},
+		{
+			name: "or binds weakest",
+			expr: Unless(Or(Metric("a"), Metric("b")), Metric("c")),
+			want: `(a or b) unless c`,
+		},
+		{
+			name: "bool comparison",
+			expr: GT(Metric("a"), Number(0)).Bool(),
+			want: `a > bool 0`,
+		},
+		{
+			name: "group left",
+			expr: Mul(Metric("a"), Metric("b")).On("pod").GroupLeft("node"),
+			want: `a * on (pod) group_left (node) b`,
+		},
+		{
+			name: "ignoring group right",
+			expr: Div(Metric("a"), Metric("b")).Ignoring("le").GroupRight(),
+			want: `a / ignoring (le) group_right () b`,
+		},
+		{
+			name: "parens",
+			expr: Parens(Metric("up")),
+			want: `(up)`,
+		},
+		{
+			name: "subquery",
+			expr: Func("avg_over_time", SubqueryOf(Sum(Rate(Metric("a"), 5*time.Minute)).By("pod"), 24*time.Hour, 5*time.Minute)),
+			want: `avg_over_time(sum by (pod) (rate(a[5m]))[1d:5m])`,
+		},
+		{
+			name: "subquery of binary operation",
+			expr: Func("max_over_time", SubqueryOf(Div(Metric("a"), Metric("b")), time.Hour, 0)),
+			want: `max_over_time((a / b)[1h:])`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Build(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Build() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		expr Expr
+	}{
+		{name: "nil", expr: nil},
+		{name: "empty selector", expr: Metric("")},
+		{name: "metric name", expr: Metric("up{a=\"b\"}")},
+		{name: "label name", expr: Metric("up", Eq("a-b", "c"))},
+		{name: "label name injection", expr: Metric("up", Eq(`a="b"} or vector(1) or up{c`, "d"))},
+		{name: "match type", expr: Metric("up", Matcher{Name: "a", Type: "==", Value: "b"})},
+		{name: "regex", expr: Metric("up", Re("a", "("))},
+		{name: "function", expr: Func("drop_database", Metric("up"))},
+		{name: "argument type", expr: Func("rate", Metric("up"))},
+		{name: "grouping label", expr: Sum(Metric("up")).By("a b")},
+		{name: "operator", expr: BinaryOp("%%", Metric("a"), Metric("b"))},
+		{name: "group without on", expr: Mul(Metric("a"), Metric("b")).GroupLeft("c")},
+		{name: "sub millisecond", expr: Metric("up").Over(time.Microsecond)},
+		{name: "nan", expr: Number(math.NaN())},
+		{name: "subquery range", expr: Func("max_over_time", SubqueryOf(Metric("up"), 0, time.Minute))},
+		{name: "subquery argument type", expr: Func("abs", SubqueryOf(Metric("up"), time.Hour, time.Minute))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if q, err := Build(tt.expr); err == nil {
+				t.Errorf("Build() = %s, want error", q)
+			}
+		})
+	}
+}
+
+func parseExpr(t *testing.T, e Expr) parser.Expr {
+	t.Helper()
+	q, err := Build(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := parser.ParseExpr(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// parse builds e and returns the matchers of the first selector of the
+// parsed query.
+func parse(t *testing.T, e Expr) []*labels.Matcher {
+	t.Helper()
+	sels := parser.ExtractSelectors(parseExpr(t, e))
+	if len(sels) == 0 {
+		t.Fatalf("no selector in %s", e)
+	}
+	return sels[0]
+}
+
+func labelMatcher(t *testing.T, matchers []*labels.Matcher, name string) *labels.Matcher {
+	t.Helper()
+	for _, m := range matchers {
+		if m.Name == name {
+			return m
+		}
+	}
+	t.Fatalf("no matcher for label %s", name)
+	return nil
+}
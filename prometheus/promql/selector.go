@@ -0,0 +1,207 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promql
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// MatchType is the operator of a label matcher.
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher matches the value of a label.
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+}
+
+// Eq matches series where label name equals value.
+func Eq(name, value string) Matcher {
+	return Matcher{Name: name, Type: MatchEqual, Value: value}
+}
+
+// Neq matches series where label name doesn't equal value.
+func Neq(name, value string) Matcher {
+	return Matcher{Name: name, Type: MatchNotEqual, Value: value}
+}
+
+// Re matches series where label name fully matches the regular expression.
+func Re(name, re string) Matcher {
+	return Matcher{Name: name, Type: MatchRegexp, Value: re}
+}
+
+// Nre matches series where label name doesn't match the regular expression.
+func Nre(name, re string) Matcher {
+	return Matcher{Name: name, Type: MatchNotRegexp, Value: re}
+}
+
+// OneOf matches series where label name equals any of values. The values
+// are escaped, so they are matched literally.
+func OneOf(name string, values ...string) Matcher {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = regexp.QuoteMeta(v)
+	}
+	return Re(name, strings.Join(quoted, "|"))
+}
+
+// String returns the matcher with the value quoted the same way as the
+// Prometheus parser does.
+func (m Matcher) String() string {
+	return m.Name + string(m.Type) + strconv.Quote(m.Value)
+}
+
+func (m Matcher) validate() error {
+	if err := validateLabelName(m.Name); err != nil {
+		return err
+	}
+	switch m.Type {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		if _, err := regexp.Compile("^(?:" + m.Value + ")$"); err != nil {
+			return fmt.Errorf("invalid regular expression for label %s: %w", m.Name, err)
+		}
+	default:
+		return fmt.Errorf("invalid match type %q for label %s", m.Type, m.Name)
+	}
+	return nil
+}
+
+// Selector selects series by metric name and label matchers. With a range
+// it is a range vector selector.
+type Selector struct {
+	metric   string
+	matchers []Matcher
+	rng      time.Duration
+	offset   time.Duration
+}
+
+// Metric selects the series of a metric. The name may be empty if there
+// are matchers.
+func Metric(name string, matchers ...Matcher) Selector {
+	return Selector{metric: name, matchers: append([]Matcher(nil), matchers...)}
+}
+
+// Where returns a copy of s with additional matchers.
+func (s Selector) Where(matchers ...Matcher) Selector {
+	s.matchers = append(append([]Matcher(nil), s.matchers...), matchers...)
+	return s
+}
+
+// Over returns a copy of s that selects a range of d for each series.
+func (s Selector) Over(d time.Duration) Selector {
+	s.rng = d
+	return s
+}
+
+// Offset returns a copy of s shifted back in time by d.
+func (s Selector) Offset(d time.Duration) Selector {
+	s.offset = d
+	return s
+}
+
+func (s Selector) String() string {
+	var sb strings.Builder
+	sb.WriteString(s.metric)
+	if len(s.matchers) > 0 {
+		ms := make([]string, len(s.matchers))
+		for i, m := range s.matchers {
+			ms[i] = m.String()
+		}
+		// the parser prints matchers in sorted order
+		sort.Strings(ms)
+		sb.WriteByte('{')
+		sb.WriteString(strings.Join(ms, ","))
+		sb.WriteByte('}')
+	}
+	if s.rng > 0 {
+		sb.WriteString("[" + model.Duration(s.rng).String() + "]")
+	}
+	switch {
+	case s.offset > 0:
+		sb.WriteString(" offset " + model.Duration(s.offset).String())
+	case s.offset < 0:
+		sb.WriteString(" offset -" + model.Duration(-s.offset).String())
+	}
+	return sb.String()
+}
+
+func (s Selector) validate() error {
+	if s.metric == "" && len(s.matchers) == 0 {
+		return errors.New("selector must have a metric name or a label matcher")
+	}
+	if s.metric != "" && !model.IsValidLegacyMetricName(s.metric) {
+		return fmt.Errorf("invalid metric name %q", s.metric)
+	}
+	for _, m := range s.matchers {
+		if err := m.validate(); err != nil {
+			return err
+		}
+	}
+	if s.rng < 0 {
+		return fmt.Errorf("invalid range %s", s.rng)
+	}
+	if err := validateDuration(s.rng); err != nil {
+		return err
+	}
+	return validateDuration(s.offset)
+}
+
+func (s Selector) precedence() int {
+	return maxPrecedence
+}
+
+func validateLabelName(name string) error {
+	if !model.LabelName(name).IsValidLegacy() {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	return nil
+}
+
+func validateLabelNames(names []string) error {
+	for _, name := range names {
+		if err := validateLabelName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateDuration rejects durations that PromQL can't express, since it has
+// a resolution of one millisecond.
+func validateDuration(d time.Duration) error {
+	if d%time.Millisecond != 0 {
+		return fmt.Errorf("duration %s is not a multiple of 1ms", d)
+	}
+	return nil
+}
@@ -0,0 +1,766 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promtest
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// DefaultLookback is how far back an instant selector looks for a sample,
+// like the --query.lookback-delta of Prometheus. As in Prometheus 2, a sample
+// exactly DefaultLookback old is still selected.
+const DefaultLookback = 5 * time.Minute
+
+// DefaultSubqueryStep is the step of subqueries without one, like the
+// default evaluation_interval of Prometheus.
+const DefaultSubqueryStep = time.Minute
+
+type (
+	scalar float64
+	str    string
+	sample struct {
+		labels labels.Labels
+		v      float64
+	}
+	vector []sample
+	matrix []*Series
+)
+
+// evaluator evaluates an expression at one timestamp. It implements the
+// subset of PromQL that tests need: selectors with offsets, arithmetic,
+// comparison and set operators with vector matching, the common
+// aggregations and the counter and _over_time functions, also over
+// subqueries. The @ modifier is not supported.
+type evaluator struct {
+	db       *Storage
+	ts       int64
+	lookback int64
+}
+
+func (ev *evaluator) eval(expr parser.Expr) (interface{}, error) {
+	switch n := expr.(type) {
+	case *parser.NumberLiteral:
+		return scalar(n.Val), nil
+	case *parser.StringLiteral:
+		return str(n.Val), nil
+	case *parser.ParenExpr:
+		return ev.eval(n.Expr)
+	case *parser.StepInvariantExpr:
+		return ev.eval(n.Expr)
+	case *parser.UnaryExpr:
+		v, err := ev.eval(n.Expr)
+		if err != nil || n.Op != parser.SUB {
+			return v, err
+		}
+		switch v := v.(type) {
+		case scalar:
+			return -v, nil
+		case vector:
+			out := make(vector, len(v))
+			for i, s := range v {
+				out[i] = sample{labels: s.labels.DropMetricName(), v: -s.v}
+			}
+			return out, nil
+		}
+		return nil, fmt.Errorf("unexpected operand of unary minus: %s", n.Expr)
+	case *parser.VectorSelector:
+		return ev.vectorSelector(n)
+	case *parser.MatrixSelector:
+		return ev.matrixSelector(n)
+	case *parser.Call:
+		return ev.call(n)
+	case *parser.AggregateExpr:
+		return ev.aggregate(n)
+	case *parser.BinaryExpr:
+		return ev.binary(n)
+	case *parser.SubqueryExpr:
+		return nil, fmt.Errorf("subqueries are only supported as function arguments: %s", n)
+	}
+	return nil, fmt.Errorf("unsupported expression %T: %s", expr, expr)
+}
+
+func checkAt(vs *parser.VectorSelector) error {
+	if vs.Timestamp != nil || vs.StartOrEnd != 0 {
+		return fmt.Errorf("the @ modifier is not supported: %s", vs)
+	}
+	return nil
+}
+
+func (ev *evaluator) vectorSelector(vs *parser.VectorSelector) (vector, error) {
+	if err := checkAt(vs); err != nil {
+		return nil, err
+	}
+	t := ev.ts - vs.OriginalOffset.Milliseconds()
+	var out vector
+	for _, ser := range ev.db.Select(vs.LabelMatchers...) {
+		if smpl, ok := ser.latest(t-ev.lookback, t); ok {
+			out = append(out, sample{labels: ser.Labels, v: smpl.V})
+		}
+	}
+	return out, nil
+}
+
+func (ev *evaluator) matrixSelector(ms *parser.MatrixSelector) (matrix, error) {
+	vs, ok := ms.VectorSelector.(*parser.VectorSelector)
+	if !ok {
+		return nil, fmt.Errorf("unexpected range selector: %s", ms)
+	}
+	if err := checkAt(vs); err != nil {
+		return nil, err
+	}
+	t := ev.ts - vs.OriginalOffset.Milliseconds()
+	var out matrix
+	for _, ser := range ev.db.Select(vs.LabelMatchers...) {
+		if w := ser.samples(t-ms.Range.Milliseconds(), t); len(w) > 0 {
+			out = append(out, &Series{Labels: ser.Labels, Samples: w})
+		}
+	}
+	return out, nil
+}
+
+// subquery evaluates the inner expression of sq at every multiple of its
+// step in its range, like Prometheus 2 including a step at the start of
+// the range.
+func (ev *evaluator) subquery(sq *parser.SubqueryExpr) (matrix, error) {
+	if sq.Timestamp != nil || sq.StartOrEnd != 0 {
+		return nil, fmt.Errorf("the @ modifier is not supported: %s", sq)
+	}
+	step := sq.Step.Milliseconds()
+	if step == 0 {
+		step = DefaultSubqueryStep.Milliseconds()
+	}
+	end := ev.ts - sq.OriginalOffset.Milliseconds()
+	start := end - sq.Range.Milliseconds()
+	t := step * (start / step)
+	if t < start {
+		t += step
+	}
+
+	var out matrix
+	series := map[string]*Series{}
+	for ; t <= end; t += step {
+		inner := &evaluator{db: ev.db, ts: t, lookback: ev.lookback}
+		v, err := inner.evalVector(sq.Expr)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range v {
+			key := s.labels.String()
+			ser, ok := series[key]
+			if !ok {
+				ser = &Series{Labels: s.labels}
+				series[key] = ser
+				out = append(out, ser)
+			}
+			ser.Samples = append(ser.Samples, Sample{T: t, V: s.v})
+		}
+	}
+	return out, nil
+}
+
+// rangeFuncs compute a value from the samples of the range [start, end].
+// ok is false if there are too few samples.
+var rangeFuncs = map[string]func(pts []Sample, start, end int64) (v float64, ok bool){
+	"rate": func(pts []Sample, start, end int64) (float64, bool) {
+		return extrapolatedRate(pts, start, end, true, true)
+	},
+	"increase": func(pts []Sample, start, end int64) (float64, bool) {
+		return extrapolatedRate(pts, start, end, true, false)
+	},
+	"delta": func(pts []Sample, start, end int64) (float64, bool) {
+		return extrapolatedRate(pts, start, end, false, false)
+	},
+	"irate": func(pts []Sample, _, _ int64) (float64, bool) {
+		if len(pts) < 2 {
+			return 0, false
+		}
+		last, prev := pts[len(pts)-1], pts[len(pts)-2]
+		d := last.V - prev.V
+		if d < 0 {
+			d = last.V
+		}
+		return d / (float64(last.T-prev.T) / 1000), true
+	},
+	"avg_over_time": func(pts []Sample, _, _ int64) (float64, bool) {
+		var sum float64
+		for _, p := range pts {
+			sum += p.V
+		}
+		return sum / float64(len(pts)), true
+	},
+	"sum_over_time": func(pts []Sample, _, _ int64) (float64, bool) {
+		var sum float64
+		for _, p := range pts {
+			sum += p.V
+		}
+		return sum, true
+	},
+	"min_over_time": func(pts []Sample, _, _ int64) (float64, bool) {
+		v := pts[0].V
+		for _, p := range pts[1:] {
+			if p.V < v || math.IsNaN(v) {
+				v = p.V
+			}
+		}
+		return v, true
+	},
+	"max_over_time": func(pts []Sample, _, _ int64) (float64, bool) {
+		v := pts[0].V
+		for _, p := range pts[1:] {
+			if p.V > v || math.IsNaN(v) {
+				v = p.V
+			}
+		}
+		return v, true
+	},
+	"count_over_time": func(pts []Sample, _, _ int64) (float64, bool) {
+		return float64(len(pts)), true
+	},
+	"last_over_time": func(pts []Sample, _, _ int64) (float64, bool) {
+		return pts[len(pts)-1].V, true
+	},
+}
+
+// extrapolatedRate is the rate, increase and delta of Prometheus: the
+// difference between the first and last sample, adjusted for counter
+// resets and extrapolated to the edges of the range.
+func extrapolatedRate(pts []Sample, rangeStart, rangeEnd int64, isCounter, isRate bool) (float64, bool) {
+	if len(pts) < 2 {
+		return 0, false
+	}
+
+	first, last := pts[0], pts[len(pts)-1]
+	result := last.V - first.V
+	if isCounter {
+		prev := first.V
+		for _, p := range pts[1:] {
+			if p.V < prev {
+				result += prev
+			}
+			prev = p.V
+		}
+	}
+
+	durationToStart := float64(first.T-rangeStart) / 1000
+	durationToEnd := float64(rangeEnd-last.T) / 1000
+	sampledInterval := float64(last.T-first.T) / 1000
+	averageInterval := sampledInterval / float64(len(pts)-1)
+
+	// extrapolate to the edges of the range only if the series doesn't seem
+	// to start or end within it
+	threshold := averageInterval * 1.1
+	if durationToStart >= threshold {
+		durationToStart = averageInterval / 2
+	}
+	if isCounter && result > 0 && first.V >= 0 {
+		// a counter can't be extrapolated below zero
+		if durationToZero := sampledInterval * (first.V / result); durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+	if durationToEnd >= threshold {
+		durationToEnd = averageInterval / 2
+	}
+	factor := (sampledInterval + durationToStart + durationToEnd) / sampledInterval
+	if isRate {
+		factor /= float64(rangeEnd-rangeStart) / 1000
+	}
+	return result * factor, true
+}
+
+// mathFuncs are applied to every sample of a vector.
+var mathFuncs = map[string]func(float64) float64{
+	"abs":   math.Abs,
+	"ceil":  math.Ceil,
+	"floor": math.Floor,
+	"exp":   math.Exp,
+	"ln":    math.Log,
+	"log2":  math.Log2,
+	"log10": math.Log10,
+	"sqrt":  math.Sqrt,
+}
+
+func (ev *evaluator) call(c *parser.Call) (interface{}, error) {
+	name := c.Func.Name
+	if fn, ok := rangeFuncs[name]; ok {
+		var (
+			m          matrix
+			start, end int64
+			err        error
+		)
+		switch arg := unwrapParens(c.Args[0]).(type) {
+		case *parser.MatrixSelector:
+			end = ev.ts - arg.VectorSelector.(*parser.VectorSelector).OriginalOffset.Milliseconds()
+			start = end - arg.Range.Milliseconds()
+			m, err = ev.matrixSelector(arg)
+		case *parser.SubqueryExpr:
+			end = ev.ts - arg.OriginalOffset.Milliseconds()
+			start = end - arg.Range.Milliseconds()
+			m, err = ev.subquery(arg)
+		default:
+			return nil, fmt.Errorf("%s: only range selectors and subqueries are supported as argument, got %s", name, c.Args[0])
+		}
+		if err != nil {
+			return nil, err
+		}
+		var out vector
+		for _, ser := range m {
+			if v, ok := fn(ser.Samples, start, end); ok {
+				lbls := ser.Labels
+				if name != "last_over_time" {
+					lbls = lbls.DropMetricName()
+				}
+				out = append(out, sample{labels: lbls, v: v})
+			}
+		}
+		return out, nil
+	}
+	if fn, ok := mathFuncs[name]; ok {
+		v, err := ev.evalVector(c.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		out := make(vector, len(v))
+		for i, s := range v {
+			out[i] = sample{labels: s.labels.DropMetricName(), v: fn(s.v)}
+		}
+		return out, nil
+	}
+
+	switch name {
+	case "time":
+		return scalar(float64(ev.ts) / 1000), nil
+	case "vector":
+		v, err := ev.eval(c.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		return vector{{labels: labels.EmptyLabels(), v: float64(v.(scalar))}}, nil
+	case "scalar":
+		v, err := ev.evalVector(c.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(v) != 1 {
+			return scalar(math.NaN()), nil
+		}
+		return scalar(v[0].v), nil
+	case "timestamp":
+		vs, ok := unwrapParens(c.Args[0]).(*parser.VectorSelector)
+		if !ok {
+			return nil, fmt.Errorf("timestamp: only selectors are supported as argument, got %s", c.Args[0])
+		}
+		if err := checkAt(vs); err != nil {
+			return nil, err
+		}
+		t := ev.ts - vs.OriginalOffset.Milliseconds()
+		var out vector
+		for _, ser := range ev.db.Select(vs.LabelMatchers...) {
+			if smpl, ok := ser.latest(t-ev.lookback, t); ok {
+				out = append(out, sample{labels: ser.Labels.DropMetricName(), v: float64(smpl.T) / 1000})
+			}
+		}
+		return out, nil
+	case "label_replace":
+		return ev.labelReplace(c)
+	}
+	return nil, fmt.Errorf("function %s is not supported", name)
+}
+
+func (ev *evaluator) labelReplace(c *parser.Call) (vector, error) {
+	v, err := ev.evalVector(c.Args[0])
+	if err != nil {
+		return nil, err
+	}
+	var args [4]string
+	for i := range args {
+		s, err := ev.eval(c.Args[i+1])
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(s.(str))
+	}
+	dst, repl, src, expr := args[0], args[1], args[2], args[3]
+	re, err := regexp.Compile("^(?s:" + expr + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression in label_replace(): %s", expr)
+	}
+	if !model.LabelName(dst).IsValidLegacy() {
+		return nil, fmt.Errorf("invalid destination label name in label_replace(): %s", dst)
+	}
+	out := make(vector, 0, len(v))
+	for _, s := range v {
+		srcVal := s.labels.Get(src)
+		idx := re.FindStringSubmatchIndex(srcVal)
+		if idx == nil {
+			out = append(out, s)
+			continue
+		}
+		res := re.ExpandString(nil, repl, srcVal, idx)
+		out = append(out, sample{labels: labels.NewBuilder(s.labels).Set(dst, string(res)).Labels(), v: s.v})
+	}
+	return out, nil
+}
+
+func unwrapParens(e parser.Expr) parser.Expr {
+	for {
+		p, ok := e.(*parser.ParenExpr)
+		if !ok {
+			return e
+		}
+		e = p.Expr
+	}
+}
+
+func (ev *evaluator) evalVector(e parser.Expr) (vector, error) {
+	v, err := ev.eval(e)
+	if err != nil {
+		return nil, err
+	}
+	vec, ok := v.(vector)
+	if !ok {
+		return nil, fmt.Errorf("expected instant vector, got %T: %s", v, e)
+	}
+	return vec, nil
+}
+
+func (ev *evaluator) aggregate(a *parser.AggregateExpr) (vector, error) {
+	v, err := ev.evalVector(a.Expr)
+	if err != nil {
+		return nil, err
+	}
+	var param float64
+	if a.Param != nil {
+		p, err := ev.eval(a.Param)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := p.(scalar)
+		if !ok {
+			return nil, fmt.Errorf("unsupported parameter of %s: %s", a.Op, a.Param)
+		}
+		param = float64(s)
+	}
+
+	type group struct {
+		labels  labels.Labels
+		values  []float64
+		samples vector
+	}
+	groups := map[string]*group{}
+	var order []string
+	for _, s := range v {
+		b := labels.NewBuilder(s.labels)
+		if a.Without {
+			b.Del(a.Grouping...).Del(model.MetricNameLabel)
+		} else {
+			b.Keep(a.Grouping...)
+		}
+		lbls := b.Labels()
+		key := lbls.String()
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: lbls}
+			groups[key] = g
+			order = append(order, key)
+		}
+		g.values = append(g.values, s.v)
+		g.samples = append(g.samples, s)
+	}
+
+	var out vector
+	for _, key := range order {
+		g := groups[key]
+		switch a.Op {
+		case parser.SUM:
+			var sum float64
+			for _, x := range g.values {
+				sum += x
+			}
+			out = append(out, sample{labels: g.labels, v: sum})
+		case parser.AVG:
+			var sum float64
+			for _, x := range g.values {
+				sum += x
+			}
+			out = append(out, sample{labels: g.labels, v: sum / float64(len(g.values))})
+		case parser.MIN, parser.MAX:
+			m := g.values[0]
+			for _, x := range g.values[1:] {
+				if math.IsNaN(m) || (a.Op == parser.MIN && x < m) || (a.Op == parser.MAX && x > m) {
+					m = x
+				}
+			}
+			out = append(out, sample{labels: g.labels, v: m})
+		case parser.COUNT:
+			out = append(out, sample{labels: g.labels, v: float64(len(g.values))})
+		case parser.GROUP:
+			out = append(out, sample{labels: g.labels, v: 1})
+		case parser.TOPK, parser.BOTTOMK:
+			ss := append(vector(nil), g.samples...)
+			sort.SliceStable(ss, func(i, j int) bool {
+				if a.Op == parser.TOPK {
+					return ss[i].v > ss[j].v
+				}
+				return ss[i].v < ss[j].v
+			})
+			if k := int(param); k < len(ss) {
+				ss = ss[:max(k, 0)]
+			}
+			out = append(out, ss...)
+		default:
+			return nil, fmt.Errorf("aggregation %s is not supported", a.Op)
+		}
+	}
+	return out, nil
+}
+
+func (ev *evaluator) binary(b *parser.BinaryExpr) (interface{}, error) {
+	lhs, err := ev.eval(b.LHS)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := ev.eval(b.RHS)
+	if err != nil {
+		return nil, err
+	}
+	switch l := lhs.(type) {
+	case scalar:
+		switch r := rhs.(type) {
+		case scalar:
+			v, _ := binop(b.Op, float64(l), float64(r))
+			return scalar(v), nil
+		case vector:
+			return vectorScalar(b, r, float64(l), true), nil
+		}
+	case vector:
+		switch r := rhs.(type) {
+		case scalar:
+			return vectorScalar(b, l, float64(r), false), nil
+		case vector:
+			if b.Op.IsSetOperator() {
+				return setOp(b, l, r), nil
+			}
+			return vectorVector(b, l, r)
+		}
+	}
+	return nil, fmt.Errorf("unsupported operands of %s: %s", b.Op, b)
+}
+
+// binop returns the result of op and, for comparisons, whether it is true.
+func binop(op parser.ItemType, l, r float64) (float64, bool) {
+	switch op {
+	case parser.ADD:
+		return l + r, true
+	case parser.SUB:
+		return l - r, true
+	case parser.MUL:
+		return l * r, true
+	case parser.DIV:
+		return l / r, true
+	case parser.MOD:
+		return math.Mod(l, r), true
+	case parser.POW:
+		return math.Pow(l, r), true
+	case parser.ATAN2:
+		return math.Atan2(l, r), true
+	}
+	var ok bool
+	switch op {
+	case parser.EQLC:
+		ok = l == r
+	case parser.NEQ:
+		ok = l != r
+	case parser.GTR:
+		ok = l > r
+	case parser.LSS:
+		ok = l < r
+	case parser.GTE:
+		ok = l >= r
+	case parser.LTE:
+		ok = l <= r
+	}
+	if ok {
+		return 1, true
+	}
+	return 0, false
+}
+
+// compare returns the sample value a comparison keeps, or 0/1 with bool.
+func compare(b *parser.BinaryExpr, l, r, keep float64) (float64, bool) {
+	v, ok := binop(b.Op, l, r)
+	if !b.Op.IsComparisonOperator() {
+		return v, true
+	}
+	if b.ReturnBool {
+		return v, true
+	}
+	return keep, ok
+}
+
+func resultLabels(b *parser.BinaryExpr, lbls labels.Labels) labels.Labels {
+	if !b.Op.IsComparisonOperator() || b.ReturnBool {
+		return lbls.DropMetricName()
+	}
+	return lbls
+}
+
+func vectorScalar(b *parser.BinaryExpr, v vector, s float64, scalarLeft bool) vector {
+	var out vector
+	for _, smpl := range v {
+		l, r := smpl.v, s
+		if scalarLeft {
+			l, r = s, smpl.v
+		}
+		if x, ok := compare(b, l, r, smpl.v); ok {
+			out = append(out, sample{labels: resultLabels(b, smpl.labels), v: x})
+		}
+	}
+	return out
+}
+
+// signature returns the labels two samples are matched on.
+func signature(m *parser.VectorMatching, lbls labels.Labels) string {
+	if m == nil {
+		return lbls.DropMetricName().String()
+	}
+	b := labels.NewBuilder(lbls)
+	if m.On {
+		b.Keep(m.MatchingLabels...)
+	} else {
+		b.Del(m.MatchingLabels...).Del(model.MetricNameLabel)
+	}
+	return b.Labels().String()
+}
+
+func setOp(b *parser.BinaryExpr, l, r vector) vector {
+	rsigs := map[string]bool{}
+	for _, s := range r {
+		rsigs[signature(b.VectorMatching, s.labels)] = true
+	}
+	var out vector
+	switch b.Op {
+	case parser.LAND:
+		for _, s := range l {
+			if rsigs[signature(b.VectorMatching, s.labels)] {
+				out = append(out, s)
+			}
+		}
+	case parser.LUNLESS:
+		for _, s := range l {
+			if !rsigs[signature(b.VectorMatching, s.labels)] {
+				out = append(out, s)
+			}
+		}
+	case parser.LOR:
+		lsigs := map[string]bool{}
+		for _, s := range l {
+			lsigs[signature(b.VectorMatching, s.labels)] = true
+			out = append(out, s)
+		}
+		for _, s := range r {
+			if !lsigs[signature(b.VectorMatching, s.labels)] {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+func vectorVector(b *parser.BinaryExpr, l, r vector) (vector, error) {
+	m := b.VectorMatching
+	if m == nil {
+		m = &parser.VectorMatching{Card: parser.CardOneToOne}
+	}
+	// the "one" side of the match is indexed, the other is iterated
+	many, one := l, r
+	if m.Card == parser.CardOneToMany {
+		many, one = r, l
+	}
+	index := make(map[string]sample, len(one))
+	for _, s := range one {
+		sig := signature(m, s.labels)
+		if _, dup := index[sig]; dup {
+			return nil, fmt.Errorf("found duplicate series for the match group %s on the %s hand-side of the operation; many-to-many matching not allowed: matching labels must be unique on one side", sig, side(m.Card != parser.CardOneToMany))
+		}
+		index[sig] = s
+	}
+
+	var out vector
+	seen := map[string]bool{}
+	results := map[string]bool{}
+	for _, s := range many {
+		sig := signature(m, s.labels)
+		o, ok := index[sig]
+		if !ok {
+			continue
+		}
+		ls, rs := s, o
+		if m.Card == parser.CardOneToMany {
+			ls, rs = o, s
+		}
+		v, keep := compare(b, ls.v, rs.v, ls.v)
+		if !keep {
+			continue
+		}
+
+		lb := labels.NewBuilder(resultLabels(b, s.labels))
+		if m.Card == parser.CardOneToOne {
+			if m.On {
+				lb.Keep(m.MatchingLabels...)
+			} else {
+				lb.Del(m.MatchingLabels...)
+			}
+		}
+		for _, name := range m.Include {
+			if val := o.labels.Get(name); val != "" {
+				lb.Set(name, val)
+			} else {
+				lb.Del(name)
+			}
+		}
+		lbls := lb.Labels()
+		if m.Card == parser.CardOneToOne {
+			if seen[sig] {
+				return nil, fmt.Errorf("multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)")
+			}
+			seen[sig] = true
+		} else {
+			if results[lbls.String()] {
+				return nil, fmt.Errorf("multiple matches for labels: grouping labels must ensure unique matches")
+			}
+			results[lbls.String()] = true
+		}
+		out = append(out, sample{labels: lbls, v: v})
+	}
+	return out, nil
+}
+
+func side(right bool) string {
+	if right {
+		return "right"
+	}
+	return "left"
+}
@@ -0,0 +1,540 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promtest
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// The expected values are the ones Prometheus 2.55 returns for the same
+// samples. Both the lookback of instant selectors and the range of range
+// selectors include their start, which changed to exclusive in 3.0.
+
+// testStorage returns 10 minutes of samples every 15s from DefaultStart:
+//
+//	counter{job="a"}   grows by 1/s from 0
+//	counter{job="b"}   grows by 2/s from 0
+//	gauge              40, 39, ..., 0
+//	reset              0, 10, 20, 5, 15 in the first minute
+//	late{start="100"}  grows by 1/s from 100, starting at 5m
+//	late{start="3"}    grows by 1/s from 3, starting at 5m
+//	gone               1 in the first minute, then a staleness marker
+func testStorage() *Storage {
+	db := NewStorage()
+	g := Generator{Start: DefaultStart, Interval: 15 * time.Second, Points: 41}
+	g.Counter(db, "counter", map[string]string{"job": "a"}, 1)
+	g.Counter(db, "counter", map[string]string{"job": "b"}, 2)
+	g.Gauge(db, "gauge", nil, func(i int) float64 { return float64(40 - i) })
+	for i, v := range []float64{0, 10, 20, 5, 15} {
+		db.Add("reset", nil, at(time.Duration(i)*15*time.Second), v)
+	}
+	Generator{Start: DefaultStart, Interval: 15 * time.Second, Points: 4}.Constant(db, "gone", nil, 1)
+	db.Stale("gone", nil, at(time.Minute))
+	late := Generator{Start: DefaultStart.Add(5 * time.Minute), Interval: 15 * time.Second, Points: 21}
+	for _, start := range []float64{100, 3} {
+		late.Gauge(db, "late", map[string]string{"start": fmt.Sprint(start)}, func(i int) float64 {
+			return start + float64(i)*15
+		})
+	}
+	return db
+}
+
+func at(d time.Duration) time.Time {
+	return DefaultStart.Add(d)
+}
+
+func TestEval(t *testing.T) {
+	db := testStorage()
+	end := 10 * time.Minute
+
+	tests := []struct {
+		name  string
+		query string
+		at    time.Duration
+		want  map[string]float64
+	}{
+		// selectors
+		{
+			name:  "selector",
+			query: `counter`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="a"}`: 600, `{__name__="counter", job="b"}`: 1200},
+		},
+		{
+			name:  "equal matcher",
+			query: `counter{job="b"}`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="b"}`: 1200},
+		},
+		{
+			name:  "regex matcher is anchored",
+			query: `counter{job=~"a|c"}`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="a"}`: 600},
+		},
+		{
+			name:  "negative regex matcher",
+			query: `counter{job!~"a"}`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="b"}`: 1200},
+		},
+		{
+			name:  "empty matcher selects series without the label",
+			query: `{__name__=~"counter|gauge", job=""}`,
+			at:    end,
+			want:  map[string]float64{`{__name__="gauge"}`: 0},
+		},
+		{
+			name:  "latest sample between scrapes",
+			query: `counter{job="a"}`,
+			at:    end - 7*time.Second,
+			want:  map[string]float64{`{__name__="counter", job="a"}`: 585},
+		},
+		{
+			name:  "sample at the start of the lookback",
+			query: `counter{job="a"}`,
+			at:    end + 5*time.Minute,
+			want:  map[string]float64{`{__name__="counter", job="a"}`: 600},
+		},
+		{
+			name:  "sample older than the lookback",
+			query: `counter{job="a"}`,
+			at:    end + 5*time.Minute + time.Millisecond,
+			want:  map[string]float64{},
+		},
+		{
+			name:  "offset",
+			query: `counter{job="a"} offset 5m`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="a"}`: 300},
+		},
+		{
+			name:  "negative offset",
+			query: `counter{job="a"} offset -1m`,
+			at:    end - 2*time.Minute,
+			want:  map[string]float64{`{__name__="counter", job="a"}`: 540},
+		},
+		{
+			name:  "selector before a staleness marker",
+			query: `gone`,
+			at:    45 * time.Second,
+			want:  map[string]float64{`{__name__="gone"}`: 1},
+		},
+		{
+			name:  "stale series within the lookback",
+			query: `gone`,
+			at:    2 * time.Minute,
+			want:  map[string]float64{},
+		},
+
+		// rate and friends
+		{
+			name:  "rate",
+			query: `rate(counter[1m])`,
+			at:    end,
+			want:  map[string]float64{`{job="a"}`: 1, `{job="b"}`: 2},
+		},
+		{
+			name:  "rate between scrapes is extrapolated",
+			query: `rate(counter{job="a"}[1m])`,
+			at:    end - 7500*time.Millisecond,
+			want:  map[string]float64{`{job="a"}`: 1},
+		},
+		{
+			name:  "rate with offset",
+			query: `rate(counter{job="b"}[5m] offset 2m)`,
+			at:    end,
+			want:  map[string]float64{`{job="b"}`: 2},
+		},
+		{
+			name:  "increase",
+			query: `increase(counter{job="a"}[1m])`,
+			at:    end,
+			want:  map[string]float64{`{job="a"}`: 60},
+		},
+		{
+			name:  "counter reset",
+			query: `increase(reset[1m])`,
+			at:    time.Minute,
+			// 15 - 0 plus the 20 before the reset
+			want: map[string]float64{`{}`: 35},
+		},
+		{
+			name:  "rate over a counter reset",
+			query: `rate(reset[1m])`,
+			at:    time.Minute,
+			want:  map[string]float64{`{}`: 35.0 / 60},
+		},
+		{
+			name:  "series starting within the range",
+			query: `rate(late{start="100"}[10m])`,
+			at:    end,
+			// extrapolated by half a scrape interval to the start:
+			// 300 * (300 + 7.5) / 300 / 600
+			want: map[string]float64{`{start="100"}`: 0.5125},
+		},
+		{
+			name:  "counter is not extrapolated below zero",
+			query: `rate(late{start="3"}[10m])`,
+			at:    end,
+			// extrapolated by 3s to where the counter would be zero
+			want: map[string]float64{`{start="3"}`: 0.505},
+		},
+		{
+			name:  "rate needs two samples",
+			query: `rate(counter[10s])`,
+			at:    end,
+			want:  map[string]float64{},
+		},
+		{
+			name:  "delta is not corrected for resets",
+			query: `delta(gauge[1m])`,
+			at:    end,
+			want:  map[string]float64{`{}`: -4},
+		},
+		{
+			name:  "irate",
+			query: `irate(counter{job="b"}[1m])`,
+			at:    end,
+			want:  map[string]float64{`{job="b"}`: 2},
+		},
+		{
+			name:  "irate after a reset",
+			query: `irate(reset[1m])`,
+			at:    45 * time.Second,
+			want:  map[string]float64{`{}`: 5.0 / 15},
+		},
+		{
+			name:  "avg_over_time",
+			query: `avg_over_time(gauge[1m])`,
+			at:    end,
+			want:  map[string]float64{`{}`: 2},
+		},
+		{
+			name:  "count_over_time includes the start of the range",
+			query: `count_over_time(gauge[1m])`,
+			at:    end,
+			want:  map[string]float64{`{}`: 5},
+		},
+		{
+			name:  "last_over_time keeps the metric name",
+			query: `last_over_time(gauge[1m])`,
+			at:    end,
+			want:  map[string]float64{`{__name__="gauge"}`: 0},
+		},
+		{
+			name:  "range skips staleness markers",
+			query: `count_over_time(gone[2m])`,
+			at:    2 * time.Minute,
+			want:  map[string]float64{`{}`: 4},
+		},
+
+		// subqueries
+		{
+			name:  "subquery includes the step at the start of the range",
+			query: `sum_over_time(rate(counter{job="a"}[1m])[5m:1m])`,
+			at:    end,
+			want:  map[string]float64{`{job="a"}`: 6},
+		},
+		{
+			name:  "subquery steps are aligned",
+			query: `count_over_time(vector(1)[5m:1m])`,
+			at:    end - 30*time.Second,
+			want:  map[string]float64{`{}`: 5},
+		},
+		{
+			name:  "subquery of series that start within the range",
+			query: `count_over_time(late[10m:1m])`,
+			at:    end,
+			want:  map[string]float64{`{start="100"}`: 6, `{start="3"}`: 6},
+		},
+		{
+			name:  "subquery with offset",
+			query: `max_over_time(sum(late)[2m:1m] offset 5m)`,
+			at:    end,
+			want:  map[string]float64{`{}`: 103},
+		},
+
+		// aggregations
+		{
+			name:  "sum",
+			query: `sum(rate(counter[1m]))`,
+			at:    end,
+			want:  map[string]float64{`{}`: 3},
+		},
+		{
+			name:  "sum by",
+			query: `sum by (job) (rate(counter[1m]))`,
+			at:    end,
+			want:  map[string]float64{`{job="a"}`: 1, `{job="b"}`: 2},
+		},
+		{
+			name:  "sum by a missing label",
+			query: `sum by (instance) (counter)`,
+			at:    end,
+			want:  map[string]float64{`{}`: 1800},
+		},
+		{
+			name:  "sum without drops the metric name",
+			query: `sum without (job) (counter)`,
+			at:    end,
+			want:  map[string]float64{`{}`: 1800},
+		},
+		{
+			name:  "avg",
+			query: `avg(counter)`,
+			at:    end,
+			want:  map[string]float64{`{}`: 900},
+		},
+		{
+			name:  "min and max",
+			query: `max(counter) - min(counter)`,
+			at:    end,
+			want:  map[string]float64{`{}`: 600},
+		},
+		{
+			name:  "count",
+			query: `count by (job) (counter)`,
+			at:    end,
+			want:  map[string]float64{`{job="a"}`: 1, `{job="b"}`: 1},
+		},
+		{
+			name:  "topk keeps the labels",
+			query: `topk(1, counter)`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="b"}`: 1200},
+		},
+		{
+			name:  "bottomk",
+			query: `bottomk(1, counter)`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="a"}`: 600},
+		},
+
+		// binary operations
+		{
+			name:  "vector times scalar drops the metric name",
+			query: `counter * 2`,
+			at:    end,
+			want:  map[string]float64{`{job="a"}`: 1200, `{job="b"}`: 2400},
+		},
+		{
+			name:  "scalar minus vector",
+			query: `1000 - counter`,
+			at:    end,
+			want:  map[string]float64{`{job="a"}`: 400, `{job="b"}`: -200},
+		},
+		{
+			name:  "comparison filters and keeps the metric name",
+			query: `counter > 1000`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="b"}`: 1200},
+		},
+		{
+			name:  "comparison with the scalar on the left keeps the vector value",
+			query: `1000 < counter`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="b"}`: 1200},
+		},
+		{
+			name:  "bool comparison",
+			query: `counter > bool 1000`,
+			at:    end,
+			want:  map[string]float64{`{job="a"}`: 0, `{job="b"}`: 1},
+		},
+		{
+			name:  "many to one",
+			query: `counter / ignoring (job) group_left () gauge offset 5m`,
+			at:    end,
+			// 20 at 5m
+			want: map[string]float64{`{job="a"}`: 30, `{job="b"}`: 60},
+		},
+		{
+			name:  "one to one on labels",
+			query: `rate(counter[1m]) / on (job) counter`,
+			at:    end,
+			want:  map[string]float64{`{job="a"}`: 1.0 / 600, `{job="b"}`: 2.0 / 1200},
+		},
+		{
+			name:  "group_left copies labels from the one side",
+			query: `counter * on () group_left (start) late{start="3"}`,
+			at:    end,
+			want:  map[string]float64{`{job="a", start="3"}`: 600 * 303, `{job="b", start="3"}`: 1200 * 303},
+		},
+		{
+			name:  "group_right",
+			query: `late{start="3"} * on () group_right (start) counter`,
+			at:    end,
+			want:  map[string]float64{`{job="a", start="3"}`: 600 * 303, `{job="b", start="3"}`: 1200 * 303},
+		},
+		{
+			name:  "comparison with group_right keeps the left value",
+			query: `late{start="3"} < on () group_right counter`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="a"}`: 303, `{__name__="counter", job="b"}`: 303},
+		},
+		{
+			name:  "and",
+			query: `counter and on (job) rate(counter{job="a"}[1m])`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="a"}`: 600},
+		},
+		{
+			name:  "or",
+			query: `counter{job="a"} or counter`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="a"}`: 600, `{__name__="counter", job="b"}`: 1200},
+		},
+		{
+			name:  "unless",
+			query: `counter unless counter{job="a"}`,
+			at:    end,
+			want:  map[string]float64{`{__name__="counter", job="b"}`: 1200},
+		},
+
+		// other functions
+		{
+			name:  "label_replace",
+			query: `label_replace(counter, "team", "team-$1", "job", "(.*)")`,
+			at:    end,
+			want: map[string]float64{
+				`{__name__="counter", job="a", team="team-a"}`: 600,
+				`{__name__="counter", job="b", team="team-b"}`: 1200,
+			},
+		},
+		{
+			name:  "timestamp",
+			query: `timestamp(gauge)`,
+			at:    end - time.Second,
+			want:  map[string]float64{`{}`: float64(at(end - 15*time.Second).Unix())},
+		},
+		{
+			name:  "vector",
+			query: `vector(1) + 1`,
+			at:    end,
+			want:  map[string]float64{`{}`: 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := evalAt(db, tt.query, at(tt.at))
+			if err != nil {
+				t.Fatal(err)
+			}
+			vec, ok := v.(vector)
+			if !ok {
+				t.Fatalf("got %T, want vector", v)
+			}
+			got := map[string]float64{}
+			for _, s := range vec {
+				if _, dup := got[s.labels.String()]; dup {
+					t.Errorf("duplicate series %s", s.labels)
+				}
+				got[s.labels.String()] = s.v
+			}
+			assertSamples(t, got, tt.want)
+		})
+	}
+}
+
+func TestEvalScalar(t *testing.T) {
+	db := testStorage()
+	for query, want := range map[string]float64{
+		`1 + 2 * 3`:                      7,
+		`2 ^ 3 ^ 2`:                      512,
+		`-(1 - 3)`:                       2,
+		`scalar(counter{job="a"})`:       600,
+		`time()`:                         float64(at(10 * time.Minute).Unix()),
+		`scalar(counter)`:                math.NaN(),
+		`scalar(sum(rate(counter[1m])))`: 3,
+	} {
+		t.Run(query, func(t *testing.T) {
+			v, err := evalAt(db, query, at(10*time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, ok := v.(scalar)
+			if !ok {
+				t.Fatalf("got %T, want scalar", v)
+			}
+			if !equal(float64(s), want) {
+				t.Errorf("got %v, want %v", s, want)
+			}
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	db := testStorage()
+	for query, want := range map[string]string{
+		// both jobs of counter match the one series of gauge
+		`gauge - on () counter`: "found duplicate series for the match group {} on the right hand-side",
+		`counter - on () gauge`: "multiple matches for labels: many-to-one matching must be explicit",
+		// gauge and reset both have no labels once the metric name is dropped
+		`{__name__=~"gauge|reset"} * on () group_left vector(1)`: "multiple matches for labels: grouping labels must ensure unique matches",
+		`counter[5m:1m]`:                   "only supported as function arguments",
+		`counter @ 100`:                    "the @ modifier is not supported",
+		`stddev(counter)`:                  "aggregation stddev is not supported",
+		`histogram_quantile(0.9, counter)`: "function histogram_quantile is not supported",
+	} {
+		t.Run(query, func(t *testing.T) {
+			_, err := evalAt(db, query, at(time.Minute))
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("got error %v, want %q", err, want)
+			}
+		})
+	}
+}
+
+func evalAt(db *Storage, query string, ts time.Time) (interface{}, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, err
+	}
+	ev := &evaluator{db: db, ts: ts.UnixMilli(), lookback: DefaultLookback.Milliseconds()}
+	return ev.eval(expr)
+}
+
+func assertSamples(t *testing.T, got, want map[string]float64) {
+	t.Helper()
+	for k, w := range want {
+		g, ok := got[k]
+		if !ok {
+			t.Errorf("missing series %s", k)
+		} else if !equal(g, w) {
+			t.Errorf("%s = %v, want %v", k, g, w)
+		}
+	}
+	for k, g := range got {
+		if _, ok := want[k]; !ok {
+			t.Errorf("unexpected series %s = %v", k, g)
+		}
+	}
+}
+
+func equal(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
@@ -0,0 +1,167 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promtest
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// LoadOpenMetricsFile reads the samples of an OpenMetrics file, see
+// LoadOpenMetrics.
+func (s *Storage) LoadOpenMetricsFile(filename string, defaultTime time.Time) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := s.LoadOpenMetrics(f, defaultTime); err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return nil
+}
+
+// LoadOpenMetrics reads samples in the OpenMetrics text format, like the
+// output of `read-prom range -o openmetrics`. A series may have many
+// samples with timestamps in seconds; samples without a timestamp are put
+// at defaultTime. Comments, metadata and exemplars are ignored.
+func (s *Storage) LoadOpenMetrics(r io.Reader, defaultTime time.Time) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		lbls, smpl, err := parseSampleLine(text, defaultTime)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		s.Append(lbls, smpl)
+	}
+	return sc.Err()
+}
+
+// parseSampleLine parses `name{label="value",...} value [timestamp]`.
+func parseSampleLine(text string, defaultTime time.Time) (labels.Labels, Sample, error) {
+	// drop an exemplar
+	if i := strings.Index(text, " # "); i >= 0 {
+		text = text[:i]
+	}
+
+	end := strings.IndexAny(text, "{ ")
+	if end <= 0 {
+		return labels.EmptyLabels(), Sample{}, errors.New("missing metric name")
+	}
+	b := labels.NewScratchBuilder(8)
+	b.Add(model.MetricNameLabel, text[:end])
+	rest := text[end:]
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		if rest, err = parseLabels(rest[1:], &b); err != nil {
+			return labels.EmptyLabels(), Sample{}, err
+		}
+	}
+	b.Sort()
+	lbls := b.Labels()
+	if name, dup := lbls.HasDuplicateLabelNames(); dup {
+		return labels.EmptyLabels(), Sample{}, fmt.Errorf("duplicate label %s", name)
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return labels.EmptyLabels(), Sample{}, fmt.Errorf("expected a value and an optional timestamp, got %q", rest)
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return labels.EmptyLabels(), Sample{}, fmt.Errorf("invalid value %q", fields[0])
+	}
+	t := defaultTime.UnixMilli()
+	if len(fields) == 2 {
+		ts, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return labels.EmptyLabels(), Sample{}, fmt.Errorf("invalid timestamp %q", fields[1])
+		}
+		t = int64(math.Round(ts * 1000))
+	}
+	return lbls, Sample{T: t, V: v}, nil
+}
+
+// parseLabels parses the labels after the opening brace and returns the
+// text after the closing brace.
+func parseLabels(s string, b *labels.ScratchBuilder) (string, error) {
+	for {
+		s = strings.TrimLeft(s, " ")
+		if strings.HasPrefix(s, "}") {
+			return s[1:], nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return "", errors.New("invalid label")
+		}
+		name := strings.TrimSpace(s[:eq])
+		if !model.LabelName(name).IsValidLegacy() {
+			return "", fmt.Errorf("invalid label name %q", name)
+		}
+		s = strings.TrimLeft(s[eq+1:], " ")
+		if !strings.HasPrefix(s, `"`) {
+			return "", fmt.Errorf("label %s: value must be quoted", name)
+		}
+		var sb strings.Builder
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] != '\\' {
+				sb.WriteByte(s[i])
+				continue
+			}
+			i++
+			if i == len(s) {
+				break
+			}
+			switch s[i] {
+			case 'n':
+				sb.WriteByte('\n')
+			case '\\', '"':
+				sb.WriteByte(s[i])
+			default:
+				return "", fmt.Errorf("label %s: invalid escape \\%c", name, s[i])
+			}
+		}
+		if i >= len(s) {
+			return "", fmt.Errorf("label %s: unterminated value", name)
+		}
+		if sb.Len() > 0 {
+			b.Add(name, sb.String())
+		}
+		s = strings.TrimLeft(s[i+1:], " ")
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return "", fmt.Errorf("label %s: expected , or }", name)
+		}
+	}
+}
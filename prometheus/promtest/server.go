@@ -0,0 +1,604 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package promtest is a stand-in for the Prometheus HTTP API, so that
+// read-prom, the Trickster config and the auth proxy can be tested end to
+// end without a cluster. Series are kept in memory and come from a
+// Generator or an OpenMetrics file. Queries are parsed with the upstream
+// PromQL parser and evaluated by a small engine that covers selectors,
+// functions like rate and aggregations like sum by. Samples and metadata
+// pushed to /api/v1/write with remote write are added to the storage.
+package promtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+)
+
+// BuildInfo is served by /api/v1/status/buildinfo.
+var BuildInfo = promv1.BuildinfoResult{
+	Version:   "2.55.1",
+	Revision:  "promtest",
+	Branch:    "HEAD",
+	BuildUser: "promtest",
+	BuildDate: "20260101-00:00:00",
+	GoVersion: "go1.24.0",
+}
+
+// maxPoints is the limit of points per series of a range query, like in
+// Prometheus.
+const maxPoints = 11000
+
+// RuleGroup is a rule group served by /api/v1/rules.
+type RuleGroup struct {
+	Name     string  `json:"name"`
+	File     string  `json:"file"`
+	Interval float64 `json:"interval"`
+	Rules    []Rule  `json:"rules"`
+}
+
+// Rule is an alerting rule if Type is "alerting" and a recording rule if it
+// is "recording".
+type Rule struct {
+	Type        string            `json:"type"`
+	Name        string            `json:"name"`
+	Query       string            `json:"query"`
+	Duration    float64           `json:"duration,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Health      string            `json:"health"`
+	State       string            `json:"state,omitempty"`
+	Alerts      []interface{}     `json:"alerts,omitempty"`
+}
+
+// Handler serves the Prometheus HTTP API from a Storage.
+type Handler struct {
+	db  *Storage
+	mux *http.ServeMux
+
+	// Now returns the evaluation time of queries without a time. It
+	// defaults to the time of the latest sample, so results don't depend on
+	// the clock.
+	Now func() time.Time
+	// Lookback is how far back instant selectors look for a sample.
+	Lookback time.Duration
+	// Rules are served by /api/v1/rules, and the alerts of their alerting
+	// rules by /api/v1/alerts.
+	Rules []RuleGroup
+
+	metaMu   sync.Mutex
+	metadata map[string]promv1.Metadata
+}
+
+// NewHandler returns a Handler that serves the series in db.
+func NewHandler(db *Storage) *Handler {
+	h := &Handler{
+		db:       db,
+		mux:      http.NewServeMux(),
+		Now:      db.MaxTime,
+		Lookback: DefaultLookback,
+		metadata: map[string]promv1.Metadata{},
+	}
+	h.mux.HandleFunc("/api/v1/query", h.query)
+	h.mux.HandleFunc("/api/v1/query_range", h.queryRange)
+	h.mux.HandleFunc("/api/v1/series", h.series)
+	h.mux.HandleFunc("/api/v1/labels", h.labels)
+	h.mux.HandleFunc("/api/v1/label/{name}/values", h.labelValues)
+	h.mux.HandleFunc("/api/v1/status/buildinfo", h.buildInfo)
+	h.mux.HandleFunc("/api/v1/status/tsdb", h.tsdb)
+	h.mux.HandleFunc("/api/v1/targets", h.targets)
+	h.mux.HandleFunc("/api/v1/rules", h.rules)
+	h.mux.HandleFunc("/api/v1/alerts", h.alerts)
+	h.mux.HandleFunc("/api/v1/metadata", h.metricMetadata)
+	h.mux.HandleFunc("POST /api/v1/write", h.write)
+	h.mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("Prometheus Server is Healthy.\n"))
+	})
+	h.mux.HandleFunc("/-/ready", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("Prometheus Server is Ready.\n"))
+	})
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Server is a Prometheus API server on a local port.
+type Server struct {
+	*httptest.Server
+	*Handler
+}
+
+// NewServer starts a Server that serves the series in db. The caller must
+// call Close when done.
+func NewServer(db *Storage) *Server {
+	h := NewHandler(db)
+	return &Server{Server: httptest.NewServer(h), Handler: h}
+}
+
+// PrometheusConfig returns the config of a client of s.
+func (s *Server) PrometheusConfig() *prometheus.Config {
+	return &prometheus.Config{Addr: s.URL}
+}
+
+type apiError struct {
+	typ    promv1.ErrorType
+	err    error
+	status int
+}
+
+func badData(format string, a ...interface{}) *apiError {
+	return &apiError{typ: promv1.ErrBadData, err: fmt.Errorf(format, a...), status: http.StatusBadRequest}
+}
+
+func (h *Handler) respond(w http.ResponseWriter, data interface{}, apiErr *apiError) {
+	body := map[string]interface{}{"status": "success", "data": data}
+	status := http.StatusOK
+	if apiErr != nil {
+		body = map[string]interface{}{
+			"status":    "error",
+			"errorType": apiErr.typ,
+			"error":     apiErr.err.Error(),
+		}
+		status = apiErr.status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func parseTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(math.Round(frac*1000))*int64(time.Millisecond)).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+func parseDuration(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+	}
+	return time.Duration(d), nil
+}
+
+func (h *Handler) parseQuery(r *http.Request) (parser.Expr, *apiError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, badData("error parsing form values: %v", err)
+	}
+	expr, err := parser.ParseExpr(r.Form.Get("query"))
+	if err != nil {
+		return nil, badData("invalid parameter \"query\": %v", err)
+	}
+	return expr, nil
+}
+
+func (h *Handler) eval(expr parser.Expr, t time.Time) (interface{}, *apiError) {
+	ev := &evaluator{db: h.db, ts: t.UnixMilli(), lookback: h.Lookback.Milliseconds()}
+	v, err := ev.eval(expr)
+	if err != nil {
+		return nil, &apiError{typ: promv1.ErrExec, err: err, status: http.StatusUnprocessableEntity}
+	}
+	return v, nil
+}
+
+func (h *Handler) query(w http.ResponseWriter, r *http.Request) {
+	expr, apiErr := h.parseQuery(r)
+	if apiErr != nil {
+		h.respond(w, nil, apiErr)
+		return
+	}
+	t, err := parseTime(r.Form.Get("time"), h.Now())
+	if err != nil {
+		h.respond(w, nil, badData("invalid parameter \"time\": %v", err))
+		return
+	}
+	v, apiErr := h.eval(expr, t)
+	if apiErr != nil {
+		h.respond(w, nil, apiErr)
+		return
+	}
+
+	ts := model.TimeFromUnixNano(t.UnixNano())
+	var result model.Value
+	switch v := v.(type) {
+	case scalar:
+		result = &model.Scalar{Value: model.SampleValue(v), Timestamp: ts}
+	case str:
+		result = &model.String{Value: string(v), Timestamp: ts}
+	case vector:
+		out := model.Vector{}
+		for _, s := range v {
+			out = append(out, &model.Sample{Metric: toMetric(s.labels), Value: model.SampleValue(s.v), Timestamp: ts})
+		}
+		result = out
+	case matrix:
+		result = toMatrix(v)
+	}
+	h.respond(w, map[string]interface{}{"resultType": result.Type().String(), "result": result}, nil)
+}
+
+func (h *Handler) queryRange(w http.ResponseWriter, r *http.Request) {
+	expr, apiErr := h.parseQuery(r)
+	if apiErr != nil {
+		h.respond(w, nil, apiErr)
+		return
+	}
+	start, err := parseTime(r.Form.Get("start"), time.Time{})
+	if err != nil || start.IsZero() {
+		h.respond(w, nil, badData("invalid parameter \"start\": %v", err))
+		return
+	}
+	end, err := parseTime(r.Form.Get("end"), time.Time{})
+	if err != nil || end.IsZero() {
+		h.respond(w, nil, badData("invalid parameter \"end\": %v", err))
+		return
+	}
+	if end.Before(start) {
+		h.respond(w, nil, badData("invalid parameter \"end\": end timestamp must not be before start time"))
+		return
+	}
+	step, err := parseDuration(r.Form.Get("step"))
+	if err != nil || step <= 0 {
+		h.respond(w, nil, badData("invalid parameter \"step\": zero or negative query resolution step widths are not accepted. Try a positive integer"))
+		return
+	}
+	if end.Sub(start)/step > maxPoints {
+		h.respond(w, nil, badData("exceeded maximum resolution of %d points per timeseries. Try decreasing the query resolution (?step=XX)", maxPoints))
+		return
+	}
+	if t := expr.Type(); t != parser.ValueTypeVector && t != parser.ValueTypeScalar {
+		h.respond(w, nil, badData("invalid expression type %q for range query, must be Scalar or instant Vector", parser.DocumentedType(t)))
+		return
+	}
+
+	series := map[string]*Series{}
+	for t := start; !t.After(end); t = t.Add(step) {
+		v, apiErr := h.eval(expr, t)
+		if apiErr != nil {
+			h.respond(w, nil, apiErr)
+			return
+		}
+		vec, ok := v.(vector)
+		if s, isScalar := v.(scalar); isScalar {
+			vec, ok = vector{{labels: labels.EmptyLabels(), v: float64(s)}}, true
+		}
+		if !ok {
+			continue
+		}
+		for _, s := range vec {
+			key := s.labels.String()
+			ser, ok := series[key]
+			if !ok {
+				ser = &Series{Labels: s.labels}
+				series[key] = ser
+			}
+			ser.Samples = append(ser.Samples, Sample{T: t.UnixMilli(), V: s.v})
+		}
+	}
+	m := make(matrix, 0, len(series))
+	for _, ser := range series {
+		m = append(m, ser)
+	}
+	h.respond(w, map[string]interface{}{"resultType": model.ValMatrix.String(), "result": toMatrix(m)}, nil)
+}
+
+func toMetric(lbls labels.Labels) model.Metric {
+	m := make(model.Metric, lbls.Len())
+	lbls.Range(func(l labels.Label) {
+		m[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	})
+	return m
+}
+
+func toMatrix(m matrix) model.Matrix {
+	out := make(model.Matrix, 0, len(m))
+	for _, ser := range m {
+		ss := &model.SampleStream{Metric: toMetric(ser.Labels)}
+		for _, s := range ser.Samples {
+			ss.Values = append(ss.Values, model.SamplePair{Timestamp: model.Time(s.T), Value: model.SampleValue(s.V)})
+		}
+		out = append(out, ss)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Metric.Before(out[j].Metric)
+	})
+	return out
+}
+
+// selectSeries returns the series that match any of the match[] selectors
+// and have a sample between the start and end parameters. Without
+// selectors, all series are returned.
+func (h *Handler) selectSeries(r *http.Request, required bool) ([]*Series, *apiError) {
+	if err := r.ParseForm(); err != nil {
+		return nil, badData("error parsing form values: %v", err)
+	}
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		if required {
+			return nil, badData("no match[] parameter provided")
+		}
+		selectors = []string{`{__name__=~".+"}`}
+	}
+	start, err := parseTime(r.Form.Get("start"), time.Unix(math.MinInt32, 0))
+	if err != nil {
+		return nil, badData("invalid parameter \"start\": %v", err)
+	}
+	end, err := parseTime(r.Form.Get("end"), time.Unix(math.MaxInt32, 0))
+	if err != nil {
+		return nil, badData("invalid parameter \"end\": %v", err)
+	}
+
+	seen := map[string]bool{}
+	var out []*Series
+	for _, sel := range selectors {
+		matchers, err := parser.ParseMetricSelector(sel)
+		if err != nil {
+			return nil, badData("invalid parameter \"match[]\": %v", err)
+		}
+		for _, ser := range h.db.Select(matchers...) {
+			key := ser.Labels.String()
+			if !seen[key] && ser.inRange(start.UnixMilli(), end.UnixMilli()) {
+				seen[key] = true
+				out = append(out, ser)
+			}
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return labels.Compare(out[i].Labels, out[j].Labels) < 0
+	})
+	return out, nil
+}
+
+func (h *Handler) series(w http.ResponseWriter, r *http.Request) {
+	series, apiErr := h.selectSeries(r, true)
+	if apiErr != nil {
+		h.respond(w, nil, apiErr)
+		return
+	}
+	out := make([]model.LabelSet, 0, len(series))
+	for _, ser := range series {
+		out = append(out, model.LabelSet(toMetric(ser.Labels)))
+	}
+	h.respond(w, out, nil)
+}
+
+func (h *Handler) labels(w http.ResponseWriter, r *http.Request) {
+	series, apiErr := h.selectSeries(r, false)
+	if apiErr != nil {
+		h.respond(w, nil, apiErr)
+		return
+	}
+	names := map[string]bool{}
+	for _, ser := range series {
+		ser.Labels.Range(func(l labels.Label) {
+			names[l.Name] = true
+		})
+	}
+	h.respond(w, sortedKeys(names), nil)
+}
+
+func (h *Handler) labelValues(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !model.LabelName(name).IsValidLegacy() {
+		h.respond(w, nil, badData("invalid label name: %q", name))
+		return
+	}
+	series, apiErr := h.selectSeries(r, false)
+	if apiErr != nil {
+		h.respond(w, nil, apiErr)
+		return
+	}
+	values := map[string]bool{}
+	for _, ser := range series {
+		if v := ser.Labels.Get(name); v != "" {
+			values[v] = true
+		}
+	}
+	h.respond(w, sortedKeys(values), nil)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (h *Handler) buildInfo(w http.ResponseWriter, _ *http.Request) {
+	h.respond(w, BuildInfo, nil)
+}
+
+// tsdb returns the cardinality statistics of all series, as if they all
+// were in the head block.
+func (h *Handler) tsdb(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			h.respond(w, nil, badData("limit must be a positive number"))
+			return
+		}
+		limit = n
+	}
+
+	all := h.db.Select()
+	metrics := map[string]uint64{}
+	pairs := map[string]uint64{}
+	values := map[string]map[string]bool{}
+	chunks := 0
+	var minT, maxT int64
+	for i, ser := range all {
+		metrics[ser.Labels.Get(model.MetricNameLabel)]++
+		ser.Labels.Range(func(l labels.Label) {
+			pairs[l.Name+"="+l.Value]++
+			if values[l.Name] == nil {
+				values[l.Name] = map[string]bool{}
+			}
+			values[l.Name][l.Value] = true
+		})
+		// a chunk holds up to 120 samples
+		chunks += (len(ser.Samples) + 119) / 120
+		if n := len(ser.Samples); n > 0 {
+			if i == 0 || ser.Samples[0].T < minT {
+				minT = ser.Samples[0].T
+			}
+			if i == 0 || ser.Samples[n-1].T > maxT {
+				maxT = ser.Samples[n-1].T
+			}
+		}
+	}
+	valueCounts := map[string]uint64{}
+	memory := map[string]uint64{}
+	for name, vs := range values {
+		valueCounts[name] = uint64(len(vs))
+		for v := range vs {
+			memory[name] += uint64(len(v))
+		}
+	}
+
+	h.respond(w, promv1.TSDBResult{
+		HeadStats: promv1.TSDBHeadStats{
+			NumSeries:     len(all),
+			NumLabelPairs: len(pairs),
+			ChunkCount:    chunks,
+			MinTime:       int(minT),
+			MaxTime:       int(maxT),
+		},
+		SeriesCountByMetricName:     topStats(metrics, limit),
+		LabelValueCountByLabelName:  topStats(valueCounts, limit),
+		MemoryInBytesByLabelName:    topStats(memory, limit),
+		SeriesCountByLabelValuePair: topStats(pairs, limit),
+	}, nil)
+}
+
+func topStats(m map[string]uint64, limit int) []promv1.Stat {
+	out := make([]promv1.Stat, 0, len(m))
+	for k, v := range m {
+		out = append(out, promv1.Stat{Name: k, Value: v})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Value != out[j].Value {
+			return out[i].Value > out[j].Value
+		}
+		return out[i].Name < out[j].Name
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
+
+// targets returns an active target for every series of up.
+func (h *Handler) targets(w http.ResponseWriter, r *http.Request) {
+	matcher, _ := labels.NewMatcher(labels.MatchEqual, model.MetricNameLabel, "up")
+	now := h.Now()
+	active := []promv1.ActiveTarget{}
+	for _, ser := range h.db.Select(matcher) {
+		last, ok := ser.latest(now.Add(-h.Lookback).UnixMilli(), now.UnixMilli())
+		if !ok {
+			continue
+		}
+		lbls := model.LabelSet(toMetric(ser.Labels.DropMetricName()))
+		t := promv1.ActiveTarget{
+			DiscoveredLabels: map[string]string{
+				model.AddressLabel: string(lbls[model.InstanceLabel]),
+				model.JobLabel:     string(lbls[model.JobLabel]),
+			},
+			Labels:     lbls,
+			ScrapePool: string(lbls[model.JobLabel]),
+			ScrapeURL:  "http://" + string(lbls[model.InstanceLabel]) + "/metrics",
+			GlobalURL:  "http://" + string(lbls[model.InstanceLabel]) + "/metrics",
+			LastScrape: time.UnixMilli(last.T).UTC(),
+			Health:     promv1.HealthGood,
+		}
+		if last.V != 1 {
+			t.Health = promv1.HealthBad
+			t.LastError = "connection refused"
+		}
+		active = append(active, t)
+	}
+	// every synthetic target is active
+	if r.URL.Query().Get("state") == "dropped" {
+		active = []promv1.ActiveTarget{}
+	}
+	h.respond(w, map[string]interface{}{"activeTargets": active, "droppedTargets": []interface{}{}}, nil)
+}
+
+func (h *Handler) rules(w http.ResponseWriter, r *http.Request) {
+	typ := strings.TrimSuffix(r.URL.Query().Get("type"), "s")
+	if typ != "" && typ != "alert" && typ != "record" {
+		h.respond(w, nil, badData("invalid query parameter type='%s'", r.URL.Query().Get("type")))
+		return
+	}
+	groups := []RuleGroup{}
+	for _, g := range h.Rules {
+		rules := []Rule{}
+		for _, rule := range g.Rules {
+			if typ == "" || strings.HasPrefix(rule.Type, typ) {
+				if rule.Health == "" {
+					rule.Health = string(promv1.RuleHealthGood)
+				}
+				if rule.Type == "alerting" && rule.State == "" {
+					rule.State = string(promv1.AlertStateInactive)
+				}
+				rules = append(rules, rule)
+			}
+		}
+		g.Rules = rules
+		groups = append(groups, g)
+	}
+	h.respond(w, map[string]interface{}{"groups": groups}, nil)
+}
+
+func (h *Handler) alerts(w http.ResponseWriter, _ *http.Request) {
+	alerts := []interface{}{}
+	for _, g := range h.Rules {
+		for _, rule := range g.Rules {
+			if rule.Type == "alerting" {
+				alerts = append(alerts, rule.Alerts...)
+			}
+		}
+	}
+	h.respond(w, map[string]interface{}{"alerts": alerts}, nil)
+}
@@ -0,0 +1,215 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+)
+
+func newTestAPI(t *testing.T) (promv1.API, *Server) {
+	t.Helper()
+	srv := NewServer(Synthetic())
+	t.Cleanup(srv.Close)
+	c, err := srv.PrometheusConfig().NewPrometheusClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return promv1.NewAPI(c), srv
+}
+
+// end is the time of the last synthetic sample.
+var end = DefaultStart.Add(time.Hour)
+
+func TestServerQuery(t *testing.T) {
+	api, _ := newTestAPI(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		query string
+		want  map[string]float64
+	}{
+		{
+			name:  "selector",
+			query: `up{job="node-exporter"}`,
+			want: map[string]float64{
+				`up{instance="node-1:9100", job="node-exporter"}`: 1,
+				`up{instance="node-2:9100", job="node-exporter"}`: 0,
+			},
+		},
+		{
+			name:  "rate",
+			query: `rate(http_requests_total{instance="api-0:8080"}[5m])`,
+			want: map[string]float64{
+				`{code="200", instance="api-0:8080", job="api", method="GET"}`: 10,
+				`{code="500", instance="api-0:8080", job="api", method="GET"}`: 0.5,
+			},
+		},
+		{
+			name:  "sum by",
+			query: `sum by (code) (rate(http_requests_total[5m]))`,
+			want:  map[string]float64{`{code="200"}`: 16, `{code="500"}`: 0.6},
+		},
+		{
+			name:  "error ratio",
+			query: `sum(rate(http_requests_total{code=~"5.."}[5m])) / sum(rate(http_requests_total[5m]))`,
+			want:  map[string]float64{`{}`: 0.6 / 16.6},
+		},
+		{
+			name: "pod cpu with node",
+			query: `sum by (pod, node) (rate(container_cpu_usage_seconds_total{namespace="demo"}[5m])
+				* on (namespace, pod) group_left (node) topk by (namespace, pod) (1, kube_pod_info))`,
+			want: map[string]float64{
+				`{node="node-1", pod="db-0"}`:            1,
+				`{node="node-1", pod="web-7d9f8-abcde"}`: 0.25,
+				`{node="node-2", pod="web-7d9f8-fghij"}`: 0.15,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, _, err := api.Query(ctx, tt.query, end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vec, ok := v.(model.Vector)
+			if !ok {
+				t.Fatalf("got %s, want vector", v.Type())
+			}
+			got := map[string]float64{}
+			for _, s := range vec {
+				if !s.Timestamp.Time().Equal(end) {
+					t.Errorf("sample at %s, want %s", s.Timestamp.Time(), end)
+				}
+				got[s.Metric.String()] = float64(s.Value)
+			}
+			assertSamples(t, got, tt.want)
+		})
+	}
+}
+
+func TestServerQueryDefaultTime(t *testing.T) {
+	_, srv := newTestAPI(t)
+	resp, err := http.Get(srv.URL + "/api/v1/query?query=time()")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Data struct {
+			Result [2]json.Number `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	// queries without a time are evaluated at the last sample
+	if got := body.Data.Result[1].String(); got != "1767229200" {
+		t.Errorf("time() = %s, want 1767229200", got)
+	}
+}
+
+func TestServerQueryRange(t *testing.T) {
+	api, _ := newTestAPI(t)
+	r := promv1.Range{Start: end.Add(-2 * time.Minute), End: end, Step: time.Minute}
+	v, _, err := api.QueryRange(context.Background(), `sum by (code) (rate(http_requests_total[5m]))`, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := v.(model.Matrix)
+	if !ok {
+		t.Fatalf("got %s, want matrix", v.Type())
+	}
+	want := map[string]float64{`{code="200"}`: 16, `{code="500"}`: 0.6}
+	if len(m) != len(want) {
+		t.Fatalf("got %d series, want %d", len(m), len(want))
+	}
+	for _, ss := range m {
+		if len(ss.Values) != 3 {
+			t.Errorf("%s has %d points, want 3", ss.Metric, len(ss.Values))
+		}
+		for i, p := range ss.Values {
+			if ts := r.Start.Add(time.Duration(i) * r.Step); !p.Timestamp.Time().Equal(ts) {
+				t.Errorf("point %d of %s at %s, want %s", i, ss.Metric, p.Timestamp.Time(), ts)
+			}
+			if !equal(float64(p.Value), want[ss.Metric.String()]) {
+				t.Errorf("point %d of %s = %v, want %v", i, ss.Metric, p.Value, want[ss.Metric.String()])
+			}
+		}
+	}
+}
+
+func TestServerSeries(t *testing.T) {
+	api, _ := newTestAPI(t)
+	ctx := context.Background()
+
+	series, _, err := api.Series(ctx, []string{`up{job=~"node.*"}`, `up{instance="localhost:9090"}`}, end.Add(-time.Hour), end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range series {
+		got = append(got, string(s[model.InstanceLabel]))
+	}
+	if want := []string{"localhost:9090", "node-1:9100", "node-2:9100"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Series() = %v, want %v", got, want)
+	}
+
+	// no samples after the last one
+	series, _, err = api.Series(ctx, []string{"up"}, end.Add(time.Minute), end.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 0 {
+		t.Errorf("Series() after the last sample = %v, want none", series)
+	}
+
+	values, _, err := api.LabelValues(ctx, "job", []string{`up`}, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (model.LabelValues{"node-exporter", "prometheus"}); !reflect.DeepEqual(values, want) {
+		t.Errorf("LabelValues() = %v, want %v", values, want)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	api, _ := newTestAPI(t)
+	ctx := context.Background()
+	for query, want := range map[string]promv1.ErrorType{
+		`sum(`:                     promv1.ErrBadData,
+		`stddev(up)`:               promv1.ErrExec,
+		`up * on () group_left up`: promv1.ErrExec,
+	} {
+		t.Run(query, func(t *testing.T) {
+			_, _, err := api.Query(ctx, query, end)
+			var apiErr *promv1.Error
+			if !errors.As(err, &apiErr) || apiErr.Type != want {
+				t.Errorf("got error %v, want %s", err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promtest
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/value"
+)
+
+// Sample is a value at a timestamp in milliseconds.
+type Sample struct {
+	T int64
+	V float64
+}
+
+// Series is a labeled list of samples sorted by time.
+type Series struct {
+	Labels  labels.Labels
+	Samples []Sample
+}
+
+// Storage is an in-memory set of series. It is safe for concurrent use.
+type Storage struct {
+	mu     sync.RWMutex
+	series map[string]*Series
+}
+
+// NewStorage returns an empty Storage.
+func NewStorage() *Storage {
+	return &Storage{series: map[string]*Series{}}
+}
+
+// Add adds a sample to the series of metric name with the given labels.
+// Samples may be added out of order; a sample at the same time as an
+// existing one replaces it.
+func (s *Storage) Add(name string, lbls map[string]string, t time.Time, v float64) {
+	m := make(map[string]string, len(lbls)+1)
+	for k, val := range lbls {
+		if val != "" {
+			m[k] = val
+		}
+	}
+	m[model.MetricNameLabel] = name
+	s.Append(labels.FromMap(m), Sample{T: t.UnixMilli(), V: v})
+}
+
+// Stale adds a staleness marker to the series of metric name with the given
+// labels, like Prometheus does when a series is gone from its target. The
+// series is no longer selected at t and after, until its next sample.
+func (s *Storage) Stale(name string, lbls map[string]string, t time.Time) {
+	s.Add(name, lbls, t, math.Float64frombits(value.StaleNaN))
+}
+
+// Append adds samples to the series with labels lbls.
+func (s *Storage) Append(lbls labels.Labels, samples ...Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := lbls.String()
+	ser, ok := s.series[key]
+	if !ok {
+		ser = &Series{Labels: lbls}
+		s.series[key] = ser
+	}
+	for _, smpl := range samples {
+		i := sort.Search(len(ser.Samples), func(i int) bool { return ser.Samples[i].T >= smpl.T })
+		switch {
+		case i < len(ser.Samples) && ser.Samples[i].T == smpl.T:
+			ser.Samples[i] = smpl
+		case i == len(ser.Samples):
+			ser.Samples = append(ser.Samples, smpl)
+		default:
+			ser.Samples = append(ser.Samples, Sample{})
+			copy(ser.Samples[i+1:], ser.Samples[i:])
+			ser.Samples[i] = smpl
+		}
+	}
+}
+
+// Select returns a copy of the series that match all matchers, sorted by
+// labels.
+func (s *Storage) Select(matchers ...*labels.Matcher) []*Series {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*Series
+	for _, ser := range s.series {
+		if matches(ser.Labels, matchers) {
+			out = append(out, &Series{
+				Labels:  ser.Labels,
+				Samples: append([]Sample(nil), ser.Samples...),
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return labels.Compare(out[i].Labels, out[j].Labels) < 0
+	})
+	return out
+}
+
+func matches(lbls labels.Labels, matchers []*labels.Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(lbls.Get(m.Name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// MaxTime returns the time of the latest sample, or the zero time if the
+// storage is empty.
+func (s *Storage) MaxTime() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var maxT int64
+	found := false
+	for _, ser := range s.series {
+		if n := len(ser.Samples); n > 0 && (!found || ser.Samples[n-1].T > maxT) {
+			maxT = ser.Samples[n-1].T
+			found = true
+		}
+	}
+	if !found {
+		return time.Time{}
+	}
+	return time.UnixMilli(maxT).UTC()
+}
+
+// latest returns the last sample in [mint, maxt], unless it is a staleness
+// marker.
+func (ser *Series) latest(mint, maxt int64) (Sample, bool) {
+	w := ser.window(mint, maxt)
+	if len(w) == 0 || value.IsStaleNaN(w[len(w)-1].V) {
+		return Sample{}, false
+	}
+	return w[len(w)-1], true
+}
+
+// samples returns the samples in [mint, maxt] without staleness markers.
+func (ser *Series) samples(mint, maxt int64) []Sample {
+	w := ser.window(mint, maxt)
+	for i, smpl := range w {
+		if value.IsStaleNaN(smpl.V) {
+			out := append([]Sample(nil), w[:i]...)
+			for _, smpl := range w[i+1:] {
+				if !value.IsStaleNaN(smpl.V) {
+					out = append(out, smpl)
+				}
+			}
+			return out
+		}
+	}
+	return w
+}
+
+// inRange reports whether ser has a sample in [mint, maxt].
+func (ser *Series) inRange(mint, maxt int64) bool {
+	i := sort.Search(len(ser.Samples), func(i int) bool { return ser.Samples[i].T >= mint })
+	return i < len(ser.Samples) && ser.Samples[i].T <= maxt
+}
+
+// window returns the samples in [mint, maxt].
+func (ser *Series) window(mint, maxt int64) []Sample {
+	i := sort.Search(len(ser.Samples), func(i int) bool { return ser.Samples[i].T >= mint })
+	j := sort.Search(len(ser.Samples), func(i int) bool { return ser.Samples[i].T > maxt })
+	if i >= j {
+		return nil
+	}
+	return ser.Samples[i:j]
+}
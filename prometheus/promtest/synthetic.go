@@ -0,0 +1,165 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promtest
+
+import (
+	"time"
+)
+
+// DefaultStart is the time of the first synthetic sample. It is fixed, so
+// tests get the same timestamps on every run.
+var DefaultStart = time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Generator writes series with evenly spaced samples, like a scrape every
+// Interval.
+type Generator struct {
+	Start    time.Time
+	Interval time.Duration
+	Points   int
+}
+
+// End returns the time of the last sample.
+func (g Generator) End() time.Time {
+	return g.Start.Add(time.Duration(g.Points-1) * g.Interval)
+}
+
+// Gauge adds a series with the values of fn for sample i.
+func (g Generator) Gauge(db *Storage, name string, lbls map[string]string, fn func(i int) float64) {
+	for i := 0; i < g.Points; i++ {
+		db.Add(name, lbls, g.Start.Add(time.Duration(i)*g.Interval), fn(i))
+	}
+}
+
+// Constant adds a series with the same value at every sample.
+func (g Generator) Constant(db *Storage, name string, lbls map[string]string, v float64) {
+	g.Gauge(db, name, lbls, func(int) float64 { return v })
+}
+
+// Counter adds a counter that grows by perSecond, so its rate is
+// perSecond.
+func (g Generator) Counter(db *Storage, name string, lbls map[string]string, perSecond float64) {
+	step := perSecond * g.Interval.Seconds()
+	g.Gauge(db, name, lbls, func(i int) float64 { return float64(i) * step })
+}
+
+// Synthetic returns a Storage with one hour of samples every 15 seconds
+// from DefaultStart for a small cluster, see Generator.Synthetic.
+func Synthetic() *Storage {
+	db := NewStorage()
+	Generator{Start: DefaultStart, Interval: 15 * time.Second, Points: 241}.Synthetic(db)
+	return db
+}
+
+// Synthetic adds the series of a small cluster to db: the up and
+// prometheus_build_info of a Prometheus and two node exporters, one of them
+// down, http_requests_total of an api job, and the cAdvisor, kubelet and
+// kube-state-metrics series of a Deployment and a StatefulSet with a
+// PersistentVolumeClaim in the demo namespace, which is enough for the
+// usage and cost reports.
+func (g Generator) Synthetic(db *Storage) {
+	g.Constant(db, "up", map[string]string{"job": "prometheus", "instance": "localhost:9090"}, 1)
+	g.Constant(db, "up", map[string]string{"job": "node-exporter", "instance": "node-1:9100"}, 1)
+	g.Constant(db, "up", map[string]string{"job": "node-exporter", "instance": "node-2:9100"}, 0)
+	g.Constant(db, "prometheus_build_info", map[string]string{
+		"job": "prometheus", "instance": "localhost:9090", "version": BuildInfo.Version,
+		"revision": BuildInfo.Revision, "branch": BuildInfo.Branch, "goversion": BuildInfo.GoVersion,
+	}, 1)
+	for _, r := range []struct {
+		instance, code string
+		perSecond      float64
+	}{
+		{"api-0:8080", "200", 10},
+		{"api-0:8080", "500", 0.5},
+		{"api-1:8080", "200", 6},
+		{"api-1:8080", "500", 0.1},
+	} {
+		g.Counter(db, "http_requests_total", map[string]string{
+			"job": "api", "instance": r.instance, "method": "GET", "code": r.code,
+		}, r.perSecond)
+	}
+
+	const ns = "demo"
+	g.Constant(db, "kube_node_labels", map[string]string{"node": "node-1", "label_kubernetes_io_hostname": "node-1"}, 1)
+	g.Constant(db, "kube_node_labels", map[string]string{
+		"node": "node-2", "label_kubernetes_io_hostname": "node-2", "label_karpenter_sh_capacity_type": "spot",
+	}, 1)
+	g.Constant(db, "kube_replicaset_owner", map[string]string{
+		"namespace": ns, "replicaset": "web-7d9f8", "owner_kind": "Deployment", "owner_name": "web",
+	}, 1)
+
+	for _, p := range []struct {
+		pod, node, ownerKind, ownerName, container, team string
+		cores, memory, cpuRequest, memoryRequest         float64
+	}{
+		{"web-7d9f8-abcde", "node-1", "ReplicaSet", "web-7d9f8", "nginx", "frontend", 0.25, 128 << 20, 0.5, 256 << 20},
+		{"web-7d9f8-fghij", "node-2", "ReplicaSet", "web-7d9f8", "nginx", "frontend", 0.15, 96 << 20, 0.5, 256 << 20},
+		{"db-0", "node-1", "StatefulSet", "db", "postgres", "backend", 1, 1 << 30, 1, 2 << 30},
+	} {
+		container := map[string]string{
+			"namespace": ns, "pod": p.pod, "container": p.container, "node": p.node,
+			"job": "kubelet", "metrics_path": "/metrics/cadvisor", "image": p.container + ":latest",
+		}
+		g.Counter(db, "container_cpu_usage_seconds_total", container, p.cores)
+		g.Constant(db, "container_memory_working_set_bytes", container, p.memory)
+		g.Counter(db, "container_network_receive_bytes_total", map[string]string{
+			"namespace": ns, "pod": p.pod, "interface": "eth0", "job": "kubelet", "metrics_path": "/metrics/cadvisor",
+		}, 2048)
+		g.Counter(db, "container_network_transmit_bytes_total", map[string]string{
+			"namespace": ns, "pod": p.pod, "interface": "eth0", "job": "kubelet", "metrics_path": "/metrics/cadvisor",
+		}, 1024)
+
+		g.Constant(db, "kube_pod_info", map[string]string{"namespace": ns, "pod": p.pod, "node": p.node}, 1)
+		g.Constant(db, "kube_pod_owner", map[string]string{
+			"namespace": ns, "pod": p.pod, "owner_kind": p.ownerKind, "owner_name": p.ownerName,
+		}, 1)
+		g.Constant(db, "kube_pod_labels", map[string]string{"namespace": ns, "pod": p.pod, "label_team": p.team}, 1)
+		for _, phase := range []string{"Pending", "Running", "Succeeded", "Failed", "Unknown"} {
+			v := 0.0
+			if phase == "Running" {
+				v = 1
+			}
+			g.Constant(db, "kube_pod_status_phase", map[string]string{"namespace": ns, "pod": p.pod, "phase": phase}, v)
+		}
+		for _, r := range []struct {
+			resource, unit string
+			value          float64
+		}{
+			{"cpu", "core", p.cpuRequest},
+			{"memory", "byte", p.memoryRequest},
+		} {
+			lbls := map[string]string{
+				"namespace": ns, "pod": p.pod, "container": p.container, "node": p.node,
+				"resource": r.resource, "unit": r.unit,
+			}
+			g.Constant(db, "kube_pod_container_resource_requests", lbls, r.value)
+			g.Constant(db, "kube_pod_container_resource_limits", lbls, 2*r.value)
+		}
+	}
+
+	pvc := map[string]string{"namespace": ns, "persistentvolumeclaim": "data-db-0"}
+	g.Constant(db, "kube_pod_spec_volumes_persistentvolumeclaims_info", map[string]string{
+		"namespace": ns, "pod": "db-0", "volume": "data", "persistentvolumeclaim": "data-db-0",
+	}, 1)
+	g.Constant(db, "kube_persistentvolumeclaim_resource_requests_storage_bytes", pvc, 10<<30)
+	g.Constant(db, "kube_persistentvolumeclaim_labels", map[string]string{
+		"namespace": ns, "persistentvolumeclaim": "data-db-0", "label_team": "backend",
+	}, 1)
+	g.Gauge(db, "kubelet_volume_stats_used_bytes", pvc, func(i int) float64 {
+		return float64(4<<30) + float64(i)*(1<<20)
+	})
+	g.Constant(db, "kubelet_volume_stats_capacity_bytes", pvc, 10<<30)
+}
@@ -0,0 +1,85 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package promtest
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/golang/snappy"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/tamalsaha/prometheus-demo/prometheus/remotewrite"
+)
+
+// write is the remote write receiver. Samples are added to the storage and
+// metadata is served by /api/v1/metadata.
+func (h *Handler) write(w http.ResponseWriter, r *http.Request) {
+	compressed, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := remotewrite.Unmarshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, ts := range req.Timeseries {
+		if ts.Labels.Get("__name__") == "" {
+			http.Error(w, "series "+ts.Labels.String()+" has no metric name", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, ts := range req.Timeseries {
+		samples := make([]Sample, 0, len(ts.Samples))
+		for _, s := range ts.Samples {
+			samples = append(samples, Sample{T: s.Timestamp, V: s.Value})
+		}
+		h.db.Append(ts.Labels, samples...)
+	}
+
+	h.metaMu.Lock()
+	for _, m := range req.Metadata {
+		h.metadata[m.MetricFamilyName] = promv1.Metadata{
+			Type: promv1.MetricType(m.Type.String()),
+			Help: m.Help,
+			Unit: m.Unit,
+		}
+	}
+	h.metaMu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// metricMetadata serves the metadata received by remote write.
+func (h *Handler) metricMetadata(w http.ResponseWriter, r *http.Request) {
+	metric := r.FormValue("metric")
+	h.metaMu.Lock()
+	defer h.metaMu.Unlock()
+	out := map[string][]promv1.Metadata{}
+	for name, m := range h.metadata {
+		if metric == "" || metric == name {
+			out[name] = []promv1.Metadata{m}
+		}
+	}
+	h.respond(w, out, nil)
+}
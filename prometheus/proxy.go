@@ -0,0 +1,236 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	prom_config "github.com/prometheus/common/config"
+	"github.com/tamalsaha/prometheus-demo/prometheus/sigv4"
+	"golang.org/x/oauth2"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Transport is how a Config with a Service reaches it.
+type Transport string
+
+const (
+	// TransportDirect sends requests to the cluster DNS name of the
+	// service, so it only works inside the cluster. It is the default
+	// without a Service.
+	TransportDirect Transport = "direct"
+	// TransportProxy sends requests through the apiserver service proxy
+	// with the kube credentials. It is the default with a Service.
+	TransportProxy Transport = "proxy"
+	// TransportPortForward tunnels connections to a ready pod of the service
+	// through the apiserver, like kubectl port-forward. Unlike the service
+	// proxy, it also works if the apiserver can't reach the pod network, and
+	// TLS is verified against the service DNS name.
+	TransportPortForward Transport = "portforward"
+)
+
+// ServiceReference points to a Prometheus compatible Service in a cluster.
+type ServiceReference struct {
+	Scheme    string `yaml:"scheme" json:"scheme"`
+	Name      string `yaml:"name" json:"name"`
+	Namespace string `yaml:"namespace" json:"namespace"`
+	Port      int    `yaml:"port" json:"port"`
+}
+
+// ParseServiceReference parses the [scheme:]namespace/name:port form. The
+// scheme defaults to http.
+func ParseServiceReference(s string) (ServiceReference, error) {
+	ref := ServiceReference{Scheme: "http"}
+	rest := s
+	if scheme, after, ok := strings.Cut(s, ":"); ok && !strings.Contains(scheme, "/") {
+		ref.Scheme, rest = scheme, after
+	}
+	ns, rest, ok := strings.Cut(rest, "/")
+	if !ok {
+		return ref, fmt.Errorf("service %q must be in [scheme:]namespace/name:port form", s)
+	}
+	name, port, ok := strings.Cut(rest, ":")
+	if !ok {
+		return ref, fmt.Errorf("service %q must be in [scheme:]namespace/name:port form", s)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return ref, fmt.Errorf("service %q has an invalid port: %w", s, err)
+	}
+	ref.Namespace, ref.Name, ref.Port = ns, name, p
+	return ref, nil
+}
+
+// String returns ref in the [scheme:]namespace/name:port form read by the
+// --service flag of read-prom.
+func (ref ServiceReference) String() string {
+	return fmt.Sprintf("%s:%s/%s:%d", ref.Scheme, ref.Namespace, ref.Name, ref.Port)
+}
+
+// ToPrometheusConfigFromServiceAccount returns a Config that reaches the
+// service through the apiserver service proxy with the tokens of ts, like a
+// satoken.Source of the service account that is allowed to use the proxy.
+// Only the apiserver CA is taken from cfg.
+func ToPrometheusConfigFromServiceAccount(cfg *rest.Config, ts oauth2.TokenSource, ref ServiceReference) (*Config, error) {
+	if err := rest.LoadTLSFiles(cfg); err != nil {
+		return nil, err
+	}
+
+	pc := &Config{
+		Addr:        ServiceProxyURL(cfg.Host, ref),
+		TokenSource: ts,
+		CAData:      cfg.TLSClientConfig.CAData,
+	}
+	pc.TLSConfig.ServerName = cfg.TLSClientConfig.ServerName
+	pc.TLSConfig.InsecureSkipVerify = cfg.TLSClientConfig.Insecure
+	return pc, nil
+}
+
+// ServiceURL returns the url of the service in the cluster DNS.
+func ServiceURL(ref ServiceReference) string {
+	scheme := ref.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s.%s.svc:%d", scheme, ref.Name, ref.Namespace, ref.Port)
+}
+
+// ServiceProxyURL returns the apiserver proxy url for the service.
+// ref: https://kubernetes.io/docs/tasks/administer-cluster/access-cluster-services/#manually-constructing-apiserver-proxy-urls
+func ServiceProxyURL(host string, ref ServiceReference) string {
+	return fmt.Sprintf("%s/api/v1/namespaces/%s/services/%s:%s:%d/proxy/", strings.TrimSuffix(host, "/"), ref.Namespace, ref.Scheme, ref.Name, ref.Port)
+}
+
+// ToPrometheusConfig returns a Config that reaches the service through the
+// apiserver service proxy using the credentials of cfg. TLS material is
+// kept in memory and never written to disk. Only static credentials are
+// copied, so that the Config can be saved; exec plugins and auth providers
+// of cfg are not. NewServiceConfig supports them.
+func ToPrometheusConfig(cfg *rest.Config, ref ServiceReference) (*Config, error) {
+	if err := rest.LoadTLSFiles(cfg); err != nil {
+		return nil, err
+	}
+
+	pc := &Config{
+		Addr: ServiceProxyURL(cfg.Host, ref),
+		BasicAuth: BasicAuth{
+			Username: cfg.Username,
+			Password: cfg.Password,
+		},
+		BearerToken:     cfg.BearerToken,
+		BearerTokenFile: cfg.BearerTokenFile,
+		CAData:          cfg.TLSClientConfig.CAData,
+		CertData:        cfg.TLSClientConfig.CertData,
+		KeyData:         cfg.TLSClientConfig.KeyData,
+	}
+	pc.TLSConfig.ServerName = cfg.TLSClientConfig.ServerName
+	pc.TLSConfig.InsecureSkipVerify = cfg.TLSClientConfig.Insecure
+	if pc.BearerTokenFile != "" {
+		// like rest.Config, prefer the token file so that rotated tokens are picked up
+		pc.BearerToken = ""
+	}
+	return pc, nil
+}
+
+// NewServiceConfig returns a Config that reaches the service with transport
+// t, using the credentials of cfg for the proxy and portforward transports.
+func NewServiceConfig(cfg *rest.Config, ref ServiceReference, t Transport) (*Config, error) {
+	pc := &Config{Transport: t, Service: &ref}
+	return pc.forService(cfg)
+}
+
+// transport returns the effective transport of p.
+func (p *Config) transport() Transport {
+	switch {
+	case p.Transport != "":
+		return p.Transport
+	case p.Service != nil:
+		return TransportProxy
+	default:
+		return TransportDirect
+	}
+}
+
+// resolveService returns p with the address and the kube credentials of its
+// Service filled in, or p itself if it has no Service.
+func (p *Config) resolveService() (*Config, error) {
+	if p.Service == nil {
+		return p, nil
+	}
+	var cfg *rest.Config
+	switch p.transport() {
+	case TransportProxy, TransportPortForward:
+		if p.restConfig != nil {
+			return p, nil // already resolved by NewServiceConfig
+		}
+		var err error
+		if cfg, err = p.KubeConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return p.forService(cfg)
+}
+
+// forService returns a copy of p that reaches p.Service with cfg.
+func (p *Config) forService(cfg *rest.Config) (*Config, error) {
+	out := *p
+	ref := *p.Service
+	switch p.transport() {
+	case TransportProxy:
+		// the apiserver authenticates the requests with the transport of
+		// cfg, which also supports exec plugins and auth providers. Any
+		// credentials or TLS settings of p would conflict with it.
+		if out.Addr == "" {
+			out.Addr = ServiceProxyURL(cfg.Host, ref)
+		}
+		out.BasicAuth = BasicAuth{}
+		out.BearerToken, out.BearerTokenFile = "", ""
+		out.Authorization = Authorization{}
+		out.OAuth2 = OAuth2{}
+		out.SigV4 = sigv4.Config{}
+		out.TokenSource = nil
+		out.CAData, out.CertData, out.KeyData = nil, nil, nil
+		out.TLSConfig = prom_config.TLSConfig{}
+		out.ProxyURL = ""
+		out.restConfig = cfg
+	case TransportPortForward:
+		if out.Addr == "" {
+			out.Addr = ServiceURL(ref)
+		}
+		out.restConfig = cfg
+	default:
+		if out.Addr == "" {
+			out.Addr = ServiceURL(ref)
+		}
+	}
+	return &out, nil
+}
+
+// KubeConfig returns the rest config of the cluster of the service, from
+// Kubeconfig and KubeContext, or the default kubeconfig or in-cluster config.
+func (p *Config) KubeConfig() (*rest.Config, error) {
+	if p.restConfig != nil {
+		return p.restConfig, nil
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = p.Kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: p.KubeContext}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
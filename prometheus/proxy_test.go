@@ -0,0 +1,113 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2"
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestServiceProxyCredentials(t *testing.T) {
+	// an exec plugin like aws eks get-token or gke-gcloud-auth-plugin
+	plugin := filepath.Join(t.TempDir(), "get-token")
+	script := `#!/bin/sh
+echo '{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","status":{"token":"exec-token"}}'
+`
+	if err := os.WriteFile(plugin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  func(host string) *rest.Config
+		want string
+	}{
+		{
+			name: "bearer token",
+			cfg: func(host string) *rest.Config {
+				return &rest.Config{Host: host, BearerToken: "kube-token"}
+			},
+			want: "Bearer kube-token",
+		},
+		{
+			name: "exec plugin",
+			cfg: func(host string) *rest.Config {
+				return &rest.Config{Host: host, ExecProvider: &clientcmdapi.ExecConfig{
+					APIVersion:      "client.authentication.k8s.io/v1",
+					Command:         plugin,
+					InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
+				}}
+			},
+			want: "Bearer exec-token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got http.Header
+			var path string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, path = r.Header, r.URL.Path
+				_, _ = w.Write([]byte(`{"status":"success","data":{}}`))
+			}))
+			defer srv.Close()
+
+			ref := ServiceReference{Scheme: "http", Namespace: "monitoring", Name: "prometheus", Port: 9090}
+			pc, err := NewServiceConfig(tt.cfg(srv.URL), ref, TransportProxy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// credentials of the config would conflict with the kube ones,
+			// the tenant header is sent through the proxy
+			pc.TokenSource = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "prometheus-token"})
+			pc.Authorization = Authorization{Credentials: "prometheus-token"}
+			pc.TenantID = "team-a"
+			pc, err = pc.forService(pc.restConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := pc.NewClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			req, err := http.NewRequest(http.MethodGet, c.URL("/api/v1/status/buildinfo", nil).String(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := c.Do(context.Background(), req); err != nil {
+				t.Fatal(err)
+			}
+			if a := got.Get("Authorization"); a != tt.want {
+				t.Errorf("Authorization = %q, want %q", a, tt.want)
+			}
+			if tenant := got.Get(TenantHeaderMimir); tenant != "team-a" {
+				t.Errorf("%s = %q, want team-a", TenantHeaderMimir, tenant)
+			}
+			if want := "/api/v1/namespaces/monitoring/services/http:prometheus:9090/proxy/api/v1/status/buildinfo"; path != want {
+				t.Errorf("path = %s, want %s", path, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package query
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+)
+
+// Client runs PromQL queries and returns typed results.
+type Client struct {
+	API promv1.API
+
+	closer io.Closer
+}
+
+func New(api promv1.API) *Client {
+	return &Client{API: api}
+}
+
+// NewForConfig returns a client for cfg. Call Close once it is no longer
+// used.
+func NewForConfig(cfg *prometheus.Config) (*Client, error) {
+	pc, err := cfg.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	if pc == nil {
+		return nil, errors.New("prometheus address is not set")
+	}
+	c := New(promv1.NewAPI(pc))
+	c.closer = pc
+	return c, nil
+}
+
+// Close closes the connections of a client returned by NewForConfig. It
+// does nothing for a client returned by New.
+func (c *Client) Close() error {
+	if c.closer == nil {
+		return nil
+	}
+	return c.closer.Close()
+}
+
+// Query evaluates an instant query at ts.
+func (c *Client) Query(ctx context.Context, query string, ts time.Time, opts ...promv1.Option) (*Result, error) {
+	val, warn, err := c.API.Query(ctx, query, ts, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := Decode(val)
+	if err != nil {
+		return nil, err
+	}
+	res.Warnings = warn
+	return res, nil
+}
+
+// QueryRange evaluates a range query.
+func (c *Client) QueryRange(ctx context.Context, query string, r promv1.Range, opts ...promv1.Option) (*Result, error) {
+	val, warn, err := c.API.QueryRange(ctx, query, r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	res, err := Decode(val)
+	if err != nil {
+		return nil, err
+	}
+	res.Warnings = warn
+	return res, nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package query
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+)
+
+// responses are bodies of the query API keyed by the query.
+var responses = map[string]string{
+	"up":     `{"status":"success","warnings":["partial response"],"data":{"resultType":"vector","result":[{"metric":{"__name__":"up","job":"node"},"value":[1700000000,"1"]}]}}`,
+	"nan":    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1700000000,"NaN"]}]}}`,
+	"hist":   `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"rpc"},"histogram":[1700000000,{"count":"4","sum":"2.5","buckets":[[0,"0","1","4"]]}]}]}}`,
+	"1":      `{"status":"success","data":{"resultType":"scalar","result":[1700000000,"1"]}}`,
+	"absent": `{"status":"success","data":{"resultType":"vector","result":[]}}`,
+	"rate":   `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"node"},"values":[[1700000000,"1"],[1700000060,"+Inf"]]}]}}`,
+}
+
+func newTestClient(t *testing.T) *Client {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.FormValue("query")]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			body = `{"status":"error","errorType":"bad_data","error":"unknown query"}`
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	c, err := NewForConfig(&prometheus.Config{Addr: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+func TestClientQuery(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+	at := ts.Time()
+
+	r, err := c.Query(ctx, "up", at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Type != model.ValVector || len(r.Samples) != 1 || r.Samples[0].Labels["job"] != "node" || r.Samples[0].Value != 1 {
+		t.Errorf("Query(up) = %+v, want the up sample", r)
+	}
+	if len(r.Warnings) != 1 || r.Warnings[0] != "partial response" {
+		t.Errorf("warnings = %q, want the partial response", r.Warnings)
+	}
+
+	if r, err = c.Query(ctx, "nan", at); err != nil || !math.IsNaN(r.Sum()) {
+		t.Errorf("Query(nan) = %+v, %v, want NaN", r, err)
+	}
+	if r, err = c.Query(ctx, "hist", at); err != nil || r.Samples[0].Histogram == nil || r.Sum() != 2.5 {
+		t.Errorf("Query(hist) = %+v, %v, want a histogram with sum 2.5", r, err)
+	}
+	if r, err = c.Query(ctx, "1", at); err != nil || r.Type != model.ValScalar || r.Sum() != 1 {
+		t.Errorf("Query(1) = %+v, %v, want scalar 1", r, err)
+	}
+	if r, err = c.Query(ctx, "absent", at); err != nil || len(r.Samples) != 0 || len(r.ToMap("job")) != 0 {
+		t.Errorf("Query(absent) = %+v, %v, want no samples", r, err)
+	}
+	if _, err = c.Query(ctx, "bad", at); err == nil {
+		t.Error("Query(bad) succeeded")
+	}
+
+	r, err = c.QueryRange(ctx, "rate", promv1.Range{Start: at, End: at.Add(time.Minute), Step: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Type != model.ValMatrix || len(r.Series) != 1 || len(r.Series[0].Points) != 2 || r.ToMap("job")["node"] != r.Series[0].Points[1].Value {
+		t.Errorf("QueryRange(rate) = %+v, want a series of 2 points", r)
+	}
+}
@@ -0,0 +1,303 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// Sample is a single value of a series at a point in time. Histogram is set
+// instead of Value when the series is a native histogram.
+type Sample struct {
+	Labels    map[string]string      `json:"labels"`
+	Timestamp time.Time              `json:"timestamp"`
+	Value     float64                `json:"value"`
+	Histogram *model.SampleHistogram `json:"histogram,omitempty"`
+}
+
+// Point is a single value of a range series.
+type Point struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Value     float64                `json:"value"`
+	Histogram *model.SampleHistogram `json:"histogram,omitempty"`
+}
+
+// Series is a labelled list of points returned by a range query.
+type Series struct {
+	Labels map[string]string `json:"labels"`
+	Points []Point           `json:"points"`
+}
+
+// jsonFloat is a float64 that encodes NaN and ±Inf as the strings used by
+// the Prometheus API, since JSON has no numbers for them.
+type jsonFloat float64
+
+func (f jsonFloat) MarshalJSON() ([]byte, error) {
+	v := float64(f)
+	switch {
+	case math.IsNaN(v):
+		return []byte(`"NaN"`), nil
+	case math.IsInf(v, 1):
+		return []byte(`"+Inf"`), nil
+	case math.IsInf(v, -1):
+		return []byte(`"-Inf"`), nil
+	}
+	return json.Marshal(v)
+}
+
+func (f *jsonFloat) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*f = jsonFloat(v)
+		return nil
+	}
+	var v float64
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*f = jsonFloat(v)
+	return nil
+}
+
+func (s Sample) MarshalJSON() ([]byte, error) {
+	type plain Sample
+	return json.Marshal(struct {
+		plain
+		Value jsonFloat `json:"value"`
+	}{plain(s), jsonFloat(s.Value)})
+}
+
+func (s *Sample) UnmarshalJSON(data []byte) error {
+	type plain Sample
+	var out struct {
+		plain
+		Value jsonFloat `json:"value"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return err
+	}
+	*s = Sample(out.plain)
+	s.Value = float64(out.Value)
+	return nil
+}
+
+func (p Point) MarshalJSON() ([]byte, error) {
+	type plain Point
+	return json.Marshal(struct {
+		plain
+		Value jsonFloat `json:"value"`
+	}{plain(p), jsonFloat(p.Value)})
+}
+
+func (p *Point) UnmarshalJSON(data []byte) error {
+	type plain Point
+	var out struct {
+		plain
+		Value jsonFloat `json:"value"`
+	}
+	if err := json.Unmarshal(data, &out); err != nil {
+		return err
+	}
+	*p = Point(out.plain)
+	p.Value = float64(out.Value)
+	return nil
+}
+
+// Result is the decoded form of a PromQL query result.
+//
+// Vector and scalar results are stored in Samples (a scalar has exactly one
+// sample with no labels), matrix results in Series and string results in
+// String.
+type Result struct {
+	Type     model.ValueType `json:"type"`
+	Samples  []Sample        `json:"samples,omitempty"`
+	Series   []Series        `json:"series,omitempty"`
+	String   string          `json:"string,omitempty"`
+	Warnings []string        `json:"warnings,omitempty"`
+}
+
+// Decode converts a model.Value returned by promv1.API into a Result.
+func Decode(v model.Value) (*Result, error) {
+	if v == nil {
+		return &Result{Type: model.ValNone}, nil
+	}
+
+	res := &Result{Type: v.Type()}
+	switch val := v.(type) {
+	case model.Vector:
+		res.Samples = make([]Sample, 0, len(val))
+		for _, s := range val {
+			res.Samples = append(res.Samples, Sample{
+				Labels:    toLabels(s.Metric),
+				Timestamp: s.Timestamp.Time(),
+				Value:     float64(s.Value),
+				Histogram: s.Histogram,
+			})
+		}
+	case model.Matrix:
+		res.Series = make([]Series, 0, len(val))
+		for _, ss := range val {
+			series := Series{
+				Labels: toLabels(ss.Metric),
+				Points: make([]Point, 0, len(ss.Values)+len(ss.Histograms)),
+			}
+			for _, p := range ss.Values {
+				series.Points = append(series.Points, Point{
+					Timestamp: p.Timestamp.Time(),
+					Value:     float64(p.Value),
+				})
+			}
+			for _, p := range ss.Histograms {
+				series.Points = append(series.Points, Point{
+					Timestamp: p.Timestamp.Time(),
+					Histogram: p.Histogram,
+				})
+			}
+			sort.SliceStable(series.Points, func(i, j int) bool {
+				return series.Points[i].Timestamp.Before(series.Points[j].Timestamp)
+			})
+			res.Series = append(res.Series, series)
+		}
+	case *model.Scalar:
+		res.Samples = []Sample{{
+			Labels:    map[string]string{},
+			Timestamp: val.Timestamp.Time(),
+			Value:     float64(val.Value),
+		}}
+	case *model.String:
+		res.String = val.Value
+	default:
+		return nil, fmt.Errorf("unsupported query result type %T", v)
+	}
+	return res, nil
+}
+
+func toLabels(m model.Metric) map[string]string {
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[string(k)] = string(v)
+	}
+	return out
+}
+
+// Instant returns one sample per series. For vector and scalar results these
+// are the samples themselves; for matrix results it is the last point of
+// each series.
+func (r *Result) Instant() []Sample {
+	if len(r.Series) == 0 {
+		return r.Samples
+	}
+	out := make([]Sample, 0, len(r.Series))
+	for _, s := range r.Series {
+		if len(s.Points) == 0 {
+			continue
+		}
+		p := s.Points[len(s.Points)-1]
+		out = append(out, Sample{
+			Labels:    s.Labels,
+			Timestamp: p.Timestamp,
+			Value:     p.Value,
+			Histogram: p.Histogram,
+		})
+	}
+	return out
+}
+
+// Sum adds up the values of Instant. Histogram samples are counted by their
+// sum of observations.
+func (r *Result) Sum() float64 {
+	var total float64
+	for _, s := range r.Instant() {
+		total += s.value()
+	}
+	return total
+}
+
+// GroupBy sums the values of Instant grouped by the given labels, like
+// PromQL's sum by (...). The returned samples only carry the grouping labels.
+func (r *Result) GroupBy(labels ...string) []Sample {
+	groups := map[string]*Sample{}
+	var keys []string
+	for _, s := range r.Instant() {
+		gl := make(map[string]string, len(labels))
+		for _, l := range labels {
+			if v, ok := s.Labels[l]; ok {
+				gl[l] = v
+			}
+		}
+		key := labelsKey(gl)
+		g, ok := groups[key]
+		if !ok {
+			g = &Sample{Labels: gl, Timestamp: s.Timestamp}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.Value += s.value()
+		if s.Timestamp.After(g.Timestamp) {
+			g.Timestamp = s.Timestamp
+		}
+	}
+
+	sort.Strings(keys)
+	out := make([]Sample, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, *groups[k])
+	}
+	return out
+}
+
+// ToMap returns the values of Instant keyed by the value of keyLabel. Samples
+// sharing the same key are added up. If keyLabel is empty, the full label set
+// is used as the key.
+func (r *Result) ToMap(keyLabel string) map[string]float64 {
+	out := map[string]float64{}
+	for _, s := range r.Instant() {
+		key := labelsKey(s.Labels)
+		if keyLabel != "" {
+			key = s.Labels[keyLabel]
+		}
+		out[key] += s.value()
+	}
+	return out
+}
+
+func (s Sample) value() float64 {
+	if s.Histogram != nil {
+		return float64(s.Histogram.Sum)
+	}
+	return s.Value
+}
+
+// labelsKey formats labels the same way as model.Metric.String.
+func labelsKey(labels map[string]string) string {
+	m := make(model.Metric, len(labels))
+	for k, v := range labels {
+		m[model.LabelName(k)] = model.LabelValue(v)
+	}
+	return m.String()
+}
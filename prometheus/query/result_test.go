@@ -0,0 +1,284 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package query
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+var ts = model.TimeFromUnix(1700000000)
+
+func histogram(count, sum float64) *model.SampleHistogram {
+	return &model.SampleHistogram{
+		Count: model.FloatString(count),
+		Sum:   model.FloatString(sum),
+		Buckets: model.HistogramBuckets{
+			{Boundaries: 0, Lower: 0, Upper: 1, Count: model.FloatString(count)},
+		},
+	}
+}
+
+func TestDecode(t *testing.T) {
+	h := histogram(4, 2.5)
+	tests := []struct {
+		name string
+		v    model.Value
+		want *Result
+	}{
+		{
+			name: "none",
+			v:    nil,
+			want: &Result{Type: model.ValNone},
+		},
+		{
+			name: "vector",
+			v: model.Vector{
+				{Metric: model.Metric{"__name__": "up", "job": "node"}, Value: 1, Timestamp: ts},
+				{Metric: model.Metric{"__name__": "rpc_duration_seconds"}, Histogram: h, Timestamp: ts},
+			},
+			want: &Result{Type: model.ValVector, Samples: []Sample{
+				{Labels: map[string]string{"__name__": "up", "job": "node"}, Timestamp: ts.Time(), Value: 1},
+				{Labels: map[string]string{"__name__": "rpc_duration_seconds"}, Timestamp: ts.Time(), Histogram: h},
+			}},
+		},
+		{
+			name: "empty vector",
+			v:    model.Vector{},
+			want: &Result{Type: model.ValVector, Samples: []Sample{}},
+		},
+		{
+			name: "scalar",
+			v:    &model.Scalar{Value: 42, Timestamp: ts},
+			want: &Result{Type: model.ValScalar, Samples: []Sample{
+				{Labels: map[string]string{}, Timestamp: ts.Time(), Value: 42},
+			}},
+		},
+		{
+			name: "string",
+			v:    &model.String{Value: "hello", Timestamp: ts},
+			want: &Result{Type: model.ValString, String: "hello"},
+		},
+		{
+			name: "matrix",
+			v: model.Matrix{
+				{
+					Metric: model.Metric{"job": "node"},
+					Values: []model.SamplePair{{Timestamp: ts, Value: 1}, {Timestamp: ts.Add(time.Minute), Value: 2}},
+				},
+				{
+					// float and histogram points of a series that changed
+					// its type are merged in time order
+					Metric:     model.Metric{"job": "api"},
+					Values:     []model.SamplePair{{Timestamp: ts, Value: 3}, {Timestamp: ts.Add(2 * time.Minute), Value: 5}},
+					Histograms: []model.SampleHistogramPair{{Timestamp: ts.Add(time.Minute), Histogram: h}},
+				},
+			},
+			want: &Result{Type: model.ValMatrix, Series: []Series{
+				{Labels: map[string]string{"job": "node"}, Points: []Point{
+					{Timestamp: ts.Time(), Value: 1},
+					{Timestamp: ts.Add(time.Minute).Time(), Value: 2},
+				}},
+				{Labels: map[string]string{"job": "api"}, Points: []Point{
+					{Timestamp: ts.Time(), Value: 3},
+					{Timestamp: ts.Add(time.Minute).Time(), Histogram: h},
+					{Timestamp: ts.Add(2 * time.Minute).Time(), Value: 5},
+				}},
+			}},
+		},
+		{
+			name: "empty matrix",
+			v:    model.Matrix{},
+			want: &Result{Type: model.ValMatrix, Series: []Series{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Decode() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// podResult is the container_memory_working_set_bytes of three pods and a
+// histogram, over two points.
+func podResult() *Result {
+	t0, t1 := ts.Time(), ts.Add(time.Minute).Time()
+	return &Result{Type: model.ValMatrix, Series: []Series{
+		{Labels: map[string]string{"namespace": "a", "pod": "a-0"}, Points: []Point{{Timestamp: t0, Value: 100}, {Timestamp: t1, Value: 1}}},
+		{Labels: map[string]string{"namespace": "a", "pod": "a-1"}, Points: []Point{{Timestamp: t0, Value: 2}}},
+		{Labels: map[string]string{"namespace": "b", "pod": "b-0"}, Points: []Point{{Timestamp: t1, Value: 4}}},
+		{Labels: map[string]string{"pod": "orphan"}, Points: []Point{{Timestamp: t1, Histogram: histogram(2, 8)}}},
+		{Labels: map[string]string{"pod": "empty"}},
+	}}
+}
+
+func TestInstant(t *testing.T) {
+	r := podResult()
+	got := r.Instant()
+	if len(got) != 4 {
+		t.Fatalf("Instant() = %+v, want the last point of the 4 series with points", got)
+	}
+	if got[0].Value != 1 || !got[0].Timestamp.Equal(ts.Add(time.Minute).Time()) {
+		t.Errorf("Instant()[0] = %+v, want the last point 1", got[0])
+	}
+	if got[3].Histogram == nil {
+		t.Errorf("Instant()[3] = %+v, want the histogram", got[3])
+	}
+	if s := r.Sum(); s != 1+2+4+8 {
+		t.Errorf("Sum() = %v, want 15 with the sum of the histogram", s)
+	}
+}
+
+func TestGroupBy(t *testing.T) {
+	t0, t1 := ts.Time(), ts.Add(time.Minute).Time()
+	tests := []struct {
+		name   string
+		labels []string
+		want   []Sample
+	}{
+		{
+			name:   "namespace",
+			labels: []string{"namespace"},
+			want: []Sample{
+				{Labels: map[string]string{"namespace": "a"}, Timestamp: t1, Value: 3},
+				{Labels: map[string]string{"namespace": "b"}, Timestamp: t1, Value: 4},
+				// series without the label are grouped together
+				{Labels: map[string]string{}, Timestamp: t1, Value: 8},
+			},
+		},
+		{
+			name: "without labels",
+			want: []Sample{{Labels: map[string]string{}, Timestamp: t1, Value: 15}},
+		},
+		{
+			name:   "several labels",
+			labels: []string{"namespace", "pod"},
+			want: []Sample{
+				{Labels: map[string]string{"namespace": "a", "pod": "a-0"}, Timestamp: t1, Value: 1},
+				{Labels: map[string]string{"namespace": "a", "pod": "a-1"}, Timestamp: t0, Value: 2},
+				{Labels: map[string]string{"namespace": "b", "pod": "b-0"}, Timestamp: t1, Value: 4},
+				{Labels: map[string]string{"pod": "orphan"}, Timestamp: t1, Value: 8},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podResult().GroupBy(tt.labels...); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GroupBy(%q) = %+v, want %+v", tt.labels, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToMap(t *testing.T) {
+	r := podResult()
+	if got, want := r.ToMap("namespace"), map[string]float64{"a": 3, "b": 4, "": 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ToMap(namespace) = %v, want %v", got, want)
+	}
+	want := map[string]float64{
+		`{namespace="a", pod="a-0"}`: 1,
+		`{namespace="a", pod="a-1"}`: 2,
+		`{namespace="b", pod="b-0"}`: 4,
+		`{pod="orphan"}`:             8,
+	}
+	if got := r.ToMap(""); !reflect.DeepEqual(got, want) {
+		t.Errorf("ToMap() = %v, want %v", got, want)
+	}
+
+	scalar := &Result{Type: model.ValScalar, Samples: []Sample{{Labels: map[string]string{}, Value: 7}}}
+	if got := scalar.ToMap(""); !reflect.DeepEqual(got, map[string]float64{"{}": 7}) {
+		t.Errorf("ToMap() of a scalar = %v, want {}: 7", got)
+	}
+}
+
+func TestJSONFloat(t *testing.T) {
+	tests := []struct {
+		value float64
+		json  string
+	}{
+		{value: 1.5, json: `1.5`},
+		{value: 0, json: `0`},
+		{value: math.NaN(), json: `"NaN"`},
+		{value: math.Inf(1), json: `"+Inf"`},
+		{value: math.Inf(-1), json: `"-Inf"`},
+	}
+	for _, tt := range tests {
+		s := Sample{Labels: map[string]string{"job": "node"}, Timestamp: ts.Time().UTC(), Value: tt.value}
+		b, err := json.Marshal(s)
+		if err != nil {
+			t.Fatalf("Marshal(%v): %v", tt.value, err)
+		}
+		want := `{"labels":{"job":"node"},"timestamp":"2023-11-14T22:13:20Z","value":` + tt.json + `}`
+		if string(b) != want {
+			t.Errorf("Marshal(%v) = %s, want %s", tt.value, b, want)
+		}
+		var got Sample
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("Unmarshal(%s): %v", b, err)
+		}
+		if !same(got.Value, tt.value) || got.Labels["job"] != "node" || !got.Timestamp.Equal(s.Timestamp) {
+			t.Errorf("Unmarshal(%s) = %+v, want %+v", b, got, s)
+		}
+
+		p := Point{Timestamp: s.Timestamp, Value: tt.value}
+		if b, err = json.Marshal(p); err != nil {
+			t.Fatalf("Marshal(%v): %v", tt.value, err)
+		}
+		var gotPoint Point
+		if err := json.Unmarshal(b, &gotPoint); err != nil || !same(gotPoint.Value, tt.value) {
+			t.Errorf("Unmarshal(%s) = %+v, %v, want %v", b, gotPoint, err, tt.value)
+		}
+	}
+
+	// a whole result, as written by read-prom -o json
+	r := &Result{Type: model.ValMatrix, Series: []Series{{
+		Labels: map[string]string{},
+		Points: []Point{{Timestamp: ts.Time().UTC(), Value: math.Inf(1)}},
+	}}}
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Result
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, r) {
+		t.Errorf("round trip of %s = %+v, want %+v", b, got, r)
+	}
+
+	var f jsonFloat
+	if err := json.Unmarshal([]byte(`"many"`), &f); err == nil {
+		t.Error(`Unmarshal("many") succeeded`)
+	}
+}
+
+// same is == that is true for two NaNs.
+func same(a, b float64) bool {
+	return a == b || math.IsNaN(a) && math.IsNaN(b)
+}
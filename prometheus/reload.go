@@ -0,0 +1,366 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	promapi "github.com/prometheus/client_golang/api"
+	"k8s.io/klog/v2"
+)
+
+// reloadDelay batches the burst of events caused by a single secret update.
+const reloadDelay = 100 * time.Millisecond
+
+// ReloadingClient is a promapi.Client that rebuilds the underlying client
+// whenever one of the credential or TLS files referenced by the Config
+// changes.
+//
+// The parent directories of the files are watched instead of the files
+// themselves, so the atomic "..data" symlink swap used by Kubernetes
+// volume mounts is picked up as well. A replaced client is closed once the
+// requests in flight on it are done.
+type ReloadingClient struct {
+	cfg     Config
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	client  atomic.Pointer[refClient]
+	hash    [sha256.Size]byte
+	reloads atomic.Int64
+
+	mu      sync.RWMutex
+	lastErr error
+}
+
+var _ promapi.Client = &ReloadingClient{}
+
+// NewReloadingClient returns a ReloadingClient for cfg. Call Close to stop
+// watching the files.
+func NewReloadingClient(cfg *Config) (*ReloadingClient, error) {
+	if !cfg.IsSet() {
+		return nil, errors.New("prometheus address is not set")
+	}
+
+	c := &ReloadingClient{
+		cfg:  *cfg,
+		done: make(chan struct{}),
+	}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+
+	dirs := c.watchedDirs()
+	if len(dirs) == 0 {
+		return c, nil
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			_ = w.Close()
+			return nil, fmt.Errorf("failed to watch %s: %w", dir, err)
+		}
+	}
+	c.watcher = w
+
+	c.wg.Add(1)
+	go c.run()
+	return c, nil
+}
+
+func (c *ReloadingClient) URL(ep string, args map[string]string) *url.URL {
+	return c.client.Load().URL(ep, args)
+}
+
+func (c *ReloadingClient) Do(ctx context.Context, req *http.Request) (*http.Response, []byte, error) {
+	rc := c.acquire()
+	defer rc.release()
+	return rc.Do(ctx, req)
+}
+
+// acquire returns the current client, which is not closed before release
+// is called.
+func (c *ReloadingClient) acquire() *refClient {
+	for {
+		// a reload may retire the client between Load and acquire
+		if rc := c.client.Load(); rc.acquire() {
+			return rc
+		}
+	}
+}
+
+// Reloads returns the number of times the client has been rebuilt after
+// a file change.
+func (c *ReloadingClient) Reloads() int64 {
+	return c.reloads.Load()
+}
+
+// LastError returns the error from the last reload attempt, if any. The
+// previous client keeps being used when a reload fails.
+func (c *ReloadingClient) LastError() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastErr
+}
+
+// Close stops watching the files and closes the current client, without
+// waiting for the requests in flight.
+func (c *ReloadingClient) Close() error {
+	var err error
+	if c.watcher != nil {
+		close(c.done)
+		err = c.watcher.Close()
+		c.wg.Wait()
+	}
+	return errors.Join(err, c.client.Load().Close())
+}
+
+// refClient counts the requests in flight on a client, so that it can be
+// closed once it is replaced and they are done. Closing it right away would
+// cut them off, along with the port forward they use.
+type refClient struct {
+	*Client
+
+	mu      sync.Mutex
+	refs    int
+	retired bool
+}
+
+func (rc *refClient) acquire() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.retired {
+		return false
+	}
+	rc.refs++
+	return true
+}
+
+func (rc *refClient) release() {
+	rc.mu.Lock()
+	rc.refs--
+	done := rc.retired && rc.refs == 0
+	rc.mu.Unlock()
+	if done {
+		rc.close()
+	}
+}
+
+// retire closes the client once the requests in flight are done.
+func (rc *refClient) retire() {
+	rc.mu.Lock()
+	rc.retired = true
+	done := rc.refs == 0
+	rc.mu.Unlock()
+	if done {
+		rc.close()
+	}
+}
+
+func (rc *refClient) close() {
+	if err := rc.Close(); err != nil {
+		klog.ErrorS(err, "failed to close the previous prometheus client")
+	}
+}
+
+func (c *ReloadingClient) run() {
+	defer c.wg.Done()
+
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-c.done:
+			return
+		case ev, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			klog.V(5).InfoS("prometheus credential directory changed", "event", ev.String())
+			timer = time.After(reloadDelay)
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			c.setLastError(err)
+		case <-timer:
+			timer = nil
+			err := c.reload()
+			c.setLastError(err)
+			if err != nil {
+				klog.ErrorS(err, "failed to reload prometheus client")
+			}
+		}
+	}
+}
+
+func (c *ReloadingClient) setLastError(err error) {
+	c.mu.Lock()
+	c.lastErr = err
+	c.mu.Unlock()
+}
+
+// reload reads the files referenced by the config and swaps in a new client
+// if any of them changed.
+func (c *ReloadingClient) reload() error {
+	inline, hash, err := c.cfg.inlineFiles()
+	if err != nil {
+		return err
+	}
+	if c.client.Load() != nil && hash == c.hash {
+		return nil
+	}
+
+	pc, err := inline.NewClient()
+	if err != nil {
+		return err
+	}
+	c.swap(pc)
+	c.hash = hash
+	return nil
+}
+
+// swap makes pc the current client and retires the previous one.
+func (c *ReloadingClient) swap(pc *Client) {
+	if prev := c.client.Swap(&refClient{Client: pc}); prev != nil {
+		c.reloads.Add(1)
+		prev.retire()
+	}
+}
+
+func (c *ReloadingClient) watchedDirs() []string {
+	seen := map[string]bool{}
+	var dirs []string
+	for _, f := range c.cfg.referencedFiles() {
+		dir := filepath.Dir(f)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func (p *Config) referencedFiles() []string {
+	var files []string
+	for _, f := range []string{
+		p.BearerTokenFile,
+		p.BasicAuth.PasswordFile,
+		p.Authorization.CredentialsFile,
+		p.OAuth2.ClientSecretFile,
+		p.TLSConfig.CAFile,
+		p.TLSConfig.CertFile,
+		p.TLSConfig.KeyFile,
+	} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// inlineFiles returns a copy of the config with the contents of the
+// referenced files loaded into memory, along with a hash of those contents.
+func (p *Config) inlineFiles() (*Config, [sha256.Size]byte, error) {
+	out := *p
+	h := sha256.New()
+
+	read := func(path string) ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		_, _ = h.Write([]byte(path))
+		_, _ = h.Write(data)
+		return data, nil
+	}
+	readSecret := func(path string) (string, error) {
+		data, err := read(path)
+		return string(bytes.TrimSpace(data)), err
+	}
+
+	var err error
+	if p.BearerTokenFile != "" {
+		if out.BearerToken, err = readSecret(p.BearerTokenFile); err != nil {
+			return nil, [sha256.Size]byte{}, err
+		}
+		out.BearerTokenFile = ""
+	}
+	if p.BasicAuth.PasswordFile != "" {
+		if out.BasicAuth.Password, err = readSecret(p.BasicAuth.PasswordFile); err != nil {
+			return nil, [sha256.Size]byte{}, err
+		}
+		out.BasicAuth.PasswordFile = ""
+	}
+	if p.Authorization.CredentialsFile != "" {
+		if out.Authorization.Credentials, err = readSecret(p.Authorization.CredentialsFile); err != nil {
+			return nil, [sha256.Size]byte{}, err
+		}
+		out.Authorization.CredentialsFile = ""
+	}
+	if p.OAuth2.ClientSecretFile != "" {
+		if out.OAuth2.ClientSecret, err = readSecret(p.OAuth2.ClientSecretFile); err != nil {
+			return nil, [sha256.Size]byte{}, err
+		}
+		out.OAuth2.ClientSecretFile = ""
+	}
+	if p.TLSConfig.CAFile != "" && len(p.CAData) == 0 {
+		if out.CAData, err = read(p.TLSConfig.CAFile); err != nil {
+			return nil, [sha256.Size]byte{}, err
+		}
+		out.TLSConfig.CAFile = ""
+	}
+	if p.TLSConfig.CertFile != "" && len(p.CertData) == 0 {
+		if out.CertData, err = read(p.TLSConfig.CertFile); err != nil {
+			return nil, [sha256.Size]byte{}, err
+		}
+		out.TLSConfig.CertFile = ""
+	}
+	if p.TLSConfig.KeyFile != "" && len(p.KeyData) == 0 {
+		if out.KeyData, err = read(p.TLSConfig.KeyFile); err != nil {
+			return nil, [sha256.Size]byte{}, err
+		}
+		out.TLSConfig.KeyFile = ""
+	}
+	if len(out.CertData) > 0 && len(out.KeyData) > 0 {
+		// the cert and key are rotated separately, wait until they match
+		if _, err := tls.X509KeyPair(out.CertData, out.KeyData); err != nil {
+			return nil, [sha256.Size]byte{}, fmt.Errorf("invalid client certificate: %w", err)
+		}
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return &out, sum, nil
+}
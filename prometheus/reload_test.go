@@ -0,0 +1,181 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReloadingClientClosesConnections(t *testing.T) {
+	closed := make(chan struct{}, 10)
+	tokens := make(chan string, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens <- r.Header.Get("Authorization")
+	}))
+	srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("one"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewReloadingClient(&Config{Addr: srv.URL, BearerTokenFile: tokenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/status/buildinfo", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := c.Do(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitClosed := func(what string) {
+		t.Helper()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the connection of the %s client was not closed", what)
+		}
+	}
+
+	get()
+	if got := <-tokens; got != "Bearer one" {
+		t.Fatalf("Authorization = %q, want Bearer one", got)
+	}
+
+	if err := os.WriteFile(tokenFile, []byte("two"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Reloads() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("client was not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitClosed("previous")
+
+	get()
+	if got := <-tokens; got != "Bearer two" {
+		t.Fatalf("Authorization = %q, want Bearer two", got)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	waitClosed("current")
+}
+
+// TestReloadingClientDrains checks that the port forward of the previous
+// client is closed only once the request in flight on it is done.
+func TestReloadingClientDrains(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("block") != "" {
+			close(started)
+			<-release
+		}
+	}))
+	defer srv.Close()
+	// a failed check must not leave the handler blocked, or Close hangs
+	unblock := sync.OnceFunc(func() { close(release) })
+	defer unblock()
+
+	newClient := func() (*Client, *fakeConnection) {
+		t.Helper()
+		pc, err := (&Config{Addr: srv.URL}).NewClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn := &fakeConnection{closed: make(chan bool)}
+		pc.fw = &portForwarder{conn: conn}
+		return pc, conn
+	}
+	isClosed := func(conn *fakeConnection) bool {
+		select {
+		case <-conn.closed:
+			return true
+		default:
+			return false
+		}
+	}
+	get := func(c *ReloadingClient, query string) error {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/status/buildinfo?"+query, nil)
+		if err != nil {
+			return err
+		}
+		_, _, err = c.Do(context.Background(), req)
+		return err
+	}
+
+	c := &ReloadingClient{}
+	prev, prevConn := newClient()
+	c.swap(prev)
+
+	inFlight := make(chan error, 1)
+	go func() {
+		inFlight <- get(c, "block=1")
+	}()
+	<-started
+
+	next, nextConn := newClient()
+	c.swap(next)
+	if c.Reloads() != 1 {
+		t.Errorf("Reloads() = %d, want 1", c.Reloads())
+	}
+	if isClosed(prevConn) {
+		t.Fatal("the port forward of the previous client was closed with a request in flight")
+	}
+	if err := get(c, ""); err != nil {
+		t.Fatalf("request on the new client: %v", err)
+	}
+
+	unblock()
+	if err := <-inFlight; err != nil {
+		t.Fatalf("request in flight during the reload: %v", err)
+	}
+	if !isClosed(prevConn) {
+		t.Error("the port forward of the previous client was not closed once drained")
+	}
+	if isClosed(nextConn) {
+		t.Error("the port forward of the current client was closed")
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !isClosed(nextConn) {
+		t.Error("Close() did not close the port forward of the current client")
+	}
+}
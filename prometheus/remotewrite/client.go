@@ -0,0 +1,150 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package remotewrite pushes samples to a Prometheus compatible backend
+// with the remote write 1.0 protocol, e.g. to store the results of a cost
+// report next to the metrics they were computed from. The backend is
+// described by a prometheus.Config, so its auth, TLS, proxy, header and
+// tenant settings are shared with the query client.
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+)
+
+// Paths of the remote write endpoint of common backends. The Addr of the
+// prometheus.Config is the base URL, like for queries.
+const (
+	// PathPrometheus needs Prometheus to run with
+	// --web.enable-remote-write-receiver.
+	PathPrometheus = "/api/v1/write"
+	// PathMimir is used by Grafana Mimir and Cortex.
+	PathMimir = "/api/v1/push"
+	// PathThanos is used by Thanos Receive.
+	PathThanos = "/api/v1/receive"
+)
+
+// version of the protocol sent in the X-Prometheus-Remote-Write-Version header
+const protocolVersion = "0.1.0"
+
+// maxErrorBody is the number of bytes of a response body included in errors.
+const maxErrorBody = 256
+
+// Client sends write requests to a remote write endpoint.
+type Client struct {
+	client *prometheus.Client
+	path   string
+}
+
+// NewClient returns a client for the remote write endpoint at path below
+// the address of cfg, e.g. PathMimir. Requests are sent through the same
+// round tripper as queries, so leave MaxRetries of cfg at zero if the
+// client is used by a Queue; the queue retries on its own. Call Close once
+// the client is no longer used.
+func NewClient(cfg *prometheus.Config, path string) (*Client, error) {
+	c, err := cfg.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("remote write address is not set")
+	}
+	if path == "" {
+		path = PathPrometheus
+	}
+	return &Client{client: c, path: path}, nil
+}
+
+// Close closes the connections of the client.
+func (c *Client) Close() error {
+	return c.client.Close()
+}
+
+// RecoverableError is returned for write requests that may succeed if they
+// are sent again: network errors, 5xx and 429 responses.
+type RecoverableError struct {
+	Err error
+	// RetryAfter is the delay asked for by the Retry-After header, or zero.
+	RetryAfter time.Duration
+}
+
+func (e *RecoverableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RecoverableError) Unwrap() error {
+	return e.Err
+}
+
+// Store sends req. Other 4xx responses mean the backend rejected the
+// samples, e.g. as out of order, and are returned as plain errors.
+func (c *Client) Store(ctx context.Context, req *WriteRequest) error {
+	return c.store(ctx, snappy.Encode(nil, req.Marshal()))
+}
+
+func (c *Client) store(ctx context.Context, compressed []byte) error {
+	u := c.client.URL(c.path, nil)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", protocolVersion)
+
+	resp, body, err := c.client.Do(ctx, httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return &RecoverableError{Err: err}
+	}
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+
+	if len(body) > maxErrorBody {
+		body = body[:maxErrorBody]
+	}
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return &RecoverableError{Err: err, RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return err
+}
+
+// retryAfter parses a Retry-After header in seconds or as an HTTP date.
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
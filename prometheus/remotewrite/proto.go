@@ -0,0 +1,299 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotewrite
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The messages of the remote write 1.0 protocol. They are encoded by hand
+// with protowire, so the gogo generated prompb package isn't needed.
+// ref: https://prometheus.io/docs/specs/remote_write_spec/
+// ref: https://github.com/prometheus/prometheus/blob/v2.55.1/prompb/remote.proto
+
+// MetricType is the type of a metric family in its metadata.
+type MetricType int32
+
+const (
+	MetricTypeUnknown        MetricType = 0
+	MetricTypeCounter        MetricType = 1
+	MetricTypeGauge          MetricType = 2
+	MetricTypeHistogram      MetricType = 3
+	MetricTypeGaugeHistogram MetricType = 4
+	MetricTypeSummary        MetricType = 5
+	MetricTypeInfo           MetricType = 6
+	MetricTypeStateset       MetricType = 7
+)
+
+var metricTypeNames = map[MetricType]string{
+	MetricTypeUnknown:        "unknown",
+	MetricTypeCounter:        "counter",
+	MetricTypeGauge:          "gauge",
+	MetricTypeHistogram:      "histogram",
+	MetricTypeGaugeHistogram: "gaugehistogram",
+	MetricTypeSummary:        "summary",
+	MetricTypeInfo:           "info",
+	MetricTypeStateset:       "stateset",
+}
+
+// String returns the name of t used by the metadata API, e.g. "counter".
+func (t MetricType) String() string {
+	if name, ok := metricTypeNames[t]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// Sample is a value at a timestamp in milliseconds.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries is a series with its samples, oldest first.
+type TimeSeries struct {
+	Labels  labels.Labels
+	Samples []Sample
+}
+
+// Metadata describes a metric family.
+type Metadata struct {
+	Type MetricType
+	Help string
+	Unit string
+}
+
+// MetricMetadata is the metadata of a metric family.
+type MetricMetadata struct {
+	MetricFamilyName string
+	Metadata
+}
+
+// WriteRequest is the body of a remote write request before it is snappy
+// compressed.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+	Metadata   []MetricMetadata
+}
+
+// field numbers of the messages
+const (
+	writeRequestTimeseries = 1
+	writeRequestMetadata   = 3
+
+	timeSeriesLabels  = 1
+	timeSeriesSamples = 2
+
+	labelName  = 1
+	labelValue = 2
+
+	sampleValue     = 1
+	sampleTimestamp = 2
+
+	metadataType             = 1
+	metadataMetricFamilyName = 2
+	metadataHelp             = 4
+	metadataUnit             = 5
+)
+
+// Marshal returns the protobuf encoding of r.
+func (r *WriteRequest) Marshal() []byte {
+	var b, msg []byte
+	for _, ts := range r.Timeseries {
+		msg = ts.appendProto(msg[:0])
+		b = protowire.AppendTag(b, writeRequestTimeseries, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	for _, m := range r.Metadata {
+		msg = m.appendProto(msg[:0])
+		b = protowire.AppendTag(b, writeRequestMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	return b
+}
+
+func (ts *TimeSeries) appendProto(b []byte) []byte {
+	ts.Labels.Range(func(l labels.Label) {
+		var msg []byte
+		msg = appendString(msg, labelName, l.Name)
+		msg = appendString(msg, labelValue, l.Value)
+		b = protowire.AppendTag(b, timeSeriesLabels, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	})
+	for _, s := range ts.Samples {
+		var msg []byte
+		msg = protowire.AppendTag(msg, sampleValue, protowire.Fixed64Type)
+		msg = protowire.AppendFixed64(msg, math.Float64bits(s.Value))
+		msg = protowire.AppendTag(msg, sampleTimestamp, protowire.VarintType)
+		msg = protowire.AppendVarint(msg, uint64(s.Timestamp))
+		b = protowire.AppendTag(b, timeSeriesSamples, protowire.BytesType)
+		b = protowire.AppendBytes(b, msg)
+	}
+	return b
+}
+
+func (m *MetricMetadata) appendProto(b []byte) []byte {
+	b = protowire.AppendTag(b, metadataType, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.Type))
+	b = appendString(b, metadataMetricFamilyName, m.MetricFamilyName)
+	b = appendString(b, metadataHelp, m.Help)
+	b = appendString(b, metadataUnit, m.Unit)
+	return b
+}
+
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// Unmarshal decodes a remote write request, like a receiver does. Fields
+// that aren't part of WriteRequest, like exemplars and native histograms,
+// are skipped.
+func Unmarshal(b []byte) (*WriteRequest, error) {
+	r := &WriteRequest{}
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		switch {
+		case num == writeRequestTimeseries && typ == protowire.BytesType:
+			ts, err := unmarshalTimeSeries(v)
+			if err != nil {
+				return fmt.Errorf("invalid time series: %w", err)
+			}
+			r.Timeseries = append(r.Timeseries, ts)
+		case num == writeRequestMetadata && typ == protowire.BytesType:
+			m, err := unmarshalMetadata(v)
+			if err != nil {
+				return fmt.Errorf("invalid metadata: %w", err)
+			}
+			r.Metadata = append(r.Metadata, m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func unmarshalTimeSeries(b []byte) (TimeSeries, error) {
+	var ts TimeSeries
+	lb := labels.NewScratchBuilder(8)
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		switch {
+		case num == timeSeriesLabels && typ == protowire.BytesType:
+			var name, value string
+			err := walk(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+				switch {
+				case num == labelName && typ == protowire.BytesType:
+					name = string(v)
+				case num == labelValue && typ == protowire.BytesType:
+					value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			lb.Add(name, value)
+		case num == timeSeriesSamples && typ == protowire.BytesType:
+			var s Sample
+			err := walk(v, func(num protowire.Number, typ protowire.Type, _ []byte, x uint64) error {
+				switch {
+				case num == sampleValue && typ == protowire.Fixed64Type:
+					s.Value = math.Float64frombits(x)
+				case num == sampleTimestamp && typ == protowire.VarintType:
+					s.Timestamp = int64(x)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+		return nil
+	})
+	lb.Sort()
+	ts.Labels = lb.Labels()
+	return ts, err
+}
+
+func unmarshalMetadata(b []byte) (MetricMetadata, error) {
+	var m MetricMetadata
+	err := walk(b, func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error {
+		switch {
+		case num == metadataType && typ == protowire.VarintType:
+			m.Type = MetricType(x)
+		case num == metadataMetricFamilyName && typ == protowire.BytesType:
+			m.MetricFamilyName = string(v)
+		case num == metadataHelp && typ == protowire.BytesType:
+			m.Help = string(v)
+		case num == metadataUnit && typ == protowire.BytesType:
+			m.Unit = string(v)
+		}
+		return nil
+	})
+	return m, err
+}
+
+// walk calls fn for every field of a message with the bytes of a
+// length-delimited field or the value of a scalar field.
+func walk(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, x uint64) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var (
+			v []byte
+			x uint64
+		)
+		switch typ {
+		case protowire.VarintType:
+			x, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			x, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var x32 uint32
+			x32, n = protowire.ConsumeFixed32(b)
+			x = uint64(x32)
+		case protowire.BytesType:
+			v, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if n > len(b) {
+			return errors.New("truncated message")
+		}
+		b = b[n:]
+		if err := fn(num, typ, v, x); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotewrite
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// golden is the encoding of testRequest by the prompb package of
+// Prometheus, one message per line.
+var golden = strings.Join([]string{
+	// timeseries { labels {...} labels {...} samples {...} }
+	"0a2b",
+	"0a0e" + "0a08" + hex.EncodeToString([]byte("__name__")) + "1202" + hex.EncodeToString([]byte("up")),
+	"0a0b" + "0a03" + hex.EncodeToString([]byte("job")) + "1204" + hex.EncodeToString([]byte("node")),
+	// value 1 as fixed64, timestamp 1000 as varint
+	"120c" + "09000000000000f03f" + "10e807",
+	// metadata { type: COUNTER metric_family_name: "up" help: "h" unit: "u" }
+	"1a0c" + "0801" + "1202" + hex.EncodeToString([]byte("up")) + "2201" + hex.EncodeToString([]byte("h")) + "2a01" + hex.EncodeToString([]byte("u")),
+}, "")
+
+func testRequest() *WriteRequest {
+	return &WriteRequest{
+		Timeseries: []TimeSeries{{
+			Labels:  labels.FromStrings("__name__", "up", "job", "node"),
+			Samples: []Sample{{Value: 1, Timestamp: 1000}},
+		}},
+		Metadata: []MetricMetadata{{
+			MetricFamilyName: "up",
+			Metadata:         Metadata{Type: MetricTypeCounter, Help: "h", Unit: "u"},
+		}},
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	want, err := hex.DecodeString(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := testRequest().Marshal(); !bytes.Equal(got, want) {
+		t.Errorf("Marshal() =\n%x\nwant\n%x", got, want)
+	}
+	r, err := Unmarshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, testRequest()) {
+		t.Errorf("Unmarshal() = %+v, want %+v", r, testRequest())
+	}
+}
+
+func TestUnmarshalRoundTrip(t *testing.T) {
+	nan := math.Float64frombits(0x7ff0000000000002)
+	req := &WriteRequest{
+		Timeseries: []TimeSeries{
+			{
+				Labels: labels.FromStrings("__name__", "temperature", "room", "kitchen"),
+				Samples: []Sample{
+					{Value: -12.5, Timestamp: -1000},
+					{Value: math.Inf(1), Timestamp: 0},
+					{Value: nan, Timestamp: math.MaxInt64},
+				},
+			},
+		},
+		Metadata: []MetricMetadata{
+			{MetricFamilyName: "temperature", Metadata: Metadata{Type: MetricTypeGauge}},
+		},
+	}
+	got, err := Unmarshal(req.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Timeseries) != 1 || len(got.Timeseries[0].Samples) != 3 {
+		t.Fatalf("Unmarshal() = %+v, want a series with 3 samples", got)
+	}
+	// NaN isn't equal to itself, the bits of staleness markers must survive
+	for i, s := range got.Timeseries[0].Samples {
+		want := req.Timeseries[0].Samples[i]
+		if math.Float64bits(s.Value) != math.Float64bits(want.Value) || s.Timestamp != want.Timestamp {
+			t.Errorf("sample %d = %v, want %v", i, s, want)
+		}
+	}
+	if want := req.Timeseries[0].Labels; !labels.Equal(got.Timeseries[0].Labels, want) {
+		t.Errorf("labels = %s, want %s", got.Timeseries[0].Labels, want)
+	}
+	if !reflect.DeepEqual(got.Metadata, req.Metadata) {
+		t.Errorf("metadata = %+v, want %+v", got.Metadata, req.Metadata)
+	}
+}
+
+func TestUnmarshalSkipsUnknownFields(t *testing.T) {
+	b, err := hex.DecodeString(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// exemplars (3) and histograms (4) of the series, and a fixed32 field
+	series := testRequest().Timeseries[0]
+	msg := series.appendProto(nil)
+	msg = protowire.AppendTag(msg, 3, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, []byte{0x09, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f})
+	msg = protowire.AppendTag(msg, 4, protowire.BytesType)
+	msg = protowire.AppendBytes(msg, []byte{0x08, 0x01})
+	msg = protowire.AppendTag(msg, 15, protowire.Fixed32Type)
+	msg = protowire.AppendFixed32(msg, 7)
+	b = protowire.AppendTag(b, writeRequestTimeseries, protowire.BytesType)
+	b = protowire.AppendBytes(b, msg)
+
+	r, err := Unmarshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testRequest()
+	want.Timeseries = append(want.Timeseries, series)
+	if !reflect.DeepEqual(r.Timeseries, want.Timeseries) {
+		t.Errorf("Unmarshal() = %+v, want %+v", r.Timeseries, want.Timeseries)
+	}
+
+	if _, err := Unmarshal(b[:len(b)-3]); err == nil {
+		t.Error("Unmarshal() of a truncated request succeeded")
+	}
+}
@@ -0,0 +1,483 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotewrite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"k8s.io/klog/v2"
+)
+
+// QueueConfig tunes the sending of samples. The fields and their defaults
+// follow the queue_config of the Prometheus remote_write configuration.
+type QueueConfig struct {
+	// The number of samples buffered per shard before Commit blocks.
+	// Defaults to 10000.
+	Capacity int `yaml:"capacity,omitempty" json:"capacity,omitempty"`
+	// The number of shards that send concurrently. Samples of a series are
+	// always sent by the same shard, in order. Defaults to 4.
+	Shards int `yaml:"shards,omitempty" json:"shards,omitempty"`
+	// The maximum number of samples per request. Defaults to 2000.
+	MaxSamplesPerSend int `yaml:"max_samples_per_send,omitempty" json:"max_samples_per_send,omitempty"`
+	// The maximum time samples wait in a shard before they are sent.
+	// Defaults to 5s.
+	BatchSendDeadline model.Duration `yaml:"batch_send_deadline,omitempty" json:"batch_send_deadline,omitempty"`
+	// The timeout of a request. Defaults to 30s.
+	RemoteTimeout model.Duration `yaml:"remote_timeout,omitempty" json:"remote_timeout,omitempty"`
+	// The initial delay before a failed request is retried, doubled after
+	// every attempt. Defaults to 30ms.
+	MinBackoff model.Duration `yaml:"min_backoff,omitempty" json:"min_backoff,omitempty"`
+	// The maximum delay between retries. Defaults to 5s.
+	MaxBackoff model.Duration `yaml:"max_backoff,omitempty" json:"max_backoff,omitempty"`
+	// The number of retries of a request before its samples are dropped.
+	// Defaults to 10.
+	MaxRetries int `yaml:"max_retries,omitempty" json:"max_retries,omitempty"`
+}
+
+// DefaultQueueConfig is used for the unset fields of a QueueConfig.
+var DefaultQueueConfig = QueueConfig{
+	Capacity:          10000,
+	Shards:            4,
+	MaxSamplesPerSend: 2000,
+	BatchSendDeadline: model.Duration(5 * time.Second),
+	RemoteTimeout:     model.Duration(30 * time.Second),
+	MinBackoff:        model.Duration(30 * time.Millisecond),
+	MaxBackoff:        model.Duration(5 * time.Second),
+	MaxRetries:        10,
+}
+
+func (c QueueConfig) withDefaults() QueueConfig {
+	d := DefaultQueueConfig
+	if c.Capacity <= 0 {
+		c.Capacity = d.Capacity
+	}
+	if c.Shards <= 0 {
+		c.Shards = d.Shards
+	}
+	if c.MaxSamplesPerSend <= 0 {
+		c.MaxSamplesPerSend = d.MaxSamplesPerSend
+	}
+	if c.BatchSendDeadline <= 0 {
+		c.BatchSendDeadline = d.BatchSendDeadline
+	}
+	if c.RemoteTimeout <= 0 {
+		c.RemoteTimeout = d.RemoteTimeout
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = d.MinBackoff
+	}
+	if c.MaxBackoff <= 0 {
+		c.MaxBackoff = d.MaxBackoff
+	}
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = d.MaxRetries
+	}
+	return c
+}
+
+// ErrClosed is returned by Commit after the queue is closed.
+var ErrClosed = errors.New("remote write queue is closed")
+
+// Appender collects samples and metadata that are queued together by
+// Commit, like the storage.Appender of Prometheus.
+type Appender interface {
+	// Append adds a sample of the series l at t in milliseconds, see
+	// timestamp.FromTime. l must have a metric name.
+	Append(l labels.Labels, t int64, v float64) error
+	// UpdateMetadata sets the type, help and unit of a metric family.
+	UpdateMetadata(metricFamily string, m Metadata) error
+	// Commit queues the samples and metadata. It blocks while the shards
+	// of the series are full, until the queue is closed.
+	Commit() error
+	// Rollback discards the samples and metadata.
+	Rollback() error
+}
+
+// Stats are the counters of a queue.
+type Stats struct {
+	// Pending samples are queued but not sent yet.
+	Pending int64 `json:"pending"`
+	Sent    int64 `json:"sent"`
+	// Failed samples were rejected by the backend or still failed after
+	// all retries, and are dropped.
+	Failed int64 `json:"failed"`
+	// Retried counts the samples of every request that is sent again.
+	Retried      int64 `json:"retried"`
+	MetadataSent int64 `json:"metadataSent"`
+}
+
+// Queue sends samples in the background. Series are spread over shards by
+// the hash of their labels, and every shard sends a request when it has
+// MaxSamplesPerSend samples or its oldest sample waited BatchSendDeadline.
+type Queue struct {
+	client *Client
+	cfg    QueueConfig
+	shards []*shard
+
+	// ctx is canceled when Close gives up waiting, to abort the requests
+	// and retries in flight.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// closing is closed first by Close, so that Commit and Flush don't
+	// block it on full or busy shards.
+	closing   chan struct{}
+	closeOnce sync.Once
+	// mu guards closed, and the shard channels being closed; it is held
+	// for reading while samples are queued.
+	mu     sync.RWMutex
+	closed bool
+
+	metaMu   sync.Mutex
+	metadata map[string]Metadata
+
+	pending, sent, failed, retried, metadataSent atomic.Int64
+}
+
+type shard struct {
+	samples chan pendingSample
+	flush   chan chan struct{}
+}
+
+type pendingSample struct {
+	labels labels.Labels
+	sample Sample
+}
+
+// NewQueue starts the shards of a queue that sends to client.
+func NewQueue(client *Client, cfg QueueConfig) *Queue {
+	cfg = cfg.withDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		client:   client,
+		cfg:      cfg,
+		ctx:      ctx,
+		cancel:   cancel,
+		closing:  make(chan struct{}),
+		metadata: map[string]Metadata{},
+	}
+	for i := 0; i < cfg.Shards; i++ {
+		s := &shard{
+			samples: make(chan pendingSample, cfg.Capacity),
+			flush:   make(chan chan struct{}),
+		}
+		q.shards = append(q.shards, s)
+		q.wg.Add(1)
+		go q.run(i, s)
+	}
+	return q
+}
+
+// Appender returns an appender that queues to q.
+func (q *Queue) Appender() Appender {
+	return &appender{q: q, metadata: map[string]Metadata{}}
+}
+
+// Stats returns the counters of the queue.
+func (q *Queue) Stats() Stats {
+	return Stats{
+		Pending:      q.pending.Load(),
+		Sent:         q.sent.Load(),
+		Failed:       q.failed.Load(),
+		Retried:      q.retried.Load(),
+		MetadataSent: q.metadataSent.Load(),
+	}
+}
+
+// Flush sends the committed samples and waits until they are sent or have
+// failed.
+func (q *Queue) Flush(ctx context.Context) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrClosed
+	}
+	done := make([]chan struct{}, len(q.shards))
+	for i, s := range q.shards {
+		done[i] = make(chan struct{})
+		select {
+		case s.flush <- done[i]:
+		case <-q.closing:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	for _, d := range done {
+		select {
+		case <-d:
+		case <-q.closing:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Close sends the committed samples and stops the shards. Commit and Flush
+// calls blocked on full shards return ErrClosed. If ctx is done first, the
+// requests in flight are aborted and the remaining samples are dropped.
+func (q *Queue) Close(ctx context.Context) error {
+	q.closeOnce.Do(func() { close(q.closing) })
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	for _, s := range q.shards {
+		close(s.samples)
+	}
+	q.mu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(stopped)
+	}()
+	defer q.cancel()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-stopped
+		return fmt.Errorf("remote write queue closed with %d samples pending: %w", q.pending.Load(), ctx.Err())
+	}
+}
+
+func (q *Queue) enqueue(samples []pendingSample, metadata map[string]Metadata) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrClosed
+	}
+	q.metaMu.Lock()
+	for name, m := range metadata {
+		q.metadata[name] = m
+	}
+	q.metaMu.Unlock()
+	for i, ps := range samples {
+		s := q.shards[ps.labels.Hash()%uint64(len(q.shards))]
+		q.pending.Add(1)
+		select {
+		case s.samples <- ps:
+		case <-q.closing:
+			q.pending.Add(-1)
+			return fmt.Errorf("%w, %d of %d samples are not queued", ErrClosed, len(samples)-i, len(samples))
+		}
+	}
+	return nil
+}
+
+// takeMetadata returns the metadata updated since the last call.
+func (q *Queue) takeMetadata() []MetricMetadata {
+	q.metaMu.Lock()
+	defer q.metaMu.Unlock()
+	if len(q.metadata) == 0 {
+		return nil
+	}
+	out := make([]MetricMetadata, 0, len(q.metadata))
+	for name, m := range q.metadata {
+		out = append(out, MetricMetadata{MetricFamilyName: name, Metadata: m})
+	}
+	clear(q.metadata)
+	return out
+}
+
+// restoreMetadata queues metadata that failed to be sent again, unless it
+// has been updated since.
+func (q *Queue) restoreMetadata(metadata []MetricMetadata) {
+	q.metaMu.Lock()
+	defer q.metaMu.Unlock()
+	for _, m := range metadata {
+		if _, ok := q.metadata[m.MetricFamilyName]; !ok {
+			q.metadata[m.MetricFamilyName] = m.Metadata
+		}
+	}
+}
+
+// run batches the samples of a shard until its channel is closed. The
+// first shard also sends the metadata.
+func (q *Queue) run(i int, s *shard) {
+	defer q.wg.Done()
+
+	deadline := time.Duration(q.cfg.BatchSendDeadline)
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+
+	batch := make([]pendingSample, 0, q.cfg.MaxSamplesPerSend)
+	send := func() {
+		var metadata []MetricMetadata
+		if i == 0 {
+			metadata = q.takeMetadata()
+		}
+		if len(batch) > 0 || len(metadata) > 0 {
+			q.send(batch, metadata)
+		}
+		batch = batch[:0]
+		timer.Reset(deadline)
+	}
+	add := func(ps pendingSample) {
+		batch = append(batch, ps)
+		if len(batch) >= q.cfg.MaxSamplesPerSend {
+			send()
+		}
+	}
+
+	for {
+		select {
+		case ps, ok := <-s.samples:
+			if !ok {
+				send()
+				return
+			}
+			add(ps)
+		case done := <-s.flush:
+			for n := len(s.samples); n > 0; n-- {
+				add(<-s.samples)
+			}
+			send()
+			close(done)
+		case <-timer.C:
+			send()
+		}
+	}
+}
+
+// send writes a batch, retrying recoverable errors with backoff.
+func (q *Queue) send(batch []pendingSample, metadata []MetricMetadata) {
+	req := &WriteRequest{Metadata: metadata}
+	for _, ps := range batch {
+		req.Timeseries = append(req.Timeseries, TimeSeries{
+			Labels:  ps.labels,
+			Samples: []Sample{ps.sample},
+		})
+	}
+	compressed := snappy.Encode(nil, req.Marshal())
+	n := int64(len(batch))
+	defer q.pending.Add(-n)
+
+	backoff := time.Duration(q.cfg.MinBackoff)
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(q.ctx, time.Duration(q.cfg.RemoteTimeout))
+		err := q.client.store(ctx, compressed)
+		cancel()
+		if err == nil {
+			q.sent.Add(n)
+			q.metadataSent.Add(int64(len(metadata)))
+			return
+		}
+
+		var re *RecoverableError
+		if !errors.As(err, &re) {
+			// the backend rejected the request, sending it again won't help
+			q.failed.Add(n)
+			klog.ErrorS(err, "Dropped remote write samples", "samples", n, "metadata", len(metadata), "attempts", attempt+1)
+			return
+		}
+		if attempt >= q.cfg.MaxRetries || q.ctx.Err() != nil {
+			q.failed.Add(n)
+			// the metadata is sent with the next request
+			q.restoreMetadata(metadata)
+			klog.ErrorS(err, "Dropped remote write samples", "samples", n, "attempts", attempt+1)
+			return
+		}
+		q.retried.Add(n)
+
+		wait := re.RetryAfter
+		if wait <= 0 {
+			wait = backoff/2 + rand.N(backoff/2+1)
+		}
+		klog.V(4).InfoS("Retrying remote write", "samples", n, "attempt", attempt+1, "wait", wait, "err", err)
+		t := time.NewTimer(wait)
+		select {
+		case <-q.ctx.Done():
+			t.Stop()
+		case <-t.C:
+		}
+		backoff = min(backoff*2, time.Duration(q.cfg.MaxBackoff))
+	}
+}
+
+type appender struct {
+	q        *Queue
+	samples  []pendingSample
+	metadata map[string]Metadata
+}
+
+func (a *appender) Append(l labels.Labels, t int64, v float64) error {
+	if err := validate(l); err != nil {
+		return err
+	}
+	a.samples = append(a.samples, pendingSample{labels: l, sample: Sample{Value: v, Timestamp: t}})
+	return nil
+}
+
+func (a *appender) UpdateMetadata(metricFamily string, m Metadata) error {
+	if !model.IsValidLegacyMetricName(metricFamily) {
+		return fmt.Errorf("invalid metric family name %q", metricFamily)
+	}
+	a.metadata[metricFamily] = m
+	return nil
+}
+
+func (a *appender) Commit() error {
+	err := a.q.enqueue(a.samples, a.metadata)
+	a.samples = nil
+	a.metadata = map[string]Metadata{}
+	return err
+}
+
+func (a *appender) Rollback() error {
+	a.samples = nil
+	a.metadata = map[string]Metadata{}
+	return nil
+}
+
+// validate checks the labels of a series like the receivers do, so a bad
+// series fails on Append instead of failing its whole request.
+func validate(l labels.Labels) error {
+	name := l.Get(model.MetricNameLabel)
+	if name == "" {
+		return fmt.Errorf("series %s has no metric name", l)
+	}
+	if !model.IsValidLegacyMetricName(name) {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+	if dup, ok := l.HasDuplicateLabelNames(); ok {
+		return fmt.Errorf("series %s has duplicate label %s", l, dup)
+	}
+	var err error
+	l.Range(func(lbl labels.Label) {
+		if err == nil && !model.LabelName(lbl.Name).IsValidLegacy() {
+			err = fmt.Errorf("series %s has invalid label name %q", l, lbl.Name)
+		}
+	})
+	return err
+}
@@ -0,0 +1,296 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package remotewrite
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+)
+
+// receiver decodes write requests and answers the nth request, counted
+// from 1, with status(n). Requests wait for release if it is not nil.
+type receiver struct {
+	status  func(n int) int
+	release chan struct{}
+
+	mu       sync.Mutex
+	requests []*WriteRequest
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	compressed, _ := io.ReadAll(r.Body)
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := Unmarshal(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rc.mu.Lock()
+	rc.requests = append(rc.requests, req)
+	n := len(rc.requests)
+	rc.mu.Unlock()
+
+	if rc.release != nil {
+		select {
+		case <-rc.release:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	status := http.StatusNoContent
+	if rc.status != nil {
+		status = rc.status(n)
+	}
+	w.WriteHeader(status)
+}
+
+func (rc *receiver) received() []*WriteRequest {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]*WriteRequest(nil), rc.requests...)
+}
+
+// newTestQueue starts a queue sending to rc with short backoffs.
+func newTestQueue(t *testing.T, rc *receiver, cfg QueueConfig) *Queue {
+	t.Helper()
+	srv := httptest.NewServer(rc)
+	t.Cleanup(srv.Close)
+	if rc.release != nil {
+		// runs before srv.Close, which waits for the handlers
+		t.Cleanup(func() { close(rc.release) })
+	}
+	c, err := NewClient(&prometheus.Config{Addr: srv.URL}, PathPrometheus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	if cfg.MinBackoff == 0 {
+		cfg.MinBackoff = model.Duration(time.Millisecond)
+		cfg.MaxBackoff = model.Duration(time.Millisecond)
+	}
+	q := NewQueue(c, cfg)
+	t.Cleanup(func() { _ = q.Close(context.Background()) })
+	return q
+}
+
+// commit appends a sample of the series m{i="<i>"} for every i in ids.
+func commit(q *Queue, metadata bool, ids ...int) error {
+	app := q.Appender()
+	for _, i := range ids {
+		if err := app.Append(labels.FromStrings("__name__", "m", "i", strconv.Itoa(i)), int64(i), float64(i)); err != nil {
+			return err
+		}
+	}
+	if metadata {
+		if err := app.UpdateMetadata("m", Metadata{Type: MetricTypeGauge, Help: "A test metric."}); err != nil {
+			return err
+		}
+	}
+	return app.Commit()
+}
+
+func samples(reqs []*WriteRequest) []int {
+	var n []int
+	for _, r := range reqs {
+		n = append(n, len(r.Timeseries))
+	}
+	return n
+}
+
+func TestQueueBatching(t *testing.T) {
+	rc := &receiver{}
+	q := newTestQueue(t, rc, QueueConfig{Shards: 1, MaxSamplesPerSend: 3, BatchSendDeadline: model.Duration(time.Hour)})
+	if err := commit(q, true, 1, 2, 3, 4, 5, 6, 7); err != nil {
+		t.Fatal(err)
+	}
+	// the last sample waits for the batch deadline, or a flush
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	reqs := rc.received()
+	if got := samples(reqs); len(got) != 3 || got[0] != 3 || got[1] != 3 || got[2] != 1 {
+		t.Fatalf("requests with %v samples, want 3, 3 and 1", got)
+	}
+	// the samples of a series are sent in order, the metadata once
+	if ts := reqs[0].Timeseries[0]; ts.Labels.Get("i") != "1" || ts.Samples[0] != (Sample{Value: 1, Timestamp: 1}) {
+		t.Errorf("first series = %+v, want m{i=\"1\"} 1 @1", ts)
+	}
+	if len(reqs[0].Metadata) != 1 || reqs[0].Metadata[0].MetricFamilyName != "m" || len(reqs[1].Metadata) != 0 {
+		t.Errorf("metadata = %+v and %+v, want m with the first request", reqs[0].Metadata, reqs[1].Metadata)
+	}
+	if s := q.Stats(); s != (Stats{Sent: 7, MetadataSent: 1}) {
+		t.Errorf("stats = %+v, want 7 sent", s)
+	}
+
+	// without a flush
+	rc = &receiver{}
+	q = newTestQueue(t, rc, QueueConfig{Shards: 1, BatchSendDeadline: model.Duration(20 * time.Millisecond)})
+	if err := commit(q, false, 1); err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); len(rc.received()) == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the sample wasn't sent after the batch deadline")
+		}
+	}
+}
+
+func TestQueueRetry(t *testing.T) {
+	rc := &receiver{status: func(n int) int {
+		if n <= 2 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusNoContent
+	}}
+	q := newTestQueue(t, rc, QueueConfig{Shards: 1})
+	if err := commit(q, false, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(rc.received()); n != 3 {
+		t.Errorf("got %d requests, want 3", n)
+	}
+	if s := q.Stats(); s != (Stats{Sent: 2, Retried: 4}) {
+		t.Errorf("stats = %+v, want 2 sent and retried twice", s)
+	}
+}
+
+func TestQueueDropsRejected(t *testing.T) {
+	rc := &receiver{status: func(int) int { return http.StatusBadRequest }}
+	q := newTestQueue(t, rc, QueueConfig{Shards: 1})
+	if err := commit(q, true, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// the rejected metadata isn't sent again either
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(rc.received()); n != 1 {
+		t.Errorf("got %d requests, want 1 without retries", n)
+	}
+	if s := q.Stats(); s != (Stats{Failed: 2}) {
+		t.Errorf("stats = %+v, want 2 failed", s)
+	}
+}
+
+func TestQueueKeepsMetadata(t *testing.T) {
+	rc := &receiver{status: func(n int) int {
+		if n <= 2 {
+			return http.StatusInternalServerError
+		}
+		return http.StatusNoContent
+	}}
+	q := newTestQueue(t, rc, QueueConfig{Shards: 1, MaxRetries: 1})
+	if err := commit(q, true, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := q.Stats(); s != (Stats{Failed: 1, Retried: 1}) {
+		t.Errorf("stats = %+v, want 1 failed after a retry", s)
+	}
+
+	// the metadata goes with the next request
+	if err := commit(q, false, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	reqs := rc.received()
+	if len(reqs) != 3 || len(reqs[2].Metadata) != 1 || len(reqs[2].Timeseries) != 1 {
+		t.Fatalf("got %d requests, want the third with the sample and the metadata", len(reqs))
+	}
+	if s := q.Stats(); s.Sent != 1 || s.MetadataSent != 1 {
+		t.Errorf("stats = %+v, want 1 sample and the metadata sent", s)
+	}
+}
+
+func TestQueueCloseDeadline(t *testing.T) {
+	rc := &receiver{release: make(chan struct{})}
+	q := newTestQueue(t, rc, QueueConfig{Shards: 1, Capacity: 1, MaxSamplesPerSend: 1})
+	// the first sample is stuck in a request, the second fills the shard
+	if err := commit(q, false, 1); err != nil {
+		t.Fatal(err)
+	}
+	for len(rc.received()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := commit(q, false, 2); err != nil {
+		t.Fatal(err)
+	}
+	blocked := make(chan error, 1)
+	go func() { blocked <- commit(q, false, 3) }()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	closed := make(chan error, 1)
+	go func() { closed <- q.Close(ctx) }()
+	select {
+	case err := <-closed:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Close() = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close() didn't return after its deadline")
+	}
+	if err := <-blocked; !errors.Is(err, ErrClosed) {
+		t.Errorf("blocked Commit() = %v, want %v", err, ErrClosed)
+	}
+	if s := q.Stats(); s.Pending != 0 || s.Failed != 2 {
+		t.Errorf("stats = %+v, want the 2 queued samples dropped", s)
+	}
+}
+
+func TestQueueClosed(t *testing.T) {
+	q := newTestQueue(t, &receiver{}, QueueConfig{})
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Close(context.Background()); err != nil {
+		t.Errorf("second Close() = %v", err)
+	}
+	if err := commit(q, false, 1); !errors.Is(err, ErrClosed) {
+		t.Errorf("Commit() = %v, want %v", err, ErrClosed)
+	}
+	if err := q.Flush(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Flush() = %v, want %v", err, ErrClosed)
+	}
+}
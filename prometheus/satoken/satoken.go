@@ -0,0 +1,232 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package satoken issues bound service account tokens with the TokenRequest
+// API. Unlike the tokens of kubernetes.io/service-account-token Secrets,
+// which are no longer created on recent clusters, they have an audience and
+// an expiry, so they are cached and refreshed before they expire.
+package satoken
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultExpiration is the requested lifetime of a token.
+	DefaultExpiration = time.Hour
+	// MinExpiration is the shortest lifetime the apiserver accepts.
+	MinExpiration = 10 * time.Minute
+
+	// like the kubelet, refresh after 80% of the lifetime of a token
+	refreshFraction = 0.8
+	retryInterval   = 10 * time.Second
+)
+
+// requestTimeout bounds a TokenRequest, also for Token, which has no
+// context.
+var requestTimeout = 30 * time.Second
+
+// Options configure the tokens requested by a Source.
+type Options struct {
+	// Audiences the token is intended for. Defaults to the audiences of the
+	// apiserver, which is what the apiserver service proxy accepts.
+	Audiences []string
+	// Expiration is the requested lifetime of the token. The apiserver may
+	// shorten or extend it. Defaults to DefaultExpiration.
+	Expiration time.Duration
+}
+
+// Source is an oauth2.TokenSource of bound tokens of a service account. A
+// token is reused until 80% of its lifetime has passed. If a refresh fails,
+// the current token is used until it expires, and the refresh is retried
+// every 10 seconds. Callers that need a token while it is refreshed share
+// the same TokenRequest.
+type Source struct {
+	kc   kubernetes.Interface
+	sa   types.NamespacedName
+	opts Options
+
+	mu         sync.Mutex
+	token      *oauth2.Token
+	refreshAt  time.Time
+	refreshing *refresh
+	listeners  []func(*oauth2.Token)
+}
+
+// refresh is a TokenRequest in flight. token and err are set once done is
+// closed.
+type refresh struct {
+	done  chan struct{}
+	token *oauth2.Token
+	err   error
+}
+
+var _ oauth2.TokenSource = &Source{}
+
+// New returns a Source of tokens of the service account sa.
+func New(kc kubernetes.Interface, sa types.NamespacedName, opts Options) (*Source, error) {
+	if opts.Expiration == 0 {
+		opts.Expiration = DefaultExpiration
+	}
+	if opts.Expiration < MinExpiration {
+		return nil, fmt.Errorf("token expiration %s is shorter than the minimum of %s", opts.Expiration, MinExpiration)
+	}
+	return &Source{kc: kc, sa: sa, opts: opts}, nil
+}
+
+// NewForConfig returns a Source that requests the tokens with the
+// credentials of cfg, which need the create verb on serviceaccounts/token.
+func NewForConfig(cfg *rest.Config, sa types.NamespacedName, opts Options) (*Source, error) {
+	kc, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return New(kc, sa, opts)
+}
+
+// Token returns the cached token, or requests a new one if it is due for a
+// refresh.
+func (s *Source) Token() (*oauth2.Token, error) {
+	return s.TokenContext(context.Background())
+}
+
+// TokenContext is Token with a context for waiting on the TokenRequest.
+// The request itself is not canceled with ctx, as other callers may be
+// waiting on it, but it times out after 30 seconds.
+func (s *Source) TokenContext(ctx context.Context) (*oauth2.Token, error) {
+	s.mu.Lock()
+	if s.token != nil && time.Now().Before(s.refreshAt) {
+		defer s.mu.Unlock()
+		return s.token, nil
+	}
+	r := s.refreshing
+	if r == nil {
+		r = &refresh{done: make(chan struct{})}
+		s.refreshing = r
+		go s.refresh(context.WithoutCancel(ctx), r)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return r.token, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// refresh requests a token without holding the lock, so that the cached
+// token is not blocked on the apiserver.
+func (s *Source) refresh(ctx context.Context, r *refresh) {
+	defer close(r.done)
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	token, err := s.request(ctx)
+
+	s.mu.Lock()
+	s.refreshing = nil
+	if err != nil {
+		defer s.mu.Unlock()
+		if now := time.Now(); s.token != nil && now.Before(s.token.Expiry) {
+			klog.ErrorS(err, "Failed to refresh service account token, using the current one", "serviceaccount", s.sa, "expiry", s.token.Expiry)
+			// don't request a token on every call until the next attempt
+			s.refreshAt = now.Add(retryInterval)
+			if s.refreshAt.After(s.token.Expiry) {
+				s.refreshAt = s.token.Expiry
+			}
+			r.token = s.token
+			return
+		}
+		r.err = err
+		return
+	}
+	s.token = token
+	s.refreshAt = refreshTime(time.Now(), token.Expiry)
+	listeners := append([]func(*oauth2.Token){}, s.listeners...)
+	s.mu.Unlock()
+
+	klog.V(2).InfoS("Refreshed service account token", "serviceaccount", s.sa, "expiry", token.Expiry)
+	for _, fn := range listeners {
+		fn(token)
+	}
+	r.token = token
+}
+
+// OnRefresh registers fn to be called with every new token, e.g. to rewrite
+// a config file that contains it.
+func (s *Source) OnRefresh(fn func(*oauth2.Token)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeners = append(s.listeners, fn)
+}
+
+// Run refreshes the token ahead of time until ctx is done, so that holders
+// of the token who don't call Token, like a generated config file, get the
+// new token before the current one expires.
+func (s *Source) Run(ctx context.Context) {
+	for {
+		wait := retryInterval
+		if _, err := s.TokenContext(ctx); err != nil {
+			klog.ErrorS(err, "Failed to request service account token", "serviceaccount", s.sa)
+		} else {
+			s.mu.Lock()
+			wait = time.Until(s.refreshAt)
+			s.mu.Unlock()
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Source) request(ctx context.Context) (*oauth2.Token, error) {
+	seconds := int64(s.opts.Expiration / time.Second)
+	tr, err := s.kc.CoreV1().ServiceAccounts(s.sa.Namespace).CreateToken(ctx, s.sa.Name, &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         s.opts.Audiences,
+			ExpirationSeconds: &seconds,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to request a token for service account %s: %w", s.sa, err)
+	}
+	return &oauth2.Token{
+		AccessToken: tr.Status.Token,
+		TokenType:   "Bearer",
+		Expiry:      tr.Status.ExpirationTimestamp.Time,
+	}, nil
+}
+
+// refreshTime returns the time after 80% of the lifetime from now to expiry.
+func refreshTime(now, expiry time.Time) time.Time {
+	return now.Add(time.Duration(float64(expiry.Sub(now)) * refreshFraction))
+}
@@ -0,0 +1,286 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package satoken
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+var sa = types.NamespacedName{Namespace: "monitoring", Name: "trickster"}
+
+// apiserver answers TokenRequests of sa with token-1, token-2 and so on,
+// valid for an hour. Requests fail while fail is set and wait for release
+// if it is not nil.
+type apiserver struct {
+	requests atomic.Int32
+	fail     atomic.Bool
+	release  chan struct{}
+	lifetime time.Duration
+}
+
+func (a *apiserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != "/api/v1/namespaces/monitoring/serviceaccounts/trickster/token" {
+		http.NotFound(w, r)
+		return
+	}
+	n := a.requests.Add(1)
+	if a.release != nil {
+		select {
+		case <-a.release:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if a.fail.Load() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","reason":"Forbidden","code":403}`))
+		return
+	}
+	var req authenticationv1.TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lifetime := a.lifetime
+	if lifetime == 0 {
+		lifetime = time.Duration(*req.Spec.ExpirationSeconds) * time.Second
+	}
+	req.Status = authenticationv1.TokenRequestStatus{
+		Token:               fmt.Sprintf("token-%d", n),
+		ExpirationTimestamp: metav1.NewTime(time.Now().Add(lifetime)),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(req)
+}
+
+func newSource(t *testing.T, a *apiserver) *Source {
+	t.Helper()
+	srv := httptest.NewServer(a)
+	t.Cleanup(srv.Close)
+	// the fake apiserver only speaks JSON
+	cfg := &rest.Config{Host: srv.URL, ContentConfig: rest.ContentConfig{ContentType: "application/json"}}
+	s, err := NewForConfig(cfg, sa, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestTokenRefresh(t *testing.T) {
+	a := &apiserver{}
+	s := newSource(t, a)
+	var refreshed []string
+	s.OnRefresh(func(token *oauth2.Token) {
+		refreshed = append(refreshed, token.AccessToken)
+	})
+
+	token, err := s.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.AccessToken != "token-1" || token.TokenType != "Bearer" {
+		t.Errorf("Token() = %+v, want token-1", token)
+	}
+	// refreshed after 80% of the hour
+	if d := time.Until(s.refreshAt); d < 47*time.Minute || d > 48*time.Minute {
+		t.Errorf("refresh in %s, want in 48m", d)
+	}
+	if token, _ = s.Token(); token.AccessToken != "token-1" || a.requests.Load() != 1 {
+		t.Errorf("second Token() = %s after %d requests, want the cached token-1", token.AccessToken, a.requests.Load())
+	}
+
+	// the refresh is due
+	s.refreshAt = time.Now()
+	if token, _ = s.Token(); token.AccessToken != "token-2" {
+		t.Errorf("Token() after the refresh time = %s, want token-2", token.AccessToken)
+	}
+	if want := []string{"token-1", "token-2"}; fmt.Sprint(refreshed) != fmt.Sprint(want) {
+		t.Errorf("OnRefresh got %v, want %v", refreshed, want)
+	}
+}
+
+func TestTokenRefreshFailure(t *testing.T) {
+	a := &apiserver{}
+	s := newSource(t, a)
+	a.fail.Store(true)
+	if _, err := s.Token(); err == nil {
+		t.Fatal("Token() without a token succeeded, want the error of the TokenRequest")
+	}
+
+	a.fail.Store(false)
+	current, err := s.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refreshed int
+	s.OnRefresh(func(*oauth2.Token) { refreshed++ })
+
+	// the current token is used while it is valid, and the refresh is
+	// retried after retryInterval
+	a.fail.Store(true)
+	s.refreshAt = time.Now()
+	token, err := s.Token()
+	if err != nil || token != current {
+		t.Fatalf("Token() with a failing refresh = %v, %v, want the current token %v", token, err, current)
+	}
+	if d := time.Until(s.refreshAt); d <= 0 || d > retryInterval {
+		t.Errorf("retry in %s, want within %s", d, retryInterval)
+	}
+	before := a.requests.Load()
+	if _, err := s.Token(); err != nil || a.requests.Load() != before {
+		t.Errorf("Token() before the retry requested a token, err %v", err)
+	}
+
+	// the retry isn't later than the expiry
+	s.token.Expiry = time.Now().Add(time.Second)
+	s.refreshAt = time.Now()
+	if _, err := s.Token(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.refreshAt.Equal(s.token.Expiry) {
+		t.Errorf("retry at %s, want at the expiry %s", s.refreshAt, s.token.Expiry)
+	}
+
+	// an expired token is not used
+	s.token.Expiry = time.Now().Add(-time.Second)
+	s.refreshAt = s.token.Expiry
+	if _, err := s.Token(); err == nil {
+		t.Error("Token() with an expired token and a failing refresh succeeded")
+	}
+	if refreshed != 0 {
+		t.Errorf("OnRefresh was called %d times for failed refreshes", refreshed)
+	}
+}
+
+func TestTokenSingleRequest(t *testing.T) {
+	a := &apiserver{release: make(chan struct{})}
+	s := newSource(t, a)
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 5)
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if token, err := s.Token(); err == nil {
+				tokens[i] = token.AccessToken
+			}
+		}()
+	}
+	for a.requests.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the lock is not held during the request
+	registered := make(chan struct{})
+	go func() {
+		s.OnRefresh(func(*oauth2.Token) {})
+		close(registered)
+	}()
+	select {
+	case <-registered:
+	case <-time.After(time.Second):
+		t.Fatal("OnRefresh blocked on the TokenRequest")
+	}
+
+	// a caller gives up with its context, the request goes on
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := s.TokenContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("TokenContext() = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(a.release)
+	wg.Wait()
+	for i, token := range tokens {
+		if token != "token-1" {
+			t.Errorf("caller %d got %q, want token-1", i, token)
+		}
+	}
+	if n := a.requests.Load(); n != 1 {
+		t.Errorf("got %d TokenRequests, want 1", n)
+	}
+}
+
+func TestTokenRequestTimeout(t *testing.T) {
+	defer func(d time.Duration) { requestTimeout = d }(requestTimeout)
+	requestTimeout = 50 * time.Millisecond
+
+	a := &apiserver{release: make(chan struct{})}
+	defer close(a.release)
+	s := newSource(t, a)
+	start := time.Now()
+	if _, err := s.Token(); err == nil {
+		t.Fatal("Token() of a hanging apiserver succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Token() returned after %s, want after the request timeout", d)
+	}
+}
+
+func TestRun(t *testing.T) {
+	// the apiserver shortens the lifetime of the tokens to 100ms
+	a := &apiserver{lifetime: 100 * time.Millisecond}
+	s := newSource(t, a)
+	refreshed := make(chan string, 10)
+	s.OnRefresh(func(token *oauth2.Token) { refreshed <- token.AccessToken })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	for _, want := range []string{"token-1", "token-2"} {
+		select {
+		case got := <-refreshed:
+			if got != want {
+				t.Errorf("refreshed %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s was not refreshed ahead of time", want)
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Run didn't return once the context was done")
+	}
+}
+
+func TestNewRejectsShortExpiration(t *testing.T) {
+	if _, err := New(nil, sa, Options{Expiration: time.Minute}); err == nil {
+		t.Error("New() with a 1m expiration succeeded")
+	}
+}
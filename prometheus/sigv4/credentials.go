@@ -0,0 +1,446 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sigv4
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshBefore is how long before expiry temporary credentials are
+// refreshed.
+const refreshBefore = 5 * time.Minute
+
+// Endpoints of the ECS container credentials and the EC2 instance metadata
+// service.
+const (
+	containerCredentialsHost = "http://169.254.170.2"
+	instanceMetadataEndpoint = "http://169.254.169.254"
+)
+
+// baseProvider resolves the credentials used to sign requests or to assume
+// RoleARN, in the order of the default chain of the AWS SDKs:
+//
+//  1. the access and secret key of the config,
+//  2. AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, unless a profile is set,
+//  3. a web identity token, like that of IAM roles for service accounts,
+//     with AWS_WEB_IDENTITY_TOKEN_FILE and AWS_ROLE_ARN,
+//  4. the profile of the shared credentials file,
+//  5. the ECS container credentials, also used by EKS Pod Identity, with
+//     AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or _FULL_URI,
+//  6. the role of the EC2 instance, unless AWS_EC2_METADATA_DISABLED is true.
+//
+// Profiles are read from the credentials file only, the role_arn,
+// source_profile and credential_process settings of the config file are not
+// supported. Temporary credentials are refreshed before they expire.
+func (c *Config) baseProvider(client *http.Client) (credentialsProvider, error) {
+	if c.AccessKey != "" || c.SecretKey != "" {
+		if c.AccessKey == "" || c.SecretKey == "" {
+			return nil, errors.New("sigv4 access key and secret key must be set together")
+		}
+		return staticProvider{AccessKey: c.AccessKey, SecretKey: c.SecretKey}, nil
+	}
+
+	if c.Profile == "" {
+		ak := os.Getenv("AWS_ACCESS_KEY_ID")
+		sk := os.Getenv("AWS_SECRET_ACCESS_KEY")
+		if ak != "" && sk != "" {
+			return staticProvider{AccessKey: ak, SecretKey: sk, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+		}
+		if tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); tokenFile != "" {
+			roleARN := os.Getenv("AWS_ROLE_ARN")
+			if roleARN == "" {
+				return nil, errors.New("AWS_WEB_IDENTITY_TOKEN_FILE is set without AWS_ROLE_ARN")
+			}
+			p := &webIdentityProvider{cfg: c, client: client, tokenFile: tokenFile, roleARN: roleARN}
+			return &refreshingProvider{fetch: p.assumeRoleWithWebIdentity}, nil
+		}
+	}
+
+	creds, err := sharedCredentials(c.Profile)
+	switch {
+	case err == nil:
+		return staticProvider(creds), nil
+	case c.Profile != "" || os.Getenv("AWS_PROFILE") != "" || !errors.Is(err, fs.ErrNotExist):
+		// a profile that was asked for, or a broken file, is not skipped
+		return nil, err
+	}
+
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI") != "" || os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") != "" {
+		p := &containerProvider{client: client}
+		return &refreshingProvider{fetch: p.credentials}, nil
+	}
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return nil, errors.New("no sigv4 credentials found in the config, the environment or the shared credentials file")
+	}
+	// off EC2 the metadata service does not answer, so do not wait long
+	p := &instanceProvider{client: &http.Client{Timeout: 5 * time.Second}}
+	return &refreshingProvider{fetch: p.credentials}, nil
+}
+
+// sharedCredentials reads a profile from the AWS shared credentials file.
+func sharedCredentials(profile string) (Credentials, error) {
+	if profile == "" {
+		profile = os.Getenv("AWS_PROFILE")
+	}
+	if profile == "" {
+		profile = "default"
+	}
+	filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if filename == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Credentials{}, err
+		}
+		filename = filepath.Join(home, ".aws", "credentials")
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("no sigv4 credentials found: %w", err)
+	}
+	defer f.Close()
+
+	var creds Credentials
+	found := false
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			found = found || section == profile
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		k, v, _ := strings.Cut(line, "=")
+		switch strings.TrimSpace(k) {
+		case "aws_access_key_id":
+			creds.AccessKey = strings.TrimSpace(v)
+		case "aws_secret_access_key":
+			creds.SecretKey = strings.TrimSpace(v)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(v)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Credentials{}, err
+	}
+	if !found {
+		return Credentials{}, fmt.Errorf("profile %q not found in %s", profile, filename)
+	}
+	if creds.AccessKey == "" || creds.SecretKey == "" {
+		return Credentials{}, fmt.Errorf("profile %q in %s has no access keys", profile, filename)
+	}
+	return creds, nil
+}
+
+// refreshingProvider caches the credentials of fetch until shortly before
+// they expire.
+type refreshingProvider struct {
+	fetch func(ctx context.Context) (Credentials, error)
+
+	mu    sync.Mutex
+	creds Credentials
+}
+
+func (p *refreshingProvider) Credentials(ctx context.Context) (Credentials, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.creds.AccessKey != "" && (p.creds.Expires.IsZero() || time.Until(p.creds.Expires) > refreshBefore) {
+		return p.creds, nil
+	}
+	creds, err := p.fetch(ctx)
+	if err != nil {
+		return Credentials{}, err
+	}
+	p.creds = creds
+	return creds, nil
+}
+
+// roleProvider assumes RoleARN with STS, signed with the base credentials.
+type roleProvider struct {
+	cfg    *Config
+	base   credentialsProvider
+	client *http.Client
+}
+
+type assumeRoleResponse struct {
+	Result struct {
+		Credentials stsCredentials `xml:"Credentials"`
+	} `xml:"AssumeRoleResult"`
+}
+
+// ref: https://docs.aws.amazon.com/STS/latest/APIReference/API_AssumeRole.html
+func (p *roleProvider) assumeRole(ctx context.Context) (Credentials, error) {
+	form := url.Values{
+		"Action":          {"AssumeRole"},
+		"Version":         {"2011-06-15"},
+		"RoleArn":         {p.cfg.RoleARN},
+		"RoleSessionName": {fmt.Sprintf("prometheus-%d", time.Now().Unix())},
+	}
+	base, err := p.base.Credentials(ctx)
+	if err != nil {
+		return Credentials{}, err
+	}
+	var out assumeRoleResponse
+	if err := postSTS(ctx, p.client, p.cfg.stsEndpoint(), form, &base, p.cfg.Region, &out); err != nil {
+		return Credentials{}, fmt.Errorf("failed to assume role %s: %w", p.cfg.RoleARN, err)
+	}
+	return out.Result.Credentials.credentials(), nil
+}
+
+func (c *Config) stsEndpoint() string {
+	if c.STSEndpoint != "" {
+		return c.STSEndpoint
+	}
+	return fmt.Sprintf("https://sts.%s.amazonaws.com/", c.Region)
+}
+
+// postSTS sends an STS request, signed if creds is set, and decodes the
+// XML response into out.
+func postSTS(ctx context.Context, client *http.Client, endpoint string, form url.Values, creds *Credentials, region string, out interface{}) error {
+	body := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(string(body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if creds != nil {
+		Sign(req, body, *creds, region, "sts", time.Now())
+	}
+	data, err := do(client, req)
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("failed to parse %s response: %w", form.Get("Action"), err)
+	}
+	return nil
+}
+
+// do sends req and returns the body of a 200 response.
+func do(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// stsCredentials are the credentials of an AssumeRole or
+// AssumeRoleWithWebIdentity response.
+type stsCredentials struct {
+	AccessKeyID     string    `xml:"AccessKeyId"`
+	SecretAccessKey string    `xml:"SecretAccessKey"`
+	SessionToken    string    `xml:"SessionToken"`
+	Expiration      time.Time `xml:"Expiration"`
+}
+
+func (c stsCredentials) credentials() Credentials {
+	return Credentials{
+		AccessKey:    c.AccessKeyID,
+		SecretKey:    c.SecretAccessKey,
+		SessionToken: c.SessionToken,
+		Expires:      c.Expiration,
+	}
+}
+
+// webIdentityProvider exchanges the token of a projected service account
+// volume for the credentials of a role.
+type webIdentityProvider struct {
+	cfg       *Config
+	client    *http.Client
+	tokenFile string
+	roleARN   string
+}
+
+type assumeRoleWithWebIdentityResponse struct {
+	Result struct {
+		Credentials stsCredentials `xml:"Credentials"`
+	} `xml:"AssumeRoleWithWebIdentityResult"`
+}
+
+// ref: https://docs.aws.amazon.com/STS/latest/APIReference/API_AssumeRoleWithWebIdentity.html
+func (p *webIdentityProvider) assumeRoleWithWebIdentity(ctx context.Context) (Credentials, error) {
+	// the kubelet rotates the token, so it is read for every request
+	token, err := os.ReadFile(p.tokenFile)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to read web identity token: %w", err)
+	}
+	session := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if session == "" {
+		session = fmt.Sprintf("prometheus-%d", time.Now().Unix())
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {p.roleARN},
+		"RoleSessionName":  {session},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	var out assumeRoleWithWebIdentityResponse
+	if err := postSTS(ctx, p.client, p.cfg.stsEndpoint(), form, nil, "", &out); err != nil {
+		return Credentials{}, fmt.Errorf("failed to assume role %s with web identity: %w", p.roleARN, err)
+	}
+	return out.Result.Credentials.credentials(), nil
+}
+
+// remoteCredentials is the response of the container credentials and the
+// instance metadata endpoints.
+type remoteCredentials struct {
+	Code            string    `json:"Code"`
+	Message         string    `json:"Message"`
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+func (c remoteCredentials) credentials() (Credentials, error) {
+	if c.Code != "" && c.Code != "Success" {
+		return Credentials{}, fmt.Errorf("%s: %s", c.Code, c.Message)
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return Credentials{}, errors.New("response has no access keys")
+	}
+	return Credentials{
+		AccessKey:    c.AccessKeyID,
+		SecretKey:    c.SecretAccessKey,
+		SessionToken: c.Token,
+		Expires:      c.Expiration,
+	}, nil
+}
+
+// containerProvider gets the credentials of an ECS task or an EKS Pod
+// Identity association.
+// ref: https://docs.aws.amazon.com/sdkref/latest/guide/feature-container-credentials.html
+type containerProvider struct {
+	client *http.Client
+}
+
+func (p *containerProvider) credentials(ctx context.Context) (Credentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		endpoint = containerCredentialsHost + rel
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("failed to read container authorization token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	data, err := do(p.client, req)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to get container credentials: %w", err)
+	}
+	var out remoteCredentials
+	if err := json.Unmarshal(data, &out); err != nil {
+		return Credentials{}, fmt.Errorf("failed to parse container credentials: %w", err)
+	}
+	creds, err := out.credentials()
+	if err != nil {
+		return Credentials{}, fmt.Errorf("invalid container credentials: %w", err)
+	}
+	return creds, nil
+}
+
+// instanceProvider gets the credentials of the role of the EC2 instance with
+// IMDSv2.
+// ref: https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instancedata-data-retrieval.html
+type instanceProvider struct {
+	client *http.Client
+}
+
+func (p *instanceProvider) credentials(ctx context.Context) (Credentials, error) {
+	endpoint := strings.TrimSuffix(os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"), "/")
+	if endpoint == "" {
+		endpoint = instanceMetadataEndpoint
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := do(p.client, req)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("no sigv4 credentials found, and the EC2 instance metadata service is not available: %w", err)
+	}
+
+	get := func(path string) ([]byte, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/latest/meta-data/iam/security-credentials/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return do(p.client, req)
+	}
+	roles, err := get("")
+	if err != nil {
+		return Credentials{}, fmt.Errorf("the EC2 instance has no role: %w", err)
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(roles)), "\n")
+	data, err := get(role)
+	if err != nil {
+		return Credentials{}, fmt.Errorf("failed to get the credentials of instance role %s: %w", role, err)
+	}
+	var out remoteCredentials
+	if err := json.Unmarshal(data, &out); err != nil {
+		return Credentials{}, fmt.Errorf("failed to parse instance credentials: %w", err)
+	}
+	creds, err := out.credentials()
+	if err != nil {
+		return Credentials{}, fmt.Errorf("invalid credentials of instance role %s: %w", role, err)
+	}
+	return creds, nil
+}
@@ -0,0 +1,339 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sigv4
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// clearEnv unsets every variable that the credential chain reads, and
+// points the shared credentials file into a temporary directory.
+func clearEnv(t *testing.T) string {
+	t.Helper()
+	for _, name := range []string{
+		"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AWS_PROFILE",
+		"AWS_WEB_IDENTITY_TOKEN_FILE", "AWS_ROLE_ARN", "AWS_ROLE_SESSION_NAME",
+		"AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "AWS_CONTAINER_CREDENTIALS_FULL_URI",
+		"AWS_CONTAINER_AUTHORIZATION_TOKEN", "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE",
+		"AWS_EC2_METADATA_SERVICE_ENDPOINT",
+	} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+	return dir
+}
+
+func writeFile(t *testing.T, name, data string) {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func resolve(t *testing.T, cfg *Config) (Credentials, error) {
+	t.Helper()
+	p, err := cfg.baseProvider(http.DefaultClient)
+	if err != nil {
+		return Credentials{}, err
+	}
+	return p.Credentials(context.Background())
+}
+
+func TestBaseProvider(t *testing.T) {
+	const sharedFile = `[default]
+aws_access_key_id = AKIDDEFAULT
+aws_secret_access_key = default-secret
+
+[dev]
+aws_access_key_id = AKIDDEV
+aws_secret_access_key = dev-secret
+aws_session_token = dev-token
+`
+	tests := []struct {
+		name    string
+		cfg     Config
+		env     map[string]string
+		shared  string
+		want    Credentials
+		wantErr string
+	}{
+		{
+			name: "config keys win",
+			cfg:  Config{AccessKey: "AKIDCONFIG", SecretKey: "config-secret"},
+			env:  map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_SECRET_ACCESS_KEY": "env-secret"},
+			want: Credentials{AccessKey: "AKIDCONFIG", SecretKey: "config-secret"},
+		},
+		{
+			name:   "environment before shared file",
+			env:    map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_SECRET_ACCESS_KEY": "env-secret", "AWS_SESSION_TOKEN": "env-token"},
+			shared: sharedFile,
+			want:   Credentials{AccessKey: "AKIDENV", SecretKey: "env-secret", SessionToken: "env-token"},
+		},
+		{
+			name:   "profile skips the environment",
+			cfg:    Config{Profile: "dev"},
+			env:    map[string]string{"AWS_ACCESS_KEY_ID": "AKIDENV", "AWS_SECRET_ACCESS_KEY": "env-secret"},
+			shared: sharedFile,
+			want:   Credentials{AccessKey: "AKIDDEV", SecretKey: "dev-secret", SessionToken: "dev-token"},
+		},
+		{
+			name:   "default profile",
+			shared: sharedFile,
+			want:   Credentials{AccessKey: "AKIDDEFAULT", SecretKey: "default-secret"},
+		},
+		{
+			name:    "missing profile",
+			cfg:     Config{Profile: "prod"},
+			shared:  sharedFile,
+			wantErr: `profile "prod" not found`,
+		},
+		{
+			name:    "missing file with a profile",
+			cfg:     Config{Profile: "dev"},
+			wantErr: "no such file",
+		},
+		{
+			name:    "nothing found",
+			wantErr: "no sigv4 credentials found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := clearEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if tt.shared != "" {
+				writeFile(t, filepath.Join(dir, "credentials"), tt.shared)
+			}
+			got, err := resolve(t, &tt.cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolve() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("resolve() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+const webIdentityResponse = `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>AKIDWEB%d</AccessKeyId>
+      <SecretAccessKey>web-secret</SecretAccessKey>
+      <SessionToken>web-token</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`
+
+func TestWebIdentity(t *testing.T) {
+	dir := clearEnv(t)
+	tokenFile := filepath.Join(dir, "token")
+	writeFile(t, tokenFile, "token-1\n")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", tokenFile)
+	t.Setenv("AWS_ROLE_ARN", "arn:aws:iam::123456789012:role/prometheus")
+	t.Setenv("AWS_ROLE_SESSION_NAME", "reader")
+
+	var calls atomic.Int32
+	var expires atomic.Value
+	expires.Store(time.Now().Add(time.Minute))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get("Authorization") != "" {
+			t.Error("AssumeRoleWithWebIdentity request is signed")
+		}
+		want := map[string]string{
+			"Action":           "AssumeRoleWithWebIdentity",
+			"RoleArn":          "arn:aws:iam::123456789012:role/prometheus",
+			"RoleSessionName":  "reader",
+			"WebIdentityToken": fmt.Sprintf("token-%d", n),
+		}
+		for k, v := range want {
+			if got := r.PostForm.Get(k); got != v {
+				t.Errorf("call %d: %s = %q, want %q", n, k, got, v)
+			}
+		}
+		fmt.Fprintf(w, webIdentityResponse, n, expires.Load().(time.Time).UTC().Format(time.RFC3339))
+	}))
+	defer srv.Close()
+
+	p, err := (&Config{Region: "us-east-1", STSEndpoint: srv.URL}).baseProvider(srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, err := p.Credentials(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKey != "AKIDWEB1" || creds.SessionToken != "web-token" {
+		t.Errorf("Credentials() = %+v", creds)
+	}
+
+	// the credentials expire within refreshBefore, so the rotated token is
+	// exchanged again
+	writeFile(t, tokenFile, "token-2")
+	expires.Store(time.Now().Add(time.Hour))
+	if creds, err = p.Credentials(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKey != "AKIDWEB2" {
+		t.Errorf("Credentials() = %+v, want refreshed credentials", creds)
+	}
+	if _, err = p.Credentials(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("STS calls = %d, want 2", n)
+	}
+}
+
+func TestContainerCredentials(t *testing.T) {
+	dir := clearEnv(t)
+	tokenFile := filepath.Join(dir, "token")
+	writeFile(t, tokenFile, "pod-identity-token\n")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/credentials" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "pod-identity-token" {
+			t.Errorf("Authorization = %q", got)
+		}
+		fmt.Fprintf(w, `{"AccessKeyId":"AKIDPOD","SecretAccessKey":"pod-secret","Token":"pod-token","Expiration":%q}`,
+			time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", srv.URL+"/v1/credentials")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN", "ignored")
+	t.Setenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE", tokenFile)
+
+	creds, err := resolve(t, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.AccessKey != "AKIDPOD" || creds.SecretKey != "pod-secret" || creds.SessionToken != "pod-token" || creds.Expires.IsZero() {
+		t.Errorf("Credentials() = %+v", creds)
+	}
+}
+
+func TestInstanceCredentials(t *testing.T) {
+	clearEnv(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != http.MethodPut || r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds") == "" {
+				t.Errorf("token request = %s %v", r.Method, r.Header)
+			}
+			fmt.Fprint(w, "imds-token")
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "imds-token" {
+			http.Error(w, "missing token", http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "node-role\n")
+		case "/latest/meta-data/iam/security-credentials/node-role":
+			fmt.Fprint(w, `{"Code":"Success","AccessKeyId":"AKIDNODE","SecretAccessKey":"node-secret","Token":"node-token","Expiration":"2030-01-01T00:00:00Z"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "")
+	t.Setenv("AWS_EC2_METADATA_SERVICE_ENDPOINT", srv.URL+"/")
+
+	creds, err := resolve(t, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Credentials{
+		AccessKey:    "AKIDNODE",
+		SecretKey:    "node-secret",
+		SessionToken: "node-token",
+		Expires:      time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	if !creds.Expires.Equal(want.Expires) {
+		t.Errorf("Expires = %v, want %v", creds.Expires, want.Expires)
+	}
+	creds.Expires = want.Expires
+	if creds != want {
+		t.Errorf("Credentials() = %+v, want %+v", creds, want)
+	}
+}
+
+// TestAssumeRoleRefreshesBase checks that RoleARN is assumed with the
+// current base credentials, not those seen when the round tripper was made.
+func TestAssumeRoleRefreshesBase(t *testing.T) {
+	clearEnv(t)
+	var base atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if want := fmt.Sprintf("Credential=AKIDBASE%d/", base.Load()); !strings.Contains(auth, want) {
+			t.Errorf("Authorization = %q, want %s", auth, want)
+		}
+		fmt.Fprintf(w, `<AssumeRoleResponse><AssumeRoleResult><Credentials>
+<AccessKeyId>AKIDROLE%d</AccessKeyId><SecretAccessKey>role-secret</SecretAccessKey>
+<Expiration>%s</Expiration></Credentials></AssumeRoleResult></AssumeRoleResponse>`,
+			base.Load(), time.Now().Add(time.Minute).UTC().Format(time.RFC3339))
+	}))
+	defer srv.Close()
+
+	cfg := &Config{Region: "us-east-1", RoleARN: "arn:aws:iam::123456789012:role/writer", STSEndpoint: srv.URL}
+	p := &refreshingProvider{fetch: (&roleProvider{
+		cfg: cfg,
+		base: &refreshingProvider{fetch: func(context.Context) (Credentials, error) {
+			n := base.Add(1)
+			return Credentials{AccessKey: fmt.Sprintf("AKIDBASE%d", n), SecretKey: "base-secret", Expires: time.Now()}, nil
+		}},
+		client: srv.Client(),
+	}).assumeRole}
+
+	for i := 1; i <= 2; i++ {
+		creds, err := p.Credentials(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("AKIDROLE%d", i); creds.AccessKey != want {
+			t.Errorf("Credentials() = %s, want %s", creds.AccessKey, want)
+		}
+	}
+}
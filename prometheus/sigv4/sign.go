@@ -0,0 +1,231 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ref: https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+
+const (
+	algorithm  = "AWS4-HMAC-SHA256"
+	timeFormat = "20060102T150405Z"
+	dateFormat = "20060102"
+
+	headerDate          = "X-Amz-Date"
+	headerSecurityToken = "X-Amz-Security-Token"
+	headerContentSHA256 = "X-Amz-Content-Sha256"
+)
+
+// Credentials are AWS access keys.
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Expires is zero for credentials that don't expire.
+	Expires time.Time
+}
+
+// Sign adds the SigV4 headers to req. body is the request payload, which is
+// not read from req.
+func Sign(req *http.Request, body []byte, creds Credentials, region, service string, now time.Time) {
+	now = now.UTC()
+	payloadHash := hashHex(body)
+
+	req.Header.Set(headerDate, now.Format(timeFormat))
+	req.Header.Set(headerContentSHA256, payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set(headerSecurityToken, creds.SessionToken)
+	} else {
+		req.Header.Del(headerSecurityToken)
+	}
+	req.Header.Del("Authorization")
+
+	scope := strings.Join([]string{now.Format(dateFormat), region, service, "aws4_request"}, "/")
+	signedHeaders, sig := signature(req, payloadHash, creds.SecretKey, scope, now)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, creds.AccessKey, scope, signedHeaders, sig))
+}
+
+// Verify checks the SigV4 signature of req against creds. It is meant for
+// test servers standing in for AWS endpoints.
+func Verify(req *http.Request, body []byte, creds Credentials, region, service string) error {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, algorithm+" ") {
+		return errors.New("request is not signed with " + algorithm)
+	}
+	fields := map[string]string{}
+	for _, f := range strings.Split(strings.TrimPrefix(auth, algorithm+" "), ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(f), "=")
+		fields[k] = v
+	}
+
+	accessKey, scope, _ := strings.Cut(fields["Credential"], "/")
+	if accessKey != creds.AccessKey {
+		return fmt.Errorf("unknown access key %q", accessKey)
+	}
+	now, err := time.Parse(timeFormat, req.Header.Get(headerDate))
+	if err != nil {
+		return fmt.Errorf("invalid %s header: %w", headerDate, err)
+	}
+	want := strings.Join([]string{now.Format(dateFormat), region, service, "aws4_request"}, "/")
+	if scope != want {
+		return fmt.Errorf("credential scope %q does not match %q", scope, want)
+	}
+	payloadHash := hashHex(body)
+	if h := req.Header.Get(headerContentSHA256); h != "" && h != payloadHash {
+		return errors.New("payload hash does not match the request body")
+	}
+	if creds.SessionToken != "" && req.Header.Get(headerSecurityToken) != creds.SessionToken {
+		return errors.New("invalid session token")
+	}
+
+	// only the headers listed by the client are part of the signature
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	r := req.Clone(req.Context())
+	r.Header = http.Header{}
+	for _, h := range signed {
+		if !strings.EqualFold(h, "host") {
+			r.Header[http.CanonicalHeaderKey(h)] = req.Header.Values(h)
+		}
+	}
+	_, sig := signature(r, payloadHash, creds.SecretKey, scope, now)
+	if !hmac.Equal([]byte(sig), []byte(fields["Signature"])) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+func signature(req *http.Request, payloadHash, secretKey, scope string, now time.Time) (string, string) {
+	headers, signedHeaders := canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		canonicalURI(req),
+		canonicalQuery(req),
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		algorithm,
+		now.Format(timeFormat),
+		scope,
+		hashHex([]byte(canonicalRequest)),
+	}, "\n")
+
+	parts := strings.Split(scope, "/")
+	key := hmacSHA256([]byte("AWS4"+secretKey), parts[0])
+	for _, p := range parts[1:] {
+		key = hmacSHA256(key, p)
+	}
+	return signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func canonicalURI(req *http.Request) string {
+	p := req.URL.EscapedPath()
+	if p == "" {
+		return "/"
+	}
+	// every path segment is encoded twice for services other than S3
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = uriEncode(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func canonicalQuery(req *http.Request) string {
+	q := req.URL.Query()
+	pairs := make([]string, 0, len(q))
+	for k, vs := range q {
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k)+"="+uriEncode(v))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeaders(req *http.Request) (string, string) {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	values := map[string]string{"host": host}
+	for k, vs := range req.Header {
+		lk := strings.ToLower(k)
+		if lk != "host" && lk != "content-type" && !strings.HasPrefix(lk, "x-amz-") {
+			continue
+		}
+		trimmed := make([]string, len(vs))
+		for i, v := range vs {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		values[lk] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, k := range names {
+		sb.WriteString(k)
+		sb.WriteByte(':')
+		sb.WriteString(values[k])
+		sb.WriteByte('\n')
+	}
+	return sb.String(), strings.Join(names, ";")
+}
+
+// uriEncode escapes everything except the RFC 3986 unreserved characters.
+func uriEncode(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func hashHex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,245 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testCreds = Credentials{
+		AccessKey:    "AKIDEXAMPLE",
+		SecretKey:    "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		SessionToken: "session-token",
+	}
+	testNow = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+)
+
+// TestSignatureVector checks the signature of the example request of the
+// AWS documentation.
+// ref: https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func TestSignatureVector(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	req.Header.Set(headerDate, testNow.Format(timeFormat))
+
+	signed, sig := signature(req, hashHex(nil), testCreds.SecretKey, "20150830/us-east-1/iam/aws4_request", testNow)
+	if signed != "content-type;host;x-amz-date" {
+		t.Errorf("signed headers = %s", signed)
+	}
+	if want := "5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"; sig != want {
+		t.Errorf("signature = %s, want %s", sig, want)
+	}
+}
+
+// TestRoundTripper sends signed requests to a stand-in server that computes
+// the signature on its own and compares it to the Authorization header.
+func TestRoundTripper(t *testing.T) {
+	errs := make(chan error, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err == nil {
+			err = checkSignature(r, body)
+		}
+		if err == nil {
+			err = Verify(r, body, testCreds, "us-east-1", DefaultService)
+		}
+		errs <- err
+	}))
+	defer srv.Close()
+
+	rt, err := NewRoundTripper(&Config{
+		Region:    "us-east-1",
+		AccessKey: testCreds.AccessKey,
+		SecretKey: testCreds.SecretKey,
+	}, http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// static keys from the config have no session token
+	rt.(*roundTripper).creds = staticProvider(testCreds)
+	rt.(*roundTripper).now = func() time.Time { return testNow }
+	client := &http.Client{Transport: rt}
+
+	base := srv.URL + "/workspaces/ws-1234/api/v1"
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+	}{
+		{name: "get", method: http.MethodGet, url: base + "/query?query=" + url.QueryEscape(`sum by (job) (rate(http_requests_total{path="/a b"}[5m]))`)},
+		{name: "repeated parameters", method: http.MethodGet, url: base + "/series?match[]=up&match[]=" + url.QueryEscape(`{__name__=~"go_.*"}`) + "&start=1"},
+		{name: "escaped path", method: http.MethodGet, url: base + "/label/a%20b/values"},
+		{name: "post form", method: http.MethodPost, url: base + "/query", body: url.Values{"query": {`up{job="a~b"}`}, "time": {"1441000000"}}.Encode()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req, err := http.NewRequest(tt.method, tt.url, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if err := <-errs; err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestVerifyRejectsTampering(t *testing.T) {
+	body := []byte("query=up")
+	req, err := http.NewRequest(http.MethodPost, "http://aps.example.com/api/v1/query", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	Sign(req, body, testCreds, "us-east-1", DefaultService, testNow)
+	if err := Verify(req, body, testCreds, "us-east-1", DefaultService); err != nil {
+		t.Fatalf("valid request: %v", err)
+	}
+
+	tampered := []struct {
+		name   string
+		modify func(r *http.Request) []byte
+	}{
+		{name: "body", modify: func(r *http.Request) []byte { return []byte("query=down") }},
+		{name: "query", modify: func(r *http.Request) []byte { r.URL.RawQuery = "x=1"; return body }},
+		{name: "signed header", modify: func(r *http.Request) []byte { r.Header.Set("Content-Type", "text/plain"); return body }},
+		{name: "region", modify: func(r *http.Request) []byte {
+			r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "us-east-1", "us-west-2", 1))
+			return body
+		}},
+	}
+	for _, tt := range tampered {
+		t.Run(tt.name, func(t *testing.T) {
+			r := req.Clone(req.Context())
+			if err := Verify(r, tt.modify(r), testCreds, "us-east-1", DefaultService); err == nil {
+				t.Error("tampered request passed verification")
+			}
+		})
+	}
+}
+
+// checkSignature computes the signature of a received request following
+// the AWS documentation, independently of Sign, and compares it to the
+// Authorization header.
+func checkSignature(r *http.Request, body []byte) error {
+	amzDate := r.Header.Get("X-Amz-Date")
+	if amzDate != testNow.Format("20060102T150405Z") {
+		return fmt.Errorf("X-Amz-Date = %q, want the fixed clock", amzDate)
+	}
+	payloadHash := sha256Hex(body)
+	if h := r.Header.Get("X-Amz-Content-Sha256"); h != payloadHash {
+		return fmt.Errorf("X-Amz-Content-Sha256 = %q, want %q", h, payloadHash)
+	}
+	if tok := r.Header.Get("X-Amz-Security-Token"); tok != testCreds.SessionToken {
+		return fmt.Errorf("X-Amz-Security-Token = %q", tok)
+	}
+
+	var signed []string
+	headers := map[string]string{"host": r.Host}
+	for k, v := range r.Header {
+		lk := strings.ToLower(k)
+		if lk == "content-type" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.Join(v, ",")
+		}
+	}
+	for k := range headers {
+		signed = append(signed, k)
+	}
+	sort.Strings(signed)
+	var canonicalHeaders strings.Builder
+	for _, k := range signed {
+		canonicalHeaders.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+
+	var segments []string
+	for _, s := range strings.Split(r.URL.EscapedPath(), "/") {
+		segments = append(segments, awsEscape(s))
+	}
+	var query []string
+	for k, vs := range r.URL.Query() {
+		for _, v := range vs {
+			query = append(query, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	sort.Strings(query)
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		strings.Join(segments, "/"),
+		strings.Join(query, "&"),
+		canonicalHeaders.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	scope := testNow.Format("20060102") + "/us-east-1/aps/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + testCreds.SecretKey)
+	for _, s := range []string{testNow.Format("20060102"), "us-east-1", "aps", "aws4_request"} {
+		key = hmacSum(key, s)
+	}
+	want := fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		testCreds.AccessKey, scope, strings.Join(signed, ";"), hex.EncodeToString(hmacSum(key, stringToSign)))
+	if got := r.Header.Get("Authorization"); got != want {
+		return fmt.Errorf("Authorization = %q, want %q", got, want)
+	}
+	return nil
+}
+
+// awsEscape encodes everything except the unreserved characters.
+func awsEscape(s string) string {
+	return strings.NewReplacer("+", "%20", "*", "%2A", "%7E", "~").Replace(url.QueryEscape(s))
+}
+
+func sha256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSum(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,141 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sigv4 signs requests to Amazon Managed Service for Prometheus
+// with AWS Signature Version 4.
+package sigv4
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DefaultService is the signing name of Amazon Managed Service for Prometheus.
+const DefaultService = "aps"
+
+// Config is the AWS SigV4 signing configuration. Without AccessKey and
+// SecretKey, credentials are resolved like the default chain of the AWS SDKs.
+type Config struct {
+	Region    string `yaml:"region,omitempty" json:"region,omitempty"`
+	AccessKey string `yaml:"access_key,omitempty" json:"access_key,omitempty"`
+	SecretKey string `yaml:"secret_key,omitempty" json:"secret_key,omitempty"`
+	Profile   string `yaml:"profile,omitempty" json:"profile,omitempty"`
+	RoleARN   string `yaml:"role_arn,omitempty" json:"role_arn,omitempty"`
+	// Service defaults to aps.
+	Service string `yaml:"service,omitempty" json:"service,omitempty"`
+	// STSEndpoint overrides the regional STS endpoint used to assume RoleARN.
+	STSEndpoint string `yaml:"sts_endpoint,omitempty" json:"sts_endpoint,omitempty"`
+}
+
+// IsSet returns true if any SigV4 option is configured.
+func (c *Config) IsSet() bool {
+	return *c != Config{}
+}
+
+func (c *Config) Validate() error {
+	if c.Region == "" {
+		return errors.New("sigv4 region must be configured")
+	}
+	if (c.AccessKey == "") != (c.SecretKey == "") {
+		return errors.New("sigv4 access key and secret key must be set together")
+	}
+	if c.AccessKey != "" && c.Profile != "" {
+		return errors.New("at most one of sigv4 access key & profile must be configured")
+	}
+	return nil
+}
+
+type credentialsProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+type staticProvider Credentials
+
+func (p staticProvider) Credentials(context.Context) (Credentials, error) {
+	return Credentials(p), nil
+}
+
+type roundTripper struct {
+	next    http.RoundTripper
+	creds   credentialsProvider
+	region  string
+	service string
+	now     func() time.Time
+}
+
+// NewRoundTripper returns a RoundTripper that signs every request with the
+// credentials resolved from cfg before passing it to next. Temporary
+// credentials are refreshed shortly before they expire.
+func NewRoundTripper(cfg *Config, next http.RoundTripper) (http.RoundTripper, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	base, err := cfg.baseProvider(client)
+	if err != nil {
+		return nil, err
+	}
+
+	rt := &roundTripper{
+		next:    next,
+		creds:   base,
+		region:  cfg.Region,
+		service: cfg.Service,
+		now:     time.Now,
+	}
+	if rt.service == "" {
+		rt.service = DefaultService
+	}
+	if cfg.RoleARN != "" {
+		p := &roleProvider{
+			cfg:    cfg,
+			base:   base,
+			client: client,
+		}
+		rt.creds = &refreshingProvider{fetch: p.assumeRole}
+	}
+	return rt, nil
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds, err := rt.creds.Credentials(req.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err = io.ReadAll(req.Body)
+		_ = req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r := req.Clone(req.Context())
+	if body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	Sign(r, body, creds, rt.region, rt.service, rt.now())
+	return rt.next.RoundTrip(r)
+}
@@ -0,0 +1,211 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultRetryBackoff    = 200 * time.Millisecond
+	defaultMaxRetryBackoff = 10 * time.Second
+	// maxRetryAfter is the longest Retry-After delay that is waited for.
+	// A response asking for a longer delay is returned instead.
+	maxRetryAfter = time.Minute
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+// wrapRoundTripper adds the retry, rate limit and instrumentation
+// middleware enabled in the config around rt.
+func (p *Config) wrapRoundTripper(rt http.RoundTripper) (http.RoundTripper, error) {
+	var m *clientMetrics
+	if p.Registerer != nil {
+		var err error
+		if m, err = registerClientMetrics(p.Registerer); err != nil {
+			return nil, err
+		}
+		rt = m.instrument(rt)
+	}
+	if p.QPS > 0 {
+		burst := p.Burst
+		if burst <= 0 {
+			burst = 1
+		}
+		rt = rateLimit(rate.NewLimiter(rate.Limit(p.QPS), burst), rt)
+	}
+	if p.MaxRetries > 0 {
+		rt = &retryRoundTripper{
+			next:       rt,
+			maxRetries: p.MaxRetries,
+			backoff:    durationOrDefault(time.Duration(p.RetryBackoff), defaultRetryBackoff),
+			maxBackoff: durationOrDefault(time.Duration(p.MaxRetryBackoff), defaultMaxRetryBackoff),
+			metrics:    m,
+		}
+	}
+	return rt, nil
+}
+
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d > 0 {
+		return d
+	}
+	return def
+}
+
+func rateLimit(l *rate.Limiter, next http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if err := l.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+		return next.RoundTrip(req)
+	})
+}
+
+// retryRoundTripper retries requests that failed with a connection reset or
+// a status code that signals a transient overload of the backend.
+type retryRoundTripper struct {
+	next       http.RoundTripper
+	maxRetries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+	metrics    *clientMetrics
+}
+
+func (rt *retryRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 && hasBody(req) {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+
+		resp, err := rt.next.RoundTrip(r)
+		if attempt >= rt.maxRetries || !retryable(resp, err) {
+			return resp, err
+		}
+		if hasBody(req) && req.GetBody == nil {
+			// the body has been consumed and can't be replayed
+			return resp, err
+		}
+
+		wait, ok := rt.wait(attempt, resp)
+		if deadline, set := req.Context().Deadline(); ok && set && time.Until(deadline) < wait {
+			// the request would time out while waiting
+			ok = false
+		}
+		if !ok {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+		if rt.metrics != nil {
+			rt.metrics.retries.WithLabelValues(endpointLabel(req)).Inc()
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-req.Context().Done():
+			t.Stop()
+			return nil, req.Context().Err()
+		case <-t.C:
+		}
+	}
+}
+
+func hasBody(req *http.Request) bool {
+	return req.Body != nil && req.Body != http.NoBody
+}
+
+// wait returns the Retry-After delay of resp if set, otherwise an
+// exponential backoff with jitter. It returns false if the server asks to
+// wait longer than maxRetryAfter.
+func (rt *retryRoundTripper) wait(attempt int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			return d, d <= maxRetryAfter
+		}
+	}
+	d := rt.backoff << attempt
+	if d <= 0 || d > rt.maxBackoff {
+		d = rt.maxBackoff
+	}
+	return d/2 + rand.N(d/2+1), true
+}
+
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second, secs >= 0
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return errors.Is(err, syscall.ECONNRESET) ||
+			errors.Is(err, syscall.ECONNREFUSED) ||
+			errors.Is(err, io.ErrUnexpectedEOF) ||
+			errors.Is(err, io.EOF)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// endpointLabel returns the Prometheus API path of the request without any
+// prefix added by proxies, e.g. /api/v1/query. Label names in the path are
+// replaced to keep the cardinality low.
+func endpointLabel(req *http.Request) string {
+	p := req.URL.Path
+	if i := strings.LastIndex(p, "/api/v1/"); i >= 0 {
+		p = p[i:]
+	}
+	if strings.HasPrefix(p, "/api/v1/label/") && strings.HasSuffix(p, "/values") {
+		return "/api/v1/label/:name/values"
+	}
+	return p
+}
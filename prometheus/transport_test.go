@@ -0,0 +1,290 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prometheus
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// flaky answers the first failures requests with status and the Retry-After
+// header, then 200 with the request body.
+type flaky struct {
+	failures   int32
+	status     int
+	retryAfter string
+	calls      atomic.Int32
+}
+
+func (f *flaky) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.calls.Add(1) <= f.failures {
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		w.WriteHeader(f.status)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	_, _ = w.Write(body)
+}
+
+func do(t *testing.T, ctx context.Context, cfg Config, method, body string) (*http.Response, error) {
+	t.Helper()
+	c, err := cfg.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, cfg.Addr+"/api/v1/query", r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _, err := c.Do(ctx, req)
+	return resp, err
+}
+
+func TestRetry(t *testing.T) {
+	fast := model.Duration(time.Millisecond)
+	tests := []struct {
+		name      string
+		srv       *flaky
+		retries   int
+		wantCode  int
+		wantCalls int32
+	}{
+		{name: "unavailable", srv: &flaky{failures: 2, status: http.StatusServiceUnavailable}, retries: 3, wantCode: 200, wantCalls: 3},
+		{name: "too many retries", srv: &flaky{failures: 5, status: http.StatusBadGateway}, retries: 2, wantCode: 502, wantCalls: 3},
+		{name: "not retryable", srv: &flaky{failures: 1, status: http.StatusBadRequest}, retries: 3, wantCode: 400, wantCalls: 1},
+		{name: "retries disabled", srv: &flaky{failures: 1, status: http.StatusServiceUnavailable}, wantCode: 503, wantCalls: 1},
+		{name: "short retry after", srv: &flaky{failures: 1, status: http.StatusTooManyRequests, retryAfter: "0"}, retries: 1, wantCode: 200, wantCalls: 2},
+		// the server asks to wait longer than maxRetryAfter
+		{name: "long retry after", srv: &flaky{failures: 1, status: http.StatusTooManyRequests, retryAfter: "3600"}, retries: 3, wantCode: 429, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.srv)
+			defer srv.Close()
+
+			cfg := Config{Addr: srv.URL, MaxRetries: tt.retries, RetryBackoff: fast, MaxRetryBackoff: fast}
+			resp, err := do(t, context.Background(), cfg, http.MethodPost, "query=up")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if got := tt.srv.calls.Load(); got != tt.wantCalls {
+				t.Errorf("got %d requests, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetryReplaysBody(t *testing.T) {
+	srv := httptest.NewServer(&flaky{failures: 1, status: http.StatusServiceUnavailable})
+	defer srv.Close()
+
+	cfg := Config{Addr: srv.URL, MaxRetries: 1, RetryBackoff: model.Duration(time.Millisecond)}
+	c, err := cfg.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/query", strings.NewReader("query=up"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, body, err := c.Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "query=up" {
+		t.Errorf("body of the retry = %q, want query=up", body)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	srv := &flaky{failures: 1, status: http.StatusServiceUnavailable, retryAfter: "30"}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	resp, err := do(t, ctx, Config{Addr: ts.URL, MaxRetries: 3}, http.MethodGet, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the response is returned instead of waiting past the deadline
+	if resp.StatusCode != http.StatusServiceUnavailable || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("got %d after %s, want 503 right away", resp.StatusCode, time.Since(start))
+	}
+}
+
+func TestRetryWait(t *testing.T) {
+	rt := &retryRoundTripper{backoff: 100 * time.Millisecond, maxBackoff: time.Second}
+	for attempt, want := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second} {
+		for range 20 {
+			d, ok := rt.wait(attempt, nil)
+			if !ok || d < want/2 || d > want {
+				t.Fatalf("wait(%d) = %s, %v, want between %s and %s", attempt, d, ok, want/2, want)
+			}
+		}
+	}
+	// Retry-After is honored even above the backoff
+	resp := &http.Response{Header: http.Header{"Retry-After": {"20"}}}
+	if d, ok := rt.wait(0, resp); !ok || d != 20*time.Second {
+		t.Errorf("wait() with Retry-After: 20 = %s, %v, want 20s", d, ok)
+	}
+	resp.Header.Set("Retry-After", "120")
+	if _, ok := rt.wait(0, resp); ok {
+		t.Error("wait() with Retry-After: 120 retries, want to give up")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: "", wantOK: false},
+		{value: "5", want: 5 * time.Second, wantOK: true},
+		{value: "0", want: 0, wantOK: true},
+		{value: "-1", wantOK: false},
+		{value: "soon", wantOK: false},
+		{value: "Wed, 21 Oct 2015 07:28:00 GMT", want: 0, wantOK: true},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.value)
+		if ok != tt.wantOK || ok && got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, %v, want %s, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got, ok := parseRetryAfter(future); !ok || got < 59*time.Minute || got > time.Hour {
+		t.Errorf("parseRetryAfter(%q) = %s, %v, want about 1h", future, got, ok)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+	}))
+	defer srv.Close()
+
+	cfg := Config{Addr: srv.URL, QPS: 20, Burst: 2}
+	c, err := cfg.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	start := time.Now()
+	for range 4 {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/v1/query", nil)
+		if _, _, err := c.Do(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a burst of 2, then 2 requests 50ms apart
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("4 requests at 20 QPS with a burst of 2 took %s, want at least 100ms", d)
+	}
+
+	// a canceled request doesn't wait for the limiter
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/api/v1/query", nil)
+	if _, _, err := c.Do(ctx, req); err == nil {
+		t.Error("canceled request succeeded")
+	}
+	if n := calls.Load(); n != 4 {
+		t.Errorf("server got %d requests, want 4", n)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	srv := httptest.NewServer(&flaky{failures: 1, status: http.StatusServiceUnavailable})
+	defer srv.Close()
+
+	reg := prom.NewRegistry()
+	cfg := Config{Addr: srv.URL, Registerer: reg, MaxRetries: 1, RetryBackoff: model.Duration(time.Millisecond)}
+	if _, err := do(t, context.Background(), cfg, http.MethodGet, ""); err != nil {
+		t.Fatal(err)
+	}
+	// a second client shares the collectors
+	c, err := cfg.NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/prefix/api/v1/label/job/values", nil)
+	if _, _, err := c.Do(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			key := mf.GetName()
+			for _, l := range m.GetLabel() {
+				key += " " + l.GetName() + "=" + l.GetValue()
+			}
+			switch {
+			case m.GetCounter() != nil:
+				got[key] = m.GetCounter().GetValue()
+			case m.GetHistogram() != nil:
+				got[key] = float64(m.GetHistogram().GetSampleCount())
+			}
+		}
+	}
+	want := map[string]float64{
+		"prometheus_client_requests_total code=503 endpoint=/api/v1/query":                        1,
+		"prometheus_client_requests_total code=200 endpoint=/api/v1/query":                        1,
+		"prometheus_client_requests_total code=200 endpoint=/api/v1/label/:name/values":           1,
+		"prometheus_client_request_duration_seconds code=503 endpoint=/api/v1/query":              1,
+		"prometheus_client_request_duration_seconds code=200 endpoint=/api/v1/query":              1,
+		"prometheus_client_request_duration_seconds code=200 endpoint=/api/v1/label/:name/values": 1,
+		"prometheus_client_retries_total endpoint=/api/v1/query":                                  1,
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("got metrics %v, want %v", got, want)
+	}
+}
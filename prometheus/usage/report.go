@@ -0,0 +1,423 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/tamalsaha/prometheus-demo/prometheus/promql"
+	"github.com/tamalsaha/prometheus-demo/prometheus/query"
+	"golang.org/x/sync/errgroup"
+	"k8s.io/klog/v2"
+)
+
+// GroupBy is the level a usage report is aggregated at.
+type GroupBy string
+
+const (
+	// ByWorkload groups pods by their top level owner, like a Deployment
+	// or CronJob. Pods without an owner are reported on their own.
+	ByWorkload  GroupBy = "workload"
+	ByNamespace GroupBy = "namespace"
+	ByNode      GroupBy = "node"
+)
+
+// ReportOptions selects the time window and grouping of a report.
+type ReportOptions struct {
+	Start   time.Time
+	End     time.Time
+	GroupBy GroupBy
+	// Namespace limits the report to one namespace. All namespaces are
+	// reported if empty.
+	Namespace string
+}
+
+// Report is the resource usage of a set of workloads over a time window.
+type Report struct {
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	GroupBy GroupBy   `json:"groupBy"`
+	Items   []Usage   `json:"items"`
+}
+
+// Usage is the resource usage of one group of pods. Only the fields that
+// identify the group for the report's GroupBy are set.
+type Usage struct {
+	Namespace string `json:"namespace,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Node      string `json:"node,omitempty"`
+	Pods      int    `json:"pods"`
+
+	// CPU is in cores, averaged over the window. Pods count for the part
+	// of the window they existed in, so a pod that ran for an hour of a
+	// day counts for 1/24, and requests and limits only count while a pod
+	// is pending or running.
+	CPU Resource `json:"cpu"`
+	// Memory is the working set in bytes, averaged over the window like
+	// CPU.
+	Memory Resource `json:"memory"`
+	// NetworkReceiveBytes and NetworkTransmitBytes are the bytes sent over
+	// the pod network during the window.
+	NetworkReceiveBytes  float64 `json:"networkReceiveBytes"`
+	NetworkTransmitBytes float64 `json:"networkTransmitBytes"`
+	// StorageBytes is the space used on the PersistentVolumeClaims mounted
+	// by the pods, averaged over the window like CPU.
+	StorageBytes float64 `json:"storageBytes"`
+}
+
+// Resource is the usage of a resource with its requests and limits. The
+// utilizations are percentages and are nil if there are no requests or
+// limits.
+type Resource struct {
+	Usage              float64  `json:"usage"`
+	Requests           float64  `json:"requests"`
+	Limits             float64  `json:"limits"`
+	RequestUtilization *float64 `json:"requestUtilization,omitempty"`
+	LimitUtilization   *float64 `json:"limitUtilization,omitempty"`
+}
+
+func (r *Resource) add(o Resource) {
+	r.Usage += o.Usage
+	r.Requests += o.Requests
+	r.Limits += o.Limits
+}
+
+func (r *Resource) computeUtilization() {
+	r.RequestUtilization = percent(r.Usage, r.Requests)
+	r.LimitUtilization = percent(r.Usage, r.Limits)
+}
+
+func percent(v, of float64) *float64 {
+	if of <= 0 {
+		return nil
+	}
+	p := v / of * 100
+	return &p
+}
+
+type podKey struct {
+	namespace, name string
+}
+
+type pvcKey struct {
+	namespace, name string
+}
+
+// pod collects what the report queries return about one pod.
+type pod struct {
+	node                 string
+	ownerKind, ownerName string
+	cpu, memory          Resource
+	rx, tx               float64
+	pvcs                 []pvcKey
+}
+
+type owner struct {
+	kind, name string
+}
+
+// reportData is the result of the report queries, before grouping.
+type reportData struct {
+	pods map[podKey]*pod
+	// replicaSets and jobs map to their owning Deployment and CronJob
+	replicaSets map[podKey]owner
+	jobs        map[podKey]owner
+	pvcUsed     map[pvcKey]float64
+}
+
+func (d *reportData) pod(labels map[string]string) *pod {
+	key := podKey{namespace: labels["namespace"], name: labels["pod"]}
+	p, ok := d.pods[key]
+	if !ok {
+		p = &pod{}
+		d.pods[key] = p
+	}
+	return p
+}
+
+// NewReport returns the usage of pods between opts.Start and opts.End. It
+// runs a fixed number of queries regardless of the number of pods, and
+// joins the results with kube_pod_owner, kube_pod_info and
+// kube_pod_status_phase from kube-state-metrics.
+func NewReport(ctx context.Context, api promv1.API, opts ReportOptions) (*Report, error) {
+	switch opts.GroupBy {
+	case ByWorkload, ByNamespace, ByNode:
+	case "":
+		opts.GroupBy = ByWorkload
+	default:
+		return nil, fmt.Errorf("unknown grouping %q, must be one of workload, namespace or node", opts.GroupBy)
+	}
+	if !opts.Start.Before(opts.End) {
+		return nil, errors.New("start of the report must be before its end")
+	}
+	window := opts.End.Sub(opts.Start).Round(time.Second)
+	if window < time.Minute {
+		return nil, fmt.Errorf("report window %s is shorter than 1m", window)
+	}
+
+	d := &reportData{
+		pods:        map[podKey]*pod{},
+		replicaSets: map[podKey]owner{},
+		jobs:        map[podKey]owner{},
+		pvcUsed:     map[pvcKey]float64{},
+	}
+	if err := d.load(ctx, query.New(api), opts, window); err != nil {
+		return nil, err
+	}
+	return &Report{
+		Start:   opts.Start,
+		End:     opts.End,
+		GroupBy: opts.GroupBy,
+		Items:   d.group(opts.GroupBy),
+	}, nil
+}
+
+// load runs the report queries concurrently. Each query fills its own part
+// of d in a callback, which runs after all queries returned.
+func (d *reportData) load(ctx context.Context, qc *query.Client, opts ReportOptions, window time.Duration) error {
+	selector := func(metric string, matchers ...promql.Matcher) promql.Selector {
+		s := promql.Metric(metric, matchers...)
+		if opts.Namespace != "" {
+			s = s.Where(promql.Eq("namespace", opts.Namespace))
+		}
+		return s
+	}
+	overTime := func(fn string, s promql.Selector) promql.Expr {
+		return promql.Func(fn, s.Over(window))
+	}
+	// average divides the sum of e over the steps of the window by the
+	// number of steps, so that series count for the steps they exist in
+	step := averageStep(window)
+	average := func(e promql.Expr) promql.Expr {
+		steps := promql.Func("count_over_time", promql.SubqueryOf(promql.Func("vector", promql.Number(1)), window, step))
+		return promql.Div(promql.Func("sum_over_time", promql.SubqueryOf(e, window, step)), promql.Func("scalar", steps))
+	}
+	// requests and limits of pods that are done are still exported until
+	// the pods are deleted
+	active := promql.BinaryOp("==", selector("kube_pod_status_phase", promql.OneOf("phase", "Pending", "Running")), promql.Number(1))
+	allocated := func(metric string) promql.Expr {
+		s := selector(metric, promql.OneOf("resource", "cpu", "memory"))
+		return average(promql.Sum(promql.And(s, active).On("namespace", "pod")).By("namespace", "pod", "resource"))
+	}
+	containers := []promql.Matcher{promql.Neq("container", ""), promql.Neq("image", "")}
+
+	type job struct {
+		expr promql.Expr
+		fill func(s query.Sample)
+	}
+	jobs := []job{
+		{
+			// the CPU seconds used during the window, over the whole window
+			expr: promql.Div(promql.Sum(promql.Increase(selector("container_cpu_usage_seconds_total", containers...), window)).By("namespace", "pod"), promql.Number(window.Seconds())),
+			fill: func(s query.Sample) { d.pod(s.Labels).cpu.Usage = s.Value },
+		},
+		{
+			expr: average(promql.Sum(selector("container_memory_working_set_bytes", containers...)).By("namespace", "pod")),
+			fill: func(s query.Sample) { d.pod(s.Labels).memory.Usage = s.Value },
+		},
+		{
+			expr: promql.Sum(promql.Increase(selector("container_network_receive_bytes_total"), window)).By("namespace", "pod"),
+			fill: func(s query.Sample) { d.pod(s.Labels).rx = s.Value },
+		},
+		{
+			expr: promql.Sum(promql.Increase(selector("container_network_transmit_bytes_total"), window)).By("namespace", "pod"),
+			fill: func(s query.Sample) { d.pod(s.Labels).tx = s.Value },
+		},
+		{
+			expr: allocated("kube_pod_container_resource_requests"),
+			fill: func(s query.Sample) { d.pod(s.Labels).resource(s.Labels["resource"]).Requests = s.Value },
+		},
+		{
+			expr: allocated("kube_pod_container_resource_limits"),
+			fill: func(s query.Sample) { d.pod(s.Labels).resource(s.Labels["resource"]).Limits = s.Value },
+		},
+		{
+			expr: promql.Max(overTime("max_over_time", selector("kube_pod_info", promql.Neq("node", "")))).By("namespace", "pod", "node"),
+			fill: func(s query.Sample) { d.pod(s.Labels).node = s.Labels["node"] },
+		},
+		{
+			expr: promql.Max(overTime("max_over_time", selector("kube_pod_owner"))).By("namespace", "pod", "owner_kind", "owner_name"),
+			fill: func(s query.Sample) {
+				if s.Labels["owner_kind"] == "" || s.Labels["owner_kind"] == "<none>" {
+					return
+				}
+				p := d.pod(s.Labels)
+				p.ownerKind, p.ownerName = s.Labels["owner_kind"], s.Labels["owner_name"]
+			},
+		},
+		{
+			expr: promql.Max(overTime("max_over_time", selector("kube_replicaset_owner", promql.Eq("owner_kind", "Deployment")))).By("namespace", "replicaset", "owner_kind", "owner_name"),
+			fill: func(s query.Sample) {
+				d.replicaSets[podKey{s.Labels["namespace"], s.Labels["replicaset"]}] = owner{s.Labels["owner_kind"], s.Labels["owner_name"]}
+			},
+		},
+		{
+			expr: promql.Max(overTime("max_over_time", selector("kube_job_owner", promql.Eq("owner_kind", "CronJob")))).By("namespace", "job_name", "owner_kind", "owner_name"),
+			fill: func(s query.Sample) {
+				d.jobs[podKey{s.Labels["namespace"], s.Labels["job_name"]}] = owner{s.Labels["owner_kind"], s.Labels["owner_name"]}
+			},
+		},
+		{
+			expr: promql.Max(overTime("max_over_time", selector("kube_pod_spec_volumes_persistentvolumeclaims_info"))).By("namespace", "pod", "persistentvolumeclaim"),
+			fill: func(s query.Sample) {
+				p := d.pod(s.Labels)
+				p.pvcs = append(p.pvcs, pvcKey{s.Labels["namespace"], s.Labels["persistentvolumeclaim"]})
+			},
+		},
+		{
+			expr: average(promql.Sum(selector("kubelet_volume_stats_used_bytes")).By("namespace", "persistentvolumeclaim")),
+			fill: func(s query.Sample) {
+				d.pvcUsed[pvcKey{s.Labels["namespace"], s.Labels["persistentvolumeclaim"]}] = s.Value
+			},
+		},
+	}
+
+	results := make([]*query.Result, len(jobs))
+	g, ctx := errgroup.WithContext(ctx)
+	for i, j := range jobs {
+		q, err := promql.Build(j.expr)
+		if err != nil {
+			return err
+		}
+		g.Go(func() error {
+			res, err := qc.Query(ctx, q, opts.End)
+			if err != nil {
+				return fmt.Errorf("failed to run %s: %w", q, err)
+			}
+			for _, w := range res.Warnings {
+				klog.Warningln(w)
+			}
+			results[i] = res
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	for i, j := range jobs {
+		for _, s := range results[i].Instant() {
+			j.fill(s)
+		}
+	}
+	return nil
+}
+
+// maxSteps is the most steps of the subqueries that average over a report
+// window.
+const maxSteps = 1440
+
+// averageStep returns the step of the subqueries that average over window:
+// a minute, or longer for windows of more than a day.
+func averageStep(window time.Duration) time.Duration {
+	step := (window / maxSteps).Truncate(time.Minute)
+	if step < time.Minute {
+		return time.Minute
+	}
+	return step
+}
+
+func (p *pod) resource(name string) *Resource {
+	if name == "cpu" {
+		return &p.cpu
+	}
+	return &p.memory
+}
+
+// workload returns the top level owner of a pod, following ReplicaSets to
+// their Deployment and Jobs to their CronJob.
+func (d *reportData) workload(key podKey, p *pod) owner {
+	switch p.ownerKind {
+	case "":
+		return owner{kind: "Pod", name: key.name}
+	case "ReplicaSet":
+		if o, ok := d.replicaSets[podKey{key.namespace, p.ownerName}]; ok {
+			return o
+		}
+	case "Job":
+		if o, ok := d.jobs[podKey{key.namespace, p.ownerName}]; ok {
+			return o
+		}
+	}
+	return owner{kind: p.ownerKind, name: p.ownerName}
+}
+
+type groupKey struct {
+	namespace, kind, name, node string
+}
+
+func (d *reportData) group(by GroupBy) []Usage {
+	groups := map[groupKey]*Usage{}
+	// a PersistentVolumeClaim mounted by several pods of a group is only
+	// counted once
+	pvcs := map[groupKey]map[pvcKey]bool{}
+	for key, p := range d.pods {
+		var id groupKey
+		switch by {
+		case ByWorkload:
+			o := d.workload(key, p)
+			id = groupKey{namespace: key.namespace, kind: o.kind, name: o.name}
+		case ByNamespace:
+			id = groupKey{namespace: key.namespace}
+		case ByNode:
+			id = groupKey{node: p.node}
+		}
+		u, ok := groups[id]
+		if !ok {
+			u = &Usage{Namespace: id.namespace, Kind: id.kind, Name: id.name, Node: id.node}
+			groups[id] = u
+			pvcs[id] = map[pvcKey]bool{}
+		}
+		u.Pods++
+		u.CPU.add(p.cpu)
+		u.Memory.add(p.memory)
+		u.NetworkReceiveBytes += p.rx
+		u.NetworkTransmitBytes += p.tx
+		for _, pvc := range p.pvcs {
+			if !pvcs[id][pvc] {
+				pvcs[id][pvc] = true
+				u.StorageBytes += d.pvcUsed[pvc]
+			}
+		}
+	}
+
+	out := make([]Usage, 0, len(groups))
+	for _, u := range groups {
+		u.CPU.computeUtilization()
+		u.Memory.computeUtilization()
+		out = append(out, *u)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Node != b.Node {
+			return a.Node < b.Node
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	return out
+}
@@ -0,0 +1,270 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usage
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/tamalsaha/prometheus-demo/prometheus/promtest"
+)
+
+const scrapeInterval = 15 * time.Second
+
+// testPod runs its containers in [start, end). kube-state-metrics exports
+// the pod until deleted, and as Succeeded after end.
+type testPod struct {
+	name, node           string
+	ownerKind, ownerName string
+	start, end, deleted  time.Duration
+	cores, memory        float64
+	cpuRequest           float64
+}
+
+func (p testPod) add(db *promtest.Storage) {
+	at := func(d time.Duration) time.Time { return promtest.DefaultStart.Add(d) }
+	gen := func(from, to time.Duration) promtest.Generator {
+		return promtest.Generator{Start: at(from), Interval: scrapeInterval, Points: int((to - from) / scrapeInterval)}
+	}
+	// series adds samples from start until to, and a staleness marker at
+	// to, like Prometheus does once the series is gone
+	series := func(to time.Duration, name string, lbls map[string]string, fn func(g promtest.Generator)) {
+		fn(gen(p.start, to))
+		db.Stale(name, lbls, at(to))
+	}
+
+	container := map[string]string{"namespace": "demo", "pod": p.name, "container": "main", "image": "main:latest"}
+	series(p.end, "container_cpu_usage_seconds_total", container, func(g promtest.Generator) {
+		g.Counter(db, "container_cpu_usage_seconds_total", container, p.cores)
+	})
+	series(p.end, "container_memory_working_set_bytes", container, func(g promtest.Generator) {
+		g.Constant(db, "container_memory_working_set_bytes", container, p.memory)
+	})
+
+	info := map[string]string{"namespace": "demo", "pod": p.name, "node": p.node}
+	series(p.deleted, "kube_pod_info", info, func(g promtest.Generator) {
+		g.Constant(db, "kube_pod_info", info, 1)
+	})
+	owner := map[string]string{"namespace": "demo", "pod": p.name, "owner_kind": p.ownerKind, "owner_name": p.ownerName}
+	series(p.deleted, "kube_pod_owner", owner, func(g promtest.Generator) {
+		g.Constant(db, "kube_pod_owner", owner, 1)
+	})
+	for phase, running := range map[string]bool{"Running": true, "Succeeded": false} {
+		lbls := map[string]string{"namespace": "demo", "pod": p.name, "phase": phase}
+		series(p.deleted, "kube_pod_status_phase", lbls, func(g promtest.Generator) {
+			g.Gauge(db, "kube_pod_status_phase", lbls, func(i int) float64 {
+				if (p.start+time.Duration(i)*scrapeInterval < p.end) == running {
+					return 1
+				}
+				return 0
+			})
+		})
+	}
+	if p.cpuRequest > 0 {
+		for metric, v := range map[string]float64{
+			"kube_pod_container_resource_requests": p.cpuRequest,
+			"kube_pod_container_resource_limits":   2 * p.cpuRequest,
+		} {
+			lbls := map[string]string{"namespace": "demo", "pod": p.name, "container": "main", "resource": "cpu", "unit": "core"}
+			series(p.deleted, metric, lbls, func(g promtest.Generator) {
+				g.Constant(db, metric, lbls, v)
+			})
+		}
+	}
+}
+
+// testStorage returns an hour of a Deployment that rolled out a new
+// ReplicaSet halfway, a CronJob that ran for 15 minutes and a pod without
+// owner.
+func testStorage() *promtest.Storage {
+	db := promtest.NewStorage()
+	// the last samples are at the end of the report
+	const hour = time.Hour + scrapeInterval
+	for _, p := range []testPod{
+		{name: "web-1-a", node: "node-1", ownerKind: "ReplicaSet", ownerName: "web-1", end: 30 * time.Minute, deleted: 30 * time.Minute, cores: 1, memory: 100, cpuRequest: 2},
+		{name: "web-2-a", node: "node-2", ownerKind: "ReplicaSet", ownerName: "web-2", start: 30 * time.Minute, end: hour, deleted: hour, cores: 1, memory: 100, cpuRequest: 2},
+		// the completed pod is kept, with its requests
+		{name: "backup-1-x", node: "node-1", ownerKind: "Job", ownerName: "backup-1", start: 15 * time.Minute, end: 30 * time.Minute, deleted: hour, cores: 2, memory: 61, cpuRequest: 1},
+		{name: "debug", node: "node-2", ownerKind: "<none>", ownerName: "<none>", end: hour, deleted: hour, cores: 0.5, memory: 10},
+	} {
+		p.add(db)
+	}
+	all := promtest.Generator{Start: promtest.DefaultStart, Interval: scrapeInterval, Points: 241}
+	for _, rs := range []string{"web-1", "web-2"} {
+		all.Constant(db, "kube_replicaset_owner", map[string]string{
+			"namespace": "demo", "replicaset": rs, "owner_kind": "Deployment", "owner_name": "web",
+		}, 1)
+	}
+	all.Constant(db, "kube_job_owner", map[string]string{
+		"namespace": "demo", "job_name": "backup-1", "owner_kind": "CronJob", "owner_name": "backup",
+	}, 1)
+	return db
+}
+
+func TestNewReport(t *testing.T) {
+	srv := promtest.NewServer(testStorage())
+	defer srv.Close()
+	c, err := srv.PrometheusConfig().NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	opts := ReportOptions{Start: promtest.DefaultStart, End: promtest.DefaultStart.Add(time.Hour)}
+	// Prometheus 2 evaluates the subqueries at 61 steps in the hour,
+	// including both ends
+	const steps = 61.0
+
+	tests := []struct {
+		by   GroupBy
+		want []Usage
+	}{
+		{
+			by: ByWorkload,
+			want: []Usage{
+				{
+					Namespace: "demo", Kind: "CronJob", Name: "backup", Pods: 1,
+					// increase is extrapolated by half a scrape interval to
+					// the end of the run, and not below zero at its start
+					CPU:    Resource{Usage: 2 * 892.5 / 3600, Requests: 15 / steps, Limits: 2 * 15 / steps},
+					Memory: Resource{Usage: 61 * 15 / steps},
+				},
+				{
+					Namespace: "demo", Kind: "Deployment", Name: "web", Pods: 2,
+					CPU:    Resource{Usage: (1792.5 + 1800) / 3600, Requests: 2, Limits: 4},
+					Memory: Resource{Usage: 100},
+				},
+				{
+					Namespace: "demo", Kind: "Pod", Name: "debug", Pods: 1,
+					CPU:    Resource{Usage: 0.5},
+					Memory: Resource{Usage: 10},
+				},
+			},
+		},
+		{
+			by: ByNode,
+			want: []Usage{
+				{
+					Node: "node-1", Pods: 2,
+					CPU:    Resource{Usage: (2*892.5 + 1792.5) / 3600, Requests: 2*30/steps + 15/steps, Limits: 4*30/steps + 2*15/steps},
+					Memory: Resource{Usage: 100*30/steps + 61*15/steps},
+				},
+				{
+					Node: "node-2", Pods: 2,
+					CPU:    Resource{Usage: (1800 + 1800) / 3600, Requests: 2 * 31 / steps, Limits: 4 * 31 / steps},
+					Memory: Resource{Usage: 100*31/steps + 10},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.by), func(t *testing.T) {
+			opts := opts
+			opts.GroupBy = tt.by
+			r, err := NewReport(context.Background(), promv1.NewAPI(c), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Items) != len(tt.want) {
+				t.Fatalf("got %d items, want %d: %+v", len(r.Items), len(tt.want), r.Items)
+			}
+			for i, want := range tt.want {
+				got := r.Items[i]
+				if got.Namespace != want.Namespace || got.Kind != want.Kind || got.Name != want.Name || got.Node != want.Node || got.Pods != want.Pods {
+					t.Errorf("item %d = %s/%s/%s on %q with %d pods, want %s/%s/%s on %q with %d pods", i,
+						got.Namespace, got.Kind, got.Name, got.Node, got.Pods, want.Namespace, want.Kind, want.Name, want.Node, want.Pods)
+				}
+				assertResource(t, want.Name+want.Node+" cpu", got.CPU, want.CPU)
+				assertResource(t, want.Name+want.Node+" memory", got.Memory, want.Memory)
+			}
+		})
+	}
+}
+
+func TestUtilization(t *testing.T) {
+	srv := promtest.NewServer(testStorage())
+	defer srv.Close()
+	c, err := srv.PrometheusConfig().NewClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r, err := NewReport(context.Background(), promv1.NewAPI(c), ReportOptions{
+		Start:     promtest.DefaultStart,
+		End:       promtest.DefaultStart.Add(time.Hour),
+		Namespace: "demo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]Resource{}
+	for _, u := range r.Items {
+		got[u.Name] = u.CPU
+	}
+
+	// the rollout doesn't count the Deployment twice
+	web := got["web"]
+	if web.RequestUtilization == nil || !equal(*web.RequestUtilization, (1792.5+1800)/3600/2*100) {
+		t.Errorf("web request utilization = %v, want about 50%%", ptr(web.RequestUtilization))
+	}
+	if web.LimitUtilization == nil || !equal(*web.LimitUtilization, (1792.5+1800)/3600/4*100) {
+		t.Errorf("web limit utilization = %v, want about 25%%", ptr(web.LimitUtilization))
+	}
+	// the requests of the completed job only count while it ran
+	backup := got["backup"]
+	if backup.RequestUtilization == nil || !equal(*backup.RequestUtilization, 2*892.5/3600/(15.0/61)*100) {
+		t.Errorf("backup request utilization = %v, want about 200%%", ptr(backup.RequestUtilization))
+	}
+	if debug := got["debug"]; debug.RequestUtilization != nil || debug.LimitUtilization != nil {
+		t.Errorf("debug utilization = %v, %v, want none without requests and limits", ptr(debug.RequestUtilization), ptr(debug.LimitUtilization))
+	}
+}
+
+func TestAverageStep(t *testing.T) {
+	for window, want := range map[time.Duration]time.Duration{
+		time.Minute:         time.Minute,
+		24 * time.Hour:      time.Minute,
+		7 * 24 * time.Hour:  7 * time.Minute,
+		30 * 24 * time.Hour: 30 * time.Minute,
+	} {
+		if got := averageStep(window); got != want {
+			t.Errorf("averageStep(%s) = %s, want %s", window, got, want)
+		}
+	}
+}
+
+func assertResource(t *testing.T, name string, got, want Resource) {
+	t.Helper()
+	if !equal(got.Usage, want.Usage) || !equal(got.Requests, want.Requests) || !equal(got.Limits, want.Limits) {
+		t.Errorf("%s = %v/%v/%v, want %v/%v/%v", name, got.Usage, got.Requests, got.Limits, want.Usage, want.Requests, want.Limits)
+	}
+}
+
+func equal(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
+
+func ptr(p *float64) interface{} {
+	if p == nil {
+		return nil
+	}
+	return *p
+}
@@ -0,0 +1,129 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package usage reads the resource usage of Kubernetes workloads from the
+// cAdvisor, kubelet and kube-state-metrics series in Prometheus.
+package usage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/tamalsaha/prometheus-demo/prometheus/promql"
+	"github.com/tamalsaha/prometheus-demo/prometheus/query"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PodCPUQuery returns the CPU cores used by a pod. Joining with
+// kube_pod_info drops the series of pods that no longer run on a node.
+//
+// Previous way: sum(node_namespace_pod_container:container_cpu_usage_seconds_total:sum_irate{namespace="%s", pod="%s", container!=""})
+func PodCPUQuery(namespace, name string) promql.Expr {
+	return promql.Sum(
+		promql.Mul(
+			promql.Sum(
+				promql.IRate(promql.Metric("container_cpu_usage_seconds_total",
+					promql.Neq("image", ""),
+					promql.Eq("metrics_path", "/metrics/cadvisor"),
+					promql.Eq("namespace", namespace),
+					promql.Eq("pod", name),
+				), 5*time.Minute),
+			).By("namespace", "pod", "container"),
+			promql.TopK(1,
+				promql.Max(promql.Metric("kube_pod_info",
+					promql.Neq("node", ""),
+					promql.Eq("namespace", namespace),
+					promql.Eq("pod", name),
+				)).By("namespace", "pod", "node"),
+			).By("namespace", "pod"),
+		).On("namespace", "pod").GroupLeft("node"),
+	).By("pod")
+}
+
+// PodMemoryQuery returns the working set bytes of the containers of a pod.
+func PodMemoryQuery(namespace, name string) promql.Expr {
+	return promql.Sum(promql.Metric("container_memory_working_set_bytes",
+		promql.Eq("namespace", namespace),
+		promql.Eq("pod", name),
+		promql.Neq("container", ""),
+		promql.Neq("image", ""),
+	))
+}
+
+// PVCUsedBytesQuery returns the bytes used on the volume of a
+// PersistentVolumeClaim.
+func PVCUsedBytesQuery(namespace, name string) promql.Expr {
+	return promql.Metric("kubelet_volume_stats_used_bytes",
+		promql.Eq("namespace", namespace),
+		promql.Eq("persistentvolumeclaim", name),
+	)
+}
+
+// PodResourceUsage returns the current CPU and memory usage of a pod. It
+// replaces client.GetPodResourceUsage from kmodules.xyz/monitoring-agent-api,
+// which doesn't escape the pod name in its queries.
+func PodResourceUsage(ctx context.Context, api promv1.API, pod metav1.ObjectMeta) (core.ResourceList, error) {
+	qc := query.New(api)
+	cpu, err := sum(ctx, qc, PodCPUQuery(pod.Namespace, pod.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cpu usage of pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	memory, err := sum(ctx, qc, PodMemoryQuery(pod.Namespace, pod.Name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query memory usage of pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	return core.ResourceList{
+		core.ResourceCPU:    CPUQuantity(cpu),
+		core.ResourceMemory: BytesQuantity(memory),
+	}, nil
+}
+
+// PVCUsage returns the current storage used by a PersistentVolumeClaim. It
+// replaces client.GetPVCUsage from kmodules.xyz/monitoring-agent-api.
+func PVCUsage(ctx context.Context, api promv1.API, pvc metav1.ObjectMeta) (resource.Quantity, error) {
+	used, err := sum(ctx, query.New(api), PVCUsedBytesQuery(pvc.Namespace, pvc.Name))
+	if err != nil {
+		return resource.Quantity{}, fmt.Errorf("failed to query storage usage of pvc %s/%s: %w", pvc.Namespace, pvc.Name, err)
+	}
+	return BytesQuantity(used), nil
+}
+
+func sum(ctx context.Context, qc *query.Client, e promql.Expr) (float64, error) {
+	q, err := promql.Build(e)
+	if err != nil {
+		return 0, err
+	}
+	res, err := qc.Query(ctx, q, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return res.Sum(), nil
+}
+
+// CPUQuantity converts cores to a quantity with millicore precision.
+func CPUQuantity(cores float64) resource.Quantity {
+	return *resource.NewMilliQuantity(int64(math.Round(cores*1000)), resource.DecimalSI)
+}
+
+// BytesQuantity converts bytes to a quantity in binary units.
+func BytesQuantity(b float64) resource.Quantity {
+	return *resource.NewQuantity(int64(math.Round(b)), resource.BinarySI)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright AppsCode Inc. and Contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package usage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/tamalsaha/prometheus-demo/prometheus/promql"
+)
+
+// The queries of kmodules.xyz/monitoring-agent-api/client the builders
+// replace.
+const (
+	kmodulesCPUQuery = `sum(
+		sum by (namespace, pod, container) (
+			irate(container_cpu_usage_seconds_total{image!="",metrics_path="/metrics/cadvisor",namespace="%s", pod="%s"}[5m])
+		)
+		* on (namespace, pod) group_left (node)
+		topk by (namespace, pod) (1,
+			max by (namespace, pod, node) (
+				kube_pod_info{node!="",namespace="%s", pod="%s"}
+			)
+		)
+	) by (pod)`
+	kmodulesMemoryQuery  = `sum(container_memory_working_set_bytes{namespace="%s", pod="%s", container!="", image!=""})`
+	kmodulesStorageQuery = `kubelet_volume_stats_used_bytes{namespace="%s", persistentvolumeclaim="%s"}`
+)
+
+func TestQueriesMatchKmodules(t *testing.T) {
+	const ns, name = "demo", "mongo-0"
+	tests := []struct {
+		name string
+		expr promql.Expr
+		want string
+	}{
+		{
+			name: "cpu",
+			expr: PodCPUQuery(ns, name),
+			want: fmt.Sprintf(kmodulesCPUQuery, ns, name, ns, name),
+		},
+		{
+			name: "memory",
+			expr: PodMemoryQuery(ns, name),
+			want: fmt.Sprintf(kmodulesMemoryQuery, ns, name),
+		},
+		{
+			name: "pvc",
+			expr: PVCUsedBytesQuery(ns, name),
+			want: fmt.Sprintf(kmodulesStorageQuery, ns, name),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := promql.Build(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := parser.ParseExpr(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// compare the parsed forms, the original queries are indented
+			if got != want.String() {
+				t.Errorf("got  %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+func TestQueriesEscapeNames(t *testing.T) {
+	const ns = `demo"}`
+	const name = `x"} or vector(1e9) or up{a="\` + "\u2028\x00"
+	tests := []struct {
+		name   string
+		expr   promql.Expr
+		labels []string
+	}{
+		{name: "cpu", expr: PodCPUQuery(ns, name), labels: []string{"namespace", "pod"}},
+		{name: "memory", expr: PodMemoryQuery(ns, name), labels: []string{"namespace", "pod"}},
+		{name: "pvc", expr: PVCUsedBytesQuery(ns, name), labels: []string{"namespace", "persistentvolumeclaim"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := promql.Build(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, err := parser.ParseExpr(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{tt.labels[0]: ns, tt.labels[1]: name}
+			sels := parser.ExtractSelectors(parsed)
+			if len(sels) == 0 {
+				t.Fatalf("no selector in %s", q)
+			}
+			for _, sel := range sels {
+				found := 0
+				for _, m := range sel {
+					if v, ok := want[m.Name]; ok {
+						found++
+						if m.Value != v {
+							t.Errorf("parsed %s=%q, want %q", m.Name, m.Value, v)
+						}
+					}
+				}
+				if found != len(want) {
+					t.Errorf("selector %v doesn't match on %v", sel, tt.labels)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tamalsaha/prometheus-demo/prometheus/access"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+func newAccessCmd(o *options) *cobra.Command {
+	var (
+		serviceAccount string
+		name           string
+		provision      bool
+		dryRun         bool
+	)
+	cmd := &cobra.Command{
+		Use:   "access",
+		Short: "Grant a service account least privilege access to Prometheus and verify it",
+		Long: `Grant a service account least privilege access to Prometheus and verify it.
+
+With --provision the service account is created, along with a Role in the
+namespace of the --service that only allows the get and create verbs on the
+proxy of that service, and a RoleBinding. This replaces applying
+tricky-auth/tricky-auth.yaml or the anonymous binding of
+trickster-conf/rbac.yaml by hand.
+
+The access of the service account is then checked with SubjectAccessReviews:
+the proxy of the service must be allowed, other verbs, other services and
+Secrets must be denied. Bindings that grant the proxy to anonymous or all
+authenticated clients, more than needed to the service account, or the proxy
+of every service to any service account, are reported as findings. The
+command fails if a check fails.`,
+		Example: `  read-prom access --service-account=default/trickster --service=monitoring/prometheus-operated:9090 --provision
+  read-prom access --service-account=default/trickster --service=auto -o json
+  read-prom access --service-account=default/trickster --service=monitoring/prometheus-operated:9090 --dry-run`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ns, saName, ok := strings.Cut(serviceAccount, "/")
+			if !ok {
+				return fmt.Errorf("--service-account %q must be in namespace/name form", serviceAccount)
+			}
+			if o.service == "" && o.prom.Service == nil {
+				return fmt.Errorf("--service is required")
+			}
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			ref, err := o.serviceReference(ctx)
+			if err != nil {
+				return err
+			}
+			opts := access.Options{
+				ServiceAccount: types.NamespacedName{Namespace: ns, Name: saName},
+				Service:        ref,
+				Name:           name,
+			}
+
+			if dryRun {
+				sa, role, binding := access.Objects(opts)
+				for _, obj := range []interface{}{sa, role, binding} {
+					data, err := yaml.Marshal(obj)
+					if err != nil {
+						return err
+					}
+					fmt.Fprintf(cmd.OutOrStdout(), "---\n%s", data)
+				}
+				return nil
+			}
+
+			kc, err := o.kubeClient()
+			if err != nil {
+				return err
+			}
+			var v accessView
+			if provision {
+				if v.Preflight, err = access.Preflight(ctx, kc, opts); err != nil {
+					return err
+				}
+				if failed := failedChecks(v.Preflight); len(failed) > 0 {
+					if err := o.print(cmd, v); err != nil {
+						return err
+					}
+					return fmt.Errorf("not allowed to provision the access: %s", strings.Join(failed, "; "))
+				}
+				if err := access.Provision(ctx, kc, opts); err != nil {
+					return err
+				}
+			}
+			if v.Checks, err = access.Verify(ctx, kc, opts); err != nil {
+				return err
+			}
+			if v.Findings, err = access.Audit(ctx, kc, opts); err != nil {
+				return err
+			}
+			for _, f := range v.Findings {
+				klog.Warningln(f.Message)
+			}
+			if err := o.print(cmd, v); err != nil {
+				return err
+			}
+			if failed := failedChecks(v.Checks); len(failed) > 0 {
+				return fmt.Errorf("%d of %d access checks failed: %s", len(failed), len(v.Checks), strings.Join(failed, "; "))
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&serviceAccount, "service-account", "", "The service account to grant access to, in namespace/name form")
+	flags.StringVar(&name, "name", "", "The name of the Role and RoleBinding. Defaults to the name of the service account")
+	flags.BoolVar(&provision, "provision", false, "Create the service account, Role and RoleBinding before verifying the access")
+	flags.BoolVar(&dryRun, "dry-run", false, "Print the service account, Role and RoleBinding instead of creating them")
+	_ = cmd.MarkFlagRequired("service-account")
+	return cmd
+}
+
+func failedChecks(checks []access.Check) []string {
+	var failed []string
+	for _, c := range checks {
+		if !c.OK() {
+			want := "denied"
+			if c.Want {
+				want = "allowed"
+			}
+			failed = append(failed, c.String()+" should be "+want)
+		}
+	}
+	return failed
+}
+
+type accessView struct {
+	Preflight []access.Check   `json:"preflight,omitempty"`
+	Checks    []access.Check   `json:"checks,omitempty"`
+	Findings  []access.Finding `json:"findings,omitempty"`
+}
+
+func (v accessView) data() interface{} {
+	return v
+}
+
+// table lists the own access needed to provision, the access of the service
+// account and the findings.
+func (v accessView) table() ([]string, [][]string) {
+	var rows [][]string
+	checkRows := func(kind string, checks []access.Check) {
+		for _, c := range checks {
+			want, allowed := "denied", "denied"
+			if c.Want {
+				want = "allowed"
+			}
+			if c.Allowed {
+				allowed = "allowed"
+			}
+			result := "ok"
+			if !c.OK() {
+				result = "FAIL"
+			}
+			rows = append(rows, []string{kind, c.String(), want, allowed, result, c.Reason})
+		}
+	}
+	checkRows("preflight", v.Preflight)
+	checkRows("check", v.Checks)
+	for _, f := range v.Findings {
+		rows = append(rows, []string{"finding", f.Binding, "", strings.Join(f.Verbs, ","), "WARN", f.Message})
+	}
+	return []string{"kind", "permission", "want", "actual", "result", "detail"}, rows
+}
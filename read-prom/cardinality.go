@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tamalsaha/prometheus-demo/prometheus/cardinality"
+	"k8s.io/klog/v2"
+)
+
+func newCardinalityCmd(o *options) *cobra.Command {
+	var (
+		limit    int
+		ts       string
+		previous string
+		t        = cardinality.DefaultThresholds
+	)
+	cmd := &cobra.Command{
+		Use:   "cardinality",
+		Short: "Report the metrics and labels with the most series and flag offenders",
+		Long: `Report the metrics and labels with the most series and flag offenders.
+
+The statistics come from /api/v1/status/tsdb, or from a count by (__name__)
+query and the label values API if the server doesn't have it. The label with
+the most values of every reported metric is found from its series. Save a
+report with -o json and pass it to --previous to see the churn since then.
+Values over a threshold are listed as findings; set a threshold to 0 to turn
+it off.`,
+		Example: `  read-prom cardinality --service=monitoring/prometheus-operated:9090
+  read-prom cardinality --limit=20 -o json > cardinality.json
+  read-prom cardinality --previous=cardinality.json --max-churn=0.2 -o json`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := cardinality.Options{Limit: limit, Thresholds: t}
+			if ts != "" {
+				var err error
+				if opts.Time, err = parseTime(ts, time.Now()); err != nil {
+					return fmt.Errorf("invalid --time: %w", err)
+				}
+			}
+			if previous != "" {
+				prev, err := cardinality.LoadReport(previous)
+				if err != nil {
+					return err
+				}
+				opts.Previous = prev
+			}
+
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			api, err := o.api(ctx)
+			if err != nil {
+				return err
+			}
+			report, err := cardinality.Analyze(ctx, api, opts)
+			if err != nil {
+				return err
+			}
+			for _, f := range report.Findings {
+				klog.Warningln(f.Message)
+			}
+			return o.print(cmd, cardinalityView{report})
+		},
+	}
+	flags := cmd.Flags()
+	flags.IntVar(&limit, "limit", cardinality.DefaultLimit, "Number of metrics and labels to report")
+	flags.StringVar(&ts, "time", "", "Look up series and label values before this time. Defaults to now")
+	flags.StringVar(&previous, "previous", "", "JSON report of an earlier run to compute the churn against")
+	flags.Uint64Var(&t.MetricSeries, "max-metric-series", t.MetricSeries, "Flag metrics with more series")
+	flags.Uint64Var(&t.LabelValues, "max-label-values", t.LabelValues, "Flag labels with more values")
+	flags.Uint64Var(&t.HeadSeries, "max-head-series", t.HeadSeries, "Flag a server with more head series")
+	flags.Float64Var(&t.Churn, "max-churn", t.Churn, "Flag metrics whose series changed by a larger fraction since --previous")
+	return cmd
+}
+
+type cardinalityView struct {
+	*cardinality.Report
+}
+
+func (v cardinalityView) data() interface{} {
+	return v.Report
+}
+
+// table lists the server, its top metrics and its top labels, with the
+// churn of metrics if there is a previous report and the findings.
+func (v cardinalityView) table() ([]string, [][]string) {
+	flags := map[string]string{}
+	for _, f := range v.Findings {
+		flags[f.Kind+"/"+f.Name] = "over " + strconv.FormatFloat(f.Threshold, 'f', -1, 64)
+	}
+	change := map[string]string{}
+	if v.Churn != nil {
+		for _, m := range v.Churn.Metrics {
+			change[m.Name] = fmt.Sprintf("%+d", m.Delta)
+			if m.New {
+				change[m.Name] = fmt.Sprintf("new, >=%+d", m.Delta)
+			}
+		}
+	}
+
+	headChange := ""
+	if v.Churn != nil {
+		headChange = fmt.Sprintf("%+d", int64(v.Churn.HeadSeriesAfter)-int64(v.Churn.HeadSeriesBefore))
+	}
+	rows := [][]string{{
+		"server", string(v.Source), strconv.FormatUint(v.HeadSeries, 10), headChange, "",
+		formatBytes(float64(v.EstimatedMemoryBytes)), "", flags["headSeries/"],
+	}}
+	for _, m := range v.Metrics {
+		flag := flags["metricSeries/"+m.Name]
+		if churn := flags["churn/"+m.Name]; churn != "" {
+			flag = join(flag, "churn "+churn)
+		}
+		topLabel := ""
+		if m.TopLabel != "" {
+			topLabel = fmt.Sprintf("%s (%d)", m.TopLabel, m.TopLabelValues)
+		}
+		rows = append(rows, []string{
+			"metric", m.Name, strconv.FormatUint(m.Series, 10), change[m.Name], formatPercent(&m.Share),
+			formatBytes(float64(m.EstimatedMemoryBytes)), topLabel, flag,
+		})
+	}
+	for _, l := range v.Labels {
+		memory := ""
+		if l.MemoryBytes > 0 {
+			memory = formatBytes(float64(l.MemoryBytes))
+		}
+		rows = append(rows, []string{
+			"label", l.Name, strconv.FormatUint(l.Values, 10), "", "", memory, "", flags["labelValues/"+l.Name],
+		})
+	}
+	return []string{"kind", "name", "series/values", "change", "% series", "est. memory", "top label", "flag"}, rows
+}
+
+func join(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + ", " + b
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/spf13/cobra"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	"github.com/tamalsaha/prometheus-demo/prometheus/convert"
+	"github.com/tamalsaha/prometheus-demo/prometheus/cost"
+	"github.com/tamalsaha/prometheus-demo/prometheus/remotewrite"
+)
+
+func newCostCmd(o *options) *cobra.Command {
+	var (
+		start, end, month string
+		step              time.Duration
+		label, namespace  string
+		basis             string
+		pricesFile        string
+		prices            cost.PriceList
+		trickster         string
+		tricksterBackend  string
+		push              bool
+		pushPath          string
+	)
+	cmd := &cobra.Command{
+		Use:   "cost",
+		Short: "Estimate what namespaces or teams owe for CPU, memory and storage over a billing period",
+		Long: `Estimate what namespaces or teams owe for CPU, memory and storage over a billing period.
+
+CPU-core-hours, memory GiB-hours and PersistentVolumeClaim GiB-hours are
+multiplied by the prices from --prices or the price flags. A price file can
+override the CPU and memory prices for nodes with given labels:
+
+  currency: USD
+  default:
+    cpuCoreHour: 0.031
+    memoryGiBHour: 0.004
+    storageGiBHour: 0.00014
+  overrides:
+  - nodeLabels:
+      karpenter.sh/capacity-type: spot
+    cpuCoreHour: 0.011
+    memoryGiBHour: 0.0015
+
+With --trickster the range queries go through the Trickster frontend generated
+by trickster-conf, so reports for the same period are served from its cache.
+
+With --push the charges are also written back to the server with remote write,
+as chargeback_cost and chargeback_usage_hours series at the current time. Use
+--push-path=/api/v1/push for Mimir and Cortex.`,
+		Example: `  read-prom cost --month=2026-09 --prices=prices.yaml
+  read-prom cost --start=-168h --label=team --cpu-price=0.03 --memory-price=0.004 -o csv
+  read-prom cost --month=2026-09 --prices=prices.yaml --trickster=http://localhost:9090
+  read-prom cost --month=2026-09 --prices=prices.yaml --push --prometheus.tenant-id=billing`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			s, e, err := billingPeriod(start, end, month)
+			if err != nil {
+				return err
+			}
+			pl := &prices
+			if pricesFile != "" {
+				if pl, err = cost.LoadPriceList(pricesFile); err != nil {
+					return err
+				}
+				// flags take precedence over the file
+				flags := cmd.Flags()
+				if flags.Changed("cpu-price") {
+					pl.Default.CPUCoreHour = prices.Default.CPUCoreHour
+				}
+				if flags.Changed("memory-price") {
+					pl.Default.MemoryGiBHour = prices.Default.MemoryGiBHour
+				}
+				if flags.Changed("storage-price") {
+					pl.Default.StorageGiBHour = prices.Default.StorageGiBHour
+				}
+				if flags.Changed("currency") {
+					pl.Currency = prices.Currency
+				}
+			}
+
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			var api promv1.API
+			if trickster != "" {
+				api, err = o.newAPI(o.withClientSettings(convert.ToTricksterFrontend(trickster, tricksterBackend)))
+			} else {
+				api, err = o.api(ctx)
+			}
+			if err != nil {
+				return err
+			}
+			report, err := cost.NewReport(ctx, api, pl, cost.Options{
+				Start:     s,
+				End:       e,
+				Step:      step,
+				Label:     label,
+				Namespace: namespace,
+				Basis:     cost.Basis(basis),
+			})
+			if err != nil {
+				return err
+			}
+			if err := o.print(cmd, costView{report}); err != nil {
+				return err
+			}
+			if push {
+				return o.pushCost(ctx, report, pushPath)
+			}
+			return nil
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&start, "start", "-720h", "Start of the billing period as RFC3339, unix seconds or relative to now")
+	flags.StringVar(&end, "end", "now", "End of the billing period as RFC3339, unix seconds or relative to now")
+	flags.StringVar(&month, "month", "", "Bill a calendar month in UTC, like 2026-09. Replaces --start and --end")
+	flags.DurationVar(&step, "step", cost.DefaultStep, "Resolution of the report")
+	flags.StringVar(&label, "label", "", "Group charges by this pod and PersistentVolumeClaim label instead of by namespace")
+	flags.StringVarP(&namespace, "namespace", "n", "", "Only bill this namespace")
+	flags.StringVar(&basis, "basis", string(cost.BasisMax), "Charge CPU and memory by max(usage, requests), usage or requests")
+	flags.StringVar(&pricesFile, "prices", "", "YAML file with the price list")
+	flags.Float64Var(&prices.Default.CPUCoreHour, "cpu-price", 0, "Price of one CPU core for an hour")
+	flags.Float64Var(&prices.Default.MemoryGiBHour, "memory-price", 0, "Price of one GiB of memory for an hour")
+	flags.Float64Var(&prices.Default.StorageGiBHour, "storage-price", 0, "Price of one GiB of PersistentVolumeClaim storage for an hour")
+	flags.StringVar(&prices.Currency, "currency", "", "Currency of the prices, only used for display")
+	flags.StringVar(&trickster, "trickster", "", "Send the range queries through this Trickster frontend, like http://localhost:9090")
+	flags.StringVar(&tricksterBackend, "trickster-backend", convert.TricksterBackendName, "Name of the Prometheus backend in the Trickster config")
+	flags.BoolVar(&push, "push", false, "Write the charges back to the server with remote write")
+	flags.StringVar(&pushPath, "push-path", remotewrite.PathPrometheus, "Path of the remote write endpoint")
+	return cmd
+}
+
+// pushCost writes the report to the remote write endpoint of the server
+// that read-prom is connected to.
+func (o *options) pushCost(ctx context.Context, report *cost.Report, path string) error {
+	pc, err := o.config(ctx)
+	if err != nil {
+		return err
+	}
+	if !pc.IsSet() {
+		return fmt.Errorf("one of --%s.address, --%s.service, --service or --appbinding is required", prometheus.DefaultFlagPrefix, prometheus.DefaultFlagPrefix)
+	}
+	// the queue retries on its own
+	rc := *pc
+	rc.MaxRetries = 0
+	client, err := remotewrite.NewClient(&rc, path)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	q := remotewrite.NewQueue(client, remotewrite.QueueConfig{})
+	app := q.Appender()
+	if err := report.Append(app, time.Now()); err != nil {
+		_ = app.Rollback()
+		_ = q.Close(ctx)
+		return err
+	}
+	if err := app.Commit(); err != nil {
+		return err
+	}
+	if err := q.Close(ctx); err != nil {
+		return err
+	}
+	if stats := q.Stats(); stats.Failed > 0 {
+		return fmt.Errorf("failed to push %d of %d samples", stats.Failed, stats.Failed+stats.Sent)
+	}
+	return nil
+}
+
+// billingPeriod returns the calendar month if set, otherwise start and end.
+func billingPeriod(start, end, month string) (time.Time, time.Time, error) {
+	if month != "" {
+		m, err := time.Parse("2006-01", month)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid --month: %w", err)
+		}
+		return m, m.AddDate(0, 1, 0), nil
+	}
+	now := time.Now()
+	s, err := parseTime(start, now)
+	if err != nil {
+		return s, s, fmt.Errorf("invalid --start: %w", err)
+	}
+	e, err := parseTime(end, now)
+	if err != nil {
+		return s, e, fmt.Errorf("invalid --end: %w", err)
+	}
+	return s, e, nil
+}
+
+type costView struct {
+	*cost.Report
+}
+
+func (v costView) data() interface{} {
+	return v.Report
+}
+
+func (v costView) table() ([]string, [][]string) {
+	group := "namespace"
+	if v.Label != "" {
+		group = v.Label
+	}
+	currency := ""
+	if v.Currency != "" {
+		currency = " (" + v.Currency + ")"
+	}
+	header := []string{
+		group,
+		"cpu core-hours", "memory GiB-hours", "storage GiB-hours",
+		"cpu cost" + currency, "memory cost" + currency, "storage cost" + currency, "total" + currency,
+	}
+	rows := make([][]string, 0, len(v.Items)+1)
+	for _, c := range v.Items {
+		name := c.Group
+		if name == "" {
+			name = "<none>"
+		}
+		rows = append(rows, chargeRow(name, c))
+	}
+	rows = append(rows, chargeRow("TOTAL", v.Total))
+	return header, rows
+}
+
+func chargeRow(name string, c cost.Charge) []string {
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	return []string{
+		name,
+		f(c.CPUCoreHours), f(c.MemoryGiBHours), f(c.StorageGiBHours),
+		f(c.CPUCost), f(c.MemoryCost), f(c.StorageCost), f(c.TotalCost),
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tamalsaha/prometheus-demo/prometheus/discovery"
+)
+
+func newDiscoverCmd(o *options) *cobra.Command {
+	var (
+		namespaces []string
+		kinds      []string
+	)
+	cmd := &cobra.Command{
+		Use:   "discover",
+		Short: "List the Prometheus compatible services of the current cluster, best first",
+		Long: `List the Prometheus compatible services of the current cluster, best first.
+
+Services are recognized by the labels and names used by kube-prometheus-stack,
+rancher-monitoring, OpenShift monitoring, the prometheus-community chart and
+Thanos, and by selecting the pods of a prometheus-operator Prometheus or
+ThanosRuler. Thanos queriers rank above Prometheus servers, which rank above
+Thanos rulers. The first service is used by --service=auto.`,
+		Example: `  read-prom discover
+  read-prom discover -n monitoring --kind=prometheus -o json`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts := discovery.Options{Namespaces: namespaces}
+			for _, k := range kinds {
+				opts.Kinds = append(opts.Kinds, discovery.Kind(k))
+			}
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			kc, err := o.kubeClient()
+			if err != nil {
+				return err
+			}
+			candidates, err := discovery.Discover(ctx, kc, opts)
+			if err != nil {
+				return err
+			}
+			if candidates == nil {
+				candidates = []discovery.Candidate{}
+			}
+			return o.print(cmd, discoverView(candidates))
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringSliceVarP(&namespaces, "namespace", "n", nil, "Only search these namespaces")
+	flags.StringSliceVar(&kinds, "kind", nil, "Only list these kinds: prometheus, thanos-querier or thanos-ruler")
+	return cmd
+}
+
+type discoverView []discovery.Candidate
+
+func (v discoverView) data() interface{} {
+	return []discovery.Candidate(v)
+}
+
+func (v discoverView) table() ([]string, [][]string) {
+	rows := make([][]string, 0, len(v))
+	for _, c := range v {
+		rows = append(rows, []string{
+			c.Service.String(), string(c.Kind), string(c.Distribution), c.Owner,
+			strconv.Itoa(c.Score), strings.Join(c.Reasons, "; "),
+		})
+	}
+	return []string{"service", "kind", "distribution", "owner", "score", "reasons"}, rows
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tamalsaha/prometheus-demo/prometheus/fanout"
+	"k8s.io/klog/v2"
+)
+
+func addClustersFlag(cmd *cobra.Command, clusters *string) {
+	cmd.Flags().StringVar(clusters, "clusters", "", "Run the query on every cluster in this YAML file of cluster names to Prometheus configs, adding a cluster label")
+}
+
+// fanout runs a query on the clusters in filename and prints the merged
+// result. Clusters that fail are logged, and the command only fails if all
+// of them do.
+func (o *options) fanout(cmd *cobra.Command, filename string, run func(e *fanout.Executor) (*fanout.Response, error)) error {
+	configs, err := fanout.LoadFile(filename)
+	if err != nil {
+		return err
+	}
+	for name, pc := range configs {
+		o.withClientSettings(pc)
+		if o.changed("record-file") {
+			pc.RecordFile = clusterFile(o.prom.RecordFile, name)
+		}
+		if o.changed("replay-file") {
+			pc.ReplayFile = clusterFile(o.prom.ReplayFile, name)
+		}
+	}
+	e, err := fanout.New(configs)
+	if err != nil {
+		return err
+	}
+	defer e.Close()
+	resp, err := run(e)
+	if err != nil {
+		return err
+	}
+	for _, s := range resp.Failed() {
+		klog.Errorf("cluster %s failed: %v", s.Cluster, s.Err())
+	}
+	warn(resp.Result.Warnings)
+	return o.print(cmd, fanoutView{resultView{resp.Result}, resp})
+}
+
+// clusterFile returns the record or replay file of a cluster, like
+// requests.prod.jsonl for requests.jsonl, so that the clusters don't share
+// one file.
+func clusterFile(filename, cluster string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "." + cluster + ext
+}
+
+// fanoutView prints the merged result, and as JSON also the status of
+// every cluster.
+type fanoutView struct {
+	resultView
+	resp *fanout.Response
+}
+
+func (v fanoutView) data() interface{} {
+	return v.resp
+}
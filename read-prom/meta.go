@@ -0,0 +1,404 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/spf13/cobra"
+)
+
+type timeRange struct {
+	start, end string
+}
+
+func (r *timeRange) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&r.start, "start", "", "Only consider data after this time, as RFC3339, unix seconds or relative to now like -1h")
+	cmd.Flags().StringVar(&r.end, "end", "", "Only consider data before this time")
+}
+
+// parse returns zero times for unset flags, which the API leaves out.
+func (r *timeRange) parse() (time.Time, time.Time, error) {
+	now := time.Now()
+	var start, end time.Time
+	var err error
+	if r.start != "" {
+		if start, err = parseTime(r.start, now); err != nil {
+			return start, end, fmt.Errorf("invalid --start: %w", err)
+		}
+	}
+	if r.end != "" {
+		if end, err = parseTime(r.end, now); err != nil {
+			return start, end, fmt.Errorf("invalid --end: %w", err)
+		}
+	}
+	return start, end, nil
+}
+
+func newSeriesCmd(o *options) *cobra.Command {
+	var tr timeRange
+	cmd := &cobra.Command{
+		Use:   "series <match>...",
+		Short: "List the series matching one or more series selectors",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			start, end, err := tr.parse()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			api, err := o.api(ctx)
+			if err != nil {
+				return err
+			}
+			series, warnings, err := api.Series(ctx, args, start, end)
+			if err != nil {
+				return err
+			}
+			warn(warnings)
+			return o.print(cmd, seriesView(series))
+		},
+	}
+	tr.addFlags(cmd)
+	return cmd
+}
+
+func newLabelsCmd(o *options) *cobra.Command {
+	var tr timeRange
+	var matches []string
+	cmd := &cobra.Command{
+		Use:   "labels [name]",
+		Short: "List label names, or the values of a label",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			start, end, err := tr.parse()
+			if err != nil {
+				return err
+			}
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			api, err := o.api(ctx)
+			if err != nil {
+				return err
+			}
+
+			if len(args) == 0 {
+				names, warnings, err := api.LabelNames(ctx, matches, start, end)
+				if err != nil {
+					return err
+				}
+				warn(warnings)
+				return o.print(cmd, listView{column: "name", items: names})
+			}
+			values, warnings, err := api.LabelValues(ctx, args[0], matches, start, end)
+			if err != nil {
+				return err
+			}
+			warn(warnings)
+			items := make([]string, 0, len(values))
+			for _, v := range values {
+				items = append(items, string(v))
+			}
+			return o.print(cmd, listView{column: "value", items: items})
+		},
+	}
+	tr.addFlags(cmd)
+	cmd.Flags().StringArrayVar(&matches, "match", nil, "Only consider series matching this selector. Can be repeated")
+	return cmd
+}
+
+func newTargetsCmd(o *options) *cobra.Command {
+	var state string
+	cmd := &cobra.Command{
+		Use:   "targets",
+		Short: "List the scrape targets",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if state != "active" && state != "dropped" && state != "any" {
+				return fmt.Errorf("--state must be one of active, dropped or any")
+			}
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			api, err := o.api(ctx)
+			if err != nil {
+				return err
+			}
+			targets, err := api.Targets(ctx)
+			if err != nil {
+				return err
+			}
+			if state == "active" {
+				targets.Dropped = nil
+			} else if state == "dropped" {
+				targets.Active = nil
+			}
+			return o.print(cmd, targetsView(targets))
+		},
+	}
+	cmd.Flags().StringVar(&state, "state", "active", "Target state. One of: active, dropped, any")
+	return cmd
+}
+
+func newRulesCmd(o *options) *cobra.Command {
+	var ruleType string
+	cmd := &cobra.Command{
+		Use:   "rules",
+		Short: "List the alerting and recording rules",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if ruleType != "" && ruleType != "alert" && ruleType != "record" {
+				return fmt.Errorf("--type must be alert or record")
+			}
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			api, err := o.api(ctx)
+			if err != nil {
+				return err
+			}
+			rules, err := api.Rules(ctx)
+			if err != nil {
+				return err
+			}
+			for i, g := range rules.Groups {
+				kept := g.Rules[:0]
+				for _, r := range g.Rules {
+					_, alerting := r.(promv1.AlertingRule)
+					if ruleType == "" || (ruleType == "alert") == alerting {
+						kept = append(kept, r)
+					}
+				}
+				rules.Groups[i].Rules = kept
+			}
+			return o.print(cmd, rulesView(rules))
+		},
+	}
+	cmd.Flags().StringVar(&ruleType, "type", "", "Only list rules of this type. One of: alert, record")
+	return cmd
+}
+
+func newAlertsCmd(o *options) *cobra.Command {
+	return &cobra.Command{
+		Use:   "alerts",
+		Short: "List the active alerts",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			api, err := o.api(ctx)
+			if err != nil {
+				return err
+			}
+			alerts, err := api.Alerts(ctx)
+			if err != nil {
+				return err
+			}
+			return o.print(cmd, alertsView(alerts))
+		},
+	}
+}
+
+func newMetadataCmd(o *options) *cobra.Command {
+	var limit int
+	cmd := &cobra.Command{
+		Use:   "metadata [metric]",
+		Short: "List the type, help and unit of metrics",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var metric, lim string
+			if len(args) > 0 {
+				metric = args[0]
+			}
+			if limit > 0 {
+				lim = strconv.Itoa(limit)
+			}
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			api, err := o.api(ctx)
+			if err != nil {
+				return err
+			}
+			md, err := api.Metadata(ctx, metric, lim)
+			if err != nil {
+				return err
+			}
+			return o.print(cmd, metadataView(md))
+		},
+	}
+	cmd.Flags().IntVar(&limit, "limit", 0, "Maximum number of metrics to return")
+	return cmd
+}
+
+type seriesView []model.LabelSet
+
+func (v seriesView) data() interface{} {
+	return []model.LabelSet(v)
+}
+
+func (v seriesView) table() ([]string, [][]string) {
+	sets := make([]map[string]string, len(v))
+	for i, ls := range v {
+		m := make(map[string]string, len(ls))
+		for k, val := range ls {
+			m[string(k)] = string(val)
+		}
+		sets[i] = m
+	}
+	columns := labelColumns(sets...)
+	rows := make([][]string, len(sets))
+	for i, set := range sets {
+		rows[i] = labelValues(columns, set)
+	}
+	return columns, rows
+}
+
+type listView struct {
+	column string
+	items  []string
+}
+
+func (v listView) data() interface{} {
+	return v.items
+}
+
+func (v listView) table() ([]string, [][]string) {
+	rows := make([][]string, len(v.items))
+	for i, item := range v.items {
+		rows[i] = []string{item}
+	}
+	return []string{v.column}, rows
+}
+
+type targetsView promv1.TargetsResult
+
+func (v targetsView) data() interface{} {
+	return promv1.TargetsResult(v)
+}
+
+func (v targetsView) table() ([]string, [][]string) {
+	var rows [][]string
+	for _, t := range v.Active {
+		rows = append(rows, []string{
+			t.ScrapePool,
+			t.ScrapeURL,
+			string(t.Health),
+			formatTime(t.LastScrape),
+			formatSeconds(t.LastScrapeDuration),
+			t.LastError,
+		})
+	}
+	for _, t := range v.Dropped {
+		rows = append(rows, []string{
+			t.DiscoveredLabels["job"],
+			t.DiscoveredLabels[model.SchemeLabel] + "://" + t.DiscoveredLabels[model.AddressLabel] + t.DiscoveredLabels[model.MetricsPathLabel],
+			"dropped",
+			"",
+			"",
+			"",
+		})
+	}
+	return []string{"pool", "url", "health", "last scrape", "duration", "error"}, rows
+}
+
+type rulesView promv1.RulesResult
+
+func (v rulesView) data() interface{} {
+	return promv1.RulesResult(v)
+}
+
+func (v rulesView) table() ([]string, [][]string) {
+	var rows [][]string
+	for _, g := range v.Groups {
+		for _, r := range g.Rules {
+			switch r := r.(type) {
+			case promv1.AlertingRule:
+				rows = append(rows, []string{g.Name, r.Name, "alert", string(r.Health), r.State, oneLine(r.Query), r.LastError})
+			case promv1.RecordingRule:
+				rows = append(rows, []string{g.Name, r.Name, "record", string(r.Health), "", oneLine(r.Query), r.LastError})
+			}
+		}
+	}
+	return []string{"group", "name", "type", "health", "state", "query", "error"}, rows
+}
+
+type alertsView promv1.AlertsResult
+
+func (v alertsView) data() interface{} {
+	return promv1.AlertsResult(v)
+}
+
+func (v alertsView) table() ([]string, [][]string) {
+	rows := make([][]string, 0, len(v.Alerts))
+	for _, a := range v.Alerts {
+		labels := a.Labels.Clone()
+		delete(labels, model.AlertNameLabel)
+		rows = append(rows, []string{
+			string(a.Labels[model.AlertNameLabel]),
+			string(a.State),
+			formatTime(a.ActiveAt),
+			a.Value,
+			labels.String(),
+		})
+	}
+	return []string{"name", "state", "active since", "value", "labels"}, rows
+}
+
+type metadataView map[string][]promv1.Metadata
+
+func (v metadataView) data() interface{} {
+	return map[string][]promv1.Metadata(v)
+}
+
+func (v metadataView) names() []string {
+	names := make([]string, 0, len(v))
+	for k := range v {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (v metadataView) table() ([]string, [][]string) {
+	var rows [][]string
+	for _, name := range v.names() {
+		for _, md := range v[name] {
+			rows = append(rows, []string{name, string(md.Type), md.Unit, md.Help})
+		}
+	}
+	return []string{"metric", "type", "unit", "help"}, rows
+}
+
+func (v metadataView) writeOpenMetrics(w io.Writer) error {
+	var sb strings.Builder
+	for _, name := range v.names() {
+		if len(v[name]) == 0 {
+			continue
+		}
+		// a metric exposed by several targets may have conflicting metadata,
+		// OpenMetrics only allows one
+		md := v[name][0]
+		fmt.Fprintf(&sb, "# TYPE %s %s\n", name, md.Type)
+		if md.Unit != "" {
+			fmt.Fprintf(&sb, "# UNIT %s %s\n", name, md.Unit)
+		}
+		if md.Help != "" {
+			fmt.Fprintf(&sb, "# HELP %s %s\n", name, escaper.Replace(md.Help))
+		}
+	}
+	sb.WriteString("# EOF\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func formatSeconds(s float64) string {
+	return time.Duration(s * float64(time.Second)).Round(time.Microsecond).String()
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	"github.com/tamalsaha/prometheus-demo/prometheus/promtest"
+	"github.com/tamalsaha/prometheus-demo/prometheus/remotewrite"
+)
+
+func readCSV(t *testing.T, out []byte) [][]string {
+	t.Helper()
+	rows, err := csv.NewReader(bytes.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid output %s: %v", out, err)
+	}
+	return rows
+}
+
+func TestSeries(t *testing.T) {
+	srv := promtest.NewServer(promtest.Synthetic())
+	defer srv.Close()
+
+	out := run(t, "series", `up{job="node-exporter"}`, `prometheus_build_info`, "--prometheus.address="+srv.URL, "-o", "json")
+	var series []model.LabelSet
+	if err := json.Unmarshal(out, &series); err != nil {
+		t.Fatalf("invalid output %s: %v", out, err)
+	}
+	var got []string
+	for _, ls := range series {
+		got = append(got, string(ls[model.MetricNameLabel])+"/"+string(ls[model.InstanceLabel]))
+	}
+	sort.Strings(got)
+	want := []string{"prometheus_build_info/localhost:9090", "up/node-1:9100", "up/node-2:9100"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("series = %v, want %v", got, want)
+	}
+}
+
+func TestLabels(t *testing.T) {
+	srv := promtest.NewServer(promtest.Synthetic())
+	defer srv.Close()
+
+	out := run(t, "labels", "--match=up", "--prometheus.address="+srv.URL, "-o", "json")
+	var names []string
+	if err := json.Unmarshal(out, &names); err != nil {
+		t.Fatalf("invalid output %s: %v", out, err)
+	}
+	if want := []string{"__name__", "instance", "job"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("label names = %v, want %v", names, want)
+	}
+
+	rows := readCSV(t, run(t, "labels", "job", `--match=up`, "--prometheus.address="+srv.URL, "-o", "csv"))
+	if want := [][]string{{"value"}, {"node-exporter"}, {"prometheus"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("label values = %v, want %v", rows, want)
+	}
+}
+
+func TestTargets(t *testing.T) {
+	srv := promtest.NewServer(promtest.Synthetic())
+	defer srv.Close()
+
+	out := run(t, "targets", "--prometheus.address="+srv.URL, "-o", "json")
+	var targets promv1.TargetsResult
+	if err := json.Unmarshal(out, &targets); err != nil {
+		t.Fatalf("invalid output %s: %v", out, err)
+	}
+	got := map[string]promv1.HealthStatus{}
+	for _, target := range targets.Active {
+		got[target.ScrapeURL] = target.Health
+	}
+	want := map[string]promv1.HealthStatus{
+		"http://localhost:9090/metrics": promv1.HealthGood,
+		"http://node-1:9100/metrics":    promv1.HealthGood,
+		"http://node-2:9100/metrics":    promv1.HealthBad,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("targets = %v, want %v", got, want)
+	}
+
+	rows := readCSV(t, run(t, "targets", "--state=dropped", "--prometheus.address="+srv.URL, "-o", "csv"))
+	if len(rows) != 1 {
+		t.Errorf("dropped targets = %v, want only the header", rows)
+	}
+}
+
+// withRules serves an alerting rule that fires for node-2 and a recording
+// rule.
+func withRules(srv *promtest.Server) {
+	srv.Rules = []promtest.RuleGroup{{
+		Name:     "node",
+		File:     "/etc/prometheus/rules/node.yaml",
+		Interval: 30,
+		Rules: []promtest.Rule{
+			{
+				Type:     "alerting",
+				Name:     "TargetDown",
+				Query:    "up == 0",
+				Duration: 300,
+				State:    "firing",
+				Alerts: []interface{}{map[string]interface{}{
+					"labels":      map[string]string{"alertname": "TargetDown", "instance": "node-2:9100", "job": "node-exporter"},
+					"annotations": map[string]string{"summary": "node-2 is down"},
+					"state":       "firing",
+					"activeAt":    "2024-01-01T00:10:00Z",
+					"value":       "0e+00",
+				}},
+			},
+			{
+				Type:  "recording",
+				Name:  "job:up:sum",
+				Query: "sum by (job) (\n  up\n)",
+			},
+		},
+	}}
+}
+
+func TestRules(t *testing.T) {
+	srv := promtest.NewServer(promtest.Synthetic())
+	defer srv.Close()
+	withRules(srv)
+
+	tests := []struct {
+		typ  string
+		want [][]string
+	}{
+		{
+			want: [][]string{
+				{"node", "TargetDown", "alert", "ok", "firing", "up == 0", ""},
+				{"node", "job:up:sum", "record", "ok", "", "sum by (job) ( up )", ""},
+			},
+		},
+		{
+			typ:  "alert",
+			want: [][]string{{"node", "TargetDown", "alert", "ok", "firing", "up == 0", ""}},
+		},
+		{
+			typ:  "record",
+			want: [][]string{{"node", "job:up:sum", "record", "ok", "", "sum by (job) ( up )", ""}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ, func(t *testing.T) {
+			rows := readCSV(t, run(t, "rules", "--type="+tt.typ, "--prometheus.address="+srv.URL, "-o", "csv"))
+			if !reflect.DeepEqual(rows[1:], tt.want) {
+				t.Errorf("rules = %v, want %v", rows[1:], tt.want)
+			}
+		})
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	srv := promtest.NewServer(promtest.Synthetic())
+	defer srv.Close()
+	withRules(srv)
+
+	rows := readCSV(t, run(t, "alerts", "--prometheus.address="+srv.URL, "-o", "csv"))
+	want := [][]string{
+		{"name", "state", "active since", "value", "labels"},
+		{"TargetDown", "firing", "2024-01-01T00:10:00Z", "0e+00", `{instance="node-2:9100", job="node-exporter"}`},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("alerts = %v, want %v", rows, want)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	srv := promtest.NewServer(promtest.Synthetic())
+	defer srv.Close()
+
+	// promtest serves the metadata it receives by remote write
+	c, err := remotewrite.NewClient(srv.PrometheusConfig(), remotewrite.PathPrometheus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Store(context.Background(), &remotewrite.WriteRequest{Metadata: []remotewrite.MetricMetadata{
+		{MetricFamilyName: "http_requests_total", Metadata: remotewrite.Metadata{Type: remotewrite.MetricTypeCounter, Help: "Requests by code.\nAll methods."}},
+		{MetricFamilyName: "process_resident_memory_bytes", Metadata: remotewrite.Metadata{Type: remotewrite.MetricTypeGauge, Help: "Resident memory.", Unit: "bytes"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := readCSV(t, run(t, "metadata", "--prometheus.address="+srv.URL, "-o", "csv"))
+	want := [][]string{
+		{"metric", "type", "unit", "help"},
+		{"http_requests_total", "counter", "", "Requests by code.\nAll methods."},
+		{"process_resident_memory_bytes", "gauge", "bytes", "Resident memory."},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("metadata = %q, want %q", rows, want)
+	}
+
+	out := run(t, "metadata", "http_requests_total", "--prometheus.address="+srv.URL, "-o", "openmetrics")
+	wantOut := "# TYPE http_requests_total counter\n# HELP http_requests_total Requests by code.\\nAll methods.\n# EOF\n"
+	if string(out) != wantOut {
+		t.Errorf("metadata = %q, want %q", out, wantOut)
+	}
+}
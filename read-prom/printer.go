@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/tamalsaha/prometheus-demo/prometheus/query"
+)
+
+const (
+	outputTable       = "table"
+	outputJSON        = "json"
+	outputCSV         = "csv"
+	outputOpenMetrics = "openmetrics"
+)
+
+// view is the result of a command in a printable form. data is printed as
+// JSON and table as a table or CSV.
+type view interface {
+	data() interface{}
+	table() (header []string, rows [][]string)
+}
+
+// openMetricsView is implemented by views that can be written in the
+// OpenMetrics text format.
+type openMetricsView interface {
+	writeOpenMetrics(w io.Writer) error
+}
+
+func printView(w io.Writer, format string, v view) error {
+	switch format {
+	case outputTable, "":
+		header, rows := v.table()
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.ToUpper(strings.Join(header, "\t")))
+		for _, row := range rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	case outputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v.data())
+	case outputCSV:
+		header, rows := v.table()
+		cw := csv.NewWriter(w)
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+		if err := cw.WriteAll(rows); err != nil {
+			return err
+		}
+		return cw.Error()
+	case outputOpenMetrics:
+		om, ok := v.(openMetricsView)
+		if !ok {
+			return errors.New("this command does not support the openmetrics output format")
+		}
+		return om.writeOpenMetrics(w)
+	}
+	return fmt.Errorf("unknown output format %q, must be one of table, json, csv or openmetrics", format)
+}
+
+// labelColumns returns the sorted union of label names, with the metric
+// name first.
+func labelColumns(sets ...map[string]string) []string {
+	seen := map[string]bool{}
+	var names []string
+	hasName := false
+	for _, set := range sets {
+		for k := range set {
+			if k == model.MetricNameLabel {
+				hasName = true
+				continue
+			}
+			if !seen[k] {
+				seen[k] = true
+				names = append(names, k)
+			}
+		}
+	}
+	sort.Strings(names)
+	if hasName {
+		names = append([]string{model.MetricNameLabel}, names...)
+	}
+	return names
+}
+
+func labelValues(columns []string, labels map[string]string) []string {
+	out := make([]string, len(columns))
+	for i, c := range columns {
+		out[i] = labels[c]
+	}
+	return out
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// formatFloat formats v the way the Prometheus text formats do.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type resultView struct {
+	*query.Result
+}
+
+func (v resultView) data() interface{} {
+	return v.Result
+}
+
+func (v resultView) table() ([]string, [][]string) {
+	if v.Type == model.ValString {
+		return []string{"value"}, [][]string{{v.String}}
+	}
+
+	sets := make([]map[string]string, 0, len(v.Samples)+len(v.Series))
+	for _, s := range v.Samples {
+		sets = append(sets, s.Labels)
+	}
+	for _, s := range v.Series {
+		sets = append(sets, s.Labels)
+	}
+	columns := labelColumns(sets...)
+	header := append(append([]string{}, columns...), "timestamp", "value")
+
+	var rows [][]string
+	for _, s := range v.Samples {
+		rows = append(rows, append(labelValues(columns, s.Labels), formatTime(s.Timestamp), sampleValue(s.Value, s.Histogram)))
+	}
+	for _, s := range v.Series {
+		lv := labelValues(columns, s.Labels)
+		for _, p := range s.Points {
+			rows = append(rows, append(append([]string{}, lv...), formatTime(p.Timestamp), sampleValue(p.Value, p.Histogram)))
+		}
+	}
+	return header, rows
+}
+
+func sampleValue(v float64, h *model.SampleHistogram) string {
+	if h != nil {
+		return h.String()
+	}
+	return formatFloat(v)
+}
+
+// writeOpenMetrics writes the samples grouped into metric families of
+// unknown type. Native histograms are written as their _count and _sum.
+// ref: https://github.com/OpenObservability/OpenMetrics/blob/main/specification/OpenMetrics.md
+func (v resultView) writeOpenMetrics(w io.Writer) error {
+	type line struct {
+		name   string
+		labels map[string]string
+		ts     time.Time
+		value  float64
+	}
+	var lines []line
+	add := func(labels map[string]string, ts time.Time, value float64, h *model.SampleHistogram) error {
+		name := labels[model.MetricNameLabel]
+		if name == "" {
+			return errors.New("series without a metric name can't be written as openmetrics, set one with label_replace(<expr>, \"__name__\", \"<name>\", \"\", \"\")")
+		}
+		if h != nil {
+			lines = append(lines,
+				line{name + "_count", labels, ts, float64(h.Count)},
+				line{name + "_sum", labels, ts, float64(h.Sum)})
+			return nil
+		}
+		lines = append(lines, line{name, labels, ts, value})
+		return nil
+	}
+	for _, s := range v.Samples {
+		if err := add(s.Labels, s.Timestamp, s.Value, s.Histogram); err != nil {
+			return err
+		}
+	}
+	for _, s := range v.Series {
+		for _, p := range s.Points {
+			if err := add(s.Labels, p.Timestamp, p.Value, p.Histogram); err != nil {
+				return err
+			}
+		}
+	}
+	// all lines of a metric family must be next to each other
+	sort.SliceStable(lines, func(i, j int) bool {
+		return lines[i].name < lines[j].name
+	})
+
+	var sb strings.Builder
+	family := ""
+	for _, l := range lines {
+		if l.name != family {
+			family = l.name
+			fmt.Fprintf(&sb, "# TYPE %s unknown\n", family)
+		}
+		sb.WriteString(l.name)
+		writeOpenMetricsLabels(&sb, l.labels)
+		fmt.Fprintf(&sb, " %s %s\n", formatFloat(l.value), strconv.FormatFloat(float64(l.ts.UnixMilli())/1000, 'f', -1, 64))
+	}
+	sb.WriteString("# EOF\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func writeOpenMetricsLabels(sb *strings.Builder, labels map[string]string) {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		if k != model.MetricNameLabel {
+			names = append(names, k)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+	sb.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteString(`="`)
+		sb.WriteString(escaper.Replace(labels[k]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
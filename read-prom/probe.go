@@ -0,0 +1,71 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+)
+
+func newProbeCmd(o *options) *cobra.Command {
+	return &cobra.Command{
+		Use:   "probe",
+		Short: "Check the connection to Prometheus and detect the backend",
+		Long: `Check the connection to Prometheus and detect the backend.
+
+The buildinfo API is requested to check that the endpoint is reachable and
+accepts the credentials. Then the flavor of the backend, Prometheus, Thanos,
+Mimir or VictoriaMetrics, and the optional APIs it serves are detected. The
+command fails with a hint on how to fix the configuration if the endpoint is
+not reachable, rejects the credentials or answers with an error.`,
+		Example: `  read-prom probe --prometheus.address=http://localhost:9090
+  read-prom probe --service=monitoring/prometheus-operated:9090 -o json`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			pc, err := o.config(ctx)
+			if err != nil {
+				return err
+			}
+			if err := pc.Validate(); err != nil {
+				return err
+			}
+			result, err := pc.Probe(ctx)
+			if result != nil {
+				if err := o.print(cmd, probeView{result}); err != nil {
+					return err
+				}
+			}
+			return err
+		},
+	}
+}
+
+type probeView struct {
+	*prometheus.ProbeResult
+}
+
+func (v probeView) data() interface{} {
+	return v.ProbeResult
+}
+
+func (v probeView) table() ([]string, [][]string) {
+	apis := make([]string, 0, len(v.APIs))
+	for name, ok := range v.APIs {
+		if ok {
+			apis = append(apis, name)
+		}
+	}
+	sort.Strings(apis)
+	status := ""
+	if v.StatusCode != 0 {
+		status = strconv.Itoa(v.StatusCode)
+	}
+	return []string{"reachable", "authorized", "status", "flavor", "version", "service proxy", "apis"}, [][]string{{
+		strconv.FormatBool(v.Reachable), strconv.FormatBool(v.Authorized), status, string(v.Flavor), v.Version,
+		strconv.FormatBool(v.ServiceProxy), strings.Join(apis, ","),
+	}}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/spf13/cobra"
+	"github.com/tamalsaha/prometheus-demo/prometheus/fanout"
+	"github.com/tamalsaha/prometheus-demo/prometheus/query"
+	"k8s.io/klog/v2"
+)
+
+// maxPoints keeps the default step of a range query below the 11,000 points
+// per series limit of Prometheus with room to spare.
+const maxPoints = 250
+
+func newQueryCmd(o *options) *cobra.Command {
+	var ts, clusters string
+	cmd := &cobra.Command{
+		Use:   "query <expr>",
+		Short: "Evaluate an instant query",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			now := time.Now()
+			t, err := parseTime(ts, now)
+			if err != nil {
+				return fmt.Errorf("invalid --time: %w", err)
+			}
+
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			if clusters != "" {
+				return o.fanout(cmd, clusters, func(e *fanout.Executor) (*fanout.Response, error) {
+					return e.Query(ctx, args[0], t)
+				})
+			}
+			api, err := o.api(ctx)
+			if err != nil {
+				return err
+			}
+			res, err := query.New(api).Query(ctx, args[0], t)
+			if err != nil {
+				return err
+			}
+			warn(res.Warnings)
+			return o.print(cmd, resultView{res})
+		},
+	}
+	cmd.Flags().StringVar(&ts, "time", "now", "Evaluation time as RFC3339, unix seconds or relative to now like -5m")
+	addClustersFlag(cmd, &clusters)
+	return cmd
+}
+
+func newRangeCmd(o *options) *cobra.Command {
+	var start, end, clusters string
+	var step time.Duration
+	cmd := &cobra.Command{
+		Use:   "range <expr>",
+		Short: "Evaluate a range query",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			r, err := parseRange(start, end, step)
+			if err != nil {
+				return err
+			}
+
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			if clusters != "" {
+				return o.fanout(cmd, clusters, func(e *fanout.Executor) (*fanout.Response, error) {
+					return e.QueryRange(ctx, args[0], r)
+				})
+			}
+			api, err := o.api(ctx)
+			if err != nil {
+				return err
+			}
+			res, err := query.New(api).QueryRange(ctx, args[0], r)
+			if err != nil {
+				return err
+			}
+			warn(res.Warnings)
+			return o.print(cmd, resultView{res})
+		},
+	}
+	cmd.Flags().StringVar(&start, "start", "-1h", "Start time as RFC3339, unix seconds or relative to now like -1h")
+	cmd.Flags().StringVar(&end, "end", "now", "End time as RFC3339, unix seconds or relative to now")
+	cmd.Flags().DurationVar(&step, "step", 0, fmt.Sprintf("Query resolution. Defaults to the range divided into %d steps", maxPoints))
+	addClustersFlag(cmd, &clusters)
+	return cmd
+}
+
+func parseRange(start, end string, step time.Duration) (promv1.Range, error) {
+	now := time.Now()
+	s, err := parseTime(start, now)
+	if err != nil {
+		return promv1.Range{}, fmt.Errorf("invalid --start: %w", err)
+	}
+	e, err := parseTime(end, now)
+	if err != nil {
+		return promv1.Range{}, fmt.Errorf("invalid --end: %w", err)
+	}
+	if !s.Before(e) {
+		return promv1.Range{}, fmt.Errorf("--start %s must be before --end %s", s.Format(time.RFC3339), e.Format(time.RFC3339))
+	}
+	if step <= 0 {
+		step = e.Sub(s) / maxPoints
+		if step < time.Second {
+			step = time.Second
+		}
+		step = step.Round(time.Second)
+	}
+	return promv1.Range{Start: s, End: e, Step: step}, nil
+}
+
+// parseTime accepts "now", RFC3339, unix seconds with an optional fraction
+// and durations relative to now, like -1h or 30m ago written as -30m.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "" || s == "now":
+		return now, nil
+	case strings.HasPrefix(s, "-") || strings.HasPrefix(s, "+"):
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return now.Add(d), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot parse %q as a time", s)
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+}
+
+func warn(warnings []string) {
+	for _, w := range warnings {
+		klog.Warningln(w)
+	}
+}
+
+func (o *options) print(cmd *cobra.Command, v view) error {
+	w := cmd.OutOrStdout()
+	return printView(w, o.output, v)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	"github.com/tamalsaha/prometheus-demo/prometheus/convert"
+	"github.com/tamalsaha/prometheus-demo/prometheus/discovery"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/klog/v2"
+	appcatalog "kmodules.xyz/custom-resources/apis/appcatalog/v1alpha1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// serviceAuto is the --service value that discovers the service.
+const serviceAuto = "auto"
+
+type options struct {
+	prom       prometheus.Config
+	flags      *pflag.FlagSet
+	service    string
+	appBinding string
+	output     string
+	timeout    time.Duration
+
+	// clients are closed once the command is done, which also closes
+	// their port forwards.
+	clients []*prometheus.Client
+}
+
+func NewRootCmd() *cobra.Command {
+	o := &options{}
+	cmd := &cobra.Command{
+		Use:   "read-prom",
+		Short: "Run PromQL and metadata queries against a Prometheus server",
+		Long: `Run PromQL and metadata queries against a Prometheus server.
+
+The server is either reached directly with --prometheus.address or through the
+Kubernetes apiserver service proxy with --service, using the current kubeconfig
+or --prometheus.kubeconfig and --prometheus.kube-context. --service is an alias
+of --prometheus.service that also accepts auto, to use the best service found
+by the discover command.
+With --prometheus.transport=portforward the service is reached through a port
+forward to one of its pods instead, which is re-established if the pod goes
+away.`,
+		Example: `  read-prom query 'up' --prometheus.address=http://localhost:9090
+  read-prom query 'up' --service=auto
+  read-prom query 'up' --service=monitoring/prometheus-operated:9090 --prometheus.transport=portforward
+  read-prom range 'rate(http_requests_total[5m])' --start=-3h --step=1m --service=monitoring/prometheus-operated:9090
+  read-prom labels job --appbinding=monitoring/prometheus -o json`,
+		SilenceUsage: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			switch o.output {
+			case outputTable, outputJSON, outputCSV, outputOpenMetrics:
+			default:
+				return fmt.Errorf("unknown output format %q, must be one of table, json, csv or openmetrics", o.output)
+			}
+			return o.prom.Load()
+		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			return o.close()
+		},
+	}
+
+	flags := cmd.PersistentFlags()
+	o.flags = flags
+	o.prom.AddFlags(flags)
+	flags.StringVar(&o.service, "service", o.service, "Alias of --prometheus.service that also accepts auto, to pick the best service found by the discover command")
+	flags.StringVar(&o.appBinding, "appbinding", o.appBinding, "Read the Prometheus connection from an AppBinding, in namespace/name form")
+	flags.StringVarP(&o.output, "output", "o", outputTable, "Output format. One of: table, json, csv, openmetrics")
+	flags.DurationVar(&o.timeout, "timeout", 30*time.Second, "The time limit of the whole command, including discovery and every request to Prometheus. 0 means no limit")
+
+	cmd.AddCommand(
+		newQueryCmd(o),
+		newRangeCmd(o),
+		newSeriesCmd(o),
+		newLabelsCmd(o),
+		newTargetsCmd(o),
+		newRulesCmd(o),
+		newAlertsCmd(o),
+		newMetadataCmd(o),
+		newUsageCmd(o),
+		newCostCmd(o),
+		newRunCmd(o),
+		newCardinalityCmd(o),
+		newDiscoverCmd(o),
+		newAccessCmd(o),
+		newProbeCmd(o),
+	)
+	return cmd
+}
+
+// config returns the connection configured with flags or an AppBinding.
+func (o *options) config(ctx context.Context) (*prometheus.Config, error) {
+	switch {
+	case o.service != "" && o.appBinding != "":
+		return nil, fmt.Errorf("--service and --appbinding are mutually exclusive")
+	case o.service != "" && o.prom.Service != nil:
+		return nil, fmt.Errorf("--service is an alias of --%s.service, set only one of them", prometheus.DefaultFlagPrefix)
+	case o.service != "":
+		ref, err := o.serviceReference(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pc := o.prom
+		pc.Service = &ref
+		return &pc, nil
+	case o.appBinding != "":
+		ns, name, ok := strings.Cut(o.appBinding, "/")
+		if !ok {
+			return nil, fmt.Errorf("--appbinding %q must be in namespace/name form", o.appBinding)
+		}
+		kc, err := o.kubeClient()
+		if err != nil {
+			return nil, err
+		}
+		var app appcatalog.AppBinding
+		if err := kc.Get(ctx, types.NamespacedName{Namespace: ns, Name: name}, &app); err != nil {
+			return nil, err
+		}
+		pc, err := convert.FromAppBinding(ctx, kc, &app)
+		if err != nil {
+			return nil, err
+		}
+		return o.withClientSettings(pc), nil
+	}
+	return &o.prom, nil
+}
+
+// serviceReference parses --service, or discovers the best service if it is
+// "auto". Without --service, it returns --prometheus.service.
+func (o *options) serviceReference(ctx context.Context) (prometheus.ServiceReference, error) {
+	if o.service == "" && o.prom.Service != nil {
+		return *o.prom.Service, nil
+	}
+	if o.service != serviceAuto {
+		return prometheus.ParseServiceReference(o.service)
+	}
+	kc, err := o.kubeClient()
+	if err != nil {
+		return prometheus.ServiceReference{}, err
+	}
+	c, err := discovery.Best(ctx, kc, discovery.Options{})
+	if err != nil {
+		return prometheus.ServiceReference{}, err
+	}
+	klog.V(1).InfoS("Discovered Prometheus", "service", c.Service, "kind", c.Kind, "distribution", c.Distribution)
+	return c.Service, nil
+}
+
+// withClientSettings applies the flags that don't describe the connection
+// itself to pc, if they are set on the command line or in the environment.
+// The settings of pc are kept otherwise.
+func (o *options) withClientSettings(pc *prometheus.Config) *prometheus.Config {
+	if o.changed("header") {
+		pc.Headers = o.prom.Headers
+	}
+	if o.changed("tenant-id") {
+		pc.TenantID = o.prom.TenantID
+	}
+	if o.changed("tenant-header") {
+		pc.TenantHeader = o.prom.TenantHeader
+	}
+	if o.changed("max-retries") {
+		pc.MaxRetries = o.prom.MaxRetries
+	}
+	if o.changed("retry-backoff") {
+		pc.RetryBackoff = o.prom.RetryBackoff
+	}
+	if o.changed("max-retry-backoff") {
+		pc.MaxRetryBackoff = o.prom.MaxRetryBackoff
+	}
+	if o.changed("qps") {
+		pc.QPS = o.prom.QPS
+	}
+	if o.changed("burst") {
+		pc.Burst = o.prom.Burst
+	}
+	if o.changed("record-file") {
+		pc.RecordFile = o.prom.RecordFile
+	}
+	if o.changed("replay-file") {
+		pc.ReplayFile = o.prom.ReplayFile
+	}
+	return pc
+}
+
+// changed returns true if the --prometheus.<name> flag is set on the command
+// line or in the environment.
+func (o *options) changed(name string) bool {
+	name = prometheus.DefaultFlagPrefix + "." + name
+	if f := o.flags.Lookup(name); f != nil && f.Changed {
+		return true
+	}
+	_, ok := os.LookupEnv(prometheus.EnvName(name))
+	return ok
+}
+
+func (o *options) api(ctx context.Context) (promv1.API, error) {
+	pc, err := o.config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return o.newAPI(pc)
+}
+
+func (o *options) newAPI(pc *prometheus.Config) (promv1.API, error) {
+	if !pc.IsSet() {
+		return nil, fmt.Errorf("one of --%s.address, --%s.service, --service or --appbinding is required", prometheus.DefaultFlagPrefix, prometheus.DefaultFlagPrefix)
+	}
+	if err := pc.Validate(); err != nil {
+		return nil, err
+	}
+	c, err := pc.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	o.clients = append(o.clients, c)
+	return promv1.NewAPI(c), nil
+}
+
+// close closes the clients returned by newAPI.
+func (o *options) close() error {
+	var errs []error
+	for _, c := range o.clients {
+		errs = append(errs, c.Close())
+	}
+	o.clients = nil
+	return errors.Join(errs...)
+}
+
+// context returns the context of a command, which ends after --timeout.
+func (o *options) context(cmd *cobra.Command) (context.Context, context.CancelFunc) {
+	if o.timeout <= 0 {
+		return context.WithCancel(cmd.Context())
+	}
+	return context.WithTimeout(cmd.Context(), o.timeout)
+}
+
+// kubeClient returns a client of the cluster of --prometheus.kubeconfig and
+// --prometheus.kube-context.
+func (o *options) kubeClient() (client.Client, error) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = appcatalog.AddToScheme(scheme)
+	_ = monitoringv1.AddToScheme(scheme)
+
+	cfg, err := o.prom.KubeConfig()
+	if err != nil {
+		return nil, err
+	}
+	return client.New(cfg, client.Options{Scheme: scheme})
+}
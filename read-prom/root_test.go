@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+	"github.com/tamalsaha/prometheus-demo/prometheus/fanout"
+	"github.com/tamalsaha/prometheus-demo/prometheus/promtest"
+	"github.com/tamalsaha/prometheus-demo/prometheus/query"
+)
+
+// end is the time of the last synthetic sample of promtest.
+var end = promtest.DefaultStart.Add(time.Hour).Format(time.RFC3339)
+
+func run(t *testing.T, args ...string) []byte {
+	t.Helper()
+	cmd := NewRootCmd()
+	var out bytes.Buffer
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs(args)
+	if err := cmd.Execute(); err != nil {
+		t.Fatalf("read-prom %v: %v\n%s", args, err, out.Bytes())
+	}
+	return out.Bytes()
+}
+
+func TestQuery(t *testing.T) {
+	srv := promtest.NewServer(promtest.Synthetic())
+	defer srv.Close()
+
+	out := run(t, "query", "sum by (code) (rate(http_requests_total[5m]))",
+		"--time="+end, "--prometheus.address="+srv.URL, "-o", "json")
+	var res query.Result
+	if err := json.Unmarshal(out, &res); err != nil {
+		t.Fatalf("invalid output %s: %v", out, err)
+	}
+	got := map[string]float64{}
+	for _, s := range res.Samples {
+		got[s.Labels["code"]] = s.Value
+	}
+	if want := map[string]float64{"200": 16, "500": 0.6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("query = %v, want %v", got, want)
+	}
+}
+
+func TestRange(t *testing.T) {
+	srv := promtest.NewServer(promtest.Synthetic())
+	defer srv.Close()
+
+	out := run(t, "range", `up{job="node-exporter"}`,
+		"--start="+promtest.DefaultStart.Add(58*time.Minute).Format(time.RFC3339), "--end="+end, "--step=1m",
+		"--prometheus.address="+srv.URL, "-o", "csv")
+	rows, err := csv.NewReader(bytes.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid output %s: %v", out, err)
+	}
+	// a header and three points of each of the two node exporters
+	if len(rows) != 7 {
+		t.Errorf("got %d rows, want 7:\n%s", len(rows), out)
+	}
+}
+
+func TestQueryClusters(t *testing.T) {
+	prod := promtest.NewServer(promtest.Synthetic())
+	defer prod.Close()
+	// node-2 is back up in staging
+	db := promtest.Synthetic()
+	db.Add("up", map[string]string{"job": "node-exporter", "instance": "node-2:9100"}, promtest.DefaultStart.Add(time.Hour), 1)
+	staging := promtest.NewServer(db)
+	defer staging.Close()
+
+	clusters := filepath.Join(t.TempDir(), "clusters.yaml")
+	data := "prod:\n  address: " + prod.URL + "\nstaging:\n  address: " + staging.URL + "\n"
+	if err := os.WriteFile(clusters, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := run(t, "query", `sum(up)`, "--time="+end, "--clusters="+clusters, "-o", "json")
+	var resp fanout.Response
+	if err := json.Unmarshal(out, &resp); err != nil {
+		t.Fatalf("invalid output %s: %v", out, err)
+	}
+	got := map[string]float64{}
+	for _, s := range resp.Result.Samples {
+		got[s.Labels[fanout.DefaultClusterLabel]] = s.Value
+	}
+	if want := map[string]float64{"prod": 2, "staging": 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("query = %v, want %v", got, want)
+	}
+	if len(resp.Failed()) != 0 {
+		t.Errorf("failed clusters: %+v", resp.Failed())
+	}
+}
+
+func TestServiceAlias(t *testing.T) {
+	newOptions := func(args ...string) *options {
+		t.Helper()
+		o := &options{flags: pflag.NewFlagSet("read-prom", pflag.ContinueOnError)}
+		o.prom.AddFlags(o.flags)
+		o.flags.StringVar(&o.service, "service", "", "")
+		if err := o.flags.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	want := prometheus.ServiceReference{Scheme: "http", Namespace: "monitoring", Name: "prometheus-operated", Port: 9090}
+
+	for _, flag := range []string{"--service", "--prometheus.service"} {
+		t.Run(flag, func(t *testing.T) {
+			o := newOptions(flag+"=http:monitoring/prometheus-operated:9090",
+				"--prometheus.kube-context=kind-dev", "--prometheus.transport=portforward")
+			pc, err := o.config(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pc.Service == nil || *pc.Service != want {
+				t.Errorf("Service = %v, want %v", pc.Service, want)
+			}
+			if pc.KubeContext != "kind-dev" || pc.Transport != prometheus.TransportPortForward {
+				t.Errorf("config() = %+v, want the kube context and transport of the flags", pc)
+			}
+		})
+	}
+
+	o := newOptions("--service=monitoring/a:9090", "--prometheus.service=monitoring/b:9090")
+	if _, err := o.config(context.Background()); err == nil {
+		t.Error("config() with --service and --prometheus.service succeeded, want error")
+	}
+}
+
+func TestProbe(t *testing.T) {
+	srv := promtest.NewServer(promtest.Synthetic())
+	defer srv.Close()
+
+	out := run(t, "probe", "--prometheus.address="+srv.URL, "-o", "json")
+	var result prometheus.ProbeResult
+	if err := json.Unmarshal(out, &result); err != nil {
+		t.Fatalf("invalid output %s: %v", out, err)
+	}
+	if !result.Reachable || !result.Authorized || result.StatusCode != 200 || !result.APIs["targets"] {
+		t.Errorf("probe = %+v, want an authorized Prometheus with the targets API", result)
+	}
+
+	cmd := NewRootCmd()
+	cmd.SetOut(&bytes.Buffer{})
+	cmd.SetErr(&bytes.Buffer{})
+	cmd.SetArgs([]string{"probe", "--prometheus.address=" + srv.URL + "/prefix"})
+	if err := cmd.Execute(); err == nil || !strings.Contains(err.Error(), "path prefix") {
+		t.Errorf("probe of a wrong path = %v, want an error about the path prefix", err)
+	}
+}
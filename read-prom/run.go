@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tamalsaha/prometheus-demo/prometheus/catalog"
+)
+
+func newRunCmd(o *options) *cobra.Command {
+	var (
+		files      []string
+		params     []string
+		ts         string
+		start, end string
+		step       time.Duration
+		render     bool
+	)
+	cmd := &cobra.Command{
+		Use:   "run [name]",
+		Short: "Run a named query from the query catalog, or list the catalog",
+		Long: `Run a named query from the query catalog, or list the catalog.
+
+The built-in catalog has the queries of the usage reports and a few common
+ones. --catalog adds YAML files or directories of queries, which replace
+built-in queries of the same name. Parameters are set with --param and are
+checked against their declared type, so a value can't change the query.`,
+		Example: `  read-prom run
+  read-prom run pod_cpu --param namespace=monitoring --param pod=prometheus-k8s-0
+  read-prom run namespace_cpu --param namespace=demo --start=-6h --step=5m -o csv
+  read-prom run http_request_rate --param job=api --param by=method --render`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c := catalog.Default
+			if len(files) > 0 {
+				extra, err := catalog.Load(files...)
+				if err != nil {
+					return err
+				}
+				c = c.Merge(extra)
+			}
+			if len(args) == 0 {
+				return o.print(cmd, catalogView(c.Queries()))
+			}
+
+			values := map[string]string{}
+			for _, p := range params {
+				k, v, ok := strings.Cut(p, "=")
+				if !ok {
+					return fmt.Errorf("invalid --param %q, must be name=value", p)
+				}
+				values[k] = v
+			}
+			q, err := c.Get(args[0])
+			if err != nil {
+				return err
+			}
+			// check the parameters before connecting
+			expr, err := q.Render(values)
+			if err != nil {
+				return err
+			}
+			if render {
+				_, err = fmt.Fprintln(cmd.OutOrStdout(), expr)
+				return err
+			}
+
+			// unset times are left zero for the defaults of the query
+			opts := catalog.Options{Step: step}
+			now := time.Now()
+			for _, t := range []struct {
+				flag, value string
+				into        *time.Time
+			}{
+				{"--time", ts, &opts.Time},
+				{"--start", start, &opts.Start},
+				{"--end", end, &opts.End},
+			} {
+				if t.value == "" {
+					continue
+				}
+				if *t.into, err = parseTime(t.value, now); err != nil {
+					return fmt.Errorf("invalid %s: %w", t.flag, err)
+				}
+			}
+
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			api, err := o.api(ctx)
+			if err != nil {
+				return err
+			}
+			res, err := c.RunWithOptions(ctx, api, q.Name, values, opts)
+			if err != nil {
+				return err
+			}
+			warn(res.Warnings)
+			return o.print(cmd, resultView{res})
+		},
+	}
+	flags := cmd.Flags()
+	flags.StringArrayVar(&files, "catalog", nil, "YAML file or directory of queries to add to the built-in catalog")
+	flags.StringArrayVarP(&params, "param", "p", nil, "Query parameter as name=value")
+	flags.StringVar(&ts, "time", "", "Evaluation time of vector and scalar queries. Defaults to now")
+	flags.StringVar(&start, "start", "", "Start of matrix queries. Defaults to the range of the query before --end")
+	flags.StringVar(&end, "end", "", "End of matrix queries. Defaults to now")
+	flags.DurationVar(&step, "step", 0, "Resolution of matrix queries. Defaults to the step of the query")
+	flags.BoolVar(&render, "render", false, "Print the query with its parameters instead of running it")
+	return cmd
+}
+
+type catalogView []*catalog.Query
+
+func (v catalogView) data() interface{} {
+	return []*catalog.Query(v)
+}
+
+func (v catalogView) table() ([]string, [][]string) {
+	rows := make([][]string, 0, len(v))
+	for _, q := range v {
+		params := make([]string, 0, len(q.Params))
+		for _, p := range q.Params {
+			s := p.Name + ":" + string(p.Type)
+			if p.Default != nil {
+				s += "=" + *p.Default
+			}
+			params = append(params, s)
+		}
+		rows = append(rows, []string{q.Name, string(q.Result), strings.Join(params, " "), q.Description})
+	}
+	return []string{"name", "result", "params", "description"}, rows
+}
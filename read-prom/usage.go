@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tamalsaha/prometheus-demo/prometheus/usage"
+)
+
+func newUsageCmd(o *options) *cobra.Command {
+	var start, end, groupBy, namespace string
+	cmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Report the CPU, memory, network and storage usage of workloads over a time window",
+		Long: `Report the CPU, memory, network and storage usage of workloads over a time window.
+
+Usage is grouped by the owning workload, namespace or node, and compared with
+the requests and limits of the pods. It needs the cAdvisor and kubelet metrics
+and kube-state-metrics.`,
+		Example: `  read-prom usage --start=-24h --by=namespace
+  read-prom usage --namespace=demo -o csv`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			now := time.Now()
+			s, err := parseTime(start, now)
+			if err != nil {
+				return fmt.Errorf("invalid --start: %w", err)
+			}
+			e, err := parseTime(end, now)
+			if err != nil {
+				return fmt.Errorf("invalid --end: %w", err)
+			}
+
+			ctx, cancel := o.context(cmd)
+			defer cancel()
+			api, err := o.api(ctx)
+			if err != nil {
+				return err
+			}
+			report, err := usage.NewReport(ctx, api, usage.ReportOptions{
+				Start:     s,
+				End:       e,
+				GroupBy:   usage.GroupBy(groupBy),
+				Namespace: namespace,
+			})
+			if err != nil {
+				return err
+			}
+			return o.print(cmd, usageView{report})
+		},
+	}
+	cmd.Flags().StringVar(&start, "start", "-1h", "Start of the window as RFC3339, unix seconds or relative to now like -24h")
+	cmd.Flags().StringVar(&end, "end", "now", "End of the window as RFC3339, unix seconds or relative to now")
+	cmd.Flags().StringVar(&groupBy, "by", string(usage.ByWorkload), "Group usage by workload, namespace or node")
+	cmd.Flags().StringVarP(&namespace, "namespace", "n", "", "Only report workloads in this namespace")
+	return cmd
+}
+
+type usageView struct {
+	*usage.Report
+}
+
+func (v usageView) data() interface{} {
+	return v.Report
+}
+
+func (v usageView) table() ([]string, [][]string) {
+	var header []string
+	switch v.GroupBy {
+	case usage.ByWorkload:
+		header = []string{"namespace", "kind", "name"}
+	case usage.ByNamespace:
+		header = []string{"namespace"}
+	case usage.ByNode:
+		header = []string{"node"}
+	}
+	header = append(header,
+		"pods",
+		"cpu", "cpu requests", "cpu limits", "cpu % requests", "cpu % limits",
+		"memory", "memory requests", "memory limits", "memory % requests", "memory % limits",
+		"network rx", "network tx", "storage")
+
+	rows := make([][]string, 0, len(v.Items))
+	for _, u := range v.Items {
+		var row []string
+		switch v.GroupBy {
+		case usage.ByWorkload:
+			row = []string{u.Namespace, u.Kind, u.Name}
+		case usage.ByNamespace:
+			row = []string{u.Namespace}
+		case usage.ByNode:
+			row = []string{u.Node}
+		}
+		row = append(row,
+			strconv.Itoa(u.Pods),
+			formatCores(u.CPU.Usage), formatCores(u.CPU.Requests), formatCores(u.CPU.Limits),
+			formatPercent(u.CPU.RequestUtilization), formatPercent(u.CPU.LimitUtilization),
+			formatBytes(u.Memory.Usage), formatBytes(u.Memory.Requests), formatBytes(u.Memory.Limits),
+			formatPercent(u.Memory.RequestUtilization), formatPercent(u.Memory.LimitUtilization),
+			formatBytes(u.NetworkReceiveBytes), formatBytes(u.NetworkTransmitBytes), formatBytes(u.StorageBytes))
+		rows = append(rows, row)
+	}
+	return header, rows
+}
+
+func formatCores(v float64) string {
+	return strconv.FormatFloat(v, 'f', 3, 64)
+}
+
+func formatBytes(v float64) string {
+	return strconv.FormatFloat(v, 'f', 0, 64)
+}
+
+func formatPercent(p *float64) string {
+	if p == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*p, 'f', 1, 64)
+}
@@ -1,75 +1,361 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/spf13/cobra"
+	"github.com/tamalsaha/prometheus-demo/prometheus/satoken"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
 	clientcmdlatest "k8s.io/client-go/tools/clientcmd/api/latest"
+	"k8s.io/klog/v2"
 	"k8s.io/klog/v2/klogr"
 	ctrl "sigs.k8s.io/controller-runtime"
 )
 
 func main() {
 	ctrl.SetLogger(klogr.New())
-	cfg := ctrl.GetConfigOrDie()
+	if err := newRootCmd().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// source is the kubeconfig used to reach the cluster and request tokens.
+type source struct {
+	kubeconfig     string
+	context        string
+	serviceAccount string
+	token          satoken.Options
+}
+
+func (s *source) clientConfig() clientcmd.ClientConfig {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = s.kubeconfig
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: s.context})
+}
+
+func (s *source) restConfig() (*rest.Config, error) {
+	cfg, err := s.clientConfig().ClientConfig()
+	if err != nil {
+		return nil, err
+	}
 	cfg.QPS = 100
 	cfg.Burst = 100
+	return cfg, nil
+}
 
-	data, err := GenerateKubeConfiguration(cfg, "default")
-	if err != nil {
-		panic(err)
+func (s *source) serviceAccountKey() (types.NamespacedName, error) {
+	ns, name, ok := strings.Cut(s.serviceAccount, "/")
+	if !ok || ns == "" || name == "" {
+		return types.NamespacedName{}, fmt.Errorf("--service-account %q must be in namespace/name form", s.serviceAccount)
 	}
-	fmt.Println(string(data))
+	return types.NamespacedName{Namespace: ns, Name: name}, nil
 }
 
+func (s *source) addFlags(cmd *cobra.Command) {
+	flags := cmd.PersistentFlags()
+	flags.StringVar(&s.kubeconfig, "kubeconfig", "", "The kubeconfig used to reach the cluster. Defaults to KUBECONFIG, ~/.kube/config or the in-cluster config")
+	flags.StringVar(&s.context, "context", "", "The kubeconfig context used to reach the cluster")
+	flags.StringVar(&s.serviceAccount, "service-account", "", "Authenticate as this service account, in namespace/name form, with a token from the TokenRequest API")
+	flags.StringSliceVar(&s.token.Audiences, "audience", nil, "Audiences of the service account token. Defaults to the audiences of the apiserver")
+	flags.DurationVar(&s.token.Expiration, "expiration", satoken.DefaultExpiration, "Requested lifetime of the service account token")
+}
+
+func newRootCmd() *cobra.Command {
+	var (
+		src         source
+		names       Names
+		file        string
+		merge       bool
+		overwrite   bool
+		exec        bool
+		execCommand string
+	)
+	cmd := &cobra.Command{
+		Use:   "rest2kube-config",
+		Short: "Generate a kubeconfig with a single context for the current cluster",
+		Long: `Generate a kubeconfig with a single context for the current cluster.
+
+By default the context uses the credentials of the current kubeconfig
+context. With --service-account it authenticates as that service account
+instead, with a bound token from the TokenRequest API that expires after
+--expiration, or with --exec, with an exec credential plugin that requests a
+fresh token whenever one is needed.
+
+The kubeconfig is printed, written to --file, or with --merge added to --file
+or ~/.kube/config. Existing clusters, contexts and users of the same name are
+only replaced with --overwrite, and the current context is left as is.`,
+		Example: `  rest2kube-config --service-account=default/trickster --expiration=24h --file=trickster.kubeconfig
+  rest2kube-config --service-account=default/trickster --exec --merge --cluster-name=prod --context-name=prod-trickster --user-name=trickster
+  rest2kube-config --context=kind-dev --namespace=monitoring`,
+		Args:         cobra.NoArgs,
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := src.restConfig()
+			if err != nil {
+				return err
+			}
+
+			var user *clientcmdapi.AuthInfo
+			if src.serviceAccount != "" {
+				sa, err := src.serviceAccountKey()
+				if err != nil {
+					return err
+				}
+				if names.Namespace == "" {
+					names.Namespace = sa.Namespace
+				}
+				if exec {
+					if user, err = src.execAuthInfo(execCommand); err != nil {
+						return err
+					}
+				} else {
+					ts, err := satoken.NewForConfig(cfg, sa, src.token)
+					if err != nil {
+						return err
+					}
+					token, err := ts.TokenContext(cmd.Context())
+					if err != nil {
+						return err
+					}
+					klog.InfoS("Requested service account token", "serviceaccount", sa, "expiry", token.Expiry.Format(time.RFC3339))
+					user = &clientcmdapi.AuthInfo{Token: token.AccessToken}
+				}
+			} else if exec {
+				return errors.New("--exec requires --service-account")
+			}
+
+			kubeconfig, err := GenerateKubeConfiguration(cfg, names, user)
+			if err != nil {
+				return err
+			}
+			switch {
+			case merge:
+				if file == "" {
+					file = clientcmd.RecommendedHomeFile
+				}
+				return MergeKubeConfiguration(file, kubeconfig, overwrite)
+			case file != "":
+				return clientcmd.WriteToFile(*kubeconfig, file)
+			}
+			data, err := runtime.Encode(clientcmdlatest.Codec, kubeconfig)
+			if err != nil {
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(data)
+			return err
+		},
+	}
+	src.addFlags(cmd)
+	flags := cmd.Flags()
+	flags.StringVar(&names.Cluster, "cluster-name", "default-cluster", "Name of the cluster in the kubeconfig")
+	flags.StringVar(&names.Context, "context-name", "default-context", "Name of the context in the kubeconfig")
+	flags.StringVar(&names.User, "user-name", "default-user", "Name of the user in the kubeconfig")
+	flags.StringVarP(&names.Namespace, "namespace", "n", "", "Namespace of the context. Defaults to the namespace of the service account, or default")
+	flags.StringVarP(&file, "file", "f", "", "Write the kubeconfig to this file instead of printing it")
+	flags.BoolVar(&merge, "merge", false, "Add the cluster, context and user to --file, or ~/.kube/config, keeping the other entries")
+	flags.BoolVar(&overwrite, "overwrite", false, "Replace existing entries of the same name when merging")
+	flags.BoolVar(&exec, "exec", false, "Use an exec credential plugin that requests service account tokens instead of a static token")
+	flags.StringVar(&execCommand, "exec-command", "", "Command of the exec credential plugin. Defaults to the path of this binary")
+
+	cmd.AddCommand(newTokenCmd(&src))
+	return cmd
+}
+
+// Names of the entries of a generated kubeconfig.
+type Names struct {
+	Cluster   string
+	Context   string
+	User      string
+	Namespace string
+}
+
+// GenerateKubeConfiguration returns a kubeconfig with a single context for
+// the cluster of cfg. The user has the credentials of cfg, unless user is
+// set.
 // https://github.com/kubernetes/client-go/issues/711#issuecomment-730112049
-func GenerateKubeConfiguration(cfg *rest.Config, namespace string) ([]byte, error) {
+func GenerateKubeConfiguration(cfg *rest.Config, names Names, user *clientcmdapi.AuthInfo) (*clientcmdapi.Config, error) {
 	if err := rest.LoadTLSFiles(cfg); err != nil {
 		return nil, err
 	}
+	if names.Namespace == "" {
+		names.Namespace = "default"
+	}
 
 	clusters := make(map[string]*clientcmdapi.Cluster)
-	clusters["default-cluster"] = &clientcmdapi.Cluster{
+	clusters[names.Cluster] = &clientcmdapi.Cluster{
 		Server:                   cfg.Host,
+		TLSServerName:            cfg.ServerName,
+		InsecureSkipTLSVerify:    cfg.Insecure,
 		CertificateAuthorityData: cfg.CAData,
 	}
 
 	contexts := make(map[string]*clientcmdapi.Context)
-	contexts["default-context"] = &clientcmdapi.Context{
-		Cluster:   "default-cluster",
-		Namespace: namespace,
-		AuthInfo:  "default-user",
+	contexts[names.Context] = &clientcmdapi.Context{
+		Cluster:   names.Cluster,
+		Namespace: names.Namespace,
+		AuthInfo:  names.User,
 	}
 
-	authinfos := make(map[string]*clientcmdapi.AuthInfo)
-	authinfos["default-user"] = &clientcmdapi.AuthInfo{
-		LocationOfOrigin:      "",
-		ClientCertificate:     "",
-		ClientCertificateData: cfg.CertData,
-		ClientKey:             "",
-		ClientKeyData:         cfg.KeyData,
-		Token:                 cfg.BearerToken,
-		TokenFile:             "",
-		Impersonate:           cfg.Impersonate.UserName,
-		ImpersonateUID:        cfg.Impersonate.UID,
-		ImpersonateGroups:     cfg.Impersonate.Groups,
-		ImpersonateUserExtra:  cfg.Impersonate.Extra,
-		Username:              cfg.Username,
-		Password:              cfg.Password,
-		AuthProvider:          cfg.AuthProvider,
-		Exec:                  cfg.ExecProvider,
-		Extensions:            nil,
+	if user == nil {
+		user = &clientcmdapi.AuthInfo{
+			LocationOfOrigin:      "",
+			ClientCertificate:     "",
+			ClientCertificateData: cfg.CertData,
+			ClientKey:             "",
+			ClientKeyData:         cfg.KeyData,
+			Token:                 cfg.BearerToken,
+			TokenFile:             "",
+			Impersonate:           cfg.Impersonate.UserName,
+			ImpersonateUID:        cfg.Impersonate.UID,
+			ImpersonateGroups:     cfg.Impersonate.Groups,
+			ImpersonateUserExtra:  cfg.Impersonate.Extra,
+			Username:              cfg.Username,
+			Password:              cfg.Password,
+			AuthProvider:          cfg.AuthProvider,
+			Exec:                  cfg.ExecProvider,
+			Extensions:            nil,
+		}
 	}
+	authinfos := make(map[string]*clientcmdapi.AuthInfo)
+	authinfos[names.User] = user
 
 	clientConfig := clientcmdapi.Config{
 		Kind:           "Config",
 		APIVersion:     "v1",
 		Clusters:       clusters,
 		Contexts:       contexts,
-		CurrentContext: "default-context",
+		CurrentContext: names.Context,
 		AuthInfos:      authinfos,
 	}
-	return runtime.Encode(clientcmdlatest.Codec, &clientConfig)
+	if err := clientcmdapi.MinifyConfig(&clientConfig); err != nil {
+		return nil, err
+	}
+	return &clientConfig, nil
+}
+
+// MergeKubeConfiguration adds the clusters, contexts and users of cfg to the
+// kubeconfig file, which is created if it doesn't exist. Entries of the same
+// name are an error unless overwrite is set. The current context of the file
+// is only set if it has none.
+func MergeKubeConfiguration(filename string, cfg *clientcmdapi.Config, overwrite bool) error {
+	existing, err := clientcmd.LoadFromFile(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		existing = clientcmdapi.NewConfig()
+	} else if err != nil {
+		return err
+	}
+
+	if !overwrite {
+		var conflicts []string
+		for name := range cfg.Clusters {
+			if _, ok := existing.Clusters[name]; ok {
+				conflicts = append(conflicts, "cluster "+name)
+			}
+		}
+		for name := range cfg.Contexts {
+			if _, ok := existing.Contexts[name]; ok {
+				conflicts = append(conflicts, "context "+name)
+			}
+		}
+		for name := range cfg.AuthInfos {
+			if _, ok := existing.AuthInfos[name]; ok {
+				conflicts = append(conflicts, "user "+name)
+			}
+		}
+		if len(conflicts) > 0 {
+			return fmt.Errorf("%s already has %s, use other names or --overwrite", filename, strings.Join(conflicts, ", "))
+		}
+	}
+
+	for name, c := range cfg.Clusters {
+		existing.Clusters[name] = c
+	}
+	for name, c := range cfg.Contexts {
+		existing.Contexts[name] = c
+	}
+	for name, u := range cfg.AuthInfos {
+		existing.AuthInfos[name] = u
+	}
+	if existing.CurrentContext == "" {
+		existing.CurrentContext = cfg.CurrentContext
+	}
+	return clientcmd.WriteToFile(*existing, filename)
+}
+
+// execAuthInfo returns a user that runs the token command of command, with
+// the kubeconfig and context the token is requested with. The context is
+// pinned, so the plugin doesn't authenticate as the service account itself
+// once the generated context is made current.
+func (s *source) execAuthInfo(command string) (*clientcmdapi.AuthInfo, error) {
+	if command == "" {
+		var err error
+		if command, err = os.Executable(); err != nil {
+			return nil, err
+		}
+	}
+	context := s.context
+	if context == "" {
+		raw, err := s.clientConfig().RawConfig()
+		if err != nil {
+			return nil, err
+		}
+		context = raw.CurrentContext
+	}
+
+	args := []string{"token", "--service-account=" + s.serviceAccount, "--expiration=" + s.token.Expiration.String()}
+	for _, aud := range s.token.Audiences {
+		args = append(args, "--audience="+aud)
+	}
+	if s.kubeconfig != "" {
+		// the plugin runs in the working directory of kubectl
+		kubeconfig, err := filepath.Abs(s.kubeconfig)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--kubeconfig="+kubeconfig)
+	}
+	if context != "" {
+		args = append(args, "--context="+context)
+	}
+	return &clientcmdapi.AuthInfo{
+		Exec: &clientcmdapi.ExecConfig{
+			APIVersion:      execCredentialAPIVersion,
+			Command:         command,
+			Args:            args,
+			InteractiveMode: clientcmdapi.NeverExecInteractiveMode,
+			InstallHint:     "rest2kube-config is needed to request service account tokens: go install github.com/tamalsaha/prometheus-demo/rest2kube-config@latest",
+		},
+	}, nil
+}
+
+// requestToken returns a token of the service account of s.
+func (s *source) requestToken(ctx context.Context) (string, time.Time, error) {
+	sa, err := s.serviceAccountKey()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	cfg, err := s.restConfig()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	ts, err := satoken.NewForConfig(cfg, sa, s.token)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token, err := ts.TokenContext(ctx)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token.AccessToken, token.Expiry, nil
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// existing is a kubeconfig with a kind cluster and an admin user.
+func existing() *clientcmdapi.Config {
+	cfg := clientcmdapi.NewConfig()
+	cfg.Clusters["kind-dev"] = &clientcmdapi.Cluster{Server: "https://127.0.0.1:6443", CertificateAuthorityData: []byte("kind-ca")}
+	cfg.AuthInfos["kind-dev"] = &clientcmdapi.AuthInfo{ClientCertificateData: []byte("cert"), ClientKeyData: []byte("key")}
+	cfg.Contexts["kind-dev"] = &clientcmdapi.Context{Cluster: "kind-dev", AuthInfo: "kind-dev", Namespace: "default"}
+	cfg.CurrentContext = "kind-dev"
+	return cfg
+}
+
+func generate(t *testing.T, names Names) *clientcmdapi.Config {
+	t.Helper()
+	cfg, err := GenerateKubeConfiguration(&rest.Config{Host: "https://prod.example.com"}, names, &clientcmdapi.AuthInfo{Token: "sa-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestMergeKubeConfiguration(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config")
+	if err := clientcmd.WriteToFile(*existing(), filename); err != nil {
+		t.Fatal(err)
+	}
+
+	prod := generate(t, Names{Cluster: "prod", Context: "prod-trickster", User: "trickster", Namespace: "monitoring"})
+	if err := MergeKubeConfiguration(filename, prod, false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := clientcmd.LoadFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the entries of the file and the current context are kept
+	want := existing()
+	if got.CurrentContext != "kind-dev" {
+		t.Errorf("current context = %s, want kind-dev", got.CurrentContext)
+	}
+	if c := got.Clusters["kind-dev"]; c == nil || c.Server != want.Clusters["kind-dev"].Server || string(c.CertificateAuthorityData) != "kind-ca" {
+		t.Errorf("cluster kind-dev = %+v, want it unchanged", c)
+	}
+	if u := got.AuthInfos["kind-dev"]; u == nil || string(u.ClientKeyData) != "key" {
+		t.Errorf("user kind-dev = %+v, want it unchanged", u)
+	}
+	if c := got.Contexts["kind-dev"]; c == nil || c.AuthInfo != "kind-dev" {
+		t.Errorf("context kind-dev = %+v, want it unchanged", c)
+	}
+	// and the generated ones added
+	if c := got.Clusters["prod"]; c == nil || c.Server != "https://prod.example.com" {
+		t.Errorf("cluster prod = %+v", c)
+	}
+	if u := got.AuthInfos["trickster"]; u == nil || u.Token != "sa-token" {
+		t.Errorf("user trickster = %+v", u)
+	}
+	if c := got.Contexts["prod-trickster"]; c == nil || c.Cluster != "prod" || c.AuthInfo != "trickster" || c.Namespace != "monitoring" {
+		t.Errorf("context prod-trickster = %+v", c)
+	}
+
+	// entries of the same name are only replaced with overwrite
+	kind := generate(t, Names{Cluster: "kind-dev", Context: "other", User: "kind-dev"})
+	err = MergeKubeConfiguration(filename, kind, false)
+	if err == nil || !strings.Contains(err.Error(), "cluster kind-dev, user kind-dev") {
+		t.Errorf("MergeKubeConfiguration() with conflicts = %v, want the conflicting cluster and user", err)
+	}
+	if after, _ := clientcmd.LoadFromFile(filename); !reflect.DeepEqual(after.Contexts, got.Contexts) {
+		t.Error("a failed merge changed the file")
+	}
+	if err := MergeKubeConfiguration(filename, kind, true); err != nil {
+		t.Fatal(err)
+	}
+	got, err = clientcmd.LoadFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := got.AuthInfos["kind-dev"]; u.Token != "sa-token" || got.CurrentContext != "kind-dev" || got.AuthInfos["trickster"] == nil {
+		t.Errorf("after overwrite: user kind-dev = %+v, current context %s", u, got.CurrentContext)
+	}
+}
+
+func TestMergeKubeConfigurationNewFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "new", "config")
+	prod := generate(t, Names{Cluster: "prod", Context: "prod", User: "prod"})
+	if err := MergeKubeConfiguration(filename, prod, false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := clientcmd.LoadFromFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a new file gets the generated context as the current one
+	if got.CurrentContext != "prod" || len(got.Contexts) != 1 {
+		t.Errorf("kubeconfig = %+v, want the prod context", got)
+	}
+}
+
+func TestExecAuthInfo(t *testing.T) {
+	dir := t.TempDir()
+	if err := clientcmd.WriteToFile(*existing(), filepath.Join(dir, "config")); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	src := source{kubeconfig: "config", serviceAccount: "monitoring/trickster"}
+	src.token.Expiration = 2 * time.Hour
+	src.token.Audiences = []string{"prometheus"}
+	user, err := src.execAuthInfo("/usr/local/bin/rest2kube-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"token", "--service-account=monitoring/trickster", "--expiration=2h0m0s", "--audience=prometheus",
+		// absolute, kubectl runs the plugin in its own working directory
+		"--kubeconfig=" + filepath.Join(dir, "config"),
+		// the current context, pinned
+		"--context=kind-dev",
+	}
+	if user.Exec == nil || user.Exec.Command != "/usr/local/bin/rest2kube-config" || !reflect.DeepEqual(user.Exec.Args, want) {
+		t.Errorf("exec = %+v, want args %q", user.Exec, want)
+	}
+	if user.Exec.APIVersion != execCredentialAPIVersion || user.Exec.InteractiveMode != clientcmdapi.NeverExecInteractiveMode {
+		t.Errorf("exec = %+v, want a non-interactive %s plugin", user.Exec, execCredentialAPIVersion)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientauthenticationv1 "k8s.io/client-go/pkg/apis/clientauthentication/v1"
+)
+
+var execCredentialAPIVersion = clientauthenticationv1.SchemeGroupVersion.String()
+
+// newTokenCmd returns the exec credential plugin set up by --exec.
+func newTokenCmd(src *source) *cobra.Command {
+	return &cobra.Command{
+		Use:   "token",
+		Short: "Print a service account token as an ExecCredential",
+		Long: `Print a service account token as an ExecCredential.
+
+This is the exec credential plugin of the kubeconfigs generated with --exec.
+kubectl and client-go run it for a new token whenever the previous one
+expires.`,
+		Example: `  rest2kube-config token --service-account=default/trickster --context=kind-dev`,
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if src.serviceAccount == "" {
+				return errors.New("--service-account is required")
+			}
+			token, expiry, err := src.requestToken(cmd.Context())
+			if err != nil {
+				return err
+			}
+			exp := metav1.NewTime(expiry)
+			cred := clientauthenticationv1.ExecCredential{
+				TypeMeta: metav1.TypeMeta{APIVersion: execCredentialAPIVersion, Kind: "ExecCredential"},
+				Status: &clientauthenticationv1.ExecCredentialStatus{
+					Token:               token,
+					ExpirationTimestamp: &exp,
+				},
+			}
+			return json.NewEncoder(cmd.OutOrStdout()).Encode(cred)
+		},
+	}
+}
@@ -2,22 +2,26 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"strconv"
-	"strings"
+	"syscall"
 	"time"
 
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	promapi "github.com/prometheus/client_golang/api"
 	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
-	prom_config "github.com/prometheus/common/config"
 	"github.com/tamalsaha/prometheus-demo/prometheus"
+	"github.com/tamalsaha/prometheus-demo/prometheus/convert"
+	"github.com/tamalsaha/prometheus-demo/prometheus/discovery"
+	"github.com/tamalsaha/prometheus-demo/prometheus/query"
+	"github.com/tamalsaha/prometheus-demo/prometheus/satoken"
 	"github.com/trickstercache/trickster/v2/cmd/trickster/config"
+	reload "github.com/trickstercache/trickster/v2/cmd/trickster/config/reload/options"
 	"github.com/trickstercache/trickster/v2/cmd/trickster/config/validate"
 	bo "github.com/trickstercache/trickster/v2/pkg/backends/options"
 	rule "github.com/trickstercache/trickster/v2/pkg/backends/rule/options"
@@ -28,9 +32,9 @@ import (
 	mo "github.com/trickstercache/trickster/v2/pkg/observability/metrics/options"
 	tracing "github.com/trickstercache/trickster/v2/pkg/observability/tracing/options"
 	rwopts "github.com/trickstercache/trickster/v2/pkg/proxy/request/rewriter/options"
-	to "github.com/trickstercache/trickster/v2/pkg/proxy/tls/options"
 	"github.com/trickstercache/trickster/v2/pkg/util/yamlx"
 	trickstercachev1alpha1 "go.openviz.dev/trickster-config/api/v1alpha1"
+	"golang.org/x/oauth2"
 	core "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -50,6 +54,7 @@ func NewClient() (client.Client, error) {
 	scheme := runtime.NewScheme()
 	_ = clientgoscheme.AddToScheme(scheme)
 	_ = trickstercachev1alpha1.AddToScheme(scheme)
+	_ = monitoringv1.AddToScheme(scheme)
 
 	ctrl.SetLogger(klog.NewKlogr())
 	cfg := ctrl.GetConfigOrDie()
@@ -75,49 +80,92 @@ func NewClient() (client.Client, error) {
 	})
 }
 
-const backendName = "k8s"
+const backendName = convert.TricksterBackendName
+
+// tricksterSA is the service account of tricky-auth/tricky-auth.yaml that
+// is allowed to use the service proxy of the Prometheus service.
+var tricksterSA = types.NamespacedName{Namespace: "default", Name: "trickster"}
 
 func main_gen_cfg() {
-	cfg := ctrl.GetConfigOrDie()
-	pc, err := prepConfig(cfg, ServiceReference{
-		Scheme: "http",
-		// Name:      "kube-prometheus-stack-prometheus"
-		Name:      "prometheus-kube-prometheus-prometheus",
-		Namespace: "monitoring",
-		Port:      9090,
-	})
+	pc, _, err := discoverConfig()
 	if err != nil {
 		panic(err)
 	}
-	//data, err := yaml.Marshal(pc)
-	//if err != nil {
-	//	panic(err)
-	//}
-	//fmt.Println(string(data))
+	if err := writeTricksterConfig(pc); err != nil {
+		panic(err)
+	}
+}
 
-	pwd, err := os.Getwd()
+// main_watch_cfg keeps the config written by main_gen_cfg up to date. The
+// service account token in the request rewriter is refreshed well before it
+// expires and Trickster is asked to reload the config, so it never has to be
+// restarted.
+func main_watch_cfg() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	pc, ts, err := discoverConfig()
 	if err != nil {
 		panic(err)
 	}
+	ts.OnRefresh(func(token *oauth2.Token) {
+		if err := writeTricksterConfig(pc); err != nil {
+			klog.ErrorS(err, "Failed to write Trickster config")
+			return
+		}
+		if err := reloadTrickster(ctx); err != nil {
+			klog.ErrorS(err, "Failed to reload Trickster config")
+			return
+		}
+		klog.InfoS("Updated Trickster config", "tokenExpiry", token.Expiry)
+	})
+	ts.Run(ctx)
+}
+
+// discoverConfig returns the connection to the best Prometheus service
+// through the apiserver service proxy with the tokens of tricksterSA.
+func discoverConfig() (*prometheus.Config, *satoken.Source, error) {
+	kc, err := NewClient()
+	if err != nil {
+		return nil, nil, err
+	}
+	// rulers only have the results of their rules
+	c, err := discovery.Best(context.TODO(), kc, discovery.Options{
+		Kinds: []discovery.Kind{discovery.KindThanosQuerier, discovery.KindPrometheus},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	klog.InfoS("Discovered Prometheus", "service", c.Service, "kind", c.Kind, "distribution", c.Distribution)
+
+	cfg := ctrl.GetConfigOrDie()
+	ts, err := satoken.NewForConfig(cfg, tricksterSA, satoken.Options{})
+	if err != nil {
+		return nil, nil, err
+	}
+	pc, err := prometheus.ToPrometheusConfigFromServiceAccount(cfg, ts, c.Service)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pc, ts, nil
+}
+
+func writeTricksterConfig(pc *prometheus.Config) error {
+	pwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	backend, rewriter, err := convert.ToTricksterBackend(pc, backendName, filepath.Join(pwd, "certs"))
+	if err != nil {
+		return err
+	}
 
 	cfg2 := config.Config{
 		Frontend: &fropt.Options{
 			ListenPort: 9090,
 		},
 		Backends: map[string]*bo.Options{
-			backendName: {
-				Provider:  "prometheus",
-				OriginURL: pc.Addr,
-				TLS: &to.Options{
-					ServeTLS:           false,
-					InsecureSkipVerify: false,
-					CertificateAuthorityPaths: []string{
-						filepath.Join(pwd, "certs", "ca.crt"),
-					},
-					// ClientCertPath: filepath.Join(pwd, "certs", "tls.crt"),
-					// ClientKeyPath:  filepath.Join(pwd, "certs", "tls.key"),
-				},
-			},
+			backendName: backend,
 		},
 		Metrics: &mo.Options{
 			ListenPort: 8481,
@@ -126,50 +174,44 @@ func main_gen_cfg() {
 			LogLevel: "info",
 		},
 	}
-
-	if pc.BasicAuth.Password != "" {
+	if rewriter != nil {
 		cfg2.RequestRewriters = map[string]*rwopts.Options{
-			backendName: {
-				Instructions: rwopts.RewriteList{
-					{
-						"header",
-						"set",
-						"Authorization",
-						"Basic " + base64.URLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", pc.BasicAuth.Username, pc.BasicAuth.Password))),
-					},
-				},
-			},
+			backendName: rewriter,
 		}
-		cfg2.Backends[backendName].ReqRewriterName = backendName
-	} else if pc.BearerToken != "" {
-		cfg2.RequestRewriters = map[string]*rwopts.Options{
-			backendName: {
-				Instructions: rwopts.RewriteList{
-					{
-						"header",
-						"set",
-						"Authorization",
-						"Bearer " + pc.BearerToken,
-					},
-				},
-			},
-		}
-		cfg2.Backends[backendName].ReqRewriterName = backendName
-	} else {
-		cfg2.Backends[backendName].TLS.ClientCertPath = filepath.Join(pwd, "certs", "tls.crt")
-		cfg2.Backends[backendName].TLS.ClientKeyPath = filepath.Join(pwd, "certs", "tls.key")
 	}
 
 	data, err := yaml.Marshal(cfg2)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// /Users/tamal/go/src/github.com/tamalsaha/prometheus-demo/trickster-conf
-	err = os.WriteFile("trickster-conf/config.yaml", data, 0o644)
+	// the config may contain credentials, and WriteFile keeps the mode of an
+	// existing file
+	filename := "trickster-conf/config.yaml"
+	if err := os.WriteFile(filename, data, 0o600); err != nil {
+		return err
+	}
+	return os.Chmod(filename, 0o600)
+}
+
+// reloadTrickster asks Trickster to reload its config file, which it does if
+// the file was modified since it was last loaded.
+func reloadTrickster(ctx context.Context) error {
+	u := fmt.Sprintf("http://localhost:%d%s", reload.DefaultReloadPort, reload.DefaultReloadHandlerPath)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return nil
 }
 
 func main() {
@@ -195,7 +237,7 @@ func main() {
 
 	/*
 		cfg := ctrl.GetConfigOrDie()
-		pcfg, err := prepConfig(cfg, ServiceReference{
+		pcfg, err := prepConfig(cfg, prometheus.ServiceReference{
 			Scheme: "http",
 			// Name:      "kube-prometheus-stack-prometheus"
 			Name:      "prometheus-kube-prometheus-prometheus",
@@ -237,99 +279,19 @@ func main() {
 	fmt.Println(string(data))
 }
 
-func getPromQueryResult(pc promv1.API, promQuery string) (map[string]float64, error) {
-	val, warn, err := pc.Query(context.Background(), promQuery, time.Now())
+func getPromQueryResult(pc promv1.API, promQuery string) (*query.Result, error) {
+	res, err := query.New(pc).Query(context.Background(), promQuery, time.Now())
 	if err != nil {
 		return nil, err
 	}
-	if warn != nil {
-		klog.Infoln("Warning: ", warn)
+	if len(res.Warnings) > 0 {
+		klog.Infoln("Warning: ", res.Warnings)
 	}
-
-	metrics := strings.Split(val.String(), "\n")
-
-	cpu := float64(0)
-
-	metricsMap := make(map[string]float64)
-
-	for _, m := range metrics {
-		val := strings.Split(m, "=>")
-		if len(val) != 2 {
-			return nil, fmt.Errorf("metrics %q is invalid for query %s", m, promQuery)
-		}
-		valStr := strings.Split(val[1], "@")
-		if len(valStr) != 2 {
-			return nil, fmt.Errorf("metrics %q is invalid for query %s", m, promQuery)
-		}
-		valStr[0] = strings.Replace(valStr[0], " ", "", -1)
-		metricVal, err := strconv.ParseFloat(valStr[0], 64)
-		if err != nil {
-			return nil, err
-		}
-		cpu += metricVal
-
-		metricsMap[val[0]] = metricVal
-	}
-
-	return metricsMap, nil
+	return res, nil
 }
 
-type ServiceReference struct {
-	Scheme    string
-	Name      string
-	Namespace string
-	Port      int
-}
-
-func prepConfig(cfg *rest.Config, ref ServiceReference) (*prometheus.Config, error) {
-	if err := rest.LoadTLSFiles(cfg); err != nil {
-		return nil, err
-	}
-
-	certDir := "certs"
-	err := os.MkdirAll(certDir, 0o755)
-	if err != nil {
-		return nil, err
-	}
-
-	var caFile, certFile, keyFile string
-	caFile = filepath.Join(certDir, "ca.crt")
-	if err := os.WriteFile(caFile, cfg.TLSClientConfig.CAData, 0o644); err != nil {
-		return nil, err
-	}
-
-	if len(cfg.TLSClientConfig.CertData) > 0 {
-		certFile = filepath.Join(certDir, "tls.crt")
-		if err := os.WriteFile(certFile, cfg.TLSClientConfig.CertData, 0o644); err != nil {
-			return nil, err
-		}
-	}
-
-	if len(cfg.TLSClientConfig.KeyData) > 0 {
-		keyFile = filepath.Join(certDir, "tls.key")
-		if err := os.WriteFile(keyFile, cfg.TLSClientConfig.KeyData, 0o644); err != nil {
-			return nil, err
-		}
-	}
-
-	return &prometheus.Config{
-		Addr: fmt.Sprintf("%s/api/v1/namespaces/%s/services/%s:%s:%d/proxy/", cfg.Host, ref.Namespace, ref.Scheme, ref.Name, ref.Port),
-		BasicAuth: prometheus.BasicAuth{
-			Username:     cfg.Username,
-			Password:     cfg.Password,
-			PasswordFile: "",
-		},
-		BearerToken:     cfg.BearerToken,
-		BearerTokenFile: "",
-		ProxyURL:        "",
-		TLSConfig: prom_config.TLSConfig{
-			CAFile:             caFile,
-			CertFile:           certFile,
-			KeyFile:            keyFile,
-			ServerName:         cfg.TLSClientConfig.ServerName,
-			InsecureSkipVerify: cfg.TLSClientConfig.Insecure,
-		},
-	}, nil
+func prepConfig(cfg *rest.Config, ref prometheus.ServiceReference) (*prometheus.Config, error) {
+	return prometheus.ToPrometheusConfig(cfg, ref)
 }
 
 func main_gen_crd_config() {
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/tamalsaha/prometheus-demo/prometheus"
+)
+
+// testdata/prometheus.jsonl is recorded from fake-prom with
+//
+//	fake-prom --listen=127.0.0.1:19491 &
+//	flags="--prometheus.address=http://127.0.0.1:19491 --prometheus.bearer-token=s3cr3t --prometheus.record-file=testdata/prometheus.jsonl"
+//	read-prom query up --time=2026-01-01T01:00:00Z $flags
+//	read-prom query 'sum by (namespace) (rate(http_requests_total[5m]))' --time=2026-01-01T01:00:00Z $flags
+//	read-prom labels job $flags
+
+func TestGetPromQueryResult(t *testing.T) {
+	for _, addr := range []string{
+		"http://127.0.0.1:9090",
+		"https://10.0.0.1:6443/api/v1/namespaces/monitoring/services/http:prometheus-operated:9090/proxy",
+		"https://trickster.example.com/1-be34d9c6-74eb-4bfe-bf22-f57c0065b713",
+	} {
+		t.Run(addr, func(t *testing.T) {
+			pc := &prometheus.Config{Addr: addr, ReplayFile: "testdata/prometheus.jsonl"}
+			c, err := pc.NewPrometheusClient()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// getPromQueryResult queries at time.Now, the replay falls back
+			// to the recording at a different time
+			res, err := getPromQueryResult(promv1.NewAPI(c), "up")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]float64{}
+			for _, s := range res.Samples {
+				got[s.Labels["instance"]] = s.Value
+			}
+			want := map[string]float64{
+				"localhost:9090": 1,
+				"node-1:9100":    1,
+				"node-2:9100":    0,
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("getPromQueryResult() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestGetPromQueryResultNoFixture(t *testing.T) {
+	pc := &prometheus.Config{Addr: "http://127.0.0.1:9090", ReplayFile: "testdata/prometheus.jsonl"}
+	c, err := pc.NewPrometheusClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res, err := getPromQueryResult(promv1.NewAPI(c), "down"); err == nil {
+		t.Errorf("getPromQueryResult() = %+v, want error", res)
+	}
+}